@@ -2,26 +2,52 @@ package app
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"log/slog"
+	"math/rand/v2"
+	"net/http"
 	"net/netip"
+	"net/url"
 	"path"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/bepass-org/warp-plus/iputils"
 	"github.com/bepass-org/warp-plus/psiphon"
 	"github.com/bepass-org/warp-plus/warp"
+	"github.com/bepass-org/warp-plus/wireguard/device"
 	"github.com/bepass-org/warp-plus/wireguard/tun"
 	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
 	"github.com/bepass-org/warp-plus/wiresocks"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const singleMTU = 1330
 const doubleMTU = 1280 // minimum mtu for IPv6, may cause frag reassembly somewhere
 
+// DefaultKeepAlive is the persistent keepalive interval of the warp peers.
+const DefaultKeepAlive = 5 * time.Second
+
 type WarpOptions struct {
-	Bind            netip.AddrPort
+	Bind netip.AddrPort
+	// NoListener keeps the tunnel up without serving a proxy on Bind, for
+	// programs dialing through Tunnel.Dial. Not supported in psiphon mode,
+	// which serves its own proxy.
+	NoListener bool
+	// SocksHandshakeTimeout closes proxy clients that don't finish the
+	// SOCKS or HTTP proxy negotiation in time, see
+	// wiresocks.WithHandshakeTimeout. 0 waits forever.
+	SocksHandshakeTimeout time.Duration
+	// AdvertiseAddr is reported to socks5 clients as the address of the UDP
+	// relay instead of the bind address, for clients behind NAT. A zero
+	// port keeps the port of the relay.
+	AdvertiseAddr   netip.AddrPort
 	Endpoint        string
 	License         string
 	DnsAddr         netip.Addr
@@ -33,27 +59,582 @@ type WarpOptions struct {
 	WireguardConfig string
 	Reserved        string
 	TestURL         string
+	// TraceCA replaces the system certificates when verifying the
+	// connectivity checks: the test URL, which must use https, and the
+	// egress IP lookups, which then go over https too. A check failing
+	// verification fails like an unreachable server.
+	TraceCA *x509.CertPool
+	// RequireColo keeps reconnecting until the tunnel lands in this colo.
+	// Only supported in normal warp mode.
+	RequireColo string
+	// Secrets resolves the license, private key and token. When nil the
+	// License field and the cached identity are used.
+	Secrets SecretProvider
+	// DialRetry retries a failed through-tunnel dial once when the tunnel
+	// handshakes again or moves to another endpoint shortly after, before
+	// failing the proxy request.
+	DialRetry bool
+	// TeamToken enrolls the devices in a Cloudflare Zero Trust team instead
+	// of registering consumer warp accounts. Team identities are cached
+	// separately and can't be combined with a license. It implies Team.
+	TeamToken string
+	// Team connects with the Zero Trust identities cached by an earlier run
+	// with TeamToken. Without it a cached team identity is never used, and
+	// loading fails rather than registering a consumer account next to it.
+	Team bool
+	// StatusFile is the path of a JSON file kept up to date with the
+	// connection state. It is removed when ctx is done.
+	StatusFile string
+	// NoCache registers a fresh identity on every run without loading or
+	// saving anything under CacheDir.
+	NoCache bool
+	// NoAutoRegister fails with ErrNoIdentity instead of registering a new
+	// identity when none is cached, leaving registration to Provision. It
+	// can't be combined with NoCache or IdentityMaxAge.
+	NoAutoRegister bool
+	// MTUProbe checks that large transfers go through after the handshake
+	// and lowers the MTU, down to 1280, while they fail but small transfers
+	// don't. Other failures fail the connection. Only supported in normal
+	// warp mode.
+	MTUProbe bool
+	// ListenBacklog sets the accept backlog of the proxy listener, 0 keeps
+	// the system default. The kernel caps it, see
+	// wiresocks.WithListenBacklog.
+	ListenBacklog int
+	// RelayBufferSize is the size of the two copy buffers of every proxied
+	// connection, 0 keeps wiresocks.BuffSize.
+	RelayBufferSize int
+	// ConnBufferCap caps the bytes buffered in the tunnel for every proxied
+	// connection in each direction, see wiresocks.WithConnBufferCap. 0
+	// keeps the growing buffers.
+	ConnBufferCap int
+	// HTTPClient is used for all cloudflare API calls when set, e.g. to
+	// control timeouts, proxies or instrumentation.
+	HTTPClient *http.Client
+	// TracerProvider receives spans for the startup phases when set.
+	TracerProvider trace.TracerProvider
+	// UserAgent overrides the User-Agent sent to the cloudflare API.
+	UserAgent string
+	// RegisterRetries is how many times a failed registration is retried.
+	RegisterRetries uint
+	// StartupDelay is waited out before the first API call and handshake,
+	// so a fleet of instances started together doesn't hit cloudflare at
+	// once. With StartupDelayRandom a random delay up to it is used.
+	StartupDelay       time.Duration
+	StartupDelayRandom bool
+	// WaitForNetwork waits up to this long before the startup delay until
+	// there is a route to the endpoint, for starts during boot before the
+	// network is up. 0 doesn't wait.
+	WaitForNetwork time.Duration
+	// ControlSocket is the path of a unix socket accepting runtime
+	// commands such as egress-ip. With Scan in normal warp mode it also
+	// accepts rescan.
+	ControlSocket string
+	// ProxyProtocol requires a PROXY protocol header on proxy connections.
+	ProxyProtocol bool
+	// DSCP marks the outer wireguard packets with this DSCP value, 0
+	// leaves them unmarked.
+	DSCP int
+	// DirectPrefixes are dialed directly instead of through the tunnel,
+	// along with localhost. Empty routes everything through the tunnel.
+	DirectPrefixes []netip.Prefix
+	// DNSConcurrency limits how many destination hostnames the proxy
+	// resolves at a time, 0 doesn't limit them.
+	DNSConcurrency int
+	// DialConcurrency limits how many dials through the tunnel run at
+	// once, see wiresocks.WithDialConcurrency. 0 doesn't limit them.
+	DialConcurrency int
+	// CircuitBreakerFailures refuses a destination for
+	// CircuitBreakerCooldown once this many dials to it failed in a row,
+	// see wiresocks.WithCircuitBreaker. 0 disables it.
+	CircuitBreakerFailures int
+	CircuitBreakerCooldown time.Duration
+	// Resolver resolves the destination hostnames of the proxy instead of
+	// the DNS servers of the tunnel, see wiresocks.WithResolver. nil keeps
+	// the built-in resolver.
+	Resolver wiresocks.Resolver
+	// DNSBypass resolves hostnames matching these rules over the local
+	// network, see wiresocks.WithDNSBypass. nil resolves everything through
+	// the tunnel.
+	DNSBypass []wiresocks.DNSBypass
+	// DNSPreload are hostnames resolved at startup and cached, see
+	// wiresocks.WithDNSPreload.
+	DNSPreload []string
+	// AllowDomains restricts the proxy to destinations matching these
+	// patterns, see wiresocks.WithAllowedDomains. nil allows everything.
+	AllowDomains []string
+	// NAT64Prefix reaches IPv4 destinations through the NAT64 gateway of
+	// this prefix, which must be reachable through the tunnel. The zero
+	// prefix disables it.
+	NAT64Prefix netip.Prefix
+	// FallbackEndpoint is tried when connecting to Endpoint fails, normally
+	// the endpoint of the other address family. Only used in normal warp
+	// mode without scanning.
+	FallbackEndpoint string
+	// ReconnectOn lists the error classes (see ErrorClass) for which RunWarp
+	// retries a failed connection instead of returning the error.
+	ReconnectOn []string
+	// SelectEndpoint picks the endpoint to connect to from the ranked scan
+	// results, e.g. by asking the user. When nil the best result is used.
+	SelectEndpoint func([]ScanResult) (netip.AddrPort, error)
+	// Pcap is the path of a pcap file receiving the outer wireguard packets,
+	// for debugging obfuscation. The capture exposes endpoints, timing and
+	// sizes of all traffic, so it should only be enabled while debugging.
+	Pcap string
+	// PcapMaxSize is the size in bytes at which the pcap file is rotated,
+	// 0 uses DefaultPcapMaxSize.
+	PcapMaxSize int64
+	// SourcePort pins the UDP source port of the outer wireguard packets,
+	// 0 lets the system pick one. Not supported in gool mode, which needs
+	// two sockets.
+	SourcePort uint16
+	// RandomSourcePort picks a new random source port on every connect.
+	RandomSourcePort bool
+	// ProxyTLS serves the proxy over TLS when set. Not supported in psiphon
+	// mode.
+	ProxyTLS *tls.Config
+	// MaxHandshakeAge is how old the last handshake may be for the tunnel
+	// to count as healthy, 0 uses DefaultMaxHandshakeAge.
+	MaxHandshakeAge time.Duration
+	// StartupGrace is how long after startup the health and ready control
+	// commands report "starting" rather than failing, while the first
+	// handshake settles.
+	StartupGrace time.Duration
+	// KeepAlive is the persistent keepalive interval of the peers, 0 uses
+	// DefaultKeepAlive and a negative value disables keepalives. Without
+	// them an idle tunnel sends nothing, which saves battery and data but
+	// lets NAT mappings expire, so the first packet after a long pause
+	// may need a new handshake.
+	KeepAlive time.Duration
+	// HandshakeRetries is how often the handshake initiation is
+	// retransmitted before an endpoint counts as unreachable, 0 uses
+	// DefaultHandshakeRetries and a negative value sends it only once. Every
+	// retry adds 10 seconds to the time it takes to fail over.
+	HandshakeRetries int
+	// SocketTimeout bounds every write on the outer wireguard socket, so a
+	// wedged socket fails the handshake or shows up in the logs instead of
+	// hanging. Reads aren't bounded, an idle tunnel is quiet. 0 means no
+	// bound.
+	SocketTimeout time.Duration
+	// BootstrapDNS resolves the host names looked up before the tunnel is
+	// up, such as a host name given as Endpoint and the location lookup of
+	// PsiphonCountryAuto. The zero value uses the system resolver.
+	BootstrapDNS netip.AddrPort
+	// IPChangeWebhook receives an IPChange as a JSON POST whenever the
+	// egress IP detected after a connect, reconnect or psiphon rotation
+	// differs from the previous one.
+	IPChangeWebhook string
+	// OnEvent is called when the tunnel connects, reconnects, switches
+	// endpoints or goes down, and by RunWarp when an attempt to connect
+	// fails, e.g. to show a notification. It must not block.
+	OnEvent func(TunnelEvent)
+	// EventLog appends the tunnel events, including failed connection
+	// attempts, to this file as JSON lines. Only used by RunWarp.
+	EventLog string
+	// EventLogMaxSize is the size at which the event log is rotated, 0 uses
+	// DefaultEventLogMaxSize.
+	EventLogMaxSize int64
+	// MinQuota fails startup when an account has less WARP+ data left, in
+	// bytes. 0 disables the check.
+	MinQuota int64
+	// IdentityMaxAge discards cached identities registered longer ago than
+	// this at startup and registers new ones, rotating the device
+	// periodically. 0 keeps identities forever.
+	IdentityMaxAge time.Duration
+	// ScanBench reorders the best this many scan results by the throughput
+	// of a short download through each of them, 0 keeps the RTT order.
+	ScanBench int
+	// UDPSocks is the [user:password@]host:port of a SOCKS5 proxy whose UDP
+	// ASSOCIATE relay carries the outer wireguard packets. In gool mode only
+	// the outer device uses it. Registration and scanning still connect
+	// directly.
+	UDPSocks string
+	// ReconnectOnNetworkChange brings the tunnel up again, rescanning if
+	// enabled, when the default route changes or the interface carrying it
+	// goes up or down or changes its addresses. Only supported on Linux,
+	// elsewhere it logs a warning.
+	ReconnectOnNetworkChange bool
+	// ReconnectCooldown is the least time between the starts of two
+	// connection attempts of RunWarp, on top of the backoff after failures
+	// and however quickly the network changes. 0 means no floor.
+	ReconnectCooldown time.Duration
+	// Statsd pushes the tunnel metrics to a StatsD server when set.
+	Statsd *StatsdOptions
+	// UsageCSV appends the bytes sent and received and the connections made
+	// since startup to this file as CSV rows, every UsageInterval or
+	// DefaultUsageInterval.
+	UsageCSV      string
+	UsageInterval time.Duration
+	// UsageCSVMaxSize is the size at which the usage CSV is rotated, 0 uses
+	// DefaultUsageCSVMaxSize.
+	UsageCSVMaxSize int64
+	// StartupBudget bounds the time RunWarp takes to bring the tunnel up
+	// across all retries, including the startup delay. 0 means no limit.
+	StartupBudget time.Duration
 }
 
 type PsiphonOptions struct {
+	// Country is the psiphon egress country, or PsiphonCountryAuto to
+	// pick one near the location reported by cloudflare.
 	Country string
+	// Rotate reconnects psiphon to another of Countries at this interval,
+	// 0 disables rotation. The proxy is then served by a relay in front of
+	// psiphon, so the next tunnel can come up before the current one is
+	// closed.
+	Rotate time.Duration
+	// Countries are the countries Rotate picks from, at least two different
+	// ones.
+	Countries []string
+	// VerifyCountry looks up the egress country through psiphon after every
+	// connect and reconnects until it matches the requested one, failing
+	// after a few attempts instead of serving from the wrong country.
+	VerifyCountry bool
+	// Fallback serves plain warp on the bind address when psiphon fails or
+	// isn't connected within this time, reporting EventPsiphonFallback,
+	// instead of failing. 0 disables the fallback.
+	Fallback time.Duration
+}
+
+// reconnectBackoff bounds the wait between connection attempts.
+var reconnectBackoff = [2]time.Duration{2 * time.Second, time.Minute}
+
+// reconnectThrottle spaces connection attempts at least cooldown apart.
+type reconnectThrottle struct {
+	cooldown time.Duration
+	last     time.Time
+}
+
+// started records the start of an attempt.
+func (r *reconnectThrottle) started() {
+	r.last = time.Now()
+}
+
+// remaining returns how long the next attempt has to wait for the cooldown.
+func (r *reconnectThrottle) remaining() time.Duration {
+	if r.last.IsZero() {
+		return 0
+	}
+	return max(r.cooldown-time.Since(r.last), 0)
 }
 
+// startWarp is StartWarp, replaceable in tests.
+var startWarp = StartWarp
+
+// RunWarp connects according to opts and serves the proxy until ctx is
+// done. It returns once the tunnel is up. Failures of a class listed in
+// opts.ReconnectOn are retried with backoff, any other failure is returned
+// right away. With opts.ReconnectOnNetworkChange the tunnel is brought up
+// again whenever the network changes.
 func RunWarp(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
-	if opts.WireguardConfig != "" {
-		if err := runWireguard(ctx, l, opts); err != nil {
-			return err
+	onEvent := opts.OnEvent
+	opts.OnEvent = func(e TunnelEvent) {
+		recordError(e)
+		if onEvent != nil {
+			onEvent(e)
 		}
+	}
+	if opts.EventLog != "" {
+		events := newEventLog(l, opts.EventLog, opts.EventLogMaxSize)
+		onEvent := opts.OnEvent
+		opts.OnEvent = func(e TunnelEvent) {
+			events.write(e)
+			if onEvent != nil {
+				onEvent(e)
+			}
+		}
+	}
+
+	throttle := &reconnectThrottle{cooldown: opts.ReconnectCooldown}
+	cancel, err := runWarpRetry(ctx, l, opts, throttle)
+	if err != nil {
+		return err
+	}
+	if !opts.ReconnectOnNetworkChange {
+		// the tunnel lives until ctx is done
+		context.AfterFunc(ctx, cancel)
+		return nil
+	}
 
+	changes, err := watchNetwork(ctx, l)
+	if err != nil {
+		l.Warn("not reconnecting on network changes", "error", err)
+		context.AfterFunc(ctx, cancel)
 		return nil
 	}
+	// only delay the first attempt
+	opts.StartupDelay = 0
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				cancel()
+				return
+			case <-changes:
+			}
+
+			// the old tunnel is likely broken, and its proxy listener has
+			// to be closed before a new one can bind the address
+			l.Info("network changed, reconnecting")
+			cancel()
+			if waitNetworkSettled(ctx, changes) != nil {
+				return
+			}
+			if wait := throttle.remaining(); wait > 0 {
+				l.Info("waiting for the reconnect cooldown", "wait", wait)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(wait):
+				}
+			}
+
+			cancel, err = runWarpRetry(ctx, l, opts, throttle)
+			if err != nil {
+				if ctx.Err() == nil {
+					l.Error("failed to reconnect after network change, waiting for the next change", "error", err)
+				}
+				cancel = func() {}
+			}
+		}
+	}()
+	return nil
+}
+
+// ErrStartupBudget is returned when the tunnel isn't up within
+// WarpOptions.StartupBudget.
+var ErrStartupBudget = errors.New("startup budget exceeded")
+
+// runWarpRetry starts the tunnel, retrying failures of a class listed in
+// opts.ReconnectOn no sooner than throttle allows. It returns a function
+// tearing the tunnel down.
+func runWarpRetry(ctx context.Context, l *slog.Logger, opts WarpOptions, throttle *reconnectThrottle) (context.CancelFunc, error) {
+	// the budget only bounds startup, the tunnel outlives it
+	budgetCtx, expire := context.WithCancelCause(ctx)
+	var budget *time.Timer
+	if opts.StartupBudget > 0 {
+		budget = time.AfterFunc(opts.StartupBudget, func() { expire(ErrStartupBudget) })
+	}
+
+	var failed []string
+	backoff := reconnectBackoff[0]
+	for {
+		attemptCtx, cancel := context.WithCancel(budgetCtx)
+		throttle.started()
+		_, err := startWarp(attemptCtx, l, opts)
+		if err == nil && (budget == nil || budget.Stop()) {
+			return func() { cancel(); expire(nil) }, nil
+		}
+		// tear down whatever the failed attempt left running
+		cancel()
+		if err == nil {
+			// the budget ran out just as the tunnel came up
+			err = context.Cause(budgetCtx)
+		}
+		if opts.OnEvent != nil {
+			opts.OnEvent(TunnelEvent{Kind: EventFailed, Err: err})
+		}
+
+		class := ErrorClass(err)
+		if budgetCtx.Err() != nil || !slices.Contains(opts.ReconnectOn, class) {
+			return nil, startupFailed(budgetCtx, expire, opts.StartupBudget, failed, err)
+		}
+		failed = append(failed, class)
+
+		wait := max(backoff, throttle.remaining())
+		l.Warn("connection failed, reconnecting", "class", class, "error", err, "backoff", wait)
+		select {
+		case <-budgetCtx.Done():
+			return nil, startupFailed(budgetCtx, expire, opts.StartupBudget, failed, err)
+		case <-time.After(wait):
+		}
+		backoff = min(2*backoff, reconnectBackoff[1])
+		// only delay the first attempt
+		opts.StartupDelay = 0
+	}
+}
+
+// startupFailed releases the budget and returns err, or a summary of the
+// attempts if the budget ran out. The classes of the failed attempts are
+// listed, err is the last error.
+func startupFailed(budgetCtx context.Context, expire context.CancelCauseFunc, budget time.Duration, failed []string, err error) error {
+	expire(nil)
+	if !errors.Is(context.Cause(budgetCtx), ErrStartupBudget) {
+		return err
+	}
+	if len(failed) == 0 {
+		return fmt.Errorf("%w: gave up after %s during the first attempt: %v", ErrStartupBudget, budget, err)
+	}
+	return fmt.Errorf("%w: gave up after %s and %d failed attempts (%s), last error: %v", ErrStartupBudget, budget, len(failed), strings.Join(failed, ", "), err)
+}
+
+// StartWarp is like RunWarp but also returns a handle to the tunnel.
+func StartWarp(ctx context.Context, l *slog.Logger, opts WarpOptions) (_ *Tunnel, err error) {
+	ctx, span := startRootSpan(ctx, opts)
+	defer func() { endSpan(span, err) }()
+
+	if opts.RequireColo != "" && (opts.WireguardConfig != "" || opts.Psiphon != nil || opts.Gool) {
+		return nil, errors.New("required colo is only supported in normal warp mode")
+	}
+
+	if opts.MTUProbe && (opts.WireguardConfig != "" || opts.Psiphon != nil || opts.Gool) {
+		return nil, errors.New("mtu probe is only supported in normal warp mode")
+	}
+
+	if opts.UDPSocks != "" {
+		if _, _, _, err := parseSocksProxy(opts.UDPSocks); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.IPChangeWebhook != "" {
+		if u, err := url.Parse(opts.IPChangeWebhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid ip change webhook %q, use an http or https url", opts.IPChangeWebhook)
+		}
+	}
+
+	if opts.TraceCA != nil && !strings.HasPrefix(opts.TestURL, "https://") {
+		return nil, errors.New("a pinned trace ca requires an https test url")
+	}
+
+	if opts.ProxyTLS != nil && opts.Psiphon != nil {
+		return nil, errors.New("proxy tls is not supported in psiphon mode")
+	}
+
+	if opts.Psiphon != nil && opts.Psiphon.Rotate > 0 && len(slices.Compact(slices.Sorted(slices.Values(opts.Psiphon.Countries)))) < 2 {
+		return nil, errors.New("psiphon rotation needs at least two different countries")
+	}
+
+	if opts.NoListener && opts.Psiphon != nil {
+		return nil, errors.New("no listener is not supported in psiphon mode")
+	}
+
+	if opts.SourcePort != 0 && opts.Gool {
+		return nil, errors.New("a fixed source port is not supported in gool mode")
+	}
+
+	if opts.SourcePort != 0 && opts.RandomSourcePort {
+		return nil, errors.New("can't use a fixed and a random source port at the same time")
+	}
+
+	if (opts.Team || opts.TeamToken != "") && opts.License != "" {
+		return nil, errors.New("can't use a license with a team token")
+	}
+
+	if err := waitForNetwork(ctx, l, opts); err != nil {
+		return nil, err
+	}
+
+	if err := startupDelay(ctx, l, opts); err != nil {
+		return nil, err
+	}
+
+	maxHandshakeAge := opts.MaxHandshakeAge
+	if maxHandshakeAge <= 0 {
+		maxHandshakeAge = DefaultMaxHandshakeAge
+	}
+	health := handshakeHealth{maxAge: maxHandshakeAge, idle: opts.keepAlive() == 0}
+	tunnel := &Tunnel{
+		status:   newStatusFile(l, opts.StatusFile, opts.mode(), health),
+		onEvent:  opts.OnEvent,
+		health:   health,
+		traceCA:  opts.TraceCA,
+		traceURL: traceURLFor(opts.TestURL, opts.TraceCA),
+		started:  time.Now(),
+		grace:    opts.StartupGrace,
+		egress:   newEgressWatcher(l, opts.IPChangeWebhook),
+	}
+	if tunnel.status != nil {
+		tunnel.status.traceCA = opts.TraceCA
+		tunnel.status.traceURL = tunnel.traceURL
+	}
+
+	historyPath := ""
+	if !opts.NoCache {
+		historyPath = path.Join(opts.CacheDir, "endpoint-history.json")
+	}
+	tunnel.history = loadEndpointHistory(l, historyPath)
+	if tunnel.status != nil {
+		go func() {
+			<-ctx.Done()
+			tunnel.status.close()
+		}()
+	}
+
+	if opts.Pcap != "" {
+		l.Warn("capturing outer tunnel packets, the capture file reveals endpoints and traffic patterns", "path", opts.Pcap)
+		tunnel.pcap, err = newPcapWriter(l, opts.Pcap, opts.PcapMaxSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create pcap file: %w", err)
+		}
+		context.AfterFunc(ctx, tunnel.pcap.close)
+	}
+
+	if opts.Statsd != nil {
+		if err := runStatsd(ctx, l, *opts.Statsd, opts.mode(), tunnel); err != nil {
+			return nil, fmt.Errorf("failed to set up statsd: %w", err)
+		}
+	}
+
+	if opts.UsageCSV != "" {
+		runUsageCSV(ctx, l, opts.UsageCSV, opts.UsageInterval, opts.UsageCSVMaxSize, tunnel)
+	}
+
+	if opts.ControlSocket != "" {
+		ctrl := newControlServer(l)
+		ctrl.handle("egress-ip", egressIPHandler(tunnel.trace))
+		ctrl.handle("health", healthHandler(tunnel.Health))
+		ctrl.handle("ready", statusHandler(tunnel.Ready, "ready"))
+		ctrl.handle("pause", pauseHandler(l, tunnel, false))
+		ctrl.handle("pause-close", pauseHandler(l, tunnel, true))
+		ctrl.handle("resume", resumeHandler(l, tunnel))
+		ctrl.handle("errors", errorsHandler)
+		if scanOpts := opts.Scan; scanOpts != nil && opts.mode() == "warp" {
+			// the keys are filled in below before the tunnel comes up
+			ctrl.handle("rescan", rescanHandler(l, tunnel, func(ctx context.Context) ([]ScanResult, error) {
+				o := *scanOpts
+				// scan afresh rather than resume the startup scan
+				o.CheckpointPath = ""
+				return wiresocks.RunScan(ctx, l, o)
+			}, requireColo(tunnel, opts.RequireColo)))
+		}
+		if err := ctrl.listen(ctx, opts.ControlSocket); err != nil {
+			return nil, fmt.Errorf("failed to start control socket: %w", err)
+		}
+	}
+
+	if opts.WireguardConfig != "" {
+		if err := runWireguard(ctx, l, opts, tunnel); err != nil {
+			return nil, err
+		}
+
+		return tunnel, nil
+	}
 
 	if opts.Psiphon != nil && opts.Gool {
-		return errors.New("can't use psiphon and gool at the same time")
+		return nil, errors.New("can't use psiphon and gool at the same time")
 	}
 
 	if opts.Psiphon != nil && opts.Psiphon.Country == "" {
-		return errors.New("must provide country for psiphon")
+		return nil, errors.New("must provide country for psiphon")
+	}
+
+	resolver := bootstrapResolver(opts.BootstrapDNS)
+	if opts.Psiphon != nil && opts.Psiphon.Country == PsiphonCountryAuto {
+		psiphonOpts := *opts.Psiphon
+		psiphonOpts.Country = autoPsiphonCountry(ctx, l, bootstrapClient(resolver))
+		opts.Psiphon = &psiphonOpts
+	}
+
+	// endpoints may be host names, resolve them before there is a tunnel
+	if opts.Scan == nil && opts.WireguardConfig == "" {
+		for _, endpoint := range []*string{&opts.Endpoint, &opts.FallbackEndpoint} {
+			if *endpoint == "" {
+				continue
+			}
+			if *endpoint, err = resolveEndpoint(ctx, resolver, *endpoint); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	// Decide Working Scenario
@@ -61,10 +642,9 @@ func RunWarp(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
 
 	if opts.Scan != nil {
 		// make primary identity
-		ident, err := warp.LoadOrCreateIdentity(l, path.Join(opts.CacheDir, "primary"), opts.License)
+		ident, err := loadIdentity(ctx, l, opts, "primary")
 		if err != nil {
-			l.Error("couldn't load primary warp identity")
-			return err
+			return nil, err
 		}
 
 		// Reading the private key from the 'Interface' section
@@ -73,40 +653,112 @@ func RunWarp(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
 		// Reading the public key from the 'Peer' section
 		opts.Scan.PublicKey = ident.Config.Peers[0].PublicKey
 
-		res, err := wiresocks.RunScan(ctx, l, *opts.Scan)
+		// Keep scan progress next to the identities so it can be resumed
+		if opts.Scan.CheckpointPath == "" && !opts.NoCache {
+			opts.Scan.CheckpointPath = path.Join(opts.CacheDir, "scan-checkpoint.json")
+		}
+
+		scanOpts := *opts.Scan
+		scanOpts.Collect = scanCollect(opts)
+		scanCtx, scanSpan := startSpan(ctx, "endpoint.scan")
+		res, err := wiresocks.RunScan(scanCtx, l, scanOpts)
+		endSpan(scanSpan, err)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		l.Debug("scan results", "endpoints", res)
+		for _, r := range res {
+			l.Debug("scan result", "endpoint", r.AddrPort, "rtt", r.RTT, "loss", r.Loss, "jitter", r.Jitter)
+		}
 
-		endpoints = make([]string, len(res))
-		for i := 0; i < len(res); i++ {
-			endpoints[i] = res[i].AddrPort.String()
+		// prefer endpoints that handshook on this network before
+		tunnel.history.rank(res)
+		for _, r := range res {
+			if rec, ok := tunnel.history.get(r.AddrPort.String()); ok {
+				l.Info("endpoint history", "endpoint", r.AddrPort, "rtt", r.RTT, "successes", rec.Successes, "failures", rec.Failures)
+			}
+		}
+
+		if opts.ScanBench > 0 {
+			conf := generateWireguardConfig(ident)
+			conf.Interface.MTU = singleMTU
+			conf.Interface.DNS = []netip.Addr{opts.DnsAddr}
+			benchCtx, benchSpan := startSpan(ctx, "endpoint.bench")
+			res, err = benchEndpoints(benchCtx, l, &conf, tunnel.deviceOptions(opts), res, opts.ScanBench)
+			endSpan(benchSpan, err)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		endpoints, err = scanEndpoints(res, opts.SelectEndpoint)
+		if err != nil {
+			return nil, err
 		}
 	}
 	l.Info("using warp endpoints", "endpoints", endpoints)
+	span.SetAttributes(attribute.StringSlice("warp.endpoints", endpoints))
 
 	var warpErr error
 	switch {
 	case opts.Psiphon != nil:
 		l.Info("running in Psiphon (cfon) mode")
 		// run primary warp on a random tcp port and run psiphon on bind address
-		warpErr = runWarpWithPsiphon(ctx, l, opts, endpoints[0])
+		warpErr = runWarpWithPsiphon(ctx, l, opts, endpoints[0], tunnel)
 	case opts.Gool:
 		l.Info("running in warp-in-warp (gool) mode")
 		// run warp in warp
-		warpErr = runWarpInWarp(ctx, l, opts, endpoints)
+		warpErr = runWarpInWarp(ctx, l, opts, endpoints, tunnel)
 	default:
 		l.Info("running in normal warp mode")
 		// just run primary warp on bindAddress
-		warpErr = runWarp(ctx, l, opts, endpoints[0])
+		warpErr = runWarp(ctx, l, opts, endpoints, tunnel)
 	}
 
-	return warpErr
+	if warpErr != nil {
+		return nil, warpErr
+	}
+	return tunnel, nil
+}
+
+// keepAlive returns the persistent keepalive interval in seconds, 0 when
+// keepalives are disabled.
+func (o WarpOptions) keepAlive() int {
+	switch {
+	case o.KeepAlive < 0:
+		return 0
+	case o.KeepAlive == 0:
+		return int(DefaultKeepAlive / time.Second)
+	}
+	return max(1, int(o.KeepAlive/time.Second))
+}
+
+// handshakeRetries returns the number of handshake retransmissions.
+func (o WarpOptions) handshakeRetries() int {
+	switch {
+	case o.HandshakeRetries < 0:
+		return 0
+	case o.HandshakeRetries == 0:
+		return DefaultHandshakeRetries
+	}
+	return o.HandshakeRetries
 }
 
-func runWireguard(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
+// mode names the working scenario selected by the options.
+func (o WarpOptions) mode() string {
+	switch {
+	case o.WireguardConfig != "":
+		return "wireguard"
+	case o.Psiphon != nil:
+		return "psiphon"
+	case o.Gool:
+		return "gool"
+	default:
+		return "warp"
+	}
+}
+
+func runWireguard(ctx context.Context, l *slog.Logger, opts WarpOptions, tunnel *Tunnel) error {
 	conf, err := wiresocks.ParseConfig(opts.WireguardConfig)
 	if err != nil {
 		return err
@@ -120,11 +772,14 @@ func runWireguard(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
 	// Enable trick and keepalive on all peers in config
 	for i, peer := range conf.Peers {
 		peer.Trick = true
-		peer.KeepAlive = 5
+		peer.KeepAlive = opts.keepAlive()
 
 		// Try resolving if the endpoint is a domain
-		addr, err := iputils.ParseResolveAddressPort(peer.Endpoint, false, opts.DnsAddr.String())
-		if err == nil {
+		if opts.BootstrapDNS.IsValid() {
+			if endpoint, err := resolveEndpoint(ctx, bootstrapResolver(opts.BootstrapDNS), peer.Endpoint); err == nil {
+				peer.Endpoint = endpoint
+			}
+		} else if addr, err := iputils.ParseResolveAddressPort(peer.Endpoint, false, opts.DnsAddr.String()); err == nil {
 			peer.Endpoint = addr.String()
 		}
 
@@ -134,6 +789,7 @@ func runWireguard(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
 	// Establish wireguard on userspace stack
 	var werr error
 	var tnet *netstack.Net
+	var dev *device.Device
 	var tunDev tun.Device
 	for _, t := range []string{"t1", "t2"} {
 		// Create userspace tun network stack
@@ -142,13 +798,13 @@ func runWireguard(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
 			continue
 		}
 
-		werr = establishWireguard(l, conf, tunDev, opts.FwMark, t)
+		dev, werr = establishWireguard(ctx, l, conf, tunDev, tunnel.deviceOptions(opts), t)
 		if werr != nil {
 			continue
 		}
 
 		// Test wireguard connectivity
-		werr = usermodeTunTest(ctx, l, tnet, opts.TestURL)
+		werr = usermodeTunTest(ctx, l, tnet, opts.TestURL, opts.TraceCA)
 		if werr != nil {
 			continue
 		}
@@ -157,53 +813,104 @@ func runWireguard(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
 	if werr != nil {
 		return werr
 	}
+	tunnel.connected(ctx, conf.Peers[0].Endpoint, dev, tnet)
 
 	// Run a proxy on the userspace stack
-	_, err = wiresocks.StartProxy(ctx, l, tnet, opts.Bind)
+	return serveProxy(ctx, l, tnet, opts, tunnel)
+}
+
+func runWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoints []string, tunnel *Tunnel) error {
+	// make primary identity
+	ident, err := loadIdentity(ctx, l, opts, "primary")
 	if err != nil {
 		return err
 	}
 
-	l.Info("serving proxy", "address", opts.Bind)
-
-	return nil
-}
-
-func runWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoint string) error {
-	// make primary identity
-	ident, err := warp.LoadOrCreateIdentity(l, path.Join(opts.CacheDir, "primary"), opts.License)
+	conf, err := warpConfig(ident, opts)
 	if err != nil {
-		l.Error("couldn't load primary warp identity")
 		return err
 	}
 
-	conf := generateWireguardConfig(ident)
+	var (
+		endpoint  string
+		dev       *device.Device
+		tnet      *netstack.Net
+		seenColos []string
+	)
+	for attempt := 0; ; attempt++ {
+		endpoint, err = coloEndpoint(endpoints, attempt)
+		if err != nil {
+			return err
+		}
+		for i := range conf.Peers {
+			conf.Peers[i].Endpoint = endpoint
+		}
 
-	// Set up MTU
-	conf.Interface.MTU = singleMTU
-	// Set up DNS Address
-	conf.Interface.DNS = []netip.Addr{opts.DnsAddr}
+		// Establish wireguard on userspace stack
+		connect := connectWarp
+		if opts.MTUProbe {
+			connect = connectWarpProbeMTU
+		}
+		dev, tnet, err = connect(ctx, l, &conf, tunnel.deviceOptions(opts), opts)
+		if err != nil && opts.Scan == nil && opts.FallbackEndpoint != "" && endpoint != opts.FallbackEndpoint {
+			l.Warn("failed to connect, trying fallback endpoint", "endpoint", endpoint, "fallback", opts.FallbackEndpoint, "error", err)
+			endpoint = opts.FallbackEndpoint
+			for i := range conf.Peers {
+				conf.Peers[i].Endpoint = endpoint
+			}
+			dev, tnet, err = connect(ctx, l, &conf, tunnel.deviceOptions(opts), opts)
+		}
+		if err != nil {
+			return err
+		}
 
-	// Enable trick and keepalive on all peers in config
-	for i, peer := range conf.Peers {
-		peer.Endpoint = endpoint
-		peer.Trick = true
-		peer.KeepAlive = 5
+		if opts.RequireColo == "" {
+			break
+		}
 
-		if opts.Reserved != "" {
-			r, err := wiresocks.ParseReserved(opts.Reserved)
-			if err != nil {
-				return err
-			}
-			peer.Reserved = r
+		colo, err := traceColo(ctx, tnet, tunnel.traceURL, opts.TraceCA)
+		if err != nil {
+			l.Warn("failed to detect colo", "endpoint", endpoint, "error", err)
+		} else if colo == opts.RequireColo {
+			l.Info("connected to required colo", "colo", colo, "endpoint", endpoint)
+			break
+		} else {
+			l.Info("connected to unwanted colo, reconnecting", "colo", colo, "want", opts.RequireColo, "endpoint", endpoint)
+			seenColos = append(seenColos, colo)
 		}
+		dev.Close()
 
-		conf.Peers[i] = peer
+		if attempt+1 >= requireColoAttempts {
+			return fmt.Errorf("couldn't connect to colo %s after %d attempts, seen colos: %v", opts.RequireColo, requireColoAttempts, seenColos)
+		}
 	}
+	// only the device in the required colo is the tunnel
+	tunnel.connected(ctx, endpoint, dev, tnet)
 
-	// Establish wireguard on userspace stack
+	// Run a proxy on the userspace stack
+	return serveProxy(ctx, l, tnet, opts, tunnel)
+}
+
+// scanCollect returns how many endpoints the scan of opts gathers: enough
+// for the benchmark, and more than the fastest two when SelectEndpoint picks
+// among them.
+func scanCollect(opts WarpOptions) int {
+	n := opts.Scan.Collect
+	if n == 0 && (opts.Scan.RankStability || opts.SelectEndpoint != nil) {
+		n = wiresocks.RankedScanCollect
+	}
+	if n == 0 {
+		n = wiresocks.DefaultScanCollect
+	}
+	return max(n, opts.ScanBench)
+}
+
+// connectWarp establishes wireguard on a userspace stack and tests
+// connectivity through it.
+func connectWarp(ctx context.Context, l *slog.Logger, conf *wiresocks.Configuration, devOpts deviceOptions, opts WarpOptions) (*device.Device, *netstack.Net, error) {
 	var werr error
 	var tnet *netstack.Net
+	var dev *device.Device
 	var tunDev tun.Device
 	for _, t := range []string{"t1", "t2"} {
 		tunDev, tnet, werr = netstack.CreateNetTUN(conf.Interface.Addresses, conf.Interface.DNS, conf.Interface.MTU)
@@ -211,37 +918,29 @@ func runWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoint str
 			continue
 		}
 
-		werr = establishWireguard(l, &conf, tunDev, opts.FwMark, t)
+		dev, werr = establishWireguard(ctx, l, conf, tunDev, devOpts, t)
 		if werr != nil {
 			continue
 		}
 
 		// Test wireguard connectivity
-		werr = usermodeTunTest(ctx, l, tnet, opts.TestURL)
+		werr = usermodeTunTest(ctx, l, tnet, opts.TestURL, opts.TraceCA)
 		if werr != nil {
+			dev.Close()
 			continue
 		}
 		break
 	}
 	if werr != nil {
-		return werr
+		return nil, nil, werr
 	}
-
-	// Run a proxy on the userspace stack
-	_, err = wiresocks.StartProxy(ctx, l, tnet, opts.Bind)
-	if err != nil {
-		return err
-	}
-
-	l.Info("serving proxy", "address", opts.Bind)
-	return nil
+	return dev, tnet, nil
 }
 
-func runWarpInWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoints []string) error {
+func runWarpInWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoints []string, tunnel *Tunnel) error {
 	// make primary identity
-	ident1, err := warp.LoadOrCreateIdentity(l, path.Join(opts.CacheDir, "primary"), opts.License)
+	ident1, err := loadIdentity(ctx, l, opts, "primary")
 	if err != nil {
-		l.Error("couldn't load primary warp identity")
 		return err
 	}
 
@@ -256,7 +955,7 @@ func runWarpInWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoi
 	for i, peer := range conf.Peers {
 		peer.Endpoint = endpoints[0]
 		peer.Trick = true
-		peer.KeepAlive = 5
+		peer.KeepAlive = opts.keepAlive()
 
 		if opts.Reserved != "" {
 			r, err := wiresocks.ParseReserved(opts.Reserved)
@@ -272,6 +971,7 @@ func runWarpInWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoi
 	// Establish wireguard on userspace stack and bind the wireguard sockets to the default interface and apply
 	var werr error
 	var tnet1 *netstack.Net
+	var dev *device.Device
 	var tunDev tun.Device
 	for _, t := range []string{"t1", "t2"} {
 		// Create userspace tun network stack
@@ -280,13 +980,13 @@ func runWarpInWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoi
 			continue
 		}
 
-		werr = establishWireguard(l.With("gool", "outer"), &conf, tunDev, opts.FwMark, t)
+		dev, werr = establishWireguard(ctx, l.With("gool", "outer"), &conf, tunDev, tunnel.deviceOptions(opts), t)
 		if werr != nil {
 			continue
 		}
 
 		// Test wireguard connectivity
-		werr = usermodeTunTest(ctx, l, tnet1, opts.TestURL)
+		werr = usermodeTunTest(ctx, l, tnet1, opts.TestURL, opts.TraceCA)
 		if werr != nil {
 			continue
 		}
@@ -303,9 +1003,8 @@ func runWarpInWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoi
 	}
 
 	// make secondary
-	ident2, err := warp.LoadOrCreateIdentity(l, path.Join(opts.CacheDir, "secondary"), opts.License)
+	ident2, err := loadIdentity(ctx, l, opts, "secondary")
 	if err != nil {
-		l.Error("couldn't load secondary warp identity")
 		return err
 	}
 
@@ -319,7 +1018,10 @@ func runWarpInWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoi
 	// Enable keepalive on all peers in config
 	for i, peer := range conf.Peers {
 		peer.Endpoint = addr.String()
-		peer.KeepAlive = 20
+		peer.KeepAlive = 0
+		if opts.keepAlive() != 0 {
+			peer.KeepAlive = 20
+		}
 
 		if opts.Reserved != "" {
 			r, err := wiresocks.ParseReserved(opts.Reserved)
@@ -339,29 +1041,23 @@ func runWarpInWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoi
 	}
 
 	// Establish wireguard on userspace stack
-	if err := establishWireguard(l.With("gool", "inner"), &conf, tunDev, opts.FwMark, "t0"); err != nil {
+	if _, err := establishWireguard(ctx, l.With("gool", "inner"), &conf, tunDev, tunnel.deviceOptions(opts).inner(), "t0"); err != nil {
 		return err
 	}
 
 	// Test wireguard connectivity
-	if err := usermodeTunTest(ctx, l, tnet2, opts.TestURL); err != nil {
+	if err := usermodeTunTest(ctx, l, tnet2, opts.TestURL, opts.TraceCA); err != nil {
 		return err
 	}
+	tunnel.connected(ctx, endpoints[0], dev, tnet2)
 
-	_, err = wiresocks.StartProxy(ctx, l, tnet2, opts.Bind)
-	if err != nil {
-		return err
-	}
-
-	l.Info("serving proxy", "address", opts.Bind)
-	return nil
+	return serveProxy(ctx, l, tnet2, opts, tunnel)
 }
 
-func runWarpWithPsiphon(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoint string) error {
+func runWarpWithPsiphon(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoint string, tunnel *Tunnel) error {
 	// make primary identity
-	ident, err := warp.LoadOrCreateIdentity(l, path.Join(opts.CacheDir, "primary"), opts.License)
+	ident, err := loadIdentity(ctx, l, opts, "primary")
 	if err != nil {
-		l.Error("couldn't load primary warp identity")
 		return err
 	}
 
@@ -376,7 +1072,7 @@ func runWarpWithPsiphon(ctx context.Context, l *slog.Logger, opts WarpOptions, e
 	for i, peer := range conf.Peers {
 		peer.Endpoint = endpoint
 		peer.Trick = true
-		peer.KeepAlive = 5
+		peer.KeepAlive = opts.keepAlive()
 
 		if opts.Reserved != "" {
 			r, err := wiresocks.ParseReserved(opts.Reserved)
@@ -392,6 +1088,7 @@ func runWarpWithPsiphon(ctx context.Context, l *slog.Logger, opts WarpOptions, e
 	// Establish wireguard on userspace stack
 	var werr error
 	var tnet *netstack.Net
+	var dev *device.Device
 	var tunDev tun.Device
 	for _, t := range []string{"t1", "t2"} {
 		// Create userspace tun network stack
@@ -400,13 +1097,13 @@ func runWarpWithPsiphon(ctx context.Context, l *slog.Logger, opts WarpOptions, e
 			continue
 		}
 
-		werr = establishWireguard(l, &conf, tunDev, opts.FwMark, t)
+		dev, werr = establishWireguard(ctx, l, &conf, tunDev, tunnel.deviceOptions(opts), t)
 		if werr != nil {
 			continue
 		}
 
 		// Test wireguard connectivity
-		werr = usermodeTunTest(ctx, l, tnet, opts.TestURL)
+		werr = usermodeTunTest(ctx, l, tnet, opts.TestURL, opts.TraceCA)
 		if werr != nil {
 			continue
 		}
@@ -415,23 +1112,169 @@ func runWarpWithPsiphon(ctx context.Context, l *slog.Logger, opts WarpOptions, e
 	if werr != nil {
 		return werr
 	}
+	// the egress ip is psiphon's, so don't look it up through warp
+	tunnel.connected(ctx, endpoint, dev, nil)
 
 	// Run a proxy on the userspace stack
-	warpBind, err := wiresocks.StartProxy(ctx, l, tnet, netip.MustParseAddrPort("127.0.0.1:0"))
+	warpBind, err := wiresocks.StartProxy(ctx, l, tnet, netip.MustParseAddrPort("127.0.0.1:0"), proxyOptions(ctx, opts, tunnel)...)
 	if err != nil {
 		return err
 	}
 
-	// run psiphon
-	err = psiphon.RunPsiphon(ctx, l.With("subsystem", "psiphon"), warpBind, opts.CacheDir, opts.Bind, opts.Psiphon.Country)
+	// run psiphon, on an internal port behind a psiphonFront when rotating
+	startAt := func(bind netip.AddrPort) psiphonStarter {
+		var start psiphonStarter = func(ctx context.Context, country string) (interface{ Close() }, error) {
+			return psiphon.RunPsiphon(ctx, l.With("subsystem", "psiphon"), warpBind, opts.CacheDir, bind, country)
+		}
+		if opts.Psiphon.VerifyCountry {
+			lookup := func(ctx context.Context) (string, error) {
+				return psiphonEgressCountry(ctx, bind, opts.TraceCA)
+			}
+			start = verifyPsiphonCountry(l, start, lookup, psiphonVerifyAttempts, tunnel.status.setCountry)
+		}
+		return start
+	}
+	bind := opts.Bind
+	if opts.Psiphon.Rotate > 0 {
+		if bind, err = freeLoopbackPort(); err != nil {
+			return err
+		}
+	}
+	start := startAt(bind)
+	if opts.Psiphon.Fallback > 0 {
+		fallback := func(err error) error {
+			if _, err := wiresocks.StartProxy(ctx, l, tnet, opts.Bind, proxyOptions(ctx, opts, tunnel)...); err != nil {
+				return err
+			}
+			tunnel.status.setMode("warp")
+			tunnel.emit(TunnelEvent{Kind: EventPsiphonFallback, Endpoint: endpoint, Err: err})
+			tunnel.checkEgress(ctx, func(ctx context.Context) (map[string]string, error) {
+				return fetchTrace(ctx, tnet, tunnel.traceURL, opts.TraceCA)
+			})
+			return nil
+		}
+		t, err := startPsiphonWithFallback(ctx, l, start, opts.Psiphon.Country, opts.Psiphon.Fallback, fallback)
+		if err != nil {
+			return err
+		}
+		if t == nil {
+			l.Info("serving proxy over plain warp", "address", opts.Bind)
+			return nil
+		}
+		return startedPsiphon(ctx, l, opts, t, bind, startAt, tunnel)
+	}
+
+	t, err := start(ctx, opts.Psiphon.Country)
 	if err != nil {
 		return fmt.Errorf("unable to run psiphon %w", err)
 	}
+	return startedPsiphon(ctx, l, opts, t, bind, startAt, tunnel)
+}
+
+// startedPsiphon records the country of a connected psiphon tunnel t, checks
+// its egress IP and starts rotating it if requested. A rotating tunnel
+// listens on bind, and the proxy address is served by a psiphonFront
+// switching to the tunnels started with startAt.
+func startedPsiphon(ctx context.Context, l *slog.Logger, opts WarpOptions, t interface{ Close() }, bind netip.AddrPort, startAt func(netip.AddrPort) psiphonStarter, tunnel *Tunnel) error {
+	var front *psiphonFront
+	if opts.Psiphon.Rotate > 0 {
+		var err error
+		if front, err = startPsiphonFront(ctx, l, opts.Bind, bind); err != nil {
+			t.Close()
+			return fmt.Errorf("unable to serve the psiphon proxy: %w", err)
+		}
+	}
 
+	connected := func(country string) {
+		tunnel.status.setCountry(country)
+		tunnel.checkEgress(ctx, func(ctx context.Context) (map[string]string, error) {
+			return psiphonTrace(ctx, opts.Bind, opts.TraceCA)
+		})
+	}
+	connected(opts.Psiphon.Country)
+	if opts.Psiphon.Rotate > 0 {
+		rotate := func(ctx context.Context, country string) (interface{ Close() }, error) {
+			next, err := freeLoopbackPort()
+			if err != nil {
+				return nil, err
+			}
+			t, err := startAt(next)(ctx, country)
+			if err != nil {
+				return nil, err
+			}
+			front.setTarget(next)
+			return t, nil
+		}
+		go rotatePsiphon(ctx, l, opts.Psiphon.Rotate, opts.Psiphon.Countries, opts.Psiphon.Country, t, rotate, connected)
+	}
 	l.Info("serving proxy", "address", opts.Bind)
 	return nil
 }
 
+// serveProxy starts the proxy on opts.Bind dialing through tnet, unless
+// opts.NoListener is set.
+func serveProxy(ctx context.Context, l *slog.Logger, tnet *netstack.Net, opts WarpOptions, tunnel *Tunnel) error {
+	if opts.NoListener {
+		l.Info("tunnel is up, not serving a proxy")
+		return nil
+	}
+	if _, err := wiresocks.StartProxy(ctx, l, tnet, opts.Bind, proxyOptions(ctx, opts, tunnel)...); err != nil {
+		return err
+	}
+	l.Info("serving proxy", "address", opts.Bind)
+	return nil
+}
+
+func proxyOptions(ctx context.Context, opts WarpOptions, tunnel *Tunnel) []wiresocks.ProxyOption {
+	var recovered func(context.Context, time.Time) bool
+	if opts.DialRetry {
+		recovered = tunnel.recovered
+	}
+	return []wiresocks.ProxyOption{
+		wiresocks.WithDialRetry(recovered),
+		wiresocks.WithListenBacklog(opts.ListenBacklog),
+		wiresocks.WithBufferSize(opts.RelayBufferSize),
+		wiresocks.WithConnBufferCap(opts.ConnBufferCap),
+		wiresocks.WithDialHook(chainDialHooks(firstDialHook(ctx), tunnel.countDial)),
+		wiresocks.WithCloseHook(tunnel.countClose),
+		wiresocks.WithProxyProtocol(opts.ProxyProtocol),
+		wiresocks.WithDirectPrefixes(opts.DirectPrefixes),
+		wiresocks.WithAdvertiseAddr(opts.AdvertiseAddr),
+		wiresocks.WithHandshakeTimeout(opts.SocksHandshakeTimeout),
+		wiresocks.WithAllowedDomains(opts.AllowDomains),
+		wiresocks.WithNAT64Prefix(opts.NAT64Prefix),
+		wiresocks.WithDNSConcurrency(opts.DNSConcurrency),
+		wiresocks.WithDialConcurrency(opts.DialConcurrency),
+		wiresocks.WithCircuitBreaker(opts.CircuitBreakerFailures, opts.CircuitBreakerCooldown),
+		wiresocks.WithTunnelHealth(tunnel.Health),
+		wiresocks.WithResolver(opts.Resolver),
+		wiresocks.WithDNSBypass(opts.DNSBypass),
+		wiresocks.WithDNSPreload(opts.DNSPreload),
+		wiresocks.WithTLSConfig(opts.ProxyTLS),
+		wiresocks.WithPause(tunnel.proxyPause()),
+	}
+}
+
+// chainDialHooks returns a dial hook calling each non-nil hook in order.
+func chainDialHooks(hooks ...func(network, address string, err error)) func(network, address string, err error) {
+	hooks = slices.DeleteFunc(hooks, func(h func(network, address string, err error)) bool { return h == nil })
+	if len(hooks) == 0 {
+		return nil
+	}
+	return func(network, address string, err error) {
+		for _, h := range hooks {
+			h(network, address, err)
+		}
+	}
+}
+
+// warpAllowedIPs are the allowed IPs of the warp peer: everything goes
+// through the tunnel, unless the proxy dials it directly.
+var warpAllowedIPs = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/0"),
+	netip.MustParsePrefix("::/0"),
+}
+
 func generateWireguardConfig(i *warp.Identity) wiresocks.Configuration {
 	priv, _ := wiresocks.EncodeBase64ToHex(i.PrivateKey)
 	pub, _ := wiresocks.EncodeBase64ToHex(i.Config.Peers[0].PublicKey)
@@ -447,12 +1290,60 @@ func generateWireguardConfig(i *warp.Identity) wiresocks.Configuration {
 		Peers: []wiresocks.PeerConfig{{
 			PublicKey:    pub,
 			PreSharedKey: "0000000000000000000000000000000000000000000000000000000000000000",
-			AllowedIPs: []netip.Prefix{
-				netip.MustParsePrefix("0.0.0.0/0"),
-				netip.MustParsePrefix("::/0"),
-			},
-			Endpoint: i.Config.Peers[0].Endpoint.Host,
-			Reserved: [3]byte{clientID[0], clientID[1], clientID[2]},
+			AllowedIPs:   warpAllowedIPs,
+			Endpoint:     i.Config.Peers[0].Endpoint.Host,
+			Reserved:     [3]byte{clientID[0], clientID[1], clientID[2]},
 		}},
 	}
 }
+
+// warpConfig returns the wireguard configuration of normal warp mode for
+// ident.
+func warpConfig(ident *warp.Identity, opts WarpOptions) (wiresocks.Configuration, error) {
+	conf := generateWireguardConfig(ident)
+
+	// Set up MTU
+	conf.Interface.MTU = singleMTU
+	// Set up DNS Address
+	conf.Interface.DNS = []netip.Addr{opts.DnsAddr}
+
+	// Enable trick and keepalive on all peers in config
+	for i, peer := range conf.Peers {
+		peer.Trick = true
+		peer.KeepAlive = opts.keepAlive()
+
+		if opts.Reserved != "" {
+			r, err := wiresocks.ParseReserved(opts.Reserved)
+			if err != nil {
+				return wiresocks.Configuration{}, err
+			}
+			peer.Reserved = r
+		}
+
+		conf.Peers[i] = peer
+	}
+	return conf, nil
+}
+
+// startupDelay waits out the configured startup delay, returning early with
+// ctx's error if it is canceled.
+func startupDelay(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
+	delay := opts.StartupDelay
+	if delay <= 0 {
+		return nil
+	}
+	if opts.StartupDelayRandom {
+		delay = rand.N(delay)
+	}
+
+	l.Info("delaying startup", "delay", delay)
+	t := time.NewTimer(delay)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
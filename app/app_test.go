@@ -0,0 +1,252 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/warp"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestStartupDelayCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := startupDelay(ctx, slog.Default(), WarpOptions{StartupDelay: time.Hour})
+	qt.Assert(t, err, qt.ErrorIs, context.Canceled)
+	qt.Assert(t, time.Since(start) < time.Second, qt.IsTrue)
+}
+
+func TestStartupDelay(t *testing.T) {
+	start := time.Now()
+	err := startupDelay(context.Background(), slog.Default(), WarpOptions{StartupDelay: 50 * time.Millisecond})
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, time.Since(start) >= 50*time.Millisecond, qt.IsTrue)
+
+	start = time.Now()
+	err = startupDelay(context.Background(), slog.Default(), WarpOptions{StartupDelay: 50 * time.Millisecond, StartupDelayRandom: true})
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, time.Since(start) < time.Second, qt.IsTrue)
+}
+
+func TestStartWarpValidatesFirst(t *testing.T) {
+	// invalid options fail right away instead of after the startup delay
+	// and the network wait
+	start := time.Now()
+	_, err := StartWarp(context.Background(), slog.Default(), WarpOptions{
+		StartupDelay:   time.Hour,
+		WaitForNetwork: time.Hour,
+		TeamToken:      "token",
+		License:        "license",
+	})
+	qt.Assert(t, err, qt.ErrorMatches, "can't use a license with a team token")
+	qt.Assert(t, time.Since(start) < time.Second, qt.IsTrue)
+}
+
+func TestStartWarpPsiphonRotation(t *testing.T) {
+	_, err := StartWarp(context.Background(), slog.Default(), WarpOptions{
+		Psiphon: &PsiphonOptions{Country: "US", Rotate: time.Minute, Countries: []string{"US", "US"}},
+	})
+	qt.Assert(t, err, qt.ErrorMatches, "psiphon rotation needs at least two different countries")
+}
+
+func TestRunWarpReconnectOn(t *testing.T) {
+	defer func(orig func(context.Context, *slog.Logger, WarpOptions) (*Tunnel, error), backoff [2]time.Duration) {
+		startWarp, reconnectBackoff = orig, backoff
+	}(startWarp, reconnectBackoff)
+	reconnectBackoff = [2]time.Duration{time.Millisecond, time.Millisecond}
+
+	for _, test := range []struct {
+		name     string
+		err      error
+		attempts int
+		wantErr  bool
+	}{
+		{"no-handshake", &ConnectError{Class: ErrClassNoHandshake, Err: context.DeadlineExceeded}, 3, false},
+		{"health-failure", &ConnectError{Class: ErrClassHealthFailure, Err: context.DeadlineExceeded}, 3, false},
+		{"account-rejected", warp.ErrAccountRejected, 1, true},
+		{"other", errors.New("boom"), 1, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			attempts := 0
+			startWarp = func(context.Context, *slog.Logger, WarpOptions) (*Tunnel, error) {
+				attempts++
+				if attempts < 3 {
+					return nil, test.err
+				}
+				return &Tunnel{}, nil
+			}
+
+			err := RunWarp(context.Background(), slog.Default(), WarpOptions{ReconnectOn: DefaultReconnectOn})
+			qt.Assert(t, attempts, qt.Equals, test.attempts)
+			if test.wantErr {
+				qt.Assert(t, err, qt.ErrorIs, test.err)
+			} else {
+				qt.Assert(t, err, qt.IsNil)
+			}
+		})
+	}
+}
+
+func TestRunWarpReconnectCooldown(t *testing.T) {
+	defer func(orig func(context.Context, *slog.Logger, WarpOptions) (*Tunnel, error), backoff [2]time.Duration) {
+		startWarp, reconnectBackoff = orig, backoff
+	}(startWarp, reconnectBackoff)
+	reconnectBackoff = [2]time.Duration{time.Millisecond, time.Millisecond}
+
+	// failures right away are still spaced by the cooldown
+	var starts []time.Time
+	startWarp = func(context.Context, *slog.Logger, WarpOptions) (*Tunnel, error) {
+		starts = append(starts, time.Now())
+		if len(starts) < 3 {
+			return nil, &ConnectError{Class: ErrClassNoHandshake, Err: context.DeadlineExceeded}
+		}
+		return &Tunnel{}, nil
+	}
+
+	const cooldown = 50 * time.Millisecond
+	err := RunWarp(context.Background(), slog.Default(), WarpOptions{ReconnectOn: DefaultReconnectOn, ReconnectCooldown: cooldown})
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, starts, qt.HasLen, 3)
+	for i := 1; i < len(starts); i++ {
+		qt.Assert(t, starts[i].Sub(starts[i-1]) >= cooldown, qt.IsTrue, qt.Commentf("attempt %d", i+1))
+	}
+}
+
+func TestRunWarpNetworkChange(t *testing.T) {
+	defer func(orig func(context.Context, *slog.Logger, WarpOptions) (*Tunnel, error), watch func(context.Context, *slog.Logger) (<-chan struct{}, error), settle time.Duration) {
+		startWarp, watchNetwork, networkSettleDelay = orig, watch, settle
+	}(startWarp, watchNetwork, networkSettleDelay)
+	networkSettleDelay = 10 * time.Millisecond
+
+	changes := make(chan struct{})
+	watchNetwork = func(context.Context, *slog.Logger) (<-chan struct{}, error) {
+		return changes, nil
+	}
+	started := make(chan context.Context, 4)
+	startWarp = func(ctx context.Context, _ *slog.Logger, _ WarpOptions) (*Tunnel, error) {
+		started <- ctx
+		return &Tunnel{}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := RunWarp(ctx, slog.Default(), WarpOptions{ReconnectOnNetworkChange: true})
+	qt.Assert(t, err, qt.IsNil)
+	first := <-started
+
+	// a burst of changes tears the tunnel down and brings it up once more
+	changes <- struct{}{}
+	changes <- struct{}{}
+	<-first.Done()
+	second := <-started
+	qt.Assert(t, second.Err(), qt.IsNil)
+	select {
+	case <-started:
+		t.Fatal("reconnected more than once")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+	<-second.Done()
+}
+
+func TestRunWarpNetworkChangeUnsupported(t *testing.T) {
+	defer func(orig func(context.Context, *slog.Logger, WarpOptions) (*Tunnel, error), watch func(context.Context, *slog.Logger) (<-chan struct{}, error)) {
+		startWarp, watchNetwork = orig, watch
+	}(startWarp, watchNetwork)
+
+	watchNetwork = func(context.Context, *slog.Logger) (<-chan struct{}, error) {
+		return nil, errNetworkWatchUnsupported
+	}
+	var tunnelCtx context.Context
+	startWarp = func(ctx context.Context, _ *slog.Logger, _ WarpOptions) (*Tunnel, error) {
+		tunnelCtx = ctx
+		return &Tunnel{}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err := RunWarp(ctx, slog.Default(), WarpOptions{ReconnectOnNetworkChange: true})
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, tunnelCtx.Err(), qt.IsNil)
+	cancel()
+	<-tunnelCtx.Done()
+}
+
+func TestRunWarpStartupBudget(t *testing.T) {
+	defer func(orig func(context.Context, *slog.Logger, WarpOptions) (*Tunnel, error), backoff [2]time.Duration) {
+		startWarp, reconnectBackoff = orig, backoff
+	}(startWarp, reconnectBackoff)
+
+	t.Run("blocked-attempt", func(t *testing.T) {
+		// e.g. registration retrying with backoff
+		startWarp = func(ctx context.Context, _ *slog.Logger, _ WarpOptions) (*Tunnel, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+
+		start := time.Now()
+		err := RunWarp(context.Background(), slog.Default(), WarpOptions{StartupBudget: 50 * time.Millisecond})
+		qt.Assert(t, err, qt.ErrorIs, ErrStartupBudget)
+		qt.Assert(t, err, qt.ErrorMatches, `.*during the first attempt.*`)
+		qt.Assert(t, time.Since(start) < time.Second, qt.IsTrue)
+	})
+
+	t.Run("retry-backoff", func(t *testing.T) {
+		reconnectBackoff = [2]time.Duration{time.Hour, time.Hour}
+		startWarp = func(context.Context, *slog.Logger, WarpOptions) (*Tunnel, error) {
+			return nil, &ConnectError{Class: ErrClassNoHandshake, Err: context.DeadlineExceeded}
+		}
+
+		start := time.Now()
+		err := RunWarp(context.Background(), slog.Default(), WarpOptions{ReconnectOn: DefaultReconnectOn, StartupBudget: 50 * time.Millisecond})
+		qt.Assert(t, err, qt.ErrorIs, ErrStartupBudget)
+		qt.Assert(t, err, qt.ErrorMatches, `.*1 failed attempts \(no-handshake\).*`)
+		qt.Assert(t, time.Since(start) < time.Second, qt.IsTrue)
+	})
+
+	t.Run("tunnel-outlives-budget", func(t *testing.T) {
+		var tunnelCtx context.Context
+		startWarp = func(ctx context.Context, _ *slog.Logger, _ WarpOptions) (*Tunnel, error) {
+			tunnelCtx = ctx
+			return &Tunnel{}, nil
+		}
+
+		err := RunWarp(context.Background(), slog.Default(), WarpOptions{StartupBudget: 10 * time.Millisecond})
+		qt.Assert(t, err, qt.IsNil)
+		time.Sleep(50 * time.Millisecond)
+		qt.Assert(t, tunnelCtx.Err(), qt.IsNil)
+	})
+}
+
+func TestServeProxyNoListener(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	freePort := func() netip.AddrPort {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		qt.Assert(t, err, qt.IsNil)
+		defer ln.Close()
+		return netip.MustParseAddrPort(ln.Addr().String())
+	}
+
+	bind := freePort()
+	err := serveProxy(ctx, slog.Default(), nil, WarpOptions{Bind: bind, NoListener: true}, &Tunnel{})
+	qt.Assert(t, err, qt.IsNil)
+	ln, err := net.Listen("tcp", bind.String())
+	qt.Assert(t, err, qt.IsNil)
+	ln.Close()
+
+	// the same options with a listener take the port
+	bind = freePort()
+	err = serveProxy(ctx, slog.Default(), nil, WarpOptions{Bind: bind}, &Tunnel{})
+	qt.Assert(t, err, qt.IsNil)
+	_, err = net.Listen("tcp", bind.String())
+	qt.Assert(t, err, qt.IsNotNil)
+}
@@ -0,0 +1,123 @@
+package app
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+const (
+	// DefaultScanBenchTop is the number of scan results benchmarked when
+	// WarpOptions.ScanBench is enabled without a count.
+	DefaultScanBenchTop = 3
+	// benchSize is the size of the benchmark download. It is small enough
+	// to finish in a few seconds on slow links but large enough to get past
+	// the initial congestion window.
+	benchSize    = 1 << 20
+	benchTimeout = 10 * time.Second
+)
+
+var benchURL = fmt.Sprintf("https://speed.cloudflare.com/__down?bytes=%d", benchSize)
+
+// benchResult is the measured download throughput of a scan result.
+type benchResult struct {
+	ScanResult
+	// Throughput is in bytes per second.
+	Throughput float64
+	Err        error
+}
+
+// measureThroughput brings up a tunnel with conf, downloads benchURL
+// through it and returns the throughput in bytes per second. It is
+// replaceable in tests.
+var measureThroughput = func(ctx context.Context, l *slog.Logger, devOpts deviceOptions, conf *wiresocks.Configuration) (float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, benchTimeout)
+	defer cancel()
+
+	tunDev, tnet, err := netstack.CreateNetTUN(conf.Interface.Addresses, conf.Interface.DNS, conf.Interface.MTU)
+	if err != nil {
+		return 0, err
+	}
+	dev, err := establishWireguard(ctx, l, conf, tunDev, devOpts, "t1")
+	if err != nil {
+		return 0, err
+	}
+	defer dev.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, benchURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	client := http.Client{Transport: &http.Transport{DialContext: tnet.DialContext}}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("benchmark download failed with status: %s", resp.Status)
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	return float64(n) / time.Since(start).Seconds(), nil
+}
+
+// benchEndpoints measures the download throughput through each of the top
+// results using conf, with its peer endpoints replaced, and moves the
+// fastest to the front. Candidates are measured one at a time so they don't
+// compete for bandwidth. Results past top keep their order.
+func benchEndpoints(ctx context.Context, l *slog.Logger, conf *wiresocks.Configuration, devOpts deviceOptions, res []ScanResult, top int) ([]ScanResult, error) {
+	top = min(top, len(res))
+	bench := make([]benchResult, 0, top)
+	for _, r := range res[:top] {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		for i := range conf.Peers {
+			conf.Peers[i].Endpoint = r.AddrPort.String()
+			conf.Peers[i].Trick = true
+		}
+
+		b := benchResult{ScanResult: r}
+		b.Throughput, b.Err = measureThroughput(ctx, l, devOpts, conf)
+		l.Info("benchmarked endpoint", "endpoint", r.AddrPort, "rtt", r.RTT, "mbps", b.Throughput*8/1e6, "error", b.Err)
+		bench = append(bench, b)
+	}
+
+	rankBench(bench)
+	ranked := make([]ScanResult, 0, len(res))
+	for _, b := range bench {
+		ranked = append(ranked, b.ScanResult)
+	}
+	return append(ranked, res[top:]...), nil
+}
+
+// rankBench sorts successful measurements by descending throughput,
+// followed by failed ones in their original order.
+func rankBench(bench []benchResult) {
+	slices.SortStableFunc(bench, func(a, b benchResult) int {
+		if (a.Err == nil) != (b.Err == nil) {
+			if a.Err == nil {
+				return -1
+			}
+			return 1
+		}
+		if a.Err != nil {
+			return 0
+		}
+		return cmp.Compare(b.Throughput, a.Throughput)
+	})
+}
@@ -0,0 +1,67 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wiresocks"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestBenchEndpoints(t *testing.T) {
+	throughput := map[string]float64{
+		"192.0.2.1:2408": 1e6,
+		"192.0.2.2:2408": 5e6,
+		"192.0.2.4:2408": 9e6,
+	}
+	orig := measureThroughput
+	t.Cleanup(func() { measureThroughput = orig })
+	var measured []string
+	measureThroughput = func(_ context.Context, _ *slog.Logger, _ deviceOptions, conf *wiresocks.Configuration) (float64, error) {
+		endpoint := conf.Peers[0].Endpoint
+		measured = append(measured, endpoint)
+		if v, ok := throughput[endpoint]; ok {
+			return v, nil
+		}
+		return 0, errors.New("download timed out")
+	}
+
+	var res []ScanResult
+	for i, rtt := range []time.Duration{10, 20, 30, 40} {
+		res = append(res, ScanResult{
+			AddrPort: netip.AddrPortFrom(netip.AddrFrom4([4]byte{192, 0, 2, byte(i + 1)}), 2408),
+			RTT:      rtt * time.Millisecond,
+		})
+	}
+
+	conf := &wiresocks.Configuration{Interface: &wiresocks.InterfaceConfig{}, Peers: []wiresocks.PeerConfig{{}}}
+	ranked, err := benchEndpoints(context.Background(), slog.Default(), conf, deviceOptions{}, res, 3)
+	qt.Assert(t, err, qt.IsNil)
+
+	// only the top 3 by RTT are measured, the 4th keeps its place
+	qt.Assert(t, measured, qt.DeepEquals, []string{"192.0.2.1:2408", "192.0.2.2:2408", "192.0.2.3:2408"})
+	var got []string
+	for _, r := range ranked {
+		got = append(got, r.AddrPort.String())
+	}
+	qt.Assert(t, got, qt.DeepEquals, []string{"192.0.2.2:2408", "192.0.2.1:2408", "192.0.2.3:2408", "192.0.2.4:2408"})
+}
+
+func TestScanCollect(t *testing.T) {
+	for _, tc := range []struct {
+		opts WarpOptions
+		want int
+	}{
+		{WarpOptions{Scan: &wiresocks.ScanOptions{}}, wiresocks.DefaultScanCollect},
+		{WarpOptions{Scan: &wiresocks.ScanOptions{}, ScanBench: 5}, 5},
+		{WarpOptions{Scan: &wiresocks.ScanOptions{RankStability: true}, ScanBench: 3}, wiresocks.RankedScanCollect},
+		{WarpOptions{Scan: &wiresocks.ScanOptions{}, SelectEndpoint: func([]ScanResult) (netip.AddrPort, error) { return netip.AddrPort{}, nil }}, wiresocks.RankedScanCollect},
+		{WarpOptions{Scan: &wiresocks.ScanOptions{Collect: 4}, ScanBench: 3}, 4},
+	} {
+		qt.Check(t, scanCollect(tc.opts), qt.Equals, tc.want)
+	}
+}
@@ -0,0 +1,135 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/bepass-org/warp-plus/warp"
+)
+
+// networkProbePort is the port probed when the endpoint isn't an address,
+// the usual warp endpoint port.
+const networkProbePort = 2408
+
+// networkProbeTimeout bounds a single check of waitForNetwork.
+const networkProbeTimeout = 3 * time.Second
+
+// networkPollInterval is the time between the checks of waitForNetwork.
+var networkPollInterval = time.Second
+
+// bootstrapResolver returns the resolver for the lookups made before the
+// tunnel is up, which go to server when it is valid and to the system
+// resolver otherwise.
+func bootstrapResolver(server netip.AddrPort) *net.Resolver {
+	if !server.IsValid() {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server.String())
+		},
+	}
+}
+
+// bootstrapClient returns an http client going out directly, resolving
+// hosts with resolver.
+func bootstrapClient(resolver *net.Resolver) *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = (&net.Dialer{Resolver: resolver}).DialContext
+	return &http.Client{Transport: t}
+}
+
+// resolveEndpoint resolves the host of endpoint with resolver unless it is
+// an IP address already, preferring IPv4 like the endpoint defaults do.
+func resolveEndpoint(ctx context.Context, resolver *net.Resolver, endpoint string) (string, error) {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid endpoint %q: %w", endpoint, err)
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return endpoint, nil
+	}
+
+	addrs, err := resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve endpoint %s: %w", host, err)
+	}
+	addr := addrs[0]
+	for _, a := range addrs {
+		if a.Unmap().Is4() {
+			addr = a
+			break
+		}
+	}
+	return net.JoinHostPort(addr.Unmap().String(), port), nil
+}
+
+// probeNetwork checks the network is up by connecting a UDP socket to
+// target. Nothing is sent, the connect only fails when there is no route to
+// target yet, as at boot before an address or a default route is set up. It
+// is replaceable in tests.
+var probeNetwork = func(ctx context.Context, target netip.AddrPort) error {
+	ctx, cancel := context.WithTimeout(ctx, networkProbeTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", target.String())
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// networkProbeTarget returns the address waitForNetwork checks for a route
+// to: the endpoint when it is given as an address, otherwise an address of
+// the warp prefixes, in IPv6 only for a scan limited to IPv6. Nothing is
+// resolved, a host name endpoint is looked up by the startup that follows.
+func networkProbeTarget(opts WarpOptions) netip.AddrPort {
+	if addr, err := netip.ParseAddrPort(opts.Endpoint); err == nil {
+		return addr
+	}
+	v6 := opts.Scan != nil && opts.Scan.V6 && !opts.Scan.V4
+	prefix := warp.RandomWarpPrefix(!v6, v6)
+	return netip.AddrPortFrom(prefix.Addr().Next(), networkProbePort)
+}
+
+// waitForNetwork waits up to opts.WaitForNetwork for the network to come
+// up, so a start during boot doesn't fail right away. Once the wait is over
+// startup goes ahead regardless and fails the usual way if the network is
+// still down.
+func waitForNetwork(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
+	if opts.WaitForNetwork <= 0 {
+		return nil
+	}
+	target := networkProbeTarget(opts)
+	err := probeNetwork(ctx, target)
+	if err == nil {
+		return nil
+	}
+
+	l.Info("waiting for the network", "timeout", opts.WaitForNetwork, "error", err)
+	deadline := time.NewTimer(opts.WaitForNetwork)
+	defer deadline.Stop()
+	ticker := time.NewTicker(networkPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline.C:
+			l.Warn("network is still unreachable, starting anyway", "waited", opts.WaitForNetwork, "error", err)
+			return nil
+		case <-ticker.C:
+			if err = probeNetwork(ctx, target); err == nil {
+				l.Info("network is up")
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wiresocks"
+	qt "github.com/frankban/quicktest"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// bootstrapDNS is a DNS server answering every A query with addr and
+// counting the queries.
+func bootstrapDNS(t *testing.T, addr netip.Addr, queries *atomic.Int32) netip.AddrPort {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			header, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+			queries.Add(1)
+			b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true, Authoritative: true})
+			_ = b.StartQuestions()
+			_ = b.Question(q)
+			_ = b.StartAnswers()
+			if q.Type == dnsmessage.TypeA {
+				_ = b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.AResource{A: addr.As4()})
+			}
+			msg, err := b.Finish()
+			if err != nil {
+				continue
+			}
+			_, _ = conn.WriteTo(msg, from)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+func TestBootstrapResolver(t *testing.T) {
+	var queries atomic.Int32
+	resolver := bootstrapResolver(bootstrapDNS(t, netip.MustParseAddr("127.0.0.1"), &queries))
+
+	// the .invalid TLD never resolves through the system resolver
+	endpoint, err := resolveEndpoint(context.Background(), resolver, "engage.warp.invalid:2408")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, endpoint, qt.Equals, "127.0.0.1:2408")
+	qt.Assert(t, queries.Load() > 0, qt.IsTrue)
+
+	// addresses aren't looked up
+	queries.Store(0)
+	endpoint, err = resolveEndpoint(context.Background(), resolver, "[2606:4700:d0::a29f:c001]:2408")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, endpoint, qt.Equals, "[2606:4700:d0::a29f:c001]:2408")
+	qt.Assert(t, queries.Load(), qt.Equals, int32(0))
+
+	// direct requests before the tunnel is up resolve through it too
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "loc=DE\n")
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	loc, err := traceLocation(context.Background(), bootstrapClient(resolver), "http://trace.warp.invalid:"+port+"/cdn-cgi/trace")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, loc, qt.Equals, "DE")
+	qt.Assert(t, queries.Load() > 0, qt.IsTrue)
+
+	qt.Assert(t, bootstrapResolver(netip.AddrPort{}), qt.Equals, net.DefaultResolver)
+	_, err = resolveEndpoint(context.Background(), resolver, "engage.warp.invalid")
+	qt.Assert(t, err, qt.ErrorMatches, `invalid endpoint .*`)
+}
+
+func TestWaitForNetwork(t *testing.T) {
+	defer func(probe func(context.Context, netip.AddrPort) error, interval time.Duration) {
+		probeNetwork, networkPollInterval = probe, interval
+	}(probeNetwork, networkPollInterval)
+	networkPollInterval = time.Millisecond
+
+	var probes atomic.Int32
+	var target netip.AddrPort
+	probeNetwork = func(_ context.Context, addr netip.AddrPort) error {
+		target = addr
+		if probes.Add(1) < 3 {
+			return errors.New("network is unreachable")
+		}
+		return nil
+	}
+	opts := WarpOptions{WaitForNetwork: time.Minute}
+	qt.Assert(t, waitForNetwork(context.Background(), slog.Default(), opts), qt.IsNil)
+	qt.Assert(t, probes.Load(), qt.Equals, int32(3))
+	qt.Assert(t, target.Port(), qt.Equals, uint16(networkProbePort))
+
+	// a network that stays down is waited for until the timeout, then
+	// startup goes ahead
+	probes.Store(-1000)
+	start := time.Now()
+	opts.WaitForNetwork = 20 * time.Millisecond
+	qt.Assert(t, waitForNetwork(context.Background(), slog.Default(), opts), qt.IsNil)
+	qt.Assert(t, time.Since(start) >= opts.WaitForNetwork, qt.IsTrue)
+	qt.Assert(t, probes.Load() > -1000+1, qt.IsTrue)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	probes.Store(-1000)
+	opts.WaitForNetwork = time.Hour
+	qt.Assert(t, waitForNetwork(ctx, slog.Default(), opts), qt.ErrorIs, context.Canceled)
+
+	// without a wait the network isn't checked
+	probes.Store(0)
+	qt.Assert(t, waitForNetwork(context.Background(), slog.Default(), WarpOptions{}), qt.IsNil)
+	qt.Assert(t, probes.Load(), qt.Equals, int32(0))
+}
+
+func TestNetworkProbeTarget(t *testing.T) {
+	qt.Assert(t, networkProbeTarget(WarpOptions{Endpoint: "203.0.113.1:500"}), qt.Equals, netip.MustParseAddrPort("203.0.113.1:500"))
+
+	target := networkProbeTarget(WarpOptions{Endpoint: "engage.cloudflareclient.com:2408"})
+	qt.Assert(t, target.Addr().Is4(), qt.IsTrue)
+	qt.Assert(t, target.Port(), qt.Equals, uint16(networkProbePort))
+
+	target = networkProbeTarget(WarpOptions{Scan: &wiresocks.ScanOptions{V6: true}})
+	qt.Assert(t, target.Addr().Is6(), qt.IsTrue)
+
+	// the probe only needs a route, nothing listens on the port
+	qt.Assert(t, probeNetwork(context.Background(), netip.MustParseAddrPort("127.0.0.1:9")), qt.IsNil)
+}
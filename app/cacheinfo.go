@@ -0,0 +1,124 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"time"
+
+	"github.com/bepass-org/warp-plus/warp"
+)
+
+// cachedIdentityNames are the identities that may be found under the cache
+// directory, relative to it.
+var cachedIdentityNames = []string{"primary", "secondary", "team/primary", "team/secondary"}
+
+// CachedIdentity describes an identity found in the cache directory. Secrets
+// are never included.
+type CachedIdentity struct {
+	Name        string `json:"name"`
+	Path        string `json:"path"`
+	Valid       bool   `json:"valid"`
+	Problem     string `json:"problem,omitempty"`
+	DeviceID    string `json:"device_id,omitempty"`
+	AccountType string `json:"account_type,omitempty"`
+	WarpPlus    bool   `json:"warp_plus,omitempty"`
+	License     string `json:"license,omitempty"`
+	IPv4        string `json:"ipv4,omitempty"`
+	IPv6        string `json:"ipv6,omitempty"`
+	// TokenAge is how long ago the device was registered, taken from the
+	// registration time or else the modification time of the file.
+	TokenAge string `json:"token_age,omitempty"`
+	// Verified is the outcome of the API check, empty when not verified.
+	Verified string `json:"verified,omitempty"`
+}
+
+// InspectCache describes the identities cached under opts.CacheDir. With
+// verify the tokens of valid identities are checked against the API.
+func InspectCache(ctx context.Context, l *slog.Logger, opts WarpOptions, verify bool) ([]CachedIdentity, error) {
+	var found []CachedIdentity
+	for _, name := range cachedIdentityNames {
+		dir := path.Join(opts.CacheDir, name)
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+
+		c := inspectIdentity(name, dir)
+		if verify && c.Valid {
+			ident, _ := warp.LoadIdentity(dir)
+			api := warp.NewWarpAPI(l.With("subsystem", "warp/account"), apiOptions(ctx, opts)...)
+			if _, err := api.GetAccount(ident.Token, ident.ID); err != nil {
+				c.Verified = err.Error()
+			} else {
+				c.Verified = "ok"
+			}
+		}
+		found = append(found, c)
+	}
+
+	if len(found) == 0 {
+		return nil, fmt.Errorf("no cached identities in %s", opts.CacheDir)
+	}
+	return found, nil
+}
+
+// identityCreated returns when the identity cached in dir was registered.
+// Identities cached before the registration time was recorded fall back to
+// the modification time of the file, which is zero if that is gone too.
+func identityCreated(ident warp.Identity, dir string) time.Time {
+	if created, err := time.Parse(time.RFC3339, ident.Created); err == nil {
+		return created
+	}
+	if fi, err := os.Stat(path.Join(dir, "wgcf-identity.json")); err == nil {
+		return fi.ModTime()
+	}
+	return time.Time{}
+}
+
+func inspectIdentity(name, dir string) CachedIdentity {
+	c := CachedIdentity{Name: name, Path: dir}
+
+	ident, err := warp.LoadIdentity(dir)
+	if err != nil {
+		c.Problem = err.Error()
+		return c
+	}
+
+	c.DeviceID = ident.ID
+	c.AccountType = ident.Account.AccountType
+	c.WarpPlus = ident.Account.WarpPlus
+	c.License = redact(ident.Account.License)
+	c.IPv4 = ident.Config.Interface.Addresses.V4
+	c.IPv6 = ident.Config.Interface.Addresses.V6
+
+	if created := identityCreated(ident, dir); !created.IsZero() {
+		c.TokenAge = time.Since(created).Round(time.Second).String()
+	}
+
+	switch {
+	case ident.ID == "":
+		err = errors.New("missing device id")
+	case ident.Token == "":
+		err = errors.New("missing token")
+	case ident.PrivateKey == "":
+		err = errors.New("missing private key")
+	}
+	if err != nil {
+		c.Problem = err.Error()
+		return c
+	}
+
+	c.Valid = true
+	return c
+}
+
+// redact keeps just enough of a secret to tell it apart from others.
+func redact(secret string) string {
+	if len(secret) <= 4 {
+		return ""
+	}
+	return secret[:4] + "..."
+}
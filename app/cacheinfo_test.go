@@ -0,0 +1,88 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bepass-org/warp-plus/warp"
+	qt "github.com/frankban/quicktest"
+)
+
+func writeIdentity(t *testing.T, dir string, ident any) {
+	qt.Assert(t, os.MkdirAll(dir, 0o755), qt.IsNil)
+	b, err := json.Marshal(ident)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, os.WriteFile(filepath.Join(dir, "wgcf-identity.json"), b, 0o600), qt.IsNil)
+}
+
+func TestInspectCache(t *testing.T) {
+	cacheDir := t.TempDir()
+
+	ident := warp.Identity{
+		ID:         "device",
+		Token:      "secret-token",
+		PrivateKey: "secret-key",
+		Created:    "2024-01-02T03:04:05Z",
+		Account:    warp.IdentityAccount{AccountType: "limited", WarpPlus: true, License: "abcd1234-efgh5678"},
+	}
+	ident.Config.Peers = []warp.IdentityConfigPeer{{PublicKey: "peer"}}
+	ident.Config.Interface.Addresses.V4 = "172.16.0.2"
+	writeIdentity(t, filepath.Join(cacheDir, "primary"), ident)
+
+	// cut off mid-write
+	qt.Assert(t, os.MkdirAll(filepath.Join(cacheDir, "secondary"), 0o755), qt.IsNil)
+	qt.Assert(t, os.WriteFile(filepath.Join(cacheDir, "secondary", "wgcf-identity.json"), []byte(`{"id":"dev`), 0o600), qt.IsNil)
+
+	var calls int
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		qt.Check(t, req.Header.Get("Authorization"), qt.Equals, "Bearer secret-token")
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{}`)),
+			Header:     make(http.Header),
+			Request:    req,
+		}, nil
+	})}
+
+	idents, err := InspectCache(context.Background(), slog.Default(), WarpOptions{CacheDir: cacheDir, HTTPClient: client}, true)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, idents, qt.HasLen, 2)
+
+	primary := idents[0]
+	qt.Assert(t, primary.Name, qt.Equals, "primary")
+	qt.Assert(t, primary.Valid, qt.IsTrue)
+	qt.Assert(t, primary.DeviceID, qt.Equals, "device")
+	qt.Assert(t, primary.AccountType, qt.Equals, "limited")
+	qt.Assert(t, primary.IPv4, qt.Equals, "172.16.0.2")
+	qt.Assert(t, primary.License, qt.Equals, "abcd...")
+	qt.Assert(t, primary.TokenAge, qt.Not(qt.Equals), "")
+	qt.Assert(t, primary.Verified, qt.Equals, "ok")
+
+	secondary := idents[1]
+	qt.Assert(t, secondary.Name, qt.Equals, "secondary")
+	qt.Assert(t, secondary.Valid, qt.IsFalse)
+	qt.Assert(t, secondary.Problem, qt.Not(qt.Equals), "")
+	qt.Assert(t, secondary.Verified, qt.Equals, "")
+
+	// only the valid identity is verified
+	qt.Assert(t, calls, qt.Equals, 1)
+
+	// no secrets in the output
+	b, err := json.Marshal(idents)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, strings.Contains(string(b), "secret"), qt.IsFalse)
+	qt.Assert(t, strings.Contains(string(b), "1234"), qt.IsFalse)
+}
+
+func TestInspectCacheEmpty(t *testing.T) {
+	_, err := InspectCache(context.Background(), slog.Default(), WarpOptions{CacheDir: t.TempDir()}, false)
+	qt.Assert(t, err, qt.ErrorMatches, "no cached identities in .*")
+}
@@ -0,0 +1,105 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bepass-org/warp-plus/warp"
+	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
+)
+
+const (
+	traceURL            = "http://connectivity.cloudflareclient.com/cdn-cgi/trace"
+	traceTLSURL         = "https://connectivity.cloudflareclient.com/cdn-cgi/trace"
+	requireColoAttempts = 5
+)
+
+// traceColo fetches the cloudflare trace endpoint at url through the tunnel
+// and returns the colo that served the request.
+func traceColo(ctx context.Context, tnet *netstack.Net, url string, roots *x509.CertPool) (string, error) {
+	trace, err := fetchTrace(ctx, tnet, url, roots)
+	if err != nil {
+		return "", err
+	}
+
+	colo, ok := trace["colo"]
+	if !ok {
+		return "", errors.New("colo not found in trace response")
+	}
+	return strings.ToUpper(colo), nil
+}
+
+// fetchTrace fetches the cloudflare trace endpoint at url through the tunnel
+// and returns its key=value pairs. With roots the server is verified against
+// them.
+func fetchTrace(ctx context.Context, tnet *netstack.Net, url string, roots *x509.CertPool) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := http.Client{Transport: checkTransport(tnet.DialContext, roots)}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("trace request failed with status: %s", resp.Status)
+	}
+
+	return parseTrace(bufio.NewScanner(resp.Body))
+}
+
+func parseTrace(scanner *bufio.Scanner) (map[string]string, error) {
+	trace := make(map[string]string)
+	for scanner.Scan() {
+		if key, value, ok := strings.Cut(scanner.Text(), "="); ok {
+			trace[key] = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return trace, nil
+}
+
+// coloEndpoint returns the endpoint to use for the given reconnect attempt.
+// The provided endpoints are tried first, then random warp endpoints of the
+// same address family.
+func coloEndpoint(endpoints []string, attempt int) (string, error) {
+	var uniq []string
+	for _, e := range endpoints {
+		if !slices.Contains(uniq, e) {
+			uniq = append(uniq, e)
+		}
+	}
+	if attempt < len(uniq) {
+		return uniq[attempt], nil
+	}
+
+	v4, v6 := true, true
+	if len(endpoints) > 0 {
+		if addrPort, err := netip.ParseAddrPort(endpoints[0]); err == nil {
+			v4, v6 = addrPort.Addr().Is4(), addrPort.Addr().Is6()
+		}
+	}
+
+	addrPort, err := warp.RandomWarpEndpoint(v4, v6)
+	if err != nil {
+		return "", err
+	}
+	return addrPort.String(), nil
+}
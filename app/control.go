@@ -0,0 +1,230 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// egressIPInterval rate limits egress-ip lookups through the tunnel.
+const egressIPInterval = 5 * time.Second
+
+// controlHandler runs a control command and returns its JSON result.
+type controlHandler func(ctx context.Context) (any, error)
+
+// controlResponse is written back for every command as a single JSON line.
+type controlResponse struct {
+	OK     bool   `json:"ok"`
+	Result any    `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// controlServer serves newline separated commands on a local socket.
+type controlServer struct {
+	l        *slog.Logger
+	commands map[string]controlHandler
+}
+
+func newControlServer(l *slog.Logger) *controlServer {
+	return &controlServer{
+		l:        l.With("subsystem", "control"),
+		commands: make(map[string]controlHandler),
+	}
+}
+
+func (c *controlServer) handle(name string, h controlHandler) {
+	c.commands[name] = h
+}
+
+// listen starts serving on a unix socket at path until ctx is done. A stale
+// socket left by an earlier run is replaced, anything else at path is an
+// error. The socket is created in a private directory and only moved to
+// path once it is restricted to 0600.
+func (c *controlServer) listen(ctx context.Context, path string) error {
+	if err := removeStaleSocket(path); err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".control-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock")
+
+	ln, err := net.Listen("unix", tmp)
+	if err != nil {
+		return err
+	}
+	// the socket is moved away from tmp, it is removed below instead
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err = os.Chmod(tmp, 0o600); err == nil {
+		err = os.Rename(tmp, path)
+	}
+	var info os.FileInfo
+	if err == nil {
+		info, err = os.Lstat(path)
+	}
+	if err != nil {
+		ln.Close()
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+		// leave a socket a later run put at path alone
+		if now, err := os.Lstat(path); err == nil && os.SameFile(info, now) {
+			os.Remove(path)
+		}
+	}()
+	go c.serve(ctx, ln)
+
+	c.l.Info("serving control socket", "path", path)
+	return nil
+}
+
+// removeStaleSocket removes the socket at path when nothing listens on it
+// any more. A live socket or a file that isn't a socket is left alone and
+// reported as an error.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode().Type() != os.ModeSocket {
+		return fmt.Errorf("%s exists and isn't a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	return os.Remove(path)
+}
+
+func (c *controlServer) serve(ctx context.Context, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				c.l.Error("control socket accept failed", "error", err)
+			}
+			return
+		}
+		go c.serveConn(ctx, conn)
+	}
+}
+
+func (c *controlServer) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	encoder := json.NewEncoder(conn)
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		name := strings.TrimSpace(scanner.Text())
+		if name == "" {
+			continue
+		}
+
+		if err := encoder.Encode(c.run(ctx, name)); err != nil {
+			return
+		}
+	}
+}
+
+func (c *controlServer) run(ctx context.Context, name string) controlResponse {
+	h, ok := c.commands[name]
+	if !ok {
+		return controlResponse{Error: fmt.Sprintf("unknown command %q", name)}
+	}
+
+	result, err := h(ctx)
+	if err != nil {
+		c.l.Debug("control command failed", "command", name, "error", err)
+		return controlResponse{Error: err.Error()}
+	}
+	return controlResponse{OK: true, Result: result}
+}
+
+// egressIP is the result of the egress-ip command.
+type egressIP struct {
+	IP   string `json:"ip"`
+	Colo string `json:"colo"`
+}
+
+// egressIPHandler looks up the current egress IP and colo through the
+// tunnel, allowing at most one lookup per egressIPInterval.
+func egressIPHandler(trace func(ctx context.Context) (map[string]string, error)) controlHandler {
+	var mu sync.Mutex
+	var last time.Time
+	return func(ctx context.Context) (any, error) {
+		mu.Lock()
+		if wait := egressIPInterval - time.Since(last); wait > 0 {
+			mu.Unlock()
+			return nil, fmt.Errorf("rate limited, retry in %s", wait.Round(time.Second))
+		}
+		last = time.Now()
+		mu.Unlock()
+
+		t, err := trace(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return egressIP{IP: t["ip"], Colo: strings.ToUpper(t["colo"])}, nil
+	}
+}
+
+// healthHandler reports the tunnel health, failing while it is unhealthy.
+func healthHandler(health func() error) controlHandler {
+	return statusHandler(health, "healthy")
+}
+
+// statusHandler answers ok while check passes, failing with its error
+// otherwise.
+func statusHandler(check func() error, ok string) controlHandler {
+	return func(context.Context) (any, error) {
+		if err := check(); err != nil {
+			return nil, err
+		}
+		return ok, nil
+	}
+}
+
+// pauseResult is the result of the pause and resume commands.
+type pauseResult struct {
+	Paused bool `json:"paused"`
+	// Closed is the number of connections closed by pause, only UDP
+	// associations unless by pause-close.
+	Closed int `json:"closed"`
+}
+
+// pauseHandler pauses the proxy of tunnel, closing the open TCP connections
+// with closeConns.
+func pauseHandler(l *slog.Logger, tunnel *Tunnel, closeConns bool) controlHandler {
+	return func(context.Context) (any, error) {
+		n := tunnel.Pause(closeConns)
+		l.Info("proxy paused", "closed", n)
+		return pauseResult{Paused: true, Closed: n}, nil
+	}
+}
+
+// resumeHandler resumes the proxy of tunnel.
+func resumeHandler(l *slog.Logger, tunnel *Tunnel) controlHandler {
+	return func(context.Context) (any, error) {
+		tunnel.Resume()
+		l.Info("proxy resumed")
+		return pauseResult{}, nil
+	}
+}
@@ -0,0 +1,231 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestControlEgressIP(t *testing.T) {
+	dir, err := os.MkdirTemp("", "ctl")
+	qt.Assert(t, err, qt.IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "warp.sock")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	traces := 0
+	ctrl := newControlServer(slog.Default())
+	ctrl.handle("egress-ip", egressIPHandler(func(context.Context) (map[string]string, error) {
+		traces++
+		return map[string]string{"ip": "104.28.1.2", "colo": "fra"}, nil
+	}))
+	qt.Assert(t, ctrl.listen(ctx, path), qt.IsNil)
+
+	fi, err := os.Stat(path)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, fi.Mode().Perm(), qt.Equals, os.FileMode(0o600))
+
+	conn, err := net.Dial("unix", path)
+	qt.Assert(t, err, qt.IsNil)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	query := func(cmd string) map[string]any {
+		_, err := conn.Write([]byte(cmd + "\n"))
+		qt.Assert(t, err, qt.IsNil)
+		line, err := r.ReadBytes('\n')
+		qt.Assert(t, err, qt.IsNil)
+		var resp map[string]any
+		qt.Assert(t, json.Unmarshal(line, &resp), qt.IsNil)
+		return resp
+	}
+
+	resp := query("egress-ip")
+	qt.Assert(t, resp["ok"], qt.Equals, true)
+	qt.Assert(t, resp["result"], qt.DeepEquals, map[string]any{"ip": "104.28.1.2", "colo": "FRA"})
+
+	// a second lookup right away is rate limited
+	resp = query("egress-ip")
+	qt.Assert(t, resp["ok"], qt.Equals, false)
+	qt.Assert(t, resp["error"], qt.Matches, "rate limited.*")
+	qt.Assert(t, traces, qt.Equals, 1)
+
+	resp = query("bogus")
+	qt.Assert(t, resp["ok"], qt.Equals, false)
+	qt.Assert(t, resp["error"], qt.Equals, `unknown command "bogus"`)
+}
+
+// reconfigurableDevice records the configuration set on it. Setting an
+// endpoint completes a handshake unless it is one of silent.
+type reconfigurableDevice struct {
+	fakeDevice
+	set    []string
+	silent []string
+}
+
+func (d *reconfigurableDevice) IpcSet(s string) error {
+	d.set = append(d.set, s)
+	_, endpoint, ok := strings.Cut(s, "endpoint=")
+	if endpoint = strings.TrimSpace(endpoint); ok && !slices.Contains(d.silent, endpoint) {
+		now := time.Now()
+		d.fakeDevice = fakeDevice(fmt.Sprintf("public_key=abcd\nendpoint=%s\nlast_handshake_time_sec=%d\nlast_handshake_time_nsec=%d\n", endpoint, now.Unix(), now.Nanosecond()))
+	}
+	return nil
+}
+
+func TestControlSocketStale(t *testing.T) {
+	dir, err := os.MkdirTemp("", "ctl")
+	qt.Assert(t, err, qt.IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "warp.sock")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctrl := newControlServer(slog.Default())
+
+	// a file that isn't a socket is never removed
+	qt.Assert(t, os.WriteFile(path, []byte("data"), 0o644), qt.IsNil)
+	qt.Assert(t, ctrl.listen(ctx, path), qt.ErrorMatches, ".* exists and isn't a socket")
+	_, err = os.Stat(path)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, os.Remove(path), qt.IsNil)
+
+	// neither is a live socket
+	live, err := net.Listen("unix", path)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, ctrl.listen(ctx, path), qt.ErrorMatches, ".* is in use by another process")
+
+	// a socket nobody listens on any more is replaced
+	live.(*net.UnixListener).SetUnlinkOnClose(false)
+	live.Close()
+	qt.Assert(t, ctrl.listen(ctx, path), qt.IsNil)
+	conn, err := net.Dial("unix", path)
+	qt.Assert(t, err, qt.IsNil)
+	conn.Close()
+
+	// the private directory the socket was created in is gone, and the
+	// socket is removed once the server stops
+	entries, err := os.ReadDir(dir)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, entries, qt.HasLen, 1)
+	cancel()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if _, err := os.Lstat(path); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("control socket wasn't removed")
+		}
+	}
+}
+
+func TestControlRescan(t *testing.T) {
+	dir, err := os.MkdirTemp("", "ctl")
+	qt.Assert(t, err, qt.IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "warp.sock")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tunnel := &Tunnel{}
+	dev := &reconfigurableDevice{fakeDevice: "public_key=abcd\nendpoint=162.159.192.1:2408\n"}
+	tunnel.connected(ctx, "162.159.192.1:2408", dev, nil)
+
+	best := netip.MustParseAddrPort("162.159.195.7:908")
+	ctrl := newControlServer(slog.Default())
+	ctrl.handle("rescan", rescanHandler(slog.Default(), tunnel, func(context.Context) ([]ScanResult, error) {
+		return []ScanResult{
+			{AddrPort: best, RTT: 20 * time.Millisecond},
+			{AddrPort: netip.MustParseAddrPort("162.159.192.1:2408"), RTT: 80 * time.Millisecond},
+		}, nil
+	}, nil))
+	qt.Assert(t, ctrl.listen(ctx, path), qt.IsNil)
+
+	resp, err := queryControl(ctx, path, "rescan")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, resp.OK, qt.IsTrue, qt.Commentf("%s", resp.Error))
+	qt.Assert(t, resp.Result, qt.DeepEquals, map[string]any{
+		"previous":   "162.159.192.1:2408",
+		"best":       "162.159.195.7:908",
+		"switched":   true,
+		"candidates": float64(2),
+	})
+	qt.Assert(t, dev.set, qt.DeepEquals, []string{"public_key=abcd\nupdate_only=true\nendpoint=162.159.195.7:908\n"})
+	qt.Assert(t, tunnel.currentEndpoint(), qt.Equals, "162.159.195.7:908")
+	qt.Assert(t, tunnel.reconnects, qt.Equals, uint64(1))
+
+	// a second rescan right away is rate limited
+	resp, err = queryControl(ctx, path, "rescan")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, resp.Error, qt.Matches, "rate limited.*")
+}
+
+func TestControlPause(t *testing.T) {
+	dir := t.TempDir()
+	statusPath := filepath.Join(dir, "status.json")
+	tunnel := &Tunnel{status: newStatusFile(slog.Default(), statusPath, "warp", handshakeHealth{maxAge: DefaultMaxHandshakeAge})}
+
+	ctrl := newControlServer(slog.Default())
+	ctrl.handle("pause", pauseHandler(slog.Default(), tunnel, false))
+	ctrl.handle("resume", resumeHandler(slog.Default(), tunnel))
+
+	resp := ctrl.run(context.Background(), "pause")
+	qt.Assert(t, resp.OK, qt.IsTrue)
+	qt.Assert(t, resp.Result, qt.Equals, pauseResult{Paused: true})
+	qt.Assert(t, tunnel.Paused(), qt.IsTrue)
+	qt.Assert(t, tunnel.proxyPause().Paused(), qt.IsTrue)
+	s, err := readStatusFile(statusPath)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, s.Paused, qt.IsTrue)
+
+	resp = ctrl.run(context.Background(), "resume")
+	qt.Assert(t, resp.OK, qt.IsTrue)
+	qt.Assert(t, tunnel.Paused(), qt.IsFalse)
+	s, err = readStatusFile(statusPath)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, s.Paused, qt.IsFalse)
+}
+
+func TestSwitchEndpointRestores(t *testing.T) {
+	defer func(orig time.Duration) { switchHandshakeTimeout = orig }(switchHandshakeTimeout)
+	switchHandshakeTimeout = 50 * time.Millisecond
+
+	ctx := context.Background()
+	tunnel := &Tunnel{}
+	dev := &reconfigurableDevice{fakeDevice: "public_key=abcd\nendpoint=162.159.192.1:2408\n", silent: []string{"162.159.195.7:908"}}
+	tunnel.connected(ctx, "162.159.192.1:2408", dev, nil)
+
+	// an endpoint that doesn't answer
+	err := tunnel.switchEndpoint(ctx, "162.159.195.7:908", nil)
+	qt.Assert(t, err, qt.ErrorMatches, "no handshake with the new endpoint")
+	qt.Assert(t, dev.set, qt.DeepEquals, []string{
+		"public_key=abcd\nupdate_only=true\nendpoint=162.159.195.7:908\n",
+		"public_key=abcd\nupdate_only=true\nendpoint=162.159.192.1:2408\n",
+	})
+	qt.Assert(t, tunnel.currentEndpoint(), qt.Equals, "162.159.192.1:2408")
+	qt.Assert(t, tunnel.reconnects, qt.Equals, uint64(0))
+
+	// an endpoint in the wrong colo
+	dev.set = nil
+	err = tunnel.switchEndpoint(ctx, "162.159.193.3:2408", func(context.Context) error { return errors.New("connected to colo AMS, want FRA") })
+	qt.Assert(t, err, qt.ErrorMatches, "connected to colo AMS, want FRA")
+	qt.Assert(t, dev.set, qt.HasLen, 2)
+	qt.Assert(t, tunnel.currentEndpoint(), qt.Equals, "162.159.192.1:2408")
+	qt.Assert(t, tunnel.reconnects, qt.Equals, uint64(0))
+}
@@ -0,0 +1,206 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Diagnostics is a support bundle for bug reports. It describes the
+// installation and the running tunnel without private keys, tokens,
+// licenses or anything identifying the user: device ids are truncated, the
+// per-device IPv6 address and the egress IP are left out and paths under
+// the home directory start with ~.
+type Diagnostics struct {
+	Generated time.Time `json:"generated"`
+	Version   string    `json:"version,omitempty"`
+	OS        string    `json:"os"`
+	Arch      string    `json:"arch"`
+	GoVersion string    `json:"go_version"`
+	// Config are the effective flag values, with secrets already redacted by
+	// the caller.
+	Config     map[string]string `json:"config,omitempty"`
+	Identities []CachedIdentity  `json:"identities,omitempty"`
+	// EndpointHistory are the handshake outcomes per endpoint, summarizing
+	// past scans and connections.
+	EndpointHistory map[string]EndpointRecord `json:"endpoint_history,omitempty"`
+	// Status is read from the status file of a running instance.
+	Status *Status `json:"status,omitempty"`
+	// Health is the answer of the health control command of a running
+	// instance.
+	Health string `json:"health,omitempty"`
+	// RecentErrors are the last failures of a running instance, as told by
+	// the errors control command.
+	RecentErrors []RecentError `json:"recent_errors,omitempty"`
+	// Errors are the problems found while collecting the bundle, such as
+	// broken identities or an unhealthy tunnel.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// Diagnose collects a support bundle for opts. It never fails, whatever
+// can't be collected is listed in Diagnostics.Errors.
+func Diagnose(ctx context.Context, l *slog.Logger, opts WarpOptions, config map[string]string) Diagnostics {
+	home, _ := os.UserHomeDir()
+	d := Diagnostics{
+		Generated: time.Now().UTC(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		GoVersion: runtime.Version(),
+		Config:    make(map[string]string, len(config)),
+	}
+	for k, v := range config {
+		d.Config[k] = anonymizePath(v, home)
+	}
+
+	idents, err := InspectCache(ctx, l, opts, false)
+	if err != nil {
+		d.Errors = append(d.Errors, err.Error())
+	}
+	for _, ident := range idents {
+		ident.Path = anonymizePath(ident.Path, home)
+		ident.DeviceID = redact(ident.DeviceID)
+		ident.IPv6 = ""
+		if ident.Problem != "" {
+			d.Errors = append(d.Errors, fmt.Sprintf("identity %s: %s", ident.Name, ident.Problem))
+		}
+		d.Identities = append(d.Identities, ident)
+	}
+
+	if !opts.NoCache {
+		h := loadEndpointHistory(l, path.Join(opts.CacheDir, "endpoint-history.json"))
+		d.EndpointHistory = maps.Clone(h.endpoints)
+	}
+
+	if opts.StatusFile != "" {
+		if s, err := readStatusFile(opts.StatusFile); err != nil {
+			d.Errors = append(d.Errors, fmt.Sprintf("status file: %v", err))
+		} else {
+			s.EgressIP = ""
+			d.Status = &s
+		}
+	}
+
+	if opts.ControlSocket != "" {
+		resp, err := queryControl(ctx, opts.ControlSocket, "health")
+		switch {
+		case err != nil:
+			d.Errors = append(d.Errors, fmt.Sprintf("control socket: %v", err))
+		case !resp.OK:
+			d.Health = "unhealthy"
+			d.Errors = append(d.Errors, fmt.Sprintf("health: %s", resp.Error))
+		default:
+			d.Health = "healthy"
+		}
+
+		if resp, err := queryControl(ctx, opts.ControlSocket, "errors"); err == nil && resp.OK {
+			// the result went through JSON as an untyped value
+			b, _ := json.Marshal(resp.Result)
+			if err := json.Unmarshal(b, &d.RecentErrors); err != nil {
+				d.Errors = append(d.Errors, fmt.Sprintf("recent errors: %v", err))
+			}
+		}
+	}
+
+	return d
+}
+
+// maxRecentErrors is how many failures the errors control command reports.
+const maxRecentErrors = 20
+
+// RecentError is a failure of the running instance.
+type RecentError struct {
+	Time  time.Time `json:"time"`
+	Kind  string    `json:"kind"`
+	Error string    `json:"error"`
+}
+
+// recentErrors are the last failures of this process. They outlive the
+// connection attempts of RunWarp, so the failures that led to a reconnect
+// are kept.
+var recentErrors struct {
+	sync.Mutex
+	errs []RecentError
+}
+
+// recordError keeps the error of e, if any, for the errors control command.
+// Attempts cancelled by a shutdown didn't fail.
+func recordError(e TunnelEvent) {
+	if e.Err == nil || errors.Is(e.Err, context.Canceled) {
+		return
+	}
+	recentErrors.Lock()
+	defer recentErrors.Unlock()
+	recentErrors.errs = append(recentErrors.errs, RecentError{Time: time.Now().UTC(), Kind: e.Kind, Error: e.Err.Error()})
+	if n := len(recentErrors.errs); n > maxRecentErrors {
+		recentErrors.errs = slices.Delete(recentErrors.errs, 0, n-maxRecentErrors)
+	}
+}
+
+// errorsHandler answers the errors control command with the recent
+// failures, oldest first.
+func errorsHandler(context.Context) (any, error) {
+	recentErrors.Lock()
+	defer recentErrors.Unlock()
+	return slices.Clone(recentErrors.errs), nil
+}
+
+// anonymizePath replaces the home directory at the start of p with ~.
+func anonymizePath(p, home string) string {
+	if home == "" || home == "/" {
+		return p
+	}
+	if p == home {
+		return "~"
+	}
+	if rest, ok := strings.CutPrefix(p, home+string(filepath.Separator)); ok {
+		return "~" + string(filepath.Separator) + rest
+	}
+	return p
+}
+
+func readStatusFile(path string) (Status, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Status{}, err
+	}
+	var s Status
+	err = json.Unmarshal(b, &s)
+	return s, err
+}
+
+// queryControl runs a single command on the control socket at path.
+func queryControl(ctx context.Context, path, command string) (controlResponse, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		return controlResponse{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if _, err := fmt.Fprintln(conn, command); err != nil {
+		return controlResponse{}, err
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return controlResponse{}, err
+	}
+	var resp controlResponse
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return controlResponse{}, errors.New("invalid control socket response")
+	}
+	return resp, nil
+}
@@ -0,0 +1,70 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bepass-org/warp-plus/warp"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestDiagnose(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	cacheDir := filepath.Join(home, ".cache", "warp-plus")
+
+	ident := warp.Identity{
+		ID:         "device-1234",
+		Token:      "secret-token",
+		PrivateKey: "secret-private-key",
+		Account:    warp.IdentityAccount{AccountType: "limited", License: "secret-license"},
+	}
+	ident.Config.Peers = []warp.IdentityConfigPeer{{PublicKey: "peer"}}
+	ident.Config.Interface.Addresses.V4 = "172.16.0.2"
+	ident.Config.Interface.Addresses.V6 = "2606:4700:110:8a36::1"
+	writeIdentity(t, filepath.Join(cacheDir, "primary"), ident)
+
+	statusPath := filepath.Join(home, "status.json")
+	b, err := json.Marshal(Status{Mode: "warp", Endpoint: "162.159.192.1:2408", EgressIP: "104.28.1.1"})
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, os.WriteFile(statusPath, b, 0o600), qt.IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctl := newControlServer(slog.Default())
+	ctl.handle("health", healthHandler(func() error { return errors.New("last handshake 5m ago") }))
+	ctl.handle("errors", errorsHandler)
+	recordError(TunnelEvent{Kind: EventFailed, Err: errors.New("handshake did not complete")})
+	recordError(TunnelEvent{Kind: EventConnected})
+	sock := filepath.Join(home, "ctl.sock")
+	qt.Assert(t, ctl.listen(ctx, sock), qt.IsNil)
+
+	d := Diagnose(ctx, slog.Default(), WarpOptions{CacheDir: cacheDir, StatusFile: statusPath, ControlSocket: sock}, map[string]string{
+		"cache-dir": cacheDir,
+		"key":       "REDACTED",
+	})
+
+	qt.Assert(t, d.Identities, qt.HasLen, 1)
+	qt.Assert(t, d.Identities[0].Path, qt.Equals, filepath.Join("~", ".cache", "warp-plus", "primary"))
+	qt.Assert(t, d.Identities[0].DeviceID, qt.Equals, "devi...")
+	qt.Assert(t, d.Config["cache-dir"], qt.Equals, filepath.Join("~", ".cache", "warp-plus"))
+	qt.Assert(t, d.Status.Endpoint, qt.Equals, "162.159.192.1:2408")
+	qt.Assert(t, d.Health, qt.Equals, "unhealthy")
+	qt.Assert(t, d.Errors, qt.DeepEquals, []string{"health: last handshake 5m ago"})
+	// other tests record errors of their own before
+	qt.Assert(t, d.RecentErrors, qt.Not(qt.HasLen), 0)
+	last := d.RecentErrors[len(d.RecentErrors)-1]
+	qt.Assert(t, last.Kind, qt.Equals, EventFailed)
+	qt.Assert(t, last.Error, qt.Equals, "handshake did not complete")
+
+	bundle, err := json.Marshal(d)
+	qt.Assert(t, err, qt.IsNil)
+	for _, secret := range []string{"secret-token", "secret-private-key", "secret-license", "device-1234", "2606:4700:110:8a36::1", "104.28.1.1", home} {
+		qt.Assert(t, string(bundle), qt.Not(qt.Contains), secret)
+	}
+}
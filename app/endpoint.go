@@ -0,0 +1,120 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/bepass-org/warp-plus/ipscanner"
+)
+
+// ScanResult is an endpoint found by scanning, along with its round-trip
+// time.
+type ScanResult = ipscanner.IPInfo
+
+// Endpoint types accepted by FamilyEndpoints.
+const (
+	EndpointAuto = "auto"
+	EndpointV4   = "v4"
+	EndpointV6   = "v6"
+)
+
+// hasRoute reports whether the host can reach the internet over network
+// ("udp4" or "udp6"). Connecting a UDP socket only consults the routing
+// table, nothing is sent.
+var hasRoute = func(network string) bool {
+	addr := "1.1.1.1:53"
+	if network == "udp6" {
+		addr = "[2606:4700:4700::1111]:53"
+	}
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// FamilyEndpoints picks the endpoint to connect to, and the one to fall back
+// to, from per address family endpoints. Either may be empty. With
+// EndpointAuto, IPv4 is preferred unless the host has no IPv4 route.
+func FamilyEndpoints(v4, v6, endpointType string) (primary, fallback string, err error) {
+	if err := checkFamily(v4, true); err != nil {
+		return "", "", err
+	}
+	if err := checkFamily(v6, false); err != nil {
+		return "", "", err
+	}
+
+	switch endpointType {
+	case EndpointV4:
+		if v4 == "" {
+			return "", "", fmt.Errorf("endpoint type %s requires an IPv4 endpoint", endpointType)
+		}
+		return v4, "", nil
+	case EndpointV6:
+		if v6 == "" {
+			return "", "", fmt.Errorf("endpoint type %s requires an IPv6 endpoint", endpointType)
+		}
+		return v6, "", nil
+	case EndpointAuto, "":
+	default:
+		return "", "", fmt.Errorf("unknown endpoint type %q", endpointType)
+	}
+
+	switch {
+	case v4 == "" || v6 == "":
+		return v4 + v6, "", nil
+	case !hasRoute("udp4") && hasRoute("udp6"):
+		return v6, v4, nil
+	default:
+		return v4, v6, nil
+	}
+}
+
+func checkFamily(endpoint string, want4 bool) error {
+	if endpoint == "" {
+		return nil
+	}
+
+	addrPort, err := netip.ParseAddrPort(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint %q: %w", endpoint, err)
+	}
+	if addrPort.Addr().Unmap().Is4() != want4 {
+		family := "IPv6"
+		if want4 {
+			family = "IPv4"
+		}
+		return fmt.Errorf("endpoint %s is not an %s address", endpoint, family)
+	}
+	return nil
+}
+
+// scanEndpoints turns the ranked scan results into the endpoints to connect
+// to. When selector is set its choice comes first, followed by the other
+// results in order.
+func scanEndpoints(res []ScanResult, selector func([]ScanResult) (netip.AddrPort, error)) ([]string, error) {
+	endpoints := make([]string, 0, len(res)+1)
+	if selector != nil {
+		chosen, err := selector(res)
+		if err != nil {
+			return nil, fmt.Errorf("failed to select endpoint: %w", err)
+		}
+		if !chosen.IsValid() {
+			return nil, fmt.Errorf("invalid selected endpoint: %v", chosen)
+		}
+		endpoints = append(endpoints, chosen.String())
+		for _, r := range res {
+			if r.AddrPort != chosen {
+				endpoints = append(endpoints, r.AddrPort.String())
+			}
+		}
+		return endpoints, nil
+	}
+
+	for _, r := range res {
+		endpoints = append(endpoints, r.AddrPort.String())
+	}
+	return endpoints, nil
+}
@@ -0,0 +1,75 @@
+package app
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestFamilyEndpoints(t *testing.T) {
+	const v4, v6 = "162.159.192.1:2408", "[2606:4700:d0::a29f:c001]:2408"
+
+	routes := map[string]bool{"udp4": true, "udp6": true}
+	orig := hasRoute
+	hasRoute = func(network string) bool { return routes[network] }
+	defer func() { hasRoute = orig }()
+
+	for _, tc := range []struct {
+		name              string
+		v4, v6, typ       string
+		noV4              bool
+		primary, fallback string
+		err               string
+	}{
+		{name: "auto prefers v4", v4: v4, v6: v6, typ: EndpointAuto, primary: v4, fallback: v6},
+		{name: "auto without v4 route", v4: v4, v6: v6, typ: EndpointAuto, noV4: true, primary: v6, fallback: v4},
+		{name: "auto with one family", v6: v6, typ: EndpointAuto, primary: v6},
+		{name: "forced v6", v4: v4, v6: v6, typ: EndpointV6, primary: v6},
+		{name: "forced v4 missing", v6: v6, typ: EndpointV4, err: "endpoint type v4 requires an IPv4 endpoint"},
+		{name: "v6 given as v4", v4: v6, typ: EndpointAuto, err: `endpoint .* is not an IPv4 address`},
+		{name: "v4 given as v6", v6: v4, typ: EndpointAuto, err: `endpoint .* is not an IPv6 address`},
+		{name: "not an address", v4: "engage.cloudflareclient.com:2408", typ: EndpointAuto, err: `invalid endpoint .*`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			routes["udp4"] = !tc.noV4
+			primary, fallback, err := FamilyEndpoints(tc.v4, tc.v6, tc.typ)
+			if tc.err != "" {
+				qt.Assert(t, err, qt.ErrorMatches, tc.err)
+				return
+			}
+			qt.Assert(t, err, qt.IsNil)
+			qt.Assert(t, primary, qt.Equals, tc.primary)
+			qt.Assert(t, fallback, qt.Equals, tc.fallback)
+		})
+	}
+}
+
+func TestScanEndpoints(t *testing.T) {
+	res := []ScanResult{
+		{AddrPort: netip.MustParseAddrPort("162.159.192.1:2408"), RTT: 50 * time.Millisecond},
+		{AddrPort: netip.MustParseAddrPort("162.159.195.7:908"), RTT: 80 * time.Millisecond},
+		{AddrPort: netip.MustParseAddrPort("188.114.96.3:500"), RTT: 90 * time.Millisecond},
+	}
+
+	endpoints, err := scanEndpoints(res, nil)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, endpoints, qt.DeepEquals, []string{"162.159.192.1:2408", "162.159.195.7:908", "188.114.96.3:500"})
+
+	var offered []ScanResult
+	endpoints, err = scanEndpoints(res, func(res []ScanResult) (netip.AddrPort, error) {
+		offered = res
+		return res[1].AddrPort, nil
+	})
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, offered, qt.HasLen, len(res))
+	qt.Assert(t, endpoints, qt.DeepEquals, []string{"162.159.195.7:908", "162.159.192.1:2408", "188.114.96.3:500"})
+
+	errCanceled := errors.New("canceled by user")
+	_, err = scanEndpoints(res, func([]ScanResult) (netip.AddrPort, error) {
+		return netip.AddrPort{}, errCanceled
+	})
+	qt.Assert(t, err, qt.ErrorIs, errCanceled)
+}
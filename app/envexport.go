@@ -0,0 +1,121 @@
+package app
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"strings"
+
+	"github.com/bepass-org/warp-plus/warp"
+)
+
+// EnvVar is an environment variable describing an account.
+type EnvVar struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	// Secret marks credentials that give access to the account.
+	Secret bool `json:"secret"`
+}
+
+// Names of the environment variables of an account.
+const (
+	EnvDeviceID      = "WARP_DEVICE_ID"
+	EnvToken         = "WARP_TOKEN"
+	EnvPrivateKey    = "WARP_PRIVATE_KEY"
+	EnvLicense       = "WARP_LICENSE"
+	EnvAccountType   = "WARP_ACCOUNT_TYPE"
+	EnvClientID      = "WARP_CLIENT_ID"
+	EnvAddressV4     = "WARP_ADDRESS_V4"
+	EnvAddressV6     = "WARP_ADDRESS_V6"
+	EnvPeerPublicKey = "WARP_PEER_PUBLIC_KEY"
+	EnvPeerEndpoint  = "WARP_PEER_ENDPOINT"
+)
+
+// ExportEnv returns the primary identity as environment variables,
+// registering it first if needed, so the account can be handed to other
+// tools and CI steps.
+func ExportEnv(ctx context.Context, l *slog.Logger, opts WarpOptions) ([]EnvVar, error) {
+	ident, err := loadIdentity(ctx, l, opts, "primary")
+	if err != nil {
+		return nil, err
+	}
+	return IdentityEnv(ident), nil
+}
+
+// IdentityEnv returns the environment variables describing ident, enough to
+// rebuild its wireguard configuration with IdentityFromEnv.
+func IdentityEnv(ident *warp.Identity) []EnvVar {
+	var peer warp.IdentityConfigPeer
+	if len(ident.Config.Peers) > 0 {
+		peer = ident.Config.Peers[0]
+	}
+	return []EnvVar{
+		{Name: EnvDeviceID, Value: ident.ID},
+		{Name: EnvToken, Value: ident.Token, Secret: true},
+		{Name: EnvPrivateKey, Value: ident.PrivateKey, Secret: true},
+		{Name: EnvLicense, Value: ident.Account.License, Secret: true},
+		{Name: EnvAccountType, Value: ident.Account.AccountType},
+		{Name: EnvClientID, Value: ident.Config.ClientID},
+		{Name: EnvAddressV4, Value: ident.Config.Interface.Addresses.V4},
+		{Name: EnvAddressV6, Value: ident.Config.Interface.Addresses.V6},
+		{Name: EnvPeerPublicKey, Value: peer.PublicKey},
+		{Name: EnvPeerEndpoint, Value: peer.Endpoint.Host},
+	}
+}
+
+// IdentityFromEnv rebuilds an identity from the variables of IdentityEnv,
+// looked up with getenv. The license and account type are optional.
+func IdentityFromEnv(getenv func(string) string) (warp.Identity, error) {
+	for _, name := range []string{EnvDeviceID, EnvToken, EnvPrivateKey, EnvClientID, EnvAddressV4, EnvAddressV6, EnvPeerPublicKey, EnvPeerEndpoint} {
+		if getenv(name) == "" {
+			return warp.Identity{}, fmt.Errorf("%s is not set", name)
+		}
+	}
+	for _, name := range []string{EnvPrivateKey, EnvPeerPublicKey} {
+		if key, err := base64.StdEncoding.DecodeString(getenv(name)); err != nil || len(key) != 32 {
+			return warp.Identity{}, fmt.Errorf("%s is not a base64 wireguard key", name)
+		}
+	}
+	if id, err := base64.StdEncoding.DecodeString(getenv(EnvClientID)); err != nil || len(id) < 3 {
+		return warp.Identity{}, fmt.Errorf("%s is not a base64 client id", EnvClientID)
+	}
+	if addr, err := netip.ParseAddr(getenv(EnvAddressV4)); err != nil || !addr.Is4() {
+		return warp.Identity{}, fmt.Errorf("%s is not an IPv4 address", EnvAddressV4)
+	}
+	if addr, err := netip.ParseAddr(getenv(EnvAddressV6)); err != nil || !addr.Is6() {
+		return warp.Identity{}, fmt.Errorf("%s is not an IPv6 address", EnvAddressV6)
+	}
+
+	var ident warp.Identity
+	ident.ID = getenv(EnvDeviceID)
+	ident.Token = getenv(EnvToken)
+	ident.PrivateKey = getenv(EnvPrivateKey)
+	ident.Account.License = getenv(EnvLicense)
+	ident.Account.AccountType = getenv(EnvAccountType)
+	ident.Config.ClientID = getenv(EnvClientID)
+	ident.Config.Interface.Addresses.V4 = getenv(EnvAddressV4)
+	ident.Config.Interface.Addresses.V6 = getenv(EnvAddressV6)
+	ident.Config.Peers = []warp.IdentityConfigPeer{{
+		PublicKey: getenv(EnvPeerPublicKey),
+		Endpoint:  warp.IdentityConfigPeerEndpoint{Host: getenv(EnvPeerEndpoint)},
+	}}
+	return ident, nil
+}
+
+// WriteEnv writes vars as export lines for a POSIX shell, single quoted, the
+// secrets marked with a comment.
+func WriteEnv(w io.Writer, vars []EnvVar) error {
+	for _, v := range vars {
+		line := "export " + v.Name + "='" + strings.ReplaceAll(v.Value, "'", `'\''`) + "'"
+		if v.Secret {
+			line += " # secret"
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
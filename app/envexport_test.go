@@ -0,0 +1,57 @@
+package app
+
+import (
+	"bufio"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/bepass-org/warp-plus/warp"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestExportEnv(t *testing.T) {
+	var ident warp.Identity
+	ident.ID = "device"
+	ident.Token = "token"
+	ident.PrivateKey = base64.StdEncoding.EncodeToString(make([]byte, 32))
+	ident.Account.License = "xxxxxxxx-xxxxxxxx-xxxxxxxx"
+	ident.Account.AccountType = "it's limited"
+	ident.Config.ClientID = base64.StdEncoding.EncodeToString([]byte{1, 2, 3})
+	ident.Config.Interface.Addresses.V4 = "172.16.0.2"
+	ident.Config.Interface.Addresses.V6 = "2606:4700:110:8a36::1"
+	ident.Config.Peers = []warp.IdentityConfigPeer{{
+		PublicKey: base64.StdEncoding.EncodeToString(make([]byte, 32)),
+		Endpoint:  warp.IdentityConfigPeerEndpoint{Host: "engage.cloudflareclient.com:2408"},
+	}}
+
+	var b strings.Builder
+	qt.Assert(t, WriteEnv(&b, IdentityEnv(&ident)), qt.IsNil)
+	qt.Assert(t, b.String(), qt.Contains, "export WARP_PRIVATE_KEY='"+ident.PrivateKey+"' # secret\n")
+	qt.Assert(t, b.String(), qt.Contains, "export WARP_DEVICE_ID='device'\n")
+
+	// parse the lines back like a shell would
+	env := map[string]string{}
+	scanner := bufio.NewScanner(strings.NewReader(b.String()))
+	for scanner.Scan() {
+		line, ok := strings.CutPrefix(scanner.Text(), "export ")
+		qt.Assert(t, ok, qt.IsTrue)
+		line = strings.TrimSuffix(line, " # secret")
+		name, value, ok := strings.Cut(line, "=")
+		qt.Assert(t, ok, qt.IsTrue)
+		value = strings.TrimSuffix(strings.TrimPrefix(value, "'"), "'")
+		env[name] = strings.ReplaceAll(value, `'\''`, "'")
+	}
+	parsed, err := IdentityFromEnv(func(name string) string { return env[name] })
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, parsed, qt.DeepEquals, ident)
+
+	// the identity is usable
+	conf, err := warpConfig(&parsed, WarpOptions{})
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, conf.Peers[0].Endpoint, qt.Equals, "engage.cloudflareclient.com:2408")
+
+	delete(env, EnvToken)
+	_, err = IdentityFromEnv(func(name string) string { return env[name] })
+	qt.Assert(t, err, qt.ErrorMatches, "WARP_TOKEN is not set")
+}
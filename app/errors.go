@@ -0,0 +1,59 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bepass-org/warp-plus/warp"
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// Error classes of connection failures, see ErrorClass.
+const (
+	ErrClassNoHandshake     = "no-handshake"
+	ErrClassHealthFailure   = "health-failure"
+	ErrClassNoEndpoints     = "no-endpoints"
+	ErrClassAccountRejected = "account-rejected"
+	ErrClassOther           = "other"
+)
+
+// ErrorClasses lists every error class.
+var ErrorClasses = []string{
+	ErrClassNoHandshake,
+	ErrClassHealthFailure,
+	ErrClassNoEndpoints,
+	ErrClassAccountRejected,
+	ErrClassOther,
+}
+
+// DefaultReconnectOn are the error classes that may go away by themselves.
+var DefaultReconnectOn = []string{ErrClassNoHandshake, ErrClassHealthFailure}
+
+// ConnectError is a connection failure of a known class.
+type ConnectError struct {
+	Class string
+	Err   error
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Class, e.Err)
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorClass classifies an error returned by RunWarp or StartWarp.
+func ErrorClass(err error) string {
+	var ce *ConnectError
+	switch {
+	case errors.As(err, &ce):
+		return ce.Class
+	case errors.Is(err, warp.ErrAccountRejected):
+		return ErrClassAccountRejected
+	case errors.Is(err, wiresocks.ErrNoScanResults):
+		return ErrClassNoEndpoints
+	default:
+		return ErrClassOther
+	}
+}
@@ -0,0 +1,101 @@
+package app
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultEventLogMaxSize is the size at which an event log is rotated.
+const DefaultEventLogMaxSize = 10 << 20
+
+// eventRecord is a line of the event log.
+type eventRecord struct {
+	Time     time.Time `json:"time"`
+	Instance string    `json:"instance"`
+	Event    string    `json:"event"`
+	Endpoint string    `json:"endpoint,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// eventLog appends tunnel events to a file as JSON lines, tagged with an id
+// telling apart the runs writing to the same file. The file is opened for
+// every event, so it can be moved away at any time and the final events of
+// a shutdown aren't lost. Once it would grow past maxSize it is moved to
+// path+".1", replacing the previous one, and a new file is started.
+type eventLog struct {
+	l        *slog.Logger
+	path     string
+	maxSize  int64
+	instance string
+
+	mu sync.Mutex
+}
+
+func newEventLog(l *slog.Logger, path string, maxSize int64) *eventLog {
+	if maxSize <= 0 {
+		maxSize = DefaultEventLogMaxSize
+	}
+	return &eventLog{
+		l:        l.With("subsystem", "eventlog"),
+		path:     path,
+		maxSize:  maxSize,
+		instance: instanceID(),
+	}
+}
+
+// instanceID is the id of this run, the same wherever the run is reported.
+var instanceID = sync.OnceValue(newInstanceID)
+
+// InstanceID returns the random id of this run, as found in the event log
+// and the service registrations, for reporting the run elsewhere.
+func InstanceID() string {
+	return instanceID()
+}
+
+// newInstanceID returns a random id for this run.
+func newInstanceID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func (e *eventLog) write(ev TunnelEvent) {
+	rec := eventRecord{Time: time.Now().UTC(), Instance: e.instance, Event: ev.Kind, Endpoint: ev.Endpoint}
+	if ev.Err != nil {
+		rec.Error = ev.Err.Error()
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.appendLocked(line); err != nil {
+		e.l.Warn("failed to write event log", "path", e.path, "error", err)
+	}
+}
+
+func (e *eventLog) appendLocked(line []byte) error {
+	if fi, err := os.Stat(e.path); err == nil && fi.Size() > 0 && fi.Size()+int64(len(line)) > e.maxSize {
+		if err := os.Rename(e.path, e.path+".1"); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(e.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
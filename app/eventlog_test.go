@@ -0,0 +1,91 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func readEventLog(t *testing.T, path string) []eventRecord {
+	f, err := os.Open(path)
+	qt.Assert(t, err, qt.IsNil)
+	defer f.Close()
+
+	var records []eventRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec eventRecord
+		qt.Assert(t, json.Unmarshal(scanner.Bytes(), &rec), qt.IsNil)
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestEventLog(t *testing.T) {
+	defer func(orig func(context.Context, *slog.Logger, WarpOptions) (*Tunnel, error), backoff [2]time.Duration) {
+		startWarp, reconnectBackoff = orig, backoff
+	}(startWarp, reconnectBackoff)
+	reconnectBackoff = [2]time.Duration{time.Millisecond, time.Millisecond}
+
+	attempts := 0
+	startWarp = func(ctx context.Context, _ *slog.Logger, opts WarpOptions) (*Tunnel, error) {
+		attempts++
+		if attempts == 1 {
+			return nil, &ConnectError{Class: ErrClassNoHandshake, Err: context.DeadlineExceeded}
+		}
+		tunnel := &Tunnel{onEvent: opts.OnEvent}
+		dev := &reconfigurableDevice{fakeDevice: "public_key=abcd\n"}
+		tunnel.connected(ctx, "162.159.192.1:2408", dev, nil)
+		tunnel.connected(ctx, "162.159.192.7:2408", dev, nil)
+		qt.Check(t, tunnel.switchEndpoint(ctx, "162.159.195.7:908", nil), qt.IsNil)
+		return tunnel, nil
+	}
+
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+	ctx, cancel := context.WithCancel(context.Background())
+	err := RunWarp(ctx, slog.Default(), WarpOptions{ReconnectOn: DefaultReconnectOn, EventLog: path})
+	qt.Assert(t, err, qt.IsNil)
+	cancel()
+
+	var records []eventRecord
+	for deadline := time.Now().Add(5 * time.Second); len(records) < 5 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		records = readEventLog(t, path)
+	}
+	qt.Assert(t, records, qt.HasLen, 5)
+
+	type event struct{ Kind, Endpoint string }
+	var got []event
+	for _, rec := range records {
+		qt.Assert(t, rec.Instance, qt.Equals, records[0].Instance)
+		qt.Assert(t, time.Since(rec.Time) < time.Minute, qt.IsTrue)
+		got = append(got, event{rec.Event, rec.Endpoint})
+	}
+	qt.Assert(t, records[0].Error, qt.Matches, ".*deadline exceeded")
+	qt.Assert(t, got, qt.DeepEquals, []event{
+		{EventFailed, ""},
+		{EventConnected, "162.159.192.1:2408"},
+		{EventReconnected, "162.159.192.7:2408"},
+		{EventEndpointSwitched, "162.159.195.7:908"},
+		{EventDisconnected, "162.159.195.7:908"},
+	})
+}
+
+func TestEventLogRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+	events := newEventLog(slog.Default(), path, 200)
+	for range 3 {
+		events.write(TunnelEvent{Kind: EventConnected, Endpoint: "162.159.192.1:2408"})
+	}
+
+	// each record is about 120 bytes, so every one starts a new file
+	qt.Assert(t, readEventLog(t, path), qt.HasLen, 1)
+	qt.Assert(t, readEventLog(t, path+".1"), qt.HasLen, 1)
+}
@@ -0,0 +1,165 @@
+package app
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// historyWindow bounds the counts of an endpoint, older outcomes are
+	// halved away so recent ones weigh more.
+	historyWindow = 20
+	// historyMaxAge expires endpoints that haven't been tried for a while.
+	historyMaxAge = 30 * 24 * time.Hour
+	// historyMaxEntries bounds the number of endpoints kept.
+	historyMaxEntries = 256
+)
+
+// EndpointRecord counts the handshake outcomes of an endpoint.
+type EndpointRecord struct {
+	Successes int       `json:"successes"`
+	Failures  int       `json:"failures"`
+	LastTried time.Time `json:"last_tried"`
+}
+
+// score estimates the chance of a handshake succeeding. Endpoints without
+// history score 0.5.
+func (r EndpointRecord) score() float64 {
+	return float64(r.Successes+1) / float64(r.Successes+r.Failures+2)
+}
+
+// endpointHistory keeps the handshake outcomes of endpoints across runs, so
+// endpoints that work on the current network are tried first. It is saved
+// to path after every update, an empty path keeps it in memory. A nil
+// *endpointHistory ignores all calls.
+type endpointHistory struct {
+	l    *slog.Logger
+	path string
+
+	mu        sync.Mutex
+	endpoints map[string]EndpointRecord
+}
+
+func loadEndpointHistory(l *slog.Logger, path string) *endpointHistory {
+	h := &endpointHistory{
+		l:         l.With("subsystem", "history"),
+		path:      path,
+		endpoints: make(map[string]EndpointRecord),
+	}
+	if path == "" {
+		return h
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			h.l.Warn("failed to read endpoint history", "path", path, "error", err)
+		}
+		return h
+	}
+	if err := json.Unmarshal(b, &h.endpoints); err != nil {
+		h.l.Warn("ignoring corrupt endpoint history", "path", path, "error", err)
+		h.endpoints = make(map[string]EndpointRecord)
+	}
+	h.expireLocked(time.Now())
+	return h
+}
+
+// record adds a handshake outcome for endpoint.
+func (h *endpointHistory) record(endpoint string, ok bool) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	r := h.endpoints[endpoint]
+	if ok {
+		r.Successes++
+	} else {
+		r.Failures++
+	}
+	if r.Successes+r.Failures > historyWindow {
+		r.Successes, r.Failures = r.Successes/2, r.Failures/2
+	}
+	r.LastTried = now
+	h.endpoints[endpoint] = r
+	h.expireLocked(now)
+
+	if err := h.saveLocked(); err != nil {
+		h.l.Warn("failed to save endpoint history", "path", h.path, "error", err)
+	}
+}
+
+// get returns the record of endpoint.
+func (h *endpointHistory) get(endpoint string) (EndpointRecord, bool) {
+	if h == nil {
+		return EndpointRecord{}, false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r, ok := h.endpoints[endpoint]
+	return r, ok
+}
+
+// rank stably sorts results by their handshake success, so the scan order
+// only decides between endpoints with the same history.
+func (h *endpointHistory) rank(results []ScanResult) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	slices.SortStableFunc(results, func(a, b ScanResult) int {
+		return cmp.Compare(h.endpoints[b.AddrPort.String()].score(), h.endpoints[a.AddrPort.String()].score())
+	})
+}
+
+// expireLocked drops stale entries and then the least recently tried ones
+// beyond historyMaxEntries.
+func (h *endpointHistory) expireLocked(now time.Time) {
+	maps.DeleteFunc(h.endpoints, func(_ string, r EndpointRecord) bool {
+		return now.Sub(r.LastTried) > historyMaxAge
+	})
+	if len(h.endpoints) <= historyMaxEntries {
+		return
+	}
+
+	keys := slices.SortedFunc(maps.Keys(h.endpoints), func(a, b string) int {
+		return h.endpoints[a].LastTried.Compare(h.endpoints[b].LastTried)
+	})
+	for _, k := range keys[:len(keys)-historyMaxEntries] {
+		delete(h.endpoints, k)
+	}
+}
+
+func (h *endpointHistory) saveLocked() error {
+	if h.path == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(h.endpoints)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(h.path), 0o755); err != nil {
+		return err
+	}
+	tmp := h.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.path)
+}
@@ -0,0 +1,74 @@
+package app
+
+import (
+	"log/slog"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestEndpointHistoryRank(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "endpoint-history.json")
+	h := loadEndpointHistory(slog.Default(), path)
+
+	const failing, working, fresh = "162.159.192.1:2408", "162.159.195.7:908", "188.114.96.3:500"
+	for range 5 {
+		h.record(failing, false)
+	}
+	h.record(working, true)
+
+	// scan order is by rtt
+	results := func() []ScanResult {
+		return []ScanResult{
+			{AddrPort: netip.MustParseAddrPort(failing), RTT: 20 * time.Millisecond},
+			{AddrPort: netip.MustParseAddrPort(fresh), RTT: 30 * time.Millisecond},
+			{AddrPort: netip.MustParseAddrPort(working), RTT: 40 * time.Millisecond},
+		}
+	}
+	order := func(res []ScanResult) []string {
+		var s []string
+		for _, r := range res {
+			s = append(s, r.AddrPort.String())
+		}
+		return s
+	}
+
+	res := results()
+	h.rank(res)
+	qt.Assert(t, order(res), qt.DeepEquals, []string{working, fresh, failing})
+
+	// the history survives a restart
+	res = results()
+	loadEndpointHistory(slog.Default(), path).rank(res)
+	qt.Assert(t, order(res), qt.DeepEquals, []string{working, fresh, failing})
+
+	// counts stay within the window
+	for range 3 * historyWindow {
+		h.record(failing, false)
+	}
+	r, ok := h.get(failing)
+	qt.Assert(t, ok, qt.IsTrue)
+	qt.Assert(t, r.Successes+r.Failures <= historyWindow, qt.IsTrue)
+}
+
+func TestEndpointHistoryExpire(t *testing.T) {
+	h := loadEndpointHistory(slog.Default(), "")
+	now := time.Now()
+	h.endpoints["stale"] = EndpointRecord{Failures: 3, LastTried: now.Add(-historyMaxAge - time.Hour)}
+	for i := range historyMaxEntries + 10 {
+		h.endpoints[netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}), 2408).String()] = EndpointRecord{LastTried: now.Add(time.Duration(i) * time.Second)}
+	}
+	h.expireLocked(now)
+
+	qt.Assert(t, h.endpoints, qt.HasLen, historyMaxEntries)
+	_, ok := h.endpoints["stale"]
+	qt.Assert(t, ok, qt.IsFalse)
+	// the least recently tried go first
+	_, ok = h.endpoints["10.0.0.0:2408"]
+	qt.Assert(t, ok, qt.IsFalse)
+	_, ok = h.endpoints["10.0.1.9:2408"]
+	qt.Assert(t, ok, qt.IsTrue)
+}
@@ -0,0 +1,224 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"time"
+
+	"github.com/bepass-org/warp-plus/warp"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ErrNoIdentity is returned when no identity is cached and
+// WarpOptions.NoAutoRegister forbids registering one.
+var ErrNoIdentity = errors.New("no cached warp identity")
+
+// loadIdentity loads or creates the named warp identity under the cache
+// directory, resolving the license, private key and token through the
+// configured SecretProvider.
+func loadIdentity(ctx context.Context, l *slog.Logger, opts WarpOptions, name string) (ident *warp.Identity, err error) {
+	_, span := startSpan(ctx, "account.load", attribute.String("warp.identity", name))
+	defer func() { endSpan(span, err) }()
+
+	if opts.NoAutoRegister && (opts.NoCache || opts.IdentityMaxAge > 0) {
+		return nil, errors.New("identities can't be replaced or registered without a cache when auto registration is disabled")
+	}
+
+	teamToken, err := opts.secret(SecretTeamToken, opts.TeamToken)
+	if err != nil {
+		return nil, err
+	}
+
+	// a private key held by the secret provider is registered as is, so
+	// no generated key is registered and cached only to be replaced
+	privateKey, err := opts.secret(SecretPrivateKey, "")
+	if err != nil {
+		return nil, err
+	}
+	apiOpts := append(apiOptions(ctx, opts), warp.WithPrivateKey(privateKey))
+
+	team := opts.Team || teamToken != ""
+	if team && teamToken == "" && opts.NoCache {
+		return nil, errors.New("a team without a cache needs a team token")
+	}
+	if !team && !opts.NoCache {
+		if err := checkNoTeamIdentity(opts, name); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.NoCache {
+		l.Warn("registering a throwaway " + name + " warp identity, this uses up a device slot on every run")
+		ident, err = createEphemeralIdentity(l, opts, teamToken, apiOpts...)
+	} else if team {
+		dir := path.Join(opts.CacheDir, "team", name)
+		if err := expireIdentity(ctx, l, opts, dir); err != nil {
+			return nil, err
+		}
+		if err := requireIdentity(opts, dir); err != nil {
+			return nil, err
+		}
+		// team identities live in their own directory so switching between
+		// a team and a consumer account never clobbers the other
+		ident, err = warp.LoadOrCreateTeamIdentity(l, dir, teamToken, apiOpts...)
+	} else {
+		var license string
+		if license, err = opts.secret(SecretLicense, opts.License); err != nil {
+			return nil, err
+		}
+		dir := path.Join(opts.CacheDir, name)
+		if err := expireIdentity(ctx, l, opts, dir); err != nil {
+			return nil, err
+		}
+		if err := requireIdentity(opts, dir); err != nil {
+			return nil, err
+		}
+		ident, err = warp.LoadOrCreateIdentity(l, dir, license, apiOpts...)
+	}
+	if err != nil {
+		l.Error("couldn't load " + name + " warp identity")
+		return nil, err
+	}
+
+	if privateKey != "" {
+		ident.PrivateKey = privateKey
+	}
+	if ident.Token, err = opts.secret(SecretToken, ident.Token); err != nil {
+		return nil, err
+	}
+
+	if opts.MinQuota > 0 {
+		if err := checkQuota(ctx, l, opts, ident, team); err != nil {
+			return nil, err
+		}
+	}
+
+	return ident, nil
+}
+
+// checkNoTeamIdentity fails when a team identity named name is cached but no
+// consumer one is, so a run that forgot to select the team doesn't quietly
+// register a consumer account instead.
+func checkNoTeamIdentity(opts WarpOptions, name string) error {
+	teamDir := path.Join(opts.CacheDir, "team", name)
+	if _, err := warp.LoadIdentity(teamDir); err != nil {
+		return nil
+	}
+	if _, err := warp.LoadIdentity(path.Join(opts.CacheDir, name)); err == nil {
+		return nil
+	}
+	return fmt.Errorf("a team identity is cached in %s but no team is selected", teamDir)
+}
+
+// requireIdentity fails with ErrNoIdentity when opts.NoAutoRegister is set
+// and no usable identity is cached in dir.
+func requireIdentity(opts WarpOptions, dir string) error {
+	if !opts.NoAutoRegister {
+		return nil
+	}
+	if _, err := warp.LoadIdentity(dir); err != nil {
+		return fmt.Errorf("%w in %s, provision one first: %v", ErrNoIdentity, dir, err)
+	}
+	return nil
+}
+
+// expireIdentity removes the identity cached in dir when it was registered
+// longer than opts.IdentityMaxAge ago, so a fresh one is registered in its
+// place. Its device is deleted first on a best-effort basis so the account
+// doesn't collect stale devices.
+func expireIdentity(ctx context.Context, l *slog.Logger, opts WarpOptions, dir string) error {
+	if opts.IdentityMaxAge <= 0 {
+		return nil
+	}
+	ident, err := warp.LoadIdentity(dir)
+	if err != nil {
+		// nothing usable is cached, a new identity is registered anyway
+		return nil
+	}
+	created := identityCreated(ident, dir)
+	if created.IsZero() || time.Since(created) <= opts.IdentityMaxAge {
+		return nil
+	}
+
+	l.Info("cached warp identity expired, registering a new one", "path", dir, "age", time.Since(created).Round(time.Second), "max", opts.IdentityMaxAge)
+	token, err := opts.secret(SecretToken, ident.Token)
+	if err == nil {
+		api := warp.NewWarpAPI(l.With("subsystem", "warp/account"), apiOptions(ctx, opts)...)
+		err = api.DeleteDevice(token, ident.ID)
+	}
+	if err != nil {
+		l.Warn("failed to delete the expired device, continuing", "device", ident.ID, "error", err)
+	}
+	return os.RemoveAll(dir)
+}
+
+// ErrQuotaTooLow is returned when the remaining WARP+ data of an account is
+// below WarpOptions.MinQuota.
+var ErrQuotaTooLow = errors.New("remaining warp+ quota is below the minimum")
+
+// checkQuota fetches the current account of ident and fails when its
+// remaining WARP+ data is below opts.MinQuota.
+func checkQuota(ctx context.Context, l *slog.Logger, opts WarpOptions, ident *warp.Identity, team bool) error {
+	if team {
+		return errors.New("minimum quota can't be checked for team accounts")
+	}
+
+	api := warp.NewWarpAPI(l.With("subsystem", "warp/account"), apiOptions(ctx, opts)...)
+	account, err := api.GetAccount(ident.Token, ident.ID)
+	if err != nil {
+		return fmt.Errorf("failed to check account quota: %w", err)
+	}
+	ident.Account = account
+
+	if account.PremiumData < opts.MinQuota {
+		return fmt.Errorf("%w: %d bytes left, need %d", ErrQuotaTooLow, account.PremiumData, opts.MinQuota)
+	}
+	l.Info("account quota is sufficient", "remaining", account.PremiumData, "min", opts.MinQuota)
+	return nil
+}
+
+// createIdentity and createTeamIdentity register identities without
+// touching the cache directory. They are variables so tests can stub out
+// the API calls.
+var (
+	createIdentity     = warp.CreateIdentity
+	createTeamIdentity = warp.CreateTeamIdentity
+)
+
+// apiOptions returns the warp API options derived from opts.
+func apiOptions(ctx context.Context, opts WarpOptions) []warp.APIOption {
+	return []warp.APIOption{
+		warp.WithContext(ctx),
+		warp.WithHTTPClient(opts.HTTPClient),
+		warp.WithUserAgent(opts.UserAgent),
+		warp.WithRegisterRetries(opts.RegisterRetries),
+	}
+}
+
+// createEphemeralIdentity registers a fresh identity that is only kept in
+// memory for the lifetime of the process.
+func createEphemeralIdentity(l *slog.Logger, opts WarpOptions, teamToken string, options ...warp.APIOption) (*warp.Identity, error) {
+	l = l.With("subsystem", "warp/account")
+
+	api := warp.NewWarpAPI(l, options...)
+
+	var ident warp.Identity
+	var err error
+	if teamToken != "" {
+		ident, err = createTeamIdentity(l, api, teamToken)
+	} else {
+		var license string
+		if license, err = opts.secret(SecretLicense, opts.License); err != nil {
+			return nil, err
+		}
+		ident, err = createIdentity(l, api, license)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ident, nil
+}
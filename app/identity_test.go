@@ -0,0 +1,184 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/warp"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestLoadIdentityNoCache(t *testing.T) {
+	orig := createIdentity
+	defer func() { createIdentity = orig }()
+
+	var registered int
+	createIdentity = func(_ *slog.Logger, _ *warp.WarpAPI, license string) (warp.Identity, error) {
+		registered++
+		return warp.Identity{ID: "fresh", PrivateKey: "key", Account: warp.IdentityAccount{License: license}}, nil
+	}
+
+	cacheDir := t.TempDir()
+	opts := WarpOptions{CacheDir: cacheDir, License: "license", NoCache: true}
+
+	for _, name := range []string{"primary", "secondary"} {
+		ident, err := loadIdentity(context.Background(), slog.Default(), opts, name)
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, ident.ID, qt.Equals, "fresh")
+		qt.Assert(t, ident.Account.License, qt.Equals, "license")
+	}
+	qt.Assert(t, registered, qt.Equals, 2)
+
+	entries, err := os.ReadDir(cacheDir)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, entries, qt.HasLen, 0)
+}
+
+func TestLoadIdentityNoAutoRegister(t *testing.T) {
+	var calls int
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		return nil, errors.New("unexpected request")
+	})}
+	cacheDir := t.TempDir()
+	opts := WarpOptions{CacheDir: cacheDir, HTTPClient: client, NoAutoRegister: true}
+
+	for _, teamToken := range []string{"", "team-token"} {
+		opts.TeamToken = teamToken
+		_, err := loadIdentity(context.Background(), slog.Default(), opts, "primary")
+		qt.Assert(t, err, qt.ErrorIs, ErrNoIdentity)
+	}
+	qt.Assert(t, calls, qt.Equals, 0)
+	entries, err := os.ReadDir(cacheDir)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, entries, qt.HasLen, 0)
+
+	// a cached identity is used as before
+	ident := warp.Identity{ID: "device", Token: "token", PrivateKey: "key"}
+	ident.Config.Peers = []warp.IdentityConfigPeer{{PublicKey: "peer"}}
+	writeIdentity(t, filepath.Join(cacheDir, "primary"), ident)
+	opts.TeamToken = ""
+	loaded, err := loadIdentity(context.Background(), slog.Default(), opts, "primary")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, loaded.ID, qt.Equals, "device")
+
+	_, err = loadIdentity(context.Background(), slog.Default(), WarpOptions{NoCache: true, NoAutoRegister: true}, "primary")
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+	qt.Assert(t, calls, qt.Equals, 0)
+}
+
+func TestLoadIdentityTeam(t *testing.T) {
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return nil, errors.New("unexpected request")
+	})}
+	cacheDir := t.TempDir()
+	opts := WarpOptions{CacheDir: cacheDir, HTTPClient: client}
+
+	ident := warp.Identity{ID: "team-device", Token: "token", PrivateKey: "key"}
+	ident.Config.Peers = []warp.IdentityConfigPeer{{PublicKey: "peer"}}
+	writeIdentity(t, filepath.Join(cacheDir, "team", "primary"), ident)
+
+	// without the team selected the cached team identity isn't silently
+	// replaced by a consumer registration
+	_, err := loadIdentity(context.Background(), slog.Default(), opts, "primary")
+	qt.Assert(t, err, qt.ErrorMatches, "a team identity is cached in .* but no team is selected")
+
+	// later runs select the team without a token
+	opts.Team = true
+	loaded, err := loadIdentity(context.Background(), slog.Default(), opts, "primary")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, loaded.ID, qt.Equals, "team-device")
+
+	_, err = loadIdentity(context.Background(), slog.Default(), opts, "secondary")
+	qt.Assert(t, err, qt.ErrorMatches, "no cached team identity and no team token provided")
+
+	opts.NoCache = true
+	_, err = loadIdentity(context.Background(), slog.Default(), opts, "primary")
+	qt.Assert(t, err, qt.ErrorMatches, "a team without a cache needs a team token")
+}
+
+func TestLoadIdentityMinQuota(t *testing.T) {
+	cacheDir := t.TempDir()
+	ident := warp.Identity{ID: "device", Token: "token", PrivateKey: "key"}
+	ident.Config.Peers = []warp.IdentityConfigPeer{{PublicKey: "peer"}}
+	writeIdentity(t, filepath.Join(cacheDir, "primary"), ident)
+
+	var remaining int64
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		qt.Check(t, req.URL.Path, qt.Matches, ".*/reg/device/account")
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(fmt.Sprintf(`{"account_type":"limited","premium_data":%d}`, remaining))),
+			Header:     make(http.Header),
+			Request:    req,
+		}, nil
+	})}
+	opts := WarpOptions{CacheDir: cacheDir, HTTPClient: client, MinQuota: 1e9}
+
+	remaining = 5e8
+	_, err := loadIdentity(context.Background(), slog.Default(), opts, "primary")
+	qt.Assert(t, err, qt.ErrorIs, ErrQuotaTooLow)
+	qt.Assert(t, ErrorClass(err), qt.Equals, ErrClassOther)
+
+	remaining = 2e9
+	loaded, err := loadIdentity(context.Background(), slog.Default(), opts, "primary")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, loaded.Account.PremiumData, qt.Equals, int64(2e9))
+}
+
+func TestLoadIdentityMaxAge(t *testing.T) {
+	cacheDir := t.TempDir()
+	ident := warp.Identity{ID: "old-device", Token: "old-token", PrivateKey: "key", Created: time.Now().Add(-48 * time.Hour).Format(time.RFC3339)}
+	ident.Config.Peers = []warp.IdentityConfigPeer{{PublicKey: "peer"}}
+	writeIdentity(t, filepath.Join(cacheDir, "primary"), ident)
+
+	var calls []string
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		path := req.URL.Path[strings.Index(req.URL.Path, "/reg"):]
+		calls = append(calls, req.Method+" "+path)
+
+		body := `{}`
+		switch {
+		case req.Method == http.MethodDelete:
+			qt.Check(t, req.Header.Get("Authorization"), qt.Equals, "Bearer old-token")
+		case req.Method == http.MethodPost && path == "/reg":
+			body = `{"id":"new-device","token":"new-token","config":{"peers":[{"public_key":"peer"}]}}`
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Header:     make(http.Header),
+			Request:    req,
+		}, nil
+	})}
+	opts := WarpOptions{CacheDir: cacheDir, HTTPClient: client, IdentityMaxAge: 72 * time.Hour}
+
+	// young enough
+	loaded, err := loadIdentity(context.Background(), slog.Default(), opts, "primary")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, loaded.ID, qt.Equals, "old-device")
+	qt.Assert(t, calls, qt.HasLen, 0)
+
+	opts.IdentityMaxAge = 24 * time.Hour
+	loaded, err = loadIdentity(context.Background(), slog.Default(), opts, "primary")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, loaded.ID, qt.Equals, "new-device")
+	qt.Assert(t, calls[:2], qt.DeepEquals, []string{"DELETE /reg/old-device", "POST /reg"})
+
+	// the new identity is cached with its registration time
+	cached, err := warp.LoadIdentity(filepath.Join(cacheDir, "primary"))
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, cached.ID, qt.Equals, "new-device")
+	created, err := time.Parse(time.RFC3339, cached.Created)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, time.Since(created) < time.Minute, qt.IsTrue)
+}
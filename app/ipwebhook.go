@@ -0,0 +1,148 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ipWebhookAttempts is how often an egress IP change is posted before
+// giving up, waiting ipWebhookBackoff times the attempt in between.
+const ipWebhookAttempts = 3
+
+var ipWebhookBackoff = time.Second
+
+// IPChange is the payload posted when the egress IP changes. OldIP is empty
+// for the first IP detected after startup.
+type IPChange struct {
+	OldIP     string    `json:"old_ip"`
+	NewIP     string    `json:"new_ip"`
+	Colo      string    `json:"colo"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// egressWatcher looks up the egress IP after every connect and posts an
+// IPChange to a webhook when it differs from the previous one. A nil
+// *egressWatcher ignores all calls.
+type egressWatcher struct {
+	l      *slog.Logger
+	url    string
+	client *http.Client
+
+	// mu guards the queue of checks run by queue. pending is the check
+	// waiting for the running one, if any.
+	mu      sync.Mutex
+	pending func()
+	running bool
+
+	// ip is only used by check, which runs one at a time.
+	ip string
+}
+
+func newEgressWatcher(l *slog.Logger, url string) *egressWatcher {
+	if url == "" {
+		return nil
+	}
+	return &egressWatcher{
+		l:      l.With("subsystem", "ip-webhook"),
+		url:    url,
+		client: &http.Client{Timeout: registrarTimeout},
+	}
+}
+
+// queue runs check in the background once the checks queued before are done,
+// so the changes are posted in the order of the connects. A check still
+// waiting is replaced, its tunnel is gone already.
+func (w *egressWatcher) queue(ctx context.Context, trace func(ctx context.Context) (map[string]string, error)) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending = func() { w.check(ctx, trace) }
+	if !w.running {
+		w.running = true
+		go w.run()
+	}
+}
+
+// run runs the queued checks until there are none left.
+func (w *egressWatcher) run() {
+	for {
+		w.mu.Lock()
+		check := w.pending
+		w.pending = nil
+		if check == nil {
+			w.running = false
+			w.mu.Unlock()
+			return
+		}
+		w.mu.Unlock()
+		check()
+	}
+}
+
+// check looks up the egress IP with trace and posts the change, if any.
+// Checks must not run concurrently, see queue.
+func (w *egressWatcher) check(ctx context.Context, trace func(ctx context.Context) (map[string]string, error)) {
+	if w == nil {
+		return
+	}
+
+	t, err := trace(ctx)
+	if err != nil || t["ip"] == "" {
+		if ctx.Err() == nil {
+			w.l.Warn("failed to detect egress ip", "error", err)
+		}
+		return
+	}
+	if t["ip"] == w.ip {
+		return
+	}
+
+	change := IPChange{OldIP: w.ip, NewIP: t["ip"], Colo: strings.ToUpper(t["colo"]), Timestamp: time.Now().UTC()}
+	w.ip = change.NewIP
+	for attempt := 1; ; attempt++ {
+		err = w.post(ctx, change)
+		if err == nil {
+			w.l.Info("posted egress ip change", "old", change.OldIP, "new", change.NewIP, "colo", change.Colo)
+			return
+		}
+		if attempt == ipWebhookAttempts || ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Duration(attempt) * ipWebhookBackoff):
+		}
+	}
+	w.l.Warn("failed to post egress ip change", "new", change.NewIP, "attempts", ipWebhookAttempts, "error", err)
+}
+
+func (w *egressWatcher) post(ctx context.Context, change IPChange) error {
+	b, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestEgressWatcher(t *testing.T) {
+	backoff := ipWebhookBackoff
+	ipWebhookBackoff = time.Millisecond
+	t.Cleanup(func() { ipWebhookBackoff = backoff })
+
+	var requests int
+	var changes []IPChange
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		// fail the first attempt to exercise the retry
+		if requests == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		var c IPChange
+		qt.Check(t, req.Method, qt.Equals, http.MethodPost)
+		qt.Check(t, json.NewDecoder(req.Body).Decode(&c), qt.IsNil)
+		changes = append(changes, c)
+	}))
+	defer srv.Close()
+
+	w := newEgressWatcher(slog.Default(), srv.URL)
+	egress := func(ip, colo string) func(context.Context) (map[string]string, error) {
+		return func(context.Context) (map[string]string, error) {
+			return map[string]string{"ip": ip, "colo": colo}, nil
+		}
+	}
+
+	w.check(context.Background(), egress("203.0.113.1", "fra"))
+	// a reconnect keeping the same egress ip posts nothing
+	w.check(context.Background(), egress("203.0.113.1", "fra"))
+	w.check(context.Background(), egress("203.0.113.2", "ams"))
+
+	qt.Assert(t, requests, qt.Equals, 3)
+	qt.Assert(t, changes, qt.HasLen, 2)
+	qt.Assert(t, changes[0].OldIP, qt.Equals, "")
+	qt.Assert(t, changes[0].NewIP, qt.Equals, "203.0.113.1")
+	qt.Assert(t, changes[1].OldIP, qt.Equals, "203.0.113.1")
+	qt.Assert(t, changes[1].NewIP, qt.Equals, "203.0.113.2")
+	qt.Assert(t, changes[1].Colo, qt.Equals, "AMS")
+	qt.Assert(t, time.Since(changes[1].Timestamp) < time.Minute, qt.IsTrue)
+
+	// disabled
+	var none *egressWatcher
+	none.check(context.Background(), egress("203.0.113.3", "fra"))
+	qt.Assert(t, newEgressWatcher(slog.Default(), ""), qt.IsNil)
+}
+
+func TestEgressWatcherQueue(t *testing.T) {
+	var mu sync.Mutex
+	var posted []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var c IPChange
+		qt.Check(t, json.NewDecoder(req.Body).Decode(&c), qt.IsNil)
+		mu.Lock()
+		posted = append(posted, c.NewIP)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	w := newEgressWatcher(slog.Default(), srv.URL)
+	started, release := make(chan struct{}), make(chan struct{})
+	egress := func(ip string) func(context.Context) (map[string]string, error) {
+		return func(context.Context) (map[string]string, error) {
+			return map[string]string{"ip": ip}, nil
+		}
+	}
+
+	// the second check is replaced by the third while the first runs
+	w.queue(context.Background(), func(ctx context.Context) (map[string]string, error) {
+		close(started)
+		<-release
+		return egress("203.0.113.1")(ctx)
+	})
+	<-started
+	w.queue(context.Background(), egress("203.0.113.2"))
+	w.queue(context.Background(), egress("203.0.113.3"))
+	close(release)
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		w.mu.Lock()
+		idle := !w.running
+		w.mu.Unlock()
+		if idle || time.Now().After(deadline) {
+			break
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	qt.Assert(t, posted, qt.DeepEquals, []string{"203.0.113.1", "203.0.113.3"})
+}
@@ -0,0 +1,129 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/device"
+	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// mtuProbeURL serves a payload large enough to need full sized packets.
+const mtuProbeURL = "https://speed.cloudflare.com/__down?bytes=262144"
+
+// mtuCandidates are tried from largest to smallest when probing. They stop
+// at the IPv6 minimum, below which the tunnel can't carry IPv6 at all.
+var mtuCandidates = []int{singleMTU, 1300, doubleMTU}
+
+// errMTUProbeStatus is a probe answered with an unexpected status, which
+// lowering the MTU can't fix.
+var errMTUProbeStatus = errors.New("mtu probe request failed")
+
+// probeMTU returns the first candidate, from largest to smallest, for which
+// try reports success. try returning an error aborts the probe, as it means
+// the tunnel failed for reasons the MTU can't fix.
+func probeMTU(ctx context.Context, candidates []int, try func(ctx context.Context, mtu int) (bool, error)) (int, error) {
+	for _, mtu := range candidates {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		ok, err := try(ctx, mtu)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return mtu, nil
+		}
+	}
+	return 0, errors.New("no working mtu found, large packets are being dropped")
+}
+
+// mtuTransferTest downloads a sized payload through the tunnel. On a path
+// that blackholes large packets the transfer stalls and times out.
+func mtuTransferTest(ctx context.Context, tnet *netstack.Net) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, mtuProbeURL, nil)
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{Transport: &http.Transport{DialContext: tnet.DialContext}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w with status: %s", errMTUProbeStatus, resp.Status)
+	}
+
+	_, err = io.Copy(io.Discard, resp.Body)
+	return err
+}
+
+// sizeRelated reports whether the large transfer failing with err is likely
+// due to the packet size: the probe host resolved and answered, and a small
+// transfer with check still goes through. Anything else fails the same way
+// at any MTU.
+func sizeRelated(ctx context.Context, err error, check func(ctx context.Context) error) bool {
+	var dnsErr *net.DNSError
+	if errors.Is(err, errMTUProbeStatus) || errors.As(err, &dnsErr) || ctx.Err() != nil {
+		return false
+	}
+	return check(ctx) == nil
+}
+
+// connectWarpProbeMTU is connectWarp followed by an MTU probe, reconnecting
+// with a lower MTU while large transfers fail but small ones go through.
+// conf is left with the MTU that worked.
+func connectWarpProbeMTU(ctx context.Context, l *slog.Logger, conf *wiresocks.Configuration, devOpts deviceOptions, opts WarpOptions) (*device.Device, *netstack.Net, error) {
+	var candidates []int
+	for _, mtu := range mtuCandidates {
+		if mtu <= conf.Interface.MTU {
+			candidates = append(candidates, mtu)
+		}
+	}
+
+	var dev *device.Device
+	var tnet *netstack.Net
+	mtu, err := probeMTU(ctx, candidates, func(ctx context.Context, mtu int) (bool, error) {
+		var err error
+		conf.Interface.MTU = mtu
+		dev, tnet, err = connectWarp(ctx, l, conf, devOpts, opts)
+		if err != nil {
+			return false, err
+		}
+
+		err = mtuTransferTest(ctx, tnet)
+		if err == nil {
+			return true, nil
+		}
+		check := func(ctx context.Context) error {
+			return usermodeTunTest(ctx, l, tnet, opts.TestURL, opts.TraceCA)
+		}
+		related := sizeRelated(ctx, err, check)
+		dev.Close()
+		if !related {
+			return false, fmt.Errorf("mtu probe failed regardless of the packet size: %w", err)
+		}
+		l.Info("large transfer failed, lowering mtu", "mtu", mtu, "error", err)
+		return false, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	l.Info("mtu probe finished", "mtu", mtu)
+	return dev, tnet, nil
+}
@@ -0,0 +1,62 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestProbeMTU(t *testing.T) {
+	candidates := []int{1330, 1280, 1200}
+
+	// picks the largest candidate that works
+	var tried []int
+	mtu, err := probeMTU(context.Background(), candidates, func(_ context.Context, mtu int) (bool, error) {
+		tried = append(tried, mtu)
+		return mtu <= 1280, nil
+	})
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, mtu, qt.Equals, 1280)
+	qt.Assert(t, tried, qt.DeepEquals, []int{1330, 1280})
+
+	// nothing works
+	_, err = probeMTU(context.Background(), candidates, func(context.Context, int) (bool, error) {
+		return false, nil
+	})
+	qt.Assert(t, err, qt.ErrorMatches, "no working mtu found.*")
+
+	// a tunnel failure aborts the probe instead of lowering the mtu
+	tried = nil
+	boom := errors.New("handshake failed")
+	_, err = probeMTU(context.Background(), candidates, func(_ context.Context, mtu int) (bool, error) {
+		tried = append(tried, mtu)
+		return false, boom
+	})
+	qt.Assert(t, err, qt.ErrorIs, boom)
+	qt.Assert(t, tried, qt.DeepEquals, []int{1330})
+}
+
+func TestSizeRelated(t *testing.T) {
+	ok := func(context.Context) error { return nil }
+	down := func(context.Context) error { return errors.New("tunnel is down") }
+	stalled := context.DeadlineExceeded
+
+	qt.Assert(t, sizeRelated(context.Background(), stalled, ok), qt.IsTrue)
+	// small transfers failing too isn't about the size
+	qt.Assert(t, sizeRelated(context.Background(), stalled, down), qt.IsFalse)
+	// neither are errors before any large packet was sent
+	qt.Assert(t, sizeRelated(context.Background(), fmt.Errorf("%w with status: 403 Forbidden", errMTUProbeStatus), ok), qt.IsFalse)
+	qt.Assert(t, sizeRelated(context.Background(), &net.DNSError{Err: "no such host", Name: "speed.cloudflare.com"}, ok), qt.IsFalse)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	qt.Assert(t, sizeRelated(ctx, stalled, ok), qt.IsFalse)
+
+	// the probe never goes below the IPv6 minimum
+	qt.Assert(t, slices.Min(mtuCandidates), qt.Equals, 1280)
+}
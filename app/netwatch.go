@@ -0,0 +1,39 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// networkSettleDelay is how long to wait after a network change before
+// reconnecting, so a burst of route and address updates, e.g. from joining
+// a WiFi network, leads to a single reconnect.
+var networkSettleDelay = 2 * time.Second
+
+var errNetworkWatchUnsupported = errors.New("network change detection is not supported on this platform")
+
+// watchNetwork reports changes of the network interfaces, their addresses or
+// routes on the returned channel until ctx is done. Changes are coalesced,
+// the channel only says that something changed. It returns
+// errNetworkWatchUnsupported on platforms without change notifications. It
+// is replaceable in tests.
+var watchNetwork func(ctx context.Context, l *slog.Logger) (<-chan struct{}, error) = platformWatchNetwork
+
+// waitNetworkSettled waits for networkSettleDelay to pass without another
+// change.
+func waitNetworkSettled(ctx context.Context, changes <-chan struct{}) error {
+	timer := time.NewTimer(networkSettleDelay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changes:
+			timer.Reset(networkSettleDelay)
+		case <-timer.C:
+			return nil
+		}
+	}
+}
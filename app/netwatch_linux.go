@@ -0,0 +1,244 @@
+package app
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// platformWatchNetwork listens for link, address and route updates on a
+// rtnetlink socket. Only the updates a reconnect helps with are reported:
+// changes of the default routes, and addresses added or removed and links
+// going up or down on the interfaces of the default routes. Refreshes of
+// known addresses and routes, e.g. from IPv6 router advertisements, and
+// interfaces that don't carry the traffic, e.g. veths of containers, are
+// ignored.
+func platformWatchNetwork(ctx context.Context, l *slog.Logger) (<-chan struct{}, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	groups := unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR | unix.RTMGRP_IPV4_ROUTE | unix.RTMGRP_IPV6_ROUTE
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: uint32(groups)}); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	// closing the socket doesn't interrupt a blocked read, so wake up
+	// periodically to notice ctx being done
+	tv := unix.Timeval{Sec: 1}
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+
+	// the current state, so updates can be told apart from refreshes. It is
+	// read after subscribing to not miss changes in between.
+	state := newNetState()
+	for _, typ := range []int{unix.RTM_GETLINK, unix.RTM_GETADDR, unix.RTM_GETROUTE} {
+		rib, err := syscall.NetlinkRIB(typ, unix.AF_UNSPEC)
+		if err != nil {
+			unix.Close(fd)
+			return nil, os.NewSyscallError("netlinkrib", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(rib)
+		if err != nil {
+			unix.Close(fd)
+			return nil, err
+		}
+		for _, m := range msgs {
+			state.update(m)
+		}
+	}
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer unix.Close(fd)
+		buf := make([]byte, 1<<16)
+		for ctx.Err() == nil {
+			n, _, err := unix.Recvfrom(fd, buf, 0)
+			switch {
+			case err == unix.EAGAIN || err == unix.EINTR:
+				continue
+			case err != nil:
+				l.Warn("stopped watching for network changes", "error", err)
+				return
+			case n == 0:
+				continue
+			}
+			msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			changed := false
+			for _, m := range msgs {
+				if change := state.update(m); change != "" {
+					l.Debug("network changed", "change", change)
+					changed = true
+				}
+			}
+			if !changed {
+				continue
+			}
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changes, nil
+}
+
+// defaultRoute identifies a default route of the main table.
+type defaultRoute struct {
+	family   uint8
+	oif      uint32
+	gateway  netip.Addr
+	priority uint32
+}
+
+// ifAddr is an address of an interface.
+type ifAddr struct {
+	index uint32
+	addr  netip.Prefix
+}
+
+// netState tracks the default routes, the addresses and whether the links
+// are up, as told by rtnetlink messages.
+type netState struct {
+	routes map[defaultRoute]bool
+	addrs  map[ifAddr]bool
+	links  map[uint32]bool
+}
+
+func newNetState() *netState {
+	return &netState{
+		routes: make(map[defaultRoute]bool),
+		addrs:  make(map[ifAddr]bool),
+		links:  make(map[uint32]bool),
+	}
+}
+
+// egress reports whether the interface index carries a default route.
+func (s *netState) egress(index uint32) bool {
+	for r := range s.routes {
+		if r.oif == index {
+			return true
+		}
+	}
+	return false
+}
+
+// update applies m and describes the change if it warrants a reconnect,
+// otherwise it returns "".
+func (s *netState) update(m syscall.NetlinkMessage) string {
+	attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+	if err != nil {
+		return ""
+	}
+	switch m.Header.Type {
+	case unix.RTM_NEWROUTE, unix.RTM_DELROUTE:
+		// family, dst_len, src_len, tos, table, protocol, scope, type
+		if len(m.Data) < unix.SizeofRtMsg || m.Data[1] != 0 || m.Data[7] != unix.RTN_UNICAST {
+			return ""
+		}
+		table := uint32(m.Data[4])
+		r := defaultRoute{family: m.Data[0]}
+		for _, a := range attrs {
+			switch a.Attr.Type {
+			case unix.RTA_TABLE:
+				table = nativeUint32(a.Value)
+			case unix.RTA_OIF:
+				r.oif = nativeUint32(a.Value)
+			case unix.RTA_PRIORITY:
+				r.priority = nativeUint32(a.Value)
+			case unix.RTA_GATEWAY:
+				r.gateway, _ = netip.AddrFromSlice(a.Value)
+			}
+		}
+		if table != unix.RT_TABLE_MAIN {
+			return ""
+		}
+		if m.Header.Type == unix.RTM_DELROUTE {
+			if !s.routes[r] {
+				return ""
+			}
+			delete(s.routes, r)
+			return fmt.Sprintf("default route via %s removed", r.gateway)
+		}
+		if s.routes[r] {
+			return ""
+		}
+		s.routes[r] = true
+		return fmt.Sprintf("default route via %s added", r.gateway)
+
+	case unix.RTM_NEWADDR, unix.RTM_DELADDR:
+		// family, prefixlen, flags, scope, index
+		if len(m.Data) < unix.SizeofIfAddrmsg {
+			return ""
+		}
+		a := ifAddr{index: nativeUint32(m.Data[4:8])}
+		for _, attr := range attrs {
+			// IFA_LOCAL is the own address on point-to-point links and
+			// comes after IFA_ADDRESS
+			if attr.Attr.Type == unix.IFA_ADDRESS || attr.Attr.Type == unix.IFA_LOCAL {
+				if addr, ok := netip.AddrFromSlice(attr.Value); ok {
+					a.addr = netip.PrefixFrom(addr, int(m.Data[1]))
+				}
+			}
+		}
+		if m.Header.Type == unix.RTM_DELADDR {
+			if !s.addrs[a] {
+				return ""
+			}
+			delete(s.addrs, a)
+			if !s.egress(a.index) {
+				return ""
+			}
+			return fmt.Sprintf("address %s removed", a.addr)
+		}
+		if s.addrs[a] {
+			return ""
+		}
+		s.addrs[a] = true
+		if !s.egress(a.index) {
+			return ""
+		}
+		return fmt.Sprintf("address %s added", a.addr)
+
+	case unix.RTM_NEWLINK, unix.RTM_DELLINK:
+		// family, pad, type, index, flags, change
+		if len(m.Data) < unix.SizeofIfInfomsg {
+			return ""
+		}
+		index := nativeUint32(m.Data[4:8])
+		flags := nativeUint32(m.Data[8:12])
+		up := m.Header.Type == unix.RTM_NEWLINK && flags&unix.IFF_UP != 0 && flags&unix.IFF_LOWER_UP != 0
+		was, known := s.links[index]
+		if m.Header.Type == unix.RTM_DELLINK {
+			delete(s.links, index)
+		} else {
+			s.links[index] = up
+		}
+		if !known || was == up || !s.egress(index) {
+			return ""
+		}
+		if up {
+			return fmt.Sprintf("link %d up", index)
+		}
+		return fmt.Sprintf("link %d down", index)
+	}
+	return ""
+}
+
+func nativeUint32(b []byte) uint32 {
+	if len(b) < 4 {
+		return 0
+	}
+	return binary.NativeEndian.Uint32(b)
+}
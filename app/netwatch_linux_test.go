@@ -0,0 +1,90 @@
+package app
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"syscall"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"golang.org/x/sys/unix"
+)
+
+// netlinkMsg builds a rtnetlink message of typ from its fixed header and
+// attributes, given as type and value pairs.
+func netlinkMsg(typ uint16, hdr []byte, attrs ...any) syscall.NetlinkMessage {
+	data := append([]byte(nil), hdr...)
+	for i := 0; i < len(attrs); i += 2 {
+		value := attrs[i+1].([]byte)
+		data = binary.NativeEndian.AppendUint16(data, uint16(4+len(value)))
+		data = binary.NativeEndian.AppendUint16(data, attrs[i].(uint16))
+		data = append(data, value...)
+		for len(data)%4 != 0 {
+			data = append(data, 0)
+		}
+	}
+	return syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: typ}, Data: data}
+}
+
+func u32(v uint32) []byte {
+	return binary.NativeEndian.AppendUint32(nil, v)
+}
+
+func routeMsg(typ uint16, dstLen uint8, table uint8, gateway string, oif uint32) syscall.NetlinkMessage {
+	gw := netip.MustParseAddr(gateway)
+	return netlinkMsg(typ, []byte{unix.AF_INET, dstLen, 0, 0, table, unix.RTPROT_BOOT, unix.RT_SCOPE_UNIVERSE, unix.RTN_UNICAST, 0, 0, 0, 0},
+		uint16(unix.RTA_GATEWAY), gw.AsSlice(), uint16(unix.RTA_OIF), u32(oif))
+}
+
+func addrMsg(typ uint16, index uint32, prefix string) syscall.NetlinkMessage {
+	p := netip.MustParsePrefix(prefix)
+	hdr := append([]byte{unix.AF_INET6, byte(p.Bits()), 0, 0}, u32(index)...)
+	return netlinkMsg(typ, hdr, uint16(unix.IFA_ADDRESS), p.Addr().AsSlice())
+}
+
+func linkMsg(index uint32, up bool) syscall.NetlinkMessage {
+	var flags uint32
+	if up {
+		flags = unix.IFF_UP | unix.IFF_LOWER_UP
+	}
+	hdr := append(append(append([]byte{unix.AF_UNSPEC, 0, 1, 0}, u32(index)...), u32(flags)...), u32(0)...)
+	return netlinkMsg(unix.RTM_NEWLINK, hdr)
+}
+
+func TestNetState(t *testing.T) {
+	s := newNetState()
+	// the initial state, eth0 is 2 and carries the default route, 3 is a
+	// container veth
+	for _, m := range []syscall.NetlinkMessage{
+		linkMsg(2, true),
+		linkMsg(3, true),
+		addrMsg(unix.RTM_NEWADDR, 2, "2001:db8::2/64"),
+		routeMsg(unix.RTM_NEWROUTE, 0, unix.RT_TABLE_MAIN, "192.0.2.1", 2),
+	} {
+		s.update(m)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		m      syscall.NetlinkMessage
+		change string
+	}{
+		{"address refresh", addrMsg(unix.RTM_NEWADDR, 2, "2001:db8::2/64"), ""},
+		{"route refresh", routeMsg(unix.RTM_NEWROUTE, 0, unix.RT_TABLE_MAIN, "192.0.2.1", 2), ""},
+		{"veth address", addrMsg(unix.RTM_NEWADDR, 3, "172.17.0.1/16"), ""},
+		{"veth down", linkMsg(3, false), ""},
+		{"new veth", linkMsg(4, true), ""},
+		{"subnet route", routeMsg(unix.RTM_NEWROUTE, 24, unix.RT_TABLE_MAIN, "192.0.2.1", 3), ""},
+		{"default route of another table", routeMsg(unix.RTM_NEWROUTE, 0, 100, "10.0.0.1", 4), ""},
+		{"egress address", addrMsg(unix.RTM_NEWADDR, 2, "2001:db8::3/64"), "address 2001:db8::3/64 added"},
+		{"egress address removed", addrMsg(unix.RTM_DELADDR, 2, "2001:db8::3/64"), "address 2001:db8::3/64 removed"},
+		{"egress down", linkMsg(2, false), "link 2 down"},
+		{"egress down again", linkMsg(2, false), ""},
+		{"egress up", linkMsg(2, true), "link 2 up"},
+		{"default route removed", routeMsg(unix.RTM_DELROUTE, 0, unix.RT_TABLE_MAIN, "192.0.2.1", 2), "default route via 192.0.2.1 removed"},
+		{"no longer egress", linkMsg(2, false), ""},
+		{"new default route", routeMsg(unix.RTM_NEWROUTE, 0, unix.RT_TABLE_MAIN, "172.17.0.254", 3), "default route via 172.17.0.254 added"},
+	} {
+		qt.Check(t, s.update(tc.m), qt.Equals, tc.change, qt.Commentf(tc.name))
+	}
+}
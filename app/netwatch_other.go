@@ -0,0 +1,12 @@
+//go:build !linux
+
+package app
+
+import (
+	"context"
+	"log/slog"
+)
+
+func platformWatchNetwork(context.Context, *slog.Logger) (<-chan struct{}, error) {
+	return nil, errNetworkWatchUnsupported
+}
@@ -0,0 +1,222 @@
+package app
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/conn"
+)
+
+const (
+	pcapSnapLen = 65535
+	// pcapLinkTypeRaw means every record starts with an IPv4 or IPv6 header.
+	pcapLinkTypeRaw = 101
+	// DefaultPcapMaxSize is the size at which a pcap file is rotated.
+	DefaultPcapMaxSize = 64 << 20
+)
+
+// pcapWriter writes the outer wireguard packets to a pcap file. The local
+// address isn't known to the bind, so packets carry the unspecified address
+// as the local side. Once the file grows past maxSize it is moved to
+// path+".1", replacing the previous one, and a new file is started. A nil
+// *pcapWriter ignores all calls.
+type pcapWriter struct {
+	l       *slog.Logger
+	path    string
+	maxSize int64
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func newPcapWriter(l *slog.Logger, path string, maxSize int64) (*pcapWriter, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultPcapMaxSize
+	}
+	w := &pcapWriter{l: l.With("subsystem", "pcap"), path: path, maxSize: maxSize}
+	if err := w.openLocked(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *pcapWriter) openLocked() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	var hdr [24]byte
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], pcapLinkTypeRaw)
+	if _, err := f.Write(hdr[:]); err != nil {
+		f.Close()
+		return err
+	}
+
+	w.f, w.size = f, int64(len(hdr))
+	return nil
+}
+
+// write records a UDP datagram exchanged with remote. out is true for
+// packets sent by this host.
+func (w *pcapWriter) write(remote netip.AddrPort, localPort uint16, payload []byte, out bool) {
+	if w == nil {
+		return
+	}
+
+	remote = netip.AddrPortFrom(remote.Addr().Unmap(), remote.Port())
+	local := netip.AddrPortFrom(netip.IPv4Unspecified(), localPort)
+	if remote.Addr().Is6() {
+		local = netip.AddrPortFrom(netip.IPv6Unspecified(), localPort)
+	}
+	src, dst := remote, local
+	if out {
+		src, dst = local, remote
+	}
+	pkt := udpPacket(src, dst, payload)
+	if len(pkt) > pcapSnapLen {
+		pkt = pkt[:pcapSnapLen]
+	}
+
+	now := time.Now()
+	var rec [16]byte
+	binary.LittleEndian.PutUint32(rec[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(pkt)))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return
+	}
+	if w.size+int64(len(rec)+len(pkt)) > w.maxSize {
+		if err := w.rotateLocked(); err != nil {
+			w.l.Warn("failed to rotate pcap file, stopping capture", "path", w.path, "error", err)
+			return
+		}
+	}
+	if _, err := w.f.Write(append(rec[:], pkt...)); err != nil {
+		w.l.Warn("failed to write pcap file, stopping capture", "path", w.path, "error", err)
+		w.f.Close()
+		w.f = nil
+		return
+	}
+	w.size += int64(len(rec) + len(pkt))
+}
+
+func (w *pcapWriter) rotateLocked() error {
+	w.f.Close()
+	w.f = nil
+	if err := os.Rename(w.path, w.path+".1"); err != nil {
+		return err
+	}
+	return w.openLocked()
+}
+
+func (w *pcapWriter) close() {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f != nil {
+		w.f.Close()
+		w.f = nil
+	}
+}
+
+// udpPacket builds an IP packet carrying payload from src to dst. The UDP
+// checksum is left empty.
+func udpPacket(src, dst netip.AddrPort, payload []byte) []byte {
+	udpLen := 8 + len(payload)
+
+	var pkt []byte
+	if src.Addr().Is4() {
+		pkt = make([]byte, 20, 20+udpLen)
+		pkt[0] = 0x45
+		binary.BigEndian.PutUint16(pkt[2:], uint16(20+udpLen))
+		pkt[6] = 0x40 // don't fragment
+		pkt[8] = 64
+		pkt[9] = 17
+		s, d := src.Addr().As4(), dst.Addr().As4()
+		copy(pkt[12:], s[:])
+		copy(pkt[16:], d[:])
+		binary.BigEndian.PutUint16(pkt[10:], ipChecksum(pkt))
+	} else {
+		pkt = make([]byte, 40, 40+udpLen)
+		pkt[0] = 0x60
+		binary.BigEndian.PutUint16(pkt[4:], uint16(udpLen))
+		pkt[6] = 17
+		pkt[7] = 64
+		s, d := src.Addr().As16(), dst.Addr().As16()
+		copy(pkt[8:], s[:])
+		copy(pkt[24:], d[:])
+	}
+
+	pkt = binary.BigEndian.AppendUint16(pkt, src.Port())
+	pkt = binary.BigEndian.AppendUint16(pkt, dst.Port())
+	pkt = binary.BigEndian.AppendUint16(pkt, uint16(udpLen))
+	pkt = binary.BigEndian.AppendUint16(pkt, 0)
+	return append(pkt, payload...)
+}
+
+func ipChecksum(hdr []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(hdr); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(hdr[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// pcapBind copies every packet passing through a bind to a pcapWriter.
+type pcapBind struct {
+	conn.Bind
+	w    *pcapWriter
+	port atomic.Uint32
+}
+
+func (b *pcapBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	fns, actualPort, err := b.Bind.Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	b.port.Store(uint32(actualPort))
+
+	wrapped := make([]conn.ReceiveFunc, len(fns))
+	for i, fn := range fns {
+		wrapped[i] = func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+			n, err := fn(packets, sizes, eps)
+			for j := 0; j < n; j++ {
+				if remote, perr := netip.ParseAddrPort(eps[j].DstToString()); perr == nil {
+					b.w.write(remote, actualPort, packets[j][:sizes[j]], false)
+				}
+			}
+			return n, err
+		}
+	}
+	return wrapped, actualPort, nil
+}
+
+func (b *pcapBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	if remote, err := netip.ParseAddrPort(ep.DstToString()); err == nil {
+		for _, buf := range bufs {
+			b.w.write(remote, uint16(b.port.Load()), buf, true)
+		}
+	}
+	return b.Bind.Send(bufs, ep)
+}
@@ -0,0 +1,102 @@
+package app
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bepass-org/warp-plus/wireguard/conn"
+	"github.com/bepass-org/warp-plus/wireguard/conn/bindtest"
+	qt "github.com/frankban/quicktest"
+)
+
+// readPcap checks the global header of a pcap file and returns its records.
+func readPcap(t *testing.T, path string) [][]byte {
+	b, err := os.ReadFile(path)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, len(b) >= 24, qt.IsTrue)
+	qt.Assert(t, binary.LittleEndian.Uint32(b[0:]), qt.Equals, uint32(0xa1b2c3d4))
+	qt.Assert(t, binary.LittleEndian.Uint16(b[4:]), qt.Equals, uint16(2))
+	qt.Assert(t, binary.LittleEndian.Uint16(b[6:]), qt.Equals, uint16(4))
+	qt.Assert(t, binary.LittleEndian.Uint32(b[20:]), qt.Equals, uint32(pcapLinkTypeRaw))
+
+	var records [][]byte
+	for b = b[24:]; len(b) > 0; {
+		qt.Assert(t, len(b) >= 16, qt.IsTrue)
+		n := binary.LittleEndian.Uint32(b[8:])
+		qt.Assert(t, binary.LittleEndian.Uint32(b[12:]), qt.Equals, n)
+		records = append(records, b[16:16+n])
+		b = b[16+n:]
+	}
+	return records
+}
+
+func TestPcapBind(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "warp.pcap")
+	w, err := newPcapWriter(slog.Default(), path, 0)
+	qt.Assert(t, err, qt.IsNil)
+
+	binds := bindtest.NewChannelBinds()
+	a := &pcapBind{Bind: binds[0], w: w}
+	fns, port, err := a.Open(0)
+	qt.Assert(t, err, qt.IsNil)
+	defer a.Close()
+	_, _, err = binds[1].Open(0)
+	qt.Assert(t, err, qt.IsNil)
+	defer binds[1].Close()
+
+	peer, err := a.ParseEndpoint("127.0.0.1:1")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, a.Send([][]byte{[]byte("handshake initiation")}, peer), qt.IsNil)
+
+	local, err := binds[1].ParseEndpoint("127.0.0.1:2")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, binds[1].Send([][]byte{[]byte("handshake response")}, local), qt.IsNil)
+	bufs, sizes, eps := [][]byte{make([]byte, 1500)}, make([]int, 1), make([]conn.Endpoint, 1)
+	n, err := fns[0](bufs, sizes, eps)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, n, qt.Equals, 1)
+	w.close()
+
+	records := readPcap(t, path)
+	qt.Assert(t, records, qt.HasLen, 2)
+
+	out := records[0]
+	qt.Assert(t, out[0], qt.Equals, byte(0x45))
+	qt.Assert(t, out[9], qt.Equals, byte(17))
+	qt.Assert(t, ipChecksum(out[:20]), qt.Equals, uint16(0))
+	qt.Assert(t, int(binary.BigEndian.Uint16(out[2:])), qt.Equals, len(out))
+	qt.Assert(t, netip.AddrFrom4([4]byte(out[16:20])), qt.Equals, netip.MustParseAddr("127.0.0.1"))
+	qt.Assert(t, binary.BigEndian.Uint16(out[20:]), qt.Equals, port)
+	qt.Assert(t, binary.BigEndian.Uint16(out[22:]), qt.Equals, uint16(1))
+	qt.Assert(t, string(out[28:]), qt.Equals, "handshake initiation")
+
+	in := records[1]
+	qt.Assert(t, in[0], qt.Equals, byte(0x45))
+	qt.Assert(t, netip.AddrFrom4([4]byte(in[12:16])), qt.Equals, netip.MustParseAddr("127.0.0.1"))
+	qt.Assert(t, binary.BigEndian.Uint16(in[22:]), qt.Equals, port)
+	qt.Assert(t, string(in[28:]), qt.Equals, "handshake response")
+}
+
+func TestPcapRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "warp.pcap")
+	// room for the header and two 100 byte packets
+	w, err := newPcapWriter(slog.Default(), path, 24+2*(16+48+100))
+	qt.Assert(t, err, qt.IsNil)
+
+	remote := netip.MustParseAddrPort("[2606:4700:d0::a29f:c001]:2408")
+	payload := make([]byte, 100)
+	for range 3 {
+		w.write(remote, 51820, payload, true)
+	}
+	w.close()
+
+	records := readPcap(t, path+".1")
+	qt.Assert(t, records, qt.HasLen, 2)
+	qt.Assert(t, records[0][0]>>4, qt.Equals, byte(6))
+	qt.Assert(t, int(binary.BigEndian.Uint16(records[0][4:])), qt.Equals, 8+len(payload))
+	qt.Assert(t, readPcap(t, path), qt.HasLen, 1)
+}
@@ -0,0 +1,94 @@
+package app
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// EndpointPing is the handshake latency measured for an endpoint.
+type EndpointPing struct {
+	Endpoint string
+	Latency  time.Duration
+	Err      error
+}
+
+// PingEndpoints measures the time to the first wireguard handshake with each
+// endpoint using the primary identity, and returns the results ranked by
+// latency with failed endpoints last. Endpoints are measured one at a time
+// so they don't compete for bandwidth.
+func PingEndpoints(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoints []string) ([]EndpointPing, error) {
+	ident, err := loadIdentity(ctx, l, opts, "primary")
+	if err != nil {
+		return nil, err
+	}
+
+	conf := generateWireguardConfig(ident)
+	conf.Interface.MTU = singleMTU
+	conf.Interface.DNS = []netip.Addr{opts.DnsAddr}
+
+	results := make([]EndpointPing, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		for i := range conf.Peers {
+			conf.Peers[i].Endpoint = endpoint
+			conf.Peers[i].Trick = true
+		}
+
+		p := EndpointPing{Endpoint: endpoint}
+		p.Latency, p.Err = handshakeLatency(ctx, l, opts, &conf)
+		l.Debug("measured handshake", "endpoint", endpoint, "latency", p.Latency, "error", p.Err)
+		results = append(results, p)
+	}
+
+	rankPings(results)
+	return results, nil
+}
+
+// rankPings sorts successful pings by latency, followed by failed ones.
+func rankPings(pings []EndpointPing) {
+	slices.SortStableFunc(pings, func(a, b EndpointPing) int {
+		if (a.Err == nil) != (b.Err == nil) {
+			if a.Err == nil {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Compare(a.Latency, b.Latency)
+	})
+}
+
+func handshakeLatency(ctx context.Context, l *slog.Logger, opts WarpOptions, conf *wiresocks.Configuration) (time.Duration, error) {
+	tunDev, _, err := netstack.CreateNetTUN(conf.Interface.Addresses, conf.Interface.DNS, conf.Interface.MTU)
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	dev, err := establishWireguard(ctx, l, conf, tunDev, deviceOptions{fwmark: opts.FwMark, dscp: opts.DSCP, port: opts.SourcePort, randomPort: opts.RandomSourcePort, socks: opts.UDPSocks, handshakeTimeout: handshakeTimeout(opts.handshakeRetries())}, "t1")
+	if err != nil {
+		if ErrorClass(err) == ErrClassNoHandshake {
+			return 0, errors.New("handshake timed out")
+		}
+		return 0, err
+	}
+	defer dev.Close()
+
+	// the device records the handshake time precisely, waitHandshake only
+	// polls for it once a second
+	stats, err := readDeviceStats(dev)
+	if err != nil {
+		return 0, err
+	}
+	return stats.LastHandshake.Sub(start), nil
+}
@@ -0,0 +1,26 @@
+package app
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestRankPings(t *testing.T) {
+	timeout := errors.New("handshake timed out")
+	pings := []EndpointPing{
+		{Endpoint: "a", Err: timeout},
+		{Endpoint: "b", Latency: 80 * time.Millisecond},
+		{Endpoint: "c", Err: timeout},
+		{Endpoint: "d", Latency: 20 * time.Millisecond},
+	}
+	rankPings(pings)
+
+	var order []string
+	for _, p := range pings {
+		order = append(order, p.Endpoint)
+	}
+	qt.Assert(t, order, qt.DeepEquals, []string{"d", "b", "a", "c"})
+}
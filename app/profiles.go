@@ -0,0 +1,47 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// profilesDir is the directory under the cache directory holding the
+// account profiles.
+const profilesDir = "profiles"
+
+// ProfileDir returns the cache directory of the named account profile under
+// cacheDir, creating it if absent. Each profile keeps its own identities, so
+// several accounts can be switched between by name.
+func ProfileDir(cacheDir, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid account profile name %q", name)
+	}
+	dir := path.Join(cacheDir, profilesDir, name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("couldn't create account profile: %w", err)
+	}
+	return dir, nil
+}
+
+// ListProfiles returns the names of the account profiles under cacheDir, in
+// lexical order.
+func ListProfiles(cacheDir string) ([]string, error) {
+	entries, err := os.ReadDir(path.Join(cacheDir, profilesDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,63 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestProfiles(t *testing.T) {
+	var devices int
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		var body any = map[string]any{"id": "account", "account_type": "free"}
+		if req.Method == http.MethodPost {
+			devices++
+			body = map[string]any{"id": "device" + strconv.Itoa(devices), "token": "token", "config": map[string]any{"peers": []any{map[string]any{"public_key": "peer"}}}}
+		}
+		b, err := json.Marshal(body)
+		qt.Check(t, err, qt.IsNil)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(string(b))),
+			Header:     make(http.Header),
+			Request:    req,
+		}, nil
+	})}
+
+	cacheDir := t.TempDir()
+	names, err := ListProfiles(cacheDir)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, names, qt.HasLen, 0)
+
+	provision := func(profile string) AccountInfo {
+		t.Helper()
+		dir, err := ProfileDir(cacheDir, profile)
+		qt.Assert(t, err, qt.IsNil)
+		info, err := Provision(context.Background(), slog.Default(), WarpOptions{CacheDir: dir, HTTPClient: client})
+		qt.Assert(t, err, qt.IsNil)
+		return info
+	}
+
+	work, personal := provision("work"), provision("personal")
+	qt.Assert(t, work.ID, qt.Not(qt.Equals), personal.ID)
+	// each profile loads its own identity again without registering
+	qt.Assert(t, provision("work").ID, qt.Equals, work.ID)
+	qt.Assert(t, provision("personal").ID, qt.Equals, personal.ID)
+	qt.Assert(t, devices, qt.Equals, 2)
+
+	names, err = ListProfiles(cacheDir)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, names, qt.DeepEquals, []string{"personal", "work"})
+
+	for _, name := range []string{"", "..", "a/b"} {
+		_, err := ProfileDir(cacheDir, name)
+		qt.Assert(t, err, qt.ErrorMatches, "invalid account profile name .*")
+	}
+}
@@ -0,0 +1,129 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"strconv"
+	"sync"
+
+	"github.com/bepass-org/warp-plus/warp"
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// AccountInfo summarizes a provisioned warp account.
+type AccountInfo struct {
+	ID          string `json:"id"`
+	AccountType string `json:"account_type"`
+	WarpPlus    bool   `json:"warp_plus"`
+	PremiumData int64  `json:"premium_data"`
+	Quota       int64  `json:"quota"`
+	Usage       int64  `json:"usage"`
+}
+
+// Provision registers the primary identity under opts.CacheDir, or loads it
+// when it is already there, applies opts.License to it and reports the
+// resulting account. With opts.Gool the secondary identity of the inner
+// tunnel is provisioned as well, so gool mode can run with NoAutoRegister.
+// No tunnel is started.
+func Provision(ctx context.Context, l *slog.Logger, opts WarpOptions) (AccountInfo, error) {
+	if opts.NoCache {
+		return AccountInfo{}, errors.New("provisioning needs a cache directory to keep the account in")
+	}
+	// provisioning is the deliberate registration NoAutoRegister defers to
+	opts.NoAutoRegister = false
+
+	ident, err := loadIdentity(ctx, l, opts, "primary")
+	if err != nil {
+		return AccountInfo{}, err
+	}
+	if opts.Gool {
+		if _, err := loadIdentity(ctx, l, opts, "secondary"); err != nil {
+			return AccountInfo{}, fmt.Errorf("secondary identity: %w", err)
+		}
+	}
+	return accountInfo(ident), nil
+}
+
+// DefaultProvisionConcurrency is how many accounts ProvisionAccounts
+// registers at once by default, few enough to stay clear of the rate limits
+// of the registration API.
+const DefaultProvisionConcurrency = 2
+
+// ProvisionAccounts provisions count accounts like Provision, each in its
+// own numbered directory under opts.CacheDir starting at 1, so they can be
+// used with --cache-dir DIR/N. At most concurrency accounts are registered
+// at once, each retrying on its own as set by opts.RegisterRetries. A
+// failed account doesn't stop the others: its AccountInfo is left empty and
+// its error joined into the returned one.
+func ProvisionAccounts(ctx context.Context, l *slog.Logger, opts WarpOptions, count, concurrency int) ([]AccountInfo, error) {
+	if count < 1 {
+		return nil, errors.New("account count must be at least 1")
+	}
+	if concurrency < 1 {
+		return nil, errors.New("provisioning concurrency must be at least 1")
+	}
+
+	infos := make([]AccountInfo, count)
+	errs := make([]error, count)
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := range count {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				errs[i] = fmt.Errorf("account %d: %w", i+1, ctx.Err())
+				return
+			}
+			defer func() { <-slots }()
+
+			accountOpts := opts
+			accountOpts.CacheDir = path.Join(opts.CacheDir, strconv.Itoa(i+1))
+			info, err := Provision(ctx, l.With("account", i+1), accountOpts)
+			if err != nil {
+				errs[i] = fmt.Errorf("account %d: %w", i+1, err)
+				return
+			}
+			infos[i] = info
+		}()
+	}
+	wg.Wait()
+	return infos, errors.Join(errs...)
+}
+
+func accountInfo(ident *warp.Identity) AccountInfo {
+	return AccountInfo{
+		ID:          ident.ID,
+		AccountType: ident.Account.AccountType,
+		WarpPlus:    ident.Account.WarpPlus,
+		PremiumData: ident.Account.PremiumData,
+		Quota:       ident.Account.Quota,
+		Usage:       ident.Account.Usage,
+	}
+}
+
+// ExportConfig returns the wireguard configuration normal warp mode would
+// use with the primary identity, registering it first if needed, so the
+// account can be used by other wireguard clients. The peer endpoint is
+// opts.Endpoint when set.
+func ExportConfig(ctx context.Context, l *slog.Logger, opts WarpOptions) (wiresocks.Configuration, error) {
+	ident, err := loadIdentity(ctx, l, opts, "primary")
+	if err != nil {
+		return wiresocks.Configuration{}, err
+	}
+	conf, err := warpConfig(ident, opts)
+	if err != nil {
+		return wiresocks.Configuration{}, err
+	}
+	if opts.Endpoint != "" {
+		for i := range conf.Peers {
+			conf.Peers[i].Endpoint = opts.Endpoint
+		}
+	}
+	return conf, nil
+}
@@ -0,0 +1,130 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestProvision(t *testing.T) {
+	account := map[string]any{"id": "account", "account_type": "free"}
+	var calls []string
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		path := req.URL.Path[strings.Index(req.URL.Path, "/reg"):]
+		calls = append(calls, req.Method+" "+path)
+
+		var body any = map[string]any{}
+		switch {
+		case req.Method == http.MethodPost && path == "/reg":
+			body = map[string]any{"id": "device", "token": "token", "config": map[string]any{"peers": []any{map[string]any{"public_key": "peer"}}}}
+		case req.Method == http.MethodPut && path == "/reg/device/account":
+			var update map[string]string
+			qt.Check(t, json.NewDecoder(req.Body).Decode(&update), qt.IsNil)
+			account["license"] = update["license"]
+			account["account_type"], account["warp_plus"], account["premium_data"] = "limited", true, 1<<40
+			body = account
+		case path == "/reg/device/account":
+			body = account
+		}
+		b, err := json.Marshal(body)
+		qt.Check(t, err, qt.IsNil)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(string(b))),
+			Header:     make(http.Header),
+			Request:    req,
+		}, nil
+	})}
+
+	opts := WarpOptions{CacheDir: t.TempDir(), HTTPClient: client}
+
+	// register
+	info, err := Provision(context.Background(), slog.Default(), opts)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, info, qt.DeepEquals, AccountInfo{ID: "device", AccountType: "free"})
+	qt.Assert(t, calls[0], qt.Equals, "POST /reg")
+
+	// apply a license to the cached account
+	calls = nil
+	opts.License = "license"
+	info, err = Provision(context.Background(), slog.Default(), opts)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, info, qt.DeepEquals, AccountInfo{ID: "device", AccountType: "limited", WarpPlus: true, PremiumData: 1 << 40})
+	qt.Assert(t, calls, qt.Contains, "PUT /reg/device/account")
+	qt.Assert(t, calls, qt.Not(qt.Contains), "POST /reg")
+
+	// report without changes
+	calls = nil
+	info, err = Provision(context.Background(), slog.Default(), opts)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, info.AccountType, qt.Equals, "limited")
+	qt.Assert(t, calls, qt.HasLen, 0)
+
+	// gool also needs the identity of the inner tunnel
+	opts.Gool = true
+	info, err = Provision(context.Background(), slog.Default(), opts)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, info.ID, qt.Equals, "device")
+	qt.Assert(t, calls, qt.Contains, "POST /reg")
+	_, err = os.Stat(filepath.Join(opts.CacheDir, "secondary", "wgcf-identity.json"))
+	qt.Assert(t, err, qt.IsNil)
+}
+
+func TestProvisionAccounts(t *testing.T) {
+	var active, peak atomic.Int32
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		n := active.Add(1)
+		defer active.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		var body any = map[string]any{"id": "account", "account_type": "free"}
+		if req.Method == http.MethodPost {
+			body = map[string]any{"id": "device", "token": "token", "config": map[string]any{"peers": []any{map[string]any{"public_key": "peer"}}}}
+		}
+		b, err := json.Marshal(body)
+		qt.Check(t, err, qt.IsNil)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(string(b))),
+			Header:     make(http.Header),
+			Request:    req,
+		}, nil
+	})}
+
+	opts := WarpOptions{CacheDir: t.TempDir(), HTTPClient: client}
+	infos, err := ProvisionAccounts(context.Background(), slog.Default(), opts, 6, 2)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, infos, qt.HasLen, 6)
+	qt.Assert(t, peak.Load(), qt.Equals, int32(2))
+	for i, info := range infos {
+		qt.Assert(t, info.ID, qt.Equals, "device")
+		_, err := os.Stat(filepath.Join(opts.CacheDir, strconv.Itoa(i+1), "primary", "wgcf-identity.json"))
+		qt.Assert(t, err, qt.IsNil)
+	}
+
+	_, err = ProvisionAccounts(context.Background(), slog.Default(), opts, 1, 0)
+	qt.Assert(t, err, qt.ErrorMatches, "provisioning concurrency must be at least 1")
+}
@@ -0,0 +1,345 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/bepass-org/warp-plus/psiphon"
+)
+
+const (
+	// PsiphonCountryAuto picks a psiphon country near the user's location.
+	PsiphonCountryAuto = "auto"
+	// defaultPsiphonCountry is used when the location can't be detected or
+	// has no psiphon country nearby.
+	defaultPsiphonCountry = "AT"
+)
+
+// nearbyCountries maps countries without psiphon egress to a close one
+// that has it.
+var nearbyCountries = map[string]string{
+	"AE": "IN", "AF": "IN", "BD": "IN", "LK": "IN", "NP": "IN", "PK": "IN", "SA": "IN",
+	"AL": "RS", "BA": "HR", "ME": "RS", "MK": "RS", "SI": "HR", "XK": "RS",
+	"AM": "BG", "AZ": "BG", "CY": "BG", "GE": "BG", "GR": "BG", "TR": "BG",
+	"BY": "PL", "LT": "LV", "MD": "RO", "UA": "PL",
+	"IQ": "RO", "IR": "RO", "JO": "RO", "LB": "RO", "SY": "RO",
+	"RU": "FI", "IS": "NO", "LU": "BE", "LI": "CH", "MT": "IT",
+	"DZ": "ES", "EG": "IT", "LY": "IT", "MA": "ES", "TN": "IT",
+	"CN": "JP", "KR": "JP", "TW": "JP", "HK": "SG",
+	"ID": "SG", "MY": "SG", "PH": "SG", "TH": "SG", "VN": "SG",
+	"NZ": "AU", "MX": "US", "BR": "US", "AR": "US", "CL": "US", "CO": "US",
+}
+
+// nearbyPsiphonCountry returns country if psiphon egresses there, otherwise
+// a supported country close to it.
+func nearbyPsiphonCountry(country string) string {
+	country = strings.ToUpper(country)
+	if slices.Contains(psiphon.Countries, country) {
+		return country
+	}
+	if c, ok := nearbyCountries[country]; ok {
+		return c
+	}
+	return defaultPsiphonCountry
+}
+
+// geoLookup returns the country the host appears to be in. It talks to
+// cloudflare directly with client, outside of any tunnel.
+var geoLookup = func(ctx context.Context, client *http.Client) (string, error) {
+	return traceLocation(ctx, client, traceURL)
+}
+
+// psiphonEgressCountry returns the country the psiphon egress appears to be
+// in, looked up through its SOCKS proxy at bind.
+func psiphonEgressCountry(ctx context.Context, bind netip.AddrPort, roots *x509.CertPool) (string, error) {
+	t := psiphonTransport(bind, roots)
+	defer t.CloseIdleConnections()
+	return traceLocation(ctx, &http.Client{Transport: t}, traceRequestURL(roots))
+}
+
+// psiphonTrace fetches the cloudflare trace through the psiphon SOCKS proxy
+// at bind.
+func psiphonTrace(ctx context.Context, bind netip.AddrPort, roots *x509.CertPool) (map[string]string, error) {
+	t := psiphonTransport(bind, roots)
+	defer t.CloseIdleConnections()
+	return getTrace(ctx, &http.Client{Transport: t}, traceRequestURL(roots))
+}
+
+// psiphonTransport returns a transport going through the psiphon SOCKS
+// proxy at bind.
+func psiphonTransport(bind netip.AddrPort, roots *x509.CertPool) *http.Transport {
+	addr := bind.Addr()
+	if addr.IsUnspecified() {
+		addr = netip.IPv6Loopback()
+		if bind.Addr().Is4() {
+			addr = netip.AddrFrom4([4]byte{127, 0, 0, 1})
+		}
+	}
+	t := checkTransport(nil, roots)
+	t.Proxy = http.ProxyURL(&url.URL{Scheme: "socks5", Host: netip.AddrPortFrom(addr, bind.Port()).String()})
+	return t
+}
+
+// traceLocation fetches the cloudflare trace at url with client and returns
+// the country it reports.
+func traceLocation(ctx context.Context, client *http.Client, url string) (string, error) {
+	trace, err := getTrace(ctx, client, url)
+	if err != nil {
+		return "", err
+	}
+	if trace["loc"] == "" {
+		return "", fmt.Errorf("location not found in trace response")
+	}
+	return trace["loc"], nil
+}
+
+// getTrace fetches the cloudflare trace at url with client.
+func getTrace(ctx context.Context, client *http.Client, url string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("trace request failed with status: %s", resp.Status)
+	}
+	return parseTrace(bufio.NewScanner(resp.Body))
+}
+
+// autoPsiphonCountry looks up the host location and picks a psiphon country
+// near it, falling back to a default country when the lookup fails.
+func autoPsiphonCountry(ctx context.Context, l *slog.Logger, client *http.Client) string {
+	loc, err := geoLookup(ctx, client)
+	if err != nil {
+		l.Warn("failed to detect location, using default psiphon country", "country", defaultPsiphonCountry, "error", err)
+		return defaultPsiphonCountry
+	}
+
+	country := nearbyPsiphonCountry(loc)
+	l.Info("picked psiphon country near detected location", "location", loc, "country", country)
+	return country
+}
+
+// psiphonStarter connects psiphon egressing in country. Closing the returned
+// tunnel must release the local proxy port.
+type psiphonStarter func(ctx context.Context, country string) (interface{ Close() }, error)
+
+// psiphonVerifyAttempts is how often psiphon is started before giving up on
+// an egress in the requested country.
+const psiphonVerifyAttempts = 3
+
+// verifyPsiphonCountry wraps start so it only returns a tunnel egressing in
+// the requested country, as reported by lookup. A tunnel landing elsewhere,
+// or whose country can't be looked up, is closed and started again, up to
+// attempts times in total, after which start fails rather than serve from
+// the wrong country. verified is called with the observed country.
+func verifyPsiphonCountry(l *slog.Logger, start psiphonStarter, lookup func(ctx context.Context) (string, error), attempts int, verified func(country string)) psiphonStarter {
+	return func(ctx context.Context, country string) (interface{ Close() }, error) {
+		var err error
+		for range attempts {
+			var t interface{ Close() }
+			t, err = start(ctx, country)
+			if err != nil {
+				return nil, err
+			}
+
+			var observed string
+			observed, err = lookup(ctx)
+			switch {
+			case err != nil:
+				err = fmt.Errorf("failed to look up the psiphon egress country: %w", err)
+			case !strings.EqualFold(observed, country):
+				err = fmt.Errorf("psiphon egress is in %s instead of %s", strings.ToUpper(observed), country)
+			default:
+				l.Info("verified psiphon egress country", "country", country)
+				verified(strings.ToUpper(observed))
+				return t, nil
+			}
+
+			t.Close()
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			l.Warn("psiphon egress country mismatch, reconnecting", "want", country, "error", err)
+		}
+		return nil, err
+	}
+}
+
+// startPsiphonWithFallback starts psiphon with start, giving up when it
+// fails or isn't connected after timeout, in which case fallback is called
+// with the reason to serve plain warp instead. It returns the psiphon
+// tunnel, or nil once it fell back.
+func startPsiphonWithFallback(ctx context.Context, l *slog.Logger, start psiphonStarter, country string, timeout time.Duration, fallback func(err error) error) (interface{ Close() }, error) {
+	// the tunnel lives on startCtx, so it is only cancelled on timeout
+	startCtx, cancel := context.WithCancel(ctx)
+	timer := time.AfterFunc(timeout, cancel)
+	t, err := start(startCtx, country)
+	timedOut := !timer.Stop()
+	if err == nil && !timedOut {
+		return t, nil
+	}
+	cancel()
+	if err == nil {
+		// connected just as the timeout hit
+		t.Close()
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if timedOut {
+		err = fmt.Errorf("psiphon didn't connect within %s", timeout)
+	}
+
+	l.Warn("psiphon failed, falling back to plain warp", "country", country, "error", err)
+	if err := fallback(err); err != nil {
+		return nil, fmt.Errorf("failed to fall back to plain warp: %w", err)
+	}
+	return nil, nil
+}
+
+// nextPsiphonCountry picks a random country of countries other than
+// current, current if there is none.
+func nextPsiphonCountry(countries []string, current string) string {
+	others := slices.DeleteFunc(slices.Clone(countries), func(c string) bool { return c == current })
+	if len(others) == 0 {
+		return current
+	}
+	return others[rand.N(len(others))]
+}
+
+// psiphonRotateBackoff bounds the wait before retrying a failed rotation.
+// The current tunnel keeps serving in the meantime.
+var psiphonRotateBackoff = [2]time.Duration{5 * time.Second, 5 * time.Minute}
+
+// rotatePsiphon reconnects psiphon to another of countries every interval
+// until ctx is done. The next tunnel is started next to the current one t,
+// which is only closed once start succeeded, so a failed rotation keeps
+// the current country and is retried with another one after a growing
+// backoff.
+func rotatePsiphon(ctx context.Context, l *slog.Logger, interval time.Duration, countries []string, country string, t interface{ Close() }, start psiphonStarter, rotated func(country string)) {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	backoff := psiphonRotateBackoff[0]
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		next := nextPsiphonCountry(countries, country)
+		l.Info("rotating psiphon egress", "from", country, "to", next)
+		nt, err := start(ctx, next)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			l.Warn("psiphon rotation failed, keeping the current country", "country", next, "retry", backoff, "error", err)
+			timer.Reset(backoff)
+			backoff = min(2*backoff, psiphonRotateBackoff[1])
+			continue
+		}
+
+		t.Close()
+		t, country = nt, next
+		rotated(country)
+		backoff = psiphonRotateBackoff[0]
+		timer.Reset(interval)
+	}
+}
+
+// psiphonFront serves the proxy address in front of a rotating psiphon
+// tunnel listening on an internal loopback port. Rotation brings the next
+// tunnel up on another port and switches the front to it, without giving
+// up the proxy address in between.
+type psiphonFront struct {
+	l      *slog.Logger
+	target atomic.Pointer[netip.AddrPort]
+}
+
+// startPsiphonFront listens on bind and forwards every connection to the
+// psiphon tunnel at target until ctx is done.
+func startPsiphonFront(ctx context.Context, l *slog.Logger, bind, target netip.AddrPort) (*psiphonFront, error) {
+	ln, err := net.Listen("tcp", bind.String())
+	if err != nil {
+		return nil, err
+	}
+	f := &psiphonFront{l: l}
+	f.setTarget(target)
+	context.AfterFunc(ctx, func() { ln.Close() })
+	go f.serve(ln)
+	return f, nil
+}
+
+// setTarget sends new connections to the psiphon tunnel at target.
+func (f *psiphonFront) setTarget(target netip.AddrPort) {
+	f.target.Store(&target)
+}
+
+func (f *psiphonFront) serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			f.l.Warn("psiphon front failed to accept", "error", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go f.forward(conn)
+	}
+}
+
+// forward relays conn to the current psiphon tunnel. Connections through a
+// tunnel that is rotated away end when it is closed.
+func (f *psiphonFront) forward(conn net.Conn) {
+	defer conn.Close()
+	upstream, err := net.Dial("tcp", f.target.Load().String())
+	if err != nil {
+		f.l.Debug("psiphon front failed to reach the tunnel", "error", err)
+		return
+	}
+	defer upstream.Close()
+
+	go func() {
+		io.Copy(upstream, conn)
+		upstream.(*net.TCPConn).CloseWrite()
+	}()
+	io.Copy(conn, upstream)
+}
+
+// freeLoopbackPort returns a loopback address with a currently unused port,
+// for a psiphon tunnel behind a psiphonFront.
+func freeLoopbackPort() (netip.AddrPort, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	addr := ln.Addr().(*net.TCPAddr).AddrPort()
+	return addr, ln.Close()
+}
@@ -0,0 +1,253 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/psiphon"
+	qt "github.com/frankban/quicktest"
+)
+
+type fakeTunnel struct {
+	mu     *sync.Mutex
+	closed *int
+}
+
+func (f fakeTunnel) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	*f.closed++
+}
+
+func TestNextPsiphonCountry(t *testing.T) {
+	for range 100 {
+		qt.Assert(t, nextPsiphonCountry([]string{"US", "US", "DE"}, "US"), qt.Equals, "DE")
+	}
+	qt.Assert(t, nextPsiphonCountry([]string{"US", "US"}, "US"), qt.Equals, "US")
+}
+
+func TestRotatePsiphon(t *testing.T) {
+	defer func(backoff [2]time.Duration) { psiphonRotateBackoff = backoff }(psiphonRotateBackoff)
+	psiphonRotateBackoff = [2]time.Duration{time.Millisecond, time.Millisecond}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	var closed, started int
+	opened := 1
+	var countries []string
+	start := func(_ context.Context, country string) (interface{ Close() }, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		// the current tunnel keeps serving until the next one is up
+		qt.Check(t, closed, qt.Equals, opened-1)
+		started++
+		if started == 2 {
+			return nil, errors.New("tunnel establishment timeout")
+		}
+		opened++
+		return fakeTunnel{&mu, &closed}, nil
+	}
+
+	done := make(chan struct{})
+	rotated := func(country string) {
+		mu.Lock()
+		defer mu.Unlock()
+		countries = append(countries, country)
+		if len(countries) == 2 {
+			cancel()
+		}
+	}
+	go func() {
+		defer close(done)
+		rotatePsiphon(ctx, slog.Default(), time.Millisecond, []string{"DE", "FR", "NL"}, "DE", fakeTunnel{&mu, &closed}, start, rotated)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("rotation didn't finish")
+	}
+
+	qt.Assert(t, countries, qt.HasLen, 2)
+	qt.Assert(t, countries[0], qt.Not(qt.Equals), "DE")
+	qt.Assert(t, countries[1], qt.Not(qt.Equals), countries[0])
+	for _, c := range countries {
+		qt.Assert(t, []string{"DE", "FR", "NL"}, qt.Contains, c)
+	}
+	// the failed rotation closed nothing, the replaced tunnels are closed
+	qt.Assert(t, started, qt.Equals, 3)
+	qt.Assert(t, closed, qt.Equals, 2)
+}
+
+func TestPsiphonFront(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// two tunnels answering with their name
+	tunnel := func(name string) netip.AddrPort {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		qt.Assert(t, err, qt.IsNil)
+		t.Cleanup(func() { ln.Close() })
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				conn.Write([]byte(name))
+				conn.Close()
+			}
+		}()
+		return ln.Addr().(*net.TCPAddr).AddrPort()
+	}
+	first, second := tunnel("first"), tunnel("second")
+
+	bind, err := freeLoopbackPort()
+	qt.Assert(t, err, qt.IsNil)
+	front, err := startPsiphonFront(ctx, slog.Default(), bind, first)
+	qt.Assert(t, err, qt.IsNil)
+
+	read := func() string {
+		conn, err := net.Dial("tcp", bind.String())
+		qt.Assert(t, err, qt.IsNil)
+		defer conn.Close()
+		b, err := io.ReadAll(conn)
+		qt.Assert(t, err, qt.IsNil)
+		return string(b)
+	}
+	qt.Assert(t, read(), qt.Equals, "first")
+	front.setTarget(second)
+	qt.Assert(t, read(), qt.Equals, "second")
+}
+
+func TestAutoPsiphonCountry(t *testing.T) {
+	orig := geoLookup
+	defer func() { geoLookup = orig }()
+
+	for _, tc := range []struct {
+		loc  string
+		err  error
+		want string
+	}{
+		{loc: "DE", want: "DE"},
+		{loc: "us", want: "US"},
+		{loc: "IR", want: "RO"},
+		{loc: "KR", want: "JP"},
+		{loc: "ZZ", want: defaultPsiphonCountry},
+		{err: errors.New("network is unreachable"), want: defaultPsiphonCountry},
+	} {
+		geoLookup = func(context.Context, *http.Client) (string, error) { return tc.loc, tc.err }
+		qt.Check(t, autoPsiphonCountry(context.Background(), slog.Default(), http.DefaultClient), qt.Equals, tc.want, qt.Commentf("loc %q", tc.loc))
+	}
+
+	for from, to := range nearbyCountries {
+		qt.Check(t, psiphon.Countries, qt.Contains, to, qt.Commentf("neighbour of %s", from))
+	}
+}
+
+func TestVerifyPsiphonCountry(t *testing.T) {
+	var mu sync.Mutex
+	var closed, started int
+	start := func(context.Context, string) (interface{ Close() }, error) {
+		started++
+		return fakeTunnel{&mu, &closed}, nil
+	}
+
+	for _, tc := range []struct {
+		name    string
+		results []string
+		started int
+		wantErr string
+	}{
+		{name: "match", results: []string{"de"}, started: 1},
+		{name: "retry", results: []string{"NL", "", "DE"}, started: 3},
+		{name: "give up", results: []string{"NL", "NL", "FR"}, started: 3, wantErr: "psiphon egress is in FR instead of DE"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			closed, started = 0, 0
+			var lookups int
+			lookup := func(context.Context) (string, error) {
+				loc := tc.results[lookups]
+				lookups++
+				if loc == "" {
+					return "", errors.New("i/o timeout")
+				}
+				return loc, nil
+			}
+			var verified string
+			verify := verifyPsiphonCountry(slog.Default(), start, lookup, psiphonVerifyAttempts, func(country string) { verified = country })
+
+			tun, err := verify(context.Background(), "DE")
+			qt.Assert(t, started, qt.Equals, tc.started)
+			if tc.wantErr != "" {
+				qt.Assert(t, err, qt.ErrorMatches, tc.wantErr)
+				qt.Assert(t, closed, qt.Equals, tc.started)
+				qt.Assert(t, verified, qt.Equals, "")
+				return
+			}
+			qt.Assert(t, err, qt.IsNil)
+			qt.Assert(t, tun, qt.IsNotNil)
+			// every tunnel but the verified one is closed
+			qt.Assert(t, closed, qt.Equals, tc.started-1)
+			qt.Assert(t, verified, qt.Equals, "DE")
+		})
+	}
+}
+
+func TestPsiphonFallback(t *testing.T) {
+	var mu sync.Mutex
+	var closed int
+	failing := func(context.Context, string) (interface{ Close() }, error) {
+		return nil, errors.New("no server entries")
+	}
+	hanging := func(ctx context.Context, _ string) (interface{ Close() }, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	working := func(ctx context.Context, _ string) (interface{ Close() }, error) {
+		return fakeTunnel{&mu, &closed}, nil
+	}
+
+	for _, tc := range []struct {
+		name     string
+		start    psiphonStarter
+		reason   string
+		fellBack bool
+	}{
+		{name: "bootstrap fails", start: failing, reason: "no server entries", fellBack: true},
+		{name: "bootstrap hangs", start: hanging, reason: "psiphon didn't connect within 20ms", fellBack: true},
+		{name: "connects", start: working},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var reason error
+			tun, err := startPsiphonWithFallback(context.Background(), slog.Default(), tc.start, "DE", 20*time.Millisecond, func(err error) error {
+				reason = err
+				return nil
+			})
+			qt.Assert(t, err, qt.IsNil)
+			if !tc.fellBack {
+				qt.Assert(t, tun, qt.IsNotNil)
+				qt.Assert(t, reason, qt.IsNil)
+				return
+			}
+			qt.Assert(t, tun, qt.IsNil)
+			qt.Assert(t, reason, qt.ErrorMatches, tc.reason)
+		})
+	}
+
+	// a failing fallback fails the start
+	_, err := startPsiphonWithFallback(context.Background(), slog.Default(), failing, "DE", time.Second, func(error) error {
+		return errors.New("address already in use")
+	})
+	qt.Assert(t, err, qt.ErrorMatches, "failed to fall back to plain warp: address already in use")
+}
@@ -0,0 +1,178 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// registrarTimeout bounds a single registration request.
+const registrarTimeout = 5 * time.Second
+
+// Registration is the record a Registrar announces.
+type Registration struct {
+	Instance string    `json:"instance"`
+	Bind     string    `json:"bind"`
+	Endpoint string    `json:"endpoint"`
+	Mode     string    `json:"mode"`
+	Healthy  bool      `json:"healthy"`
+	Updated  time.Time `json:"updated"`
+}
+
+// Registrar announces the running instance for service discovery. Every
+// change of the tunnel state is registered again and the instance is
+// deregistered when the tunnel goes down. The registry is updated in the
+// background so a slow one doesn't hold up the tunnel, changes made while
+// an update is under way are sent together afterwards.
+//
+// For an http or https target the registration is POSTed as JSON to it and
+// deregistered with a DELETE carrying the same record. For a file target,
+// e.g. file:///run/warp-plus, the record is written to <instance>.json in
+// that directory and removed again. It is safe for concurrent use.
+type Registrar struct {
+	l      *slog.Logger
+	target *url.URL
+	client *http.Client
+	// kick wakes up the sender, a pending wake-up covers later changes.
+	kick chan struct{}
+
+	mu  sync.Mutex
+	rec Registration
+	// up is whether the instance should be registered.
+	up bool
+
+	// sendMu serializes the requests to the registry.
+	sendMu     sync.Mutex
+	registered bool
+}
+
+// NewRegistrar returns a Registrar announcing the instance configured by
+// opts to target.
+func NewRegistrar(l *slog.Logger, target string, opts WarpOptions) (*Registrar, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid registrar url: %w", err)
+	}
+	switch {
+	case u.Scheme == "http" || u.Scheme == "https":
+	case u.Scheme == "file" && u.Path != "":
+	default:
+		return nil, fmt.Errorf("invalid registrar url %q, use http, https or file", target)
+	}
+	r := &Registrar{
+		l:      l.With("subsystem", "registrar"),
+		target: u,
+		client: &http.Client{Timeout: registrarTimeout},
+		kick:   make(chan struct{}, 1),
+		rec:    Registration{Instance: instanceID(), Bind: opts.Bind.String(), Mode: opts.mode()},
+	}
+	go func() {
+		for range r.kick {
+			r.sync(context.Background())
+		}
+	}()
+	return r, nil
+}
+
+// OnEvent updates the registration for e, to be chained into
+// WarpOptions.OnEvent. It doesn't wait for the registry.
+func (r *Registrar) OnEvent(e TunnelEvent) {
+	r.mu.Lock()
+	switch e.Kind {
+	case EventConnected, EventReconnected, EventEndpointSwitched:
+		r.rec.Endpoint, r.rec.Healthy, r.up = e.Endpoint, true, true
+	case EventPsiphonFallback:
+		r.rec.Mode = "warp"
+	case EventDisconnected:
+		r.up = false
+	default:
+		r.mu.Unlock()
+		return
+	}
+	r.rec.Updated = time.Now().UTC()
+	r.mu.Unlock()
+
+	select {
+	case r.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Deregister removes the registration, if any, waiting for the registry. It
+// is called on the disconnected event already, but the process may exit
+// before that event is handled.
+func (r *Registrar) Deregister(ctx context.Context) {
+	r.mu.Lock()
+	r.up = false
+	r.mu.Unlock()
+	r.sync(ctx)
+}
+
+// sync brings the registry up to date with the latest state.
+func (r *Registrar) sync(ctx context.Context) {
+	r.sendMu.Lock()
+	defer r.sendMu.Unlock()
+
+	r.mu.Lock()
+	rec, up := r.rec, r.up
+	r.mu.Unlock()
+
+	if up {
+		if err := r.send(ctx, http.MethodPost, rec); err != nil {
+			r.l.Warn("failed to register instance", "target", r.target.Redacted(), "error", err)
+			return
+		}
+		r.registered = true
+		return
+	}
+	if !r.registered {
+		return
+	}
+	r.registered = false
+	rec.Healthy, rec.Updated = false, time.Now().UTC()
+	if err := r.send(ctx, http.MethodDelete, rec); err != nil {
+		r.l.Warn("failed to deregister instance", "target", r.target.Redacted(), "error", err)
+	}
+}
+func (r *Registrar) send(ctx context.Context, method string, rec Registration) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	if r.target.Scheme == "file" {
+		path := filepath.Join(filepath.FromSlash(r.target.Path), rec.Instance+".json")
+		if method == http.MethodDelete {
+			return os.Remove(path)
+		}
+		// write and rename so readers never see a partial record
+		if err := os.WriteFile(path+".tmp", b, 0o644); err != nil {
+			return err
+		}
+		return os.Rename(path+".tmp", path)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, r.target.String(), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestRegistrar(t *testing.T) {
+	type call struct {
+		Method, Endpoint, Mode string
+		Healthy                bool
+	}
+	var mu sync.Mutex
+	var calls []call
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var rec Registration
+		qt.Check(t, json.NewDecoder(req.Body).Decode(&rec), qt.IsNil)
+		mu.Lock()
+		calls = append(calls, call{req.Method, rec.Endpoint, rec.Mode, rec.Healthy})
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	// the registry is updated in the background, wait for each update
+	waitCalls := func(n int) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+			mu.Lock()
+			got := len(calls)
+			mu.Unlock()
+			if got >= n {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("got %d registry calls, want %d", got, n)
+			}
+		}
+	}
+
+	opts := WarpOptions{Bind: netip.MustParseAddrPort("127.0.0.1:8086"), Psiphon: &PsiphonOptions{Country: "DE"}}
+	r, err := NewRegistrar(slog.Default(), srv.URL, opts)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, r.rec.Instance, qt.Equals, instanceID())
+
+	r.OnEvent(TunnelEvent{Kind: EventFailed, Err: errors.New("no handshake")})
+	r.OnEvent(TunnelEvent{Kind: EventConnected, Endpoint: "162.159.192.1:2408"})
+	waitCalls(1)
+	r.OnEvent(TunnelEvent{Kind: EventEndpointSwitched, Endpoint: "162.159.195.1:2408"})
+	waitCalls(2)
+	r.OnEvent(TunnelEvent{Kind: EventPsiphonFallback, Endpoint: "162.159.195.1:2408"})
+	waitCalls(3)
+	r.OnEvent(TunnelEvent{Kind: EventDisconnected, Endpoint: "162.159.195.1:2408"})
+	waitCalls(4)
+	// already deregistered
+	r.Deregister(context.Background())
+
+	qt.Assert(t, calls, qt.DeepEquals, []call{
+		{http.MethodPost, "162.159.192.1:2408", "psiphon", true},
+		{http.MethodPost, "162.159.195.1:2408", "psiphon", true},
+		{http.MethodPost, "162.159.195.1:2408", "warp", true},
+		{http.MethodDelete, "162.159.195.1:2408", "warp", false},
+	})
+}
+
+func TestRegistrarFile(t *testing.T) {
+	dir := t.TempDir()
+	r, err := NewRegistrar(slog.Default(), "file://"+filepath.ToSlash(dir), WarpOptions{Bind: netip.MustParseAddrPort("127.0.0.1:8086")})
+	qt.Assert(t, err, qt.IsNil)
+
+	r.OnEvent(TunnelEvent{Kind: EventConnected, Endpoint: "162.159.192.1:2408"})
+	r.sync(context.Background())
+	b, err := os.ReadFile(filepath.Join(dir, r.rec.Instance+".json"))
+	qt.Assert(t, err, qt.IsNil)
+	var rec Registration
+	qt.Assert(t, json.Unmarshal(b, &rec), qt.IsNil)
+	qt.Assert(t, rec.Bind, qt.Equals, "127.0.0.1:8086")
+	qt.Assert(t, rec.Mode, qt.Equals, "warp")
+	qt.Assert(t, rec.Healthy, qt.IsTrue)
+
+	// shutdown before the disconnected event
+	r.Deregister(context.Background())
+	entries, err := os.ReadDir(dir)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, entries, qt.HasLen, 0)
+
+	_, err = NewRegistrar(slog.Default(), "consul://localhost", WarpOptions{})
+	qt.Assert(t, err, qt.ErrorMatches, `invalid registrar url .*`)
+}
+
+func TestRegistrarSlowRegistry(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var endpoints []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var rec Registration
+		qt.Check(t, json.NewDecoder(req.Body).Decode(&rec), qt.IsNil)
+		<-release
+		mu.Lock()
+		endpoints = append(endpoints, req.Method+" "+rec.Endpoint)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	r, err := NewRegistrar(slog.Default(), srv.URL, WarpOptions{Bind: netip.MustParseAddrPort("127.0.0.1:8086")})
+	qt.Assert(t, err, qt.IsNil)
+
+	// the events don't wait for the stuck registry
+	start := time.Now()
+	for _, endpoint := range []string{"162.159.192.1:2408", "162.159.192.2:2408", "162.159.192.3:2408", "162.159.192.4:2408"} {
+		r.OnEvent(TunnelEvent{Kind: EventEndpointSwitched, Endpoint: endpoint})
+	}
+	qt.Assert(t, time.Since(start) < time.Second, qt.IsTrue)
+
+	// the changes made meanwhile are sent as one, the latest
+	close(release)
+	last := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(endpoints) == 0 {
+			return ""
+		}
+		return endpoints[len(endpoints)-1]
+	}
+	for deadline := time.Now().Add(5 * time.Second); last() != "POST 162.159.192.4:2408"; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("latest endpoint wasn't registered, last call %q", last())
+		}
+	}
+	mu.Lock()
+	qt.Assert(t, len(endpoints) <= 2, qt.IsTrue, qt.Commentf("%v", endpoints))
+	mu.Unlock()
+}
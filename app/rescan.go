@@ -0,0 +1,212 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/device"
+)
+
+// rescanInterval rate limits rescans, which send a burst of handshakes.
+const rescanInterval = time.Minute
+
+// rescanResult is the result of the rescan command.
+type rescanResult struct {
+	Previous string `json:"previous"`
+	Best     string `json:"best"`
+	Switched bool   `json:"switched"`
+	// Candidates is the number of endpoints that answered the scan.
+	Candidates int `json:"candidates"`
+}
+
+// ipcSetter is implemented by wireguard devices that can be reconfigured
+// while running.
+type ipcSetter interface {
+	IpcSet(string) error
+}
+
+// rescanHandler runs scan while the tunnel keeps serving and moves the
+// tunnel to the best endpoint found if it isn't the current one already.
+// The results are ranked by the endpoint history like at startup. verify,
+// when set, must accept the tunnel through the new endpoint, e.g. check its
+// colo. At most one rescan runs per rescanInterval.
+func rescanHandler(l *slog.Logger, tunnel *Tunnel, scan func(ctx context.Context) ([]ScanResult, error), verify func(context.Context) error) controlHandler {
+	var mu sync.Mutex
+	var last time.Time
+	return func(ctx context.Context) (any, error) {
+		mu.Lock()
+		if wait := rescanInterval - time.Since(last); wait > 0 {
+			mu.Unlock()
+			return nil, fmt.Errorf("rate limited, retry in %s", wait.Round(time.Second))
+		}
+		last = time.Now()
+		mu.Unlock()
+
+		current := tunnel.currentEndpoint()
+		if current == "" {
+			return nil, errNoTunnel
+		}
+
+		res, err := scan(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("scan failed: %w", err)
+		}
+		if len(res) == 0 {
+			return nil, errors.New("scan found no endpoints")
+		}
+		tunnel.history.rank(res)
+
+		result := rescanResult{Previous: current, Best: res[0].AddrPort.String(), Candidates: len(res)}
+		if result.Best == current {
+			l.Info("rescan found no better endpoint", "endpoint", current)
+			return result, nil
+		}
+		if err := tunnel.switchEndpoint(ctx, result.Best, verify); err != nil {
+			return nil, fmt.Errorf("failed to switch to %s: %w", result.Best, err)
+		}
+		l.Info("rescan switched endpoint", "from", current, "to", result.Best, "rtt", res[0].RTT)
+		result.Switched = true
+		return result, nil
+	}
+}
+
+// requireColo returns a check that the tunnel lands in colo, nil when colo
+// is empty.
+func requireColo(tunnel *Tunnel, colo string) func(context.Context) error {
+	if colo == "" {
+		return nil
+	}
+	return func(ctx context.Context) error {
+		trace, err := tunnel.trace(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to detect colo: %w", err)
+		}
+		if got := strings.ToUpper(trace["colo"]); got != colo {
+			return fmt.Errorf("connected to colo %s, want %s", got, colo)
+		}
+		return nil
+	}
+}
+
+// currentEndpoint returns the endpoint of the active tunnel, empty while it
+// is down.
+func (t *Tunnel) currentEndpoint() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.dev == nil {
+		return ""
+	}
+	return t.endpoint
+}
+
+// switchHandshakeTimeout bounds the wait for the handshake with a new
+// endpoint, long enough for a retransmitted initiation.
+var switchHandshakeTimeout = 12 * time.Second
+
+// switchEndpoint points the peer of the running device at endpoint, which
+// wireguard handles like roaming: the session continues and open
+// connections survive. The switch only sticks once a fresh handshake
+// completes through endpoint within switchHandshakeTimeout and verify, when
+// set, accepts the tunnel. Otherwise the peer goes back to its previous
+// endpoint. A switch counts as a reconnect.
+func (t *Tunnel) switchEndpoint(ctx context.Context, endpoint string, verify func(context.Context) error) error {
+	t.mu.Lock()
+	dev, tnet, previous := t.dev, t.tnet, t.endpoint
+	t.mu.Unlock()
+	if dev == nil {
+		return errNoTunnel
+	}
+	setter, ok := dev.(ipcSetter)
+	if !ok {
+		return errors.New("device can't be reconfigured")
+	}
+
+	get, err := dev.IpcGet()
+	if err != nil {
+		return err
+	}
+	var keys []string
+	scanner := bufio.NewScanner(strings.NewReader(get))
+	for scanner.Scan() {
+		if key, ok := strings.CutPrefix(scanner.Text(), "public_key="); ok {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return errors.New("device has no peers")
+	}
+	setEndpoint := func(endpoint string) error {
+		var request strings.Builder
+		for _, key := range keys {
+			fmt.Fprintf(&request, "public_key=%s\nupdate_only=true\nendpoint=%s\n", key, endpoint)
+		}
+		if err := setter.IpcSet(request.String()); err != nil {
+			return err
+		}
+		// don't wait for the next rekey to find out whether endpoint answers
+		for _, key := range keys {
+			initiateHandshake(dev, key)
+		}
+		return nil
+	}
+
+	switched := time.Now()
+	if err := setEndpoint(endpoint); err != nil {
+		return err
+	}
+	err = waitFreshHandshake(ctx, dev, switched)
+	if err == nil && verify != nil {
+		err = verify(ctx)
+	}
+	if err != nil {
+		if restoreErr := setEndpoint(previous); restoreErr != nil {
+			return errors.Join(err, fmt.Errorf("restore %s: %w", previous, restoreErr))
+		}
+		return err
+	}
+
+	t.activate(ctx, endpoint, dev, tnet, EventEndpointSwitched)
+	return nil
+}
+
+// initiateHandshake starts a handshake with the peer of dev with the hex
+// encoded public key right away. Devices other than wireguard's handshake
+// on their own schedule.
+func initiateHandshake(dev ipcGetter, publicKey string) {
+	d, ok := dev.(*device.Device)
+	if !ok {
+		return
+	}
+	var pk device.NoisePublicKey
+	if err := pk.FromHex(publicKey); err != nil {
+		return
+	}
+	if peer := d.LookupPeer(pk); peer != nil {
+		peer.SendHandshakeInitiation(false)
+	}
+}
+
+// waitFreshHandshake waits up to switchHandshakeTimeout for a handshake of
+// dev that completed after since.
+func waitFreshHandshake(ctx context.Context, dev ipcGetter, since time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, switchHandshakeTimeout)
+	defer cancel()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if stats, err := readDeviceStats(dev); err == nil && !stats.LastHandshake.Before(since) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return errors.New("no handshake with the new endpoint")
+		case <-ticker.C:
+		}
+	}
+}
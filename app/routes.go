@@ -0,0 +1,57 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// Route is a routing decision of the proxy, for auditing.
+type Route struct {
+	// Rule is the kind of rule, e.g. allowed-ip or direct.
+	Rule string
+	// Match is the destination, domain or prefix the rule applies to.
+	Match string
+	// Action is what happens to matching requests.
+	Action string
+}
+
+// EffectiveRoutes lists the routing decisions opts results in, in the order
+// the proxy applies them: the domain allowlist, the DNS bypass rules, the
+// destinations dialed directly, the NAT64 translation and finally the
+// allowed IPs of the tunnel.
+func EffectiveRoutes(opts WarpOptions) []Route {
+	var routes []Route
+	if opts.AllowDomains != nil {
+		for _, pattern := range opts.AllowDomains {
+			routes = append(routes, Route{"allow-domain", pattern, "allow"})
+		}
+		routes = append(routes, Route{"allow-domain", "*", "refuse"})
+	}
+	for _, rule := range opts.DNSBypass {
+		routes = append(routes, Route{"dns-bypass", rule.Suffix, fmt.Sprintf("resolve with %s, outside the tunnel", rule.Server)})
+	}
+	if len(opts.DirectPrefixes) > 0 {
+		routes = append(routes, Route{"direct", "localhost", "direct"})
+		for _, prefix := range opts.DirectPrefixes {
+			routes = append(routes, Route{"direct", prefix.String(), "direct"})
+		}
+	}
+	if opts.NAT64Prefix.IsValid() {
+		routes = append(routes, Route{"nat64", "0.0.0.0/0", "tunnel, translated into " + opts.NAT64Prefix.String()})
+	}
+	for _, prefix := range warpAllowedIPs {
+		routes = append(routes, Route{"allowed-ip", prefix.String(), "tunnel"})
+	}
+	return routes
+}
+
+// WriteRoutes writes routes as a table.
+func WriteRoutes(w io.Writer, routes []Route) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RULE\tMATCH\tACTION")
+	for _, r := range routes {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Rule, r.Match, r.Action)
+	}
+	return tw.Flush()
+}
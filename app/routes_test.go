@@ -0,0 +1,41 @@
+package app
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/bepass-org/warp-plus/wiresocks"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestEffectiveRoutes(t *testing.T) {
+	bypass, err := wiresocks.ParseDNSBypass("corp.internal=10.0.0.53")
+	qt.Assert(t, err, qt.IsNil)
+	opts := WarpOptions{
+		AllowDomains:   []string{"api.example.com", "*.example.net"},
+		DNSBypass:      []wiresocks.DNSBypass{bypass},
+		DirectPrefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fc00::/7")},
+		NAT64Prefix:    wiresocks.WellKnownNAT64Prefix,
+	}
+
+	var b strings.Builder
+	qt.Assert(t, WriteRoutes(&b, EffectiveRoutes(opts)), qt.IsNil)
+	qt.Assert(t, b.String(), qt.Equals, `RULE          MATCH            ACTION
+allow-domain  api.example.com  allow
+allow-domain  *.example.net    allow
+allow-domain  *                refuse
+dns-bypass    corp.internal    resolve with 10.0.0.53:53, outside the tunnel
+direct        localhost        direct
+direct        10.0.0.0/8       direct
+direct        fc00::/7         direct
+nat64         0.0.0.0/0        tunnel, translated into 64:ff9b::/96
+allowed-ip    0.0.0.0/0        tunnel
+allowed-ip    ::/0             tunnel
+`)
+
+	// without rules everything goes through the tunnel
+	b.Reset()
+	qt.Assert(t, WriteRoutes(&b, EffectiveRoutes(WarpOptions{})), qt.IsNil)
+	qt.Assert(t, b.String(), qt.Equals, "RULE        MATCH      ACTION\nallowed-ip  0.0.0.0/0  tunnel\nallowed-ip  ::/0       tunnel\n")
+}
@@ -0,0 +1,42 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Names of the secrets resolved through a SecretProvider.
+const (
+	SecretLicense    = "license"
+	SecretPrivateKey = "private_key"
+	SecretToken      = "token"
+	SecretTeamToken  = "team_token"
+)
+
+// ErrSecretNotFound is returned by a SecretProvider that doesn't hold the
+// requested secret, in which case the default flag/file value is used.
+var ErrSecretNotFound = errors.New("secret not found")
+
+// SecretProvider resolves secrets such as the license, private key and API
+// token at runtime, allowing library consumers to keep them in an external
+// secrets manager instead of argv or the cache directory.
+type SecretProvider interface {
+	Get(name string) (string, error)
+}
+
+// secret resolves name through the configured SecretProvider, falling back
+// to def when there is no provider or it doesn't hold the secret.
+func (o WarpOptions) secret(name, def string) (string, error) {
+	if o.Secrets == nil {
+		return def, nil
+	}
+
+	value, err := o.Secrets.Get(name)
+	switch {
+	case errors.Is(err, ErrSecretNotFound):
+		return def, nil
+	case err != nil:
+		return "", fmt.Errorf("failed to resolve secret %s: %w", name, err)
+	}
+	return value, nil
+}
@@ -0,0 +1,47 @@
+package app
+
+import (
+	"errors"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+type fakeSecrets map[string]string
+
+func (f fakeSecrets) Get(name string) (string, error) {
+	if name == "broken" {
+		return "", errors.New("vault sealed")
+	}
+	v, ok := f[name]
+	if !ok {
+		return "", ErrSecretNotFound
+	}
+	return v, nil
+}
+
+func TestSecretProvider(t *testing.T) {
+	opts := WarpOptions{
+		License: "flag-license",
+		Secrets: fakeSecrets{SecretLicense: "vault-license"},
+	}
+
+	license, err := opts.secret(SecretLicense, opts.License)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, license, qt.Equals, "vault-license")
+
+	token, err := opts.secret(SecretToken, "cached-token")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, token, qt.Equals, "cached-token")
+
+	_, err = opts.secret("broken", "")
+	qt.Assert(t, err, qt.ErrorMatches, "failed to resolve secret broken: vault sealed")
+}
+
+func TestSecretProviderDefault(t *testing.T) {
+	opts := WarpOptions{License: "flag-license"}
+
+	license, err := opts.secret(SecretLicense, opts.License)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, license, qt.Equals, "flag-license")
+}
@@ -0,0 +1,323 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/conn"
+)
+
+const socksHandshakeTimeout = 10 * time.Second
+
+// socksBind sends the outer wireguard packets through the UDP ASSOCIATE relay
+// of a SOCKS5 proxy, for networks where that is the only way out. The relay
+// lives as long as the TCP connection it was requested on. The proxy is
+// given as [user:password@]host:port, with credentials it may require
+// username/password authentication.
+type socksBind struct {
+	proxy string
+	// timeout bounds every write on the relay socket, 0 means no bound. It
+	// is set before Open.
+	timeout time.Duration
+
+	mu    sync.Mutex
+	ctrl  net.Conn
+	udp   *net.UDPConn
+	relay netip.AddrPort
+}
+
+var _ conn.Bind = (*socksBind)(nil)
+
+func newSocksBind(proxy string) *socksBind {
+	return &socksBind{proxy: proxy}
+}
+
+func (b *socksBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.udp != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+
+	addr, user, pass, err := parseSocksProxy(b.proxy)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl, err := net.DialTimeout("tcp", addr, socksHandshakeTimeout)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to connect to socks5 proxy: %w", err)
+	}
+	relay, err := socksAssociate(ctrl, user, pass)
+	if err != nil {
+		ctrl.Close()
+		return nil, 0, fmt.Errorf("socks5 proxy %s: %w", addr, err)
+	}
+	// proxies commonly answer with the unspecified address, meaning the
+	// relay is on the address the control connection went to
+	if relay.Addr().IsUnspecified() {
+		proxyAddr, _ := netip.ParseAddrPort(ctrl.RemoteAddr().String())
+		relay = netip.AddrPortFrom(proxyAddr.Addr(), relay.Port())
+	}
+
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{Port: int(port)})
+	if err != nil {
+		ctrl.Close()
+		return nil, 0, err
+	}
+
+	b.ctrl, b.udp, b.relay = ctrl, udp, relay
+	actualPort := uint16(udp.LocalAddr().(*net.UDPAddr).Port)
+	return []conn.ReceiveFunc{b.makeReceiveFunc(udp)}, actualPort, nil
+}
+
+// parseSocksProxy splits a proxy given as [user:password@]host:port.
+func parseSocksProxy(proxy string) (addr, user, pass string, err error) {
+	addr = proxy
+	if i := strings.LastIndexByte(proxy, '@'); i >= 0 {
+		var ok bool
+		user, pass, ok = strings.Cut(proxy[:i], ":")
+		if !ok || user == "" || len(user) > 255 || len(pass) > 255 {
+			return "", "", "", errors.New("invalid udp socks proxy credentials, use user:password@host:port")
+		}
+		addr = proxy[i+1:]
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", "", "", fmt.Errorf("invalid udp socks proxy: %w", err)
+	}
+	return addr, user, pass, nil
+}
+
+// socksAssociate negotiates a UDP ASSOCIATE on ctrl, authenticating with
+// user and pass if the proxy asks for it, and returns the address of the
+// relay.
+func socksAssociate(ctrl net.Conn, user, pass string) (netip.AddrPort, error) {
+	ctrl.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	defer ctrl.SetDeadline(time.Time{})
+
+	// version 5, no authentication and, with credentials, username/password
+	greeting := []byte{5, 1, 0}
+	if user != "" {
+		greeting = []byte{5, 2, 0, 2}
+	}
+	if _, err := ctrl.Write(greeting); err != nil {
+		return netip.AddrPort{}, err
+	}
+	var method [2]byte
+	if _, err := io.ReadFull(ctrl, method[:]); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if method[0] != 5 {
+		return netip.AddrPort{}, errors.New("not a socks5 proxy")
+	}
+	switch {
+	case method[1] == 0:
+	case method[1] == 2 && user != "":
+		if err := socksAuth(ctrl, user, pass); err != nil {
+			return netip.AddrPort{}, err
+		}
+	case user == "":
+		return netip.AddrPort{}, errors.New("proxy requires authentication, give the credentials as user:password@host:port")
+	default:
+		return netip.AddrPort{}, errors.New("proxy accepts neither username/password nor no authentication")
+	}
+
+	// the client address isn't known before sending, so leave it empty
+	if _, err := ctrl.Write([]byte{5, 3, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		return netip.AddrPort{}, err
+	}
+	var reply [3]byte
+	if _, err := io.ReadFull(ctrl, reply[:]); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if reply[1] != 0 {
+		return netip.AddrPort{}, fmt.Errorf("UDP ASSOCIATE not supported (reply %d)", reply[1])
+	}
+	host, port, err := readSocksHost(ctrl)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid UDP ASSOCIATE reply: %w", err)
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return netip.AddrPortFrom(addr.Unmap(), port), nil
+	}
+	// the relay may be named by a domain, which has to be resolved here
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(socksHandshakeTimeout))
+	defer cancel()
+	relay, err := resolveEndpoint(ctx, net.DefaultResolver, net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("UDP ASSOCIATE relay: %w", err)
+	}
+	return netip.ParseAddrPort(relay)
+}
+
+// socksAuth does the username/password authentication of RFC 1929.
+func socksAuth(ctrl net.Conn, user, pass string) error {
+	req := append([]byte{1, byte(len(user))}, user...)
+	req = append(append(req, byte(len(pass))), pass...)
+	if _, err := ctrl.Write(req); err != nil {
+		return err
+	}
+	var status [2]byte
+	if _, err := io.ReadFull(ctrl, status[:]); err != nil {
+		return err
+	}
+	if status[1] != 0 {
+		return errors.New("proxy rejected the credentials")
+	}
+	return nil
+}
+
+// readSocksHost reads a SOCKS5 address, returning the IP address or domain
+// name as host.
+func readSocksHost(r io.Reader) (string, uint16, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", 0, err
+	}
+	var host []byte
+	switch atyp[0] {
+	case 1:
+		host = make([]byte, 4)
+	case 3:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", 0, err
+		}
+		host = make([]byte, n[0])
+	case 4:
+		host = make([]byte, 16)
+	default:
+		return "", 0, fmt.Errorf("unsupported address type %d", atyp[0])
+	}
+	if _, err := io.ReadFull(r, host); err != nil {
+		return "", 0, err
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", 0, err
+	}
+	if atyp[0] == 3 {
+		return string(host), binary.BigEndian.Uint16(port[:]), nil
+	}
+	addr, _ := netip.AddrFromSlice(host)
+	return addr.Unmap().String(), binary.BigEndian.Uint16(port[:]), nil
+}
+
+// readSocksAddr reads a SOCKS5 address that must be an IP address.
+func readSocksAddr(r io.Reader) (netip.AddrPort, error) {
+	host, port, err := readSocksHost(r)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("unexpected domain address %q", host)
+	}
+	return netip.AddrPortFrom(addr, port), nil
+}
+
+// socksUDPHeader returns the header the relay expects in front of a
+// datagram to dst.
+func socksUDPHeader(dst netip.AddrPort) []byte {
+	hdr := []byte{0, 0, 0}
+	if dst.Addr().Is4() {
+		ip := dst.Addr().As4()
+		hdr = append(append(hdr, 1), ip[:]...)
+	} else {
+		ip := dst.Addr().As16()
+		hdr = append(append(hdr, 4), ip[:]...)
+	}
+	return binary.BigEndian.AppendUint16(hdr, dst.Port())
+}
+
+func (b *socksBind) makeReceiveFunc(udp *net.UDPConn) conn.ReceiveFunc {
+	buf := make([]byte, 1<<16)
+	return func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		for {
+			n, err := udp.Read(buf)
+			if err != nil {
+				return 0, err
+			}
+			// RSV, FRAG, then the address the datagram came from
+			if n < 4 || buf[2] != 0 {
+				continue // fragments aren't supported
+			}
+			r := bytes.NewReader(buf[3:n])
+			src, err := readSocksAddr(r)
+			if err != nil {
+				continue // wireguard only answers from IP addresses
+			}
+			sizes[0] = copy(packets[0], buf[n-r.Len():n])
+			eps[0] = &conn.StdNetEndpoint{AddrPort: src}
+			return 1, nil
+		}
+	}
+}
+
+func (b *socksBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.udp == nil {
+		return nil
+	}
+	err := b.udp.Close()
+	b.ctrl.Close()
+	b.ctrl, b.udp = nil, nil
+	return err
+}
+
+// SetTimeout bounds every write on the relay socket to d, 0 means no
+// bound. It is meant to be set before Open.
+func (b *socksBind) SetTimeout(d time.Duration) {
+	b.timeout = d
+}
+
+// SetMark is a no-op, the packets leave through the proxy.
+func (b *socksBind) SetMark(mark uint32) error {
+	return nil
+}
+
+func (b *socksBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	b.mu.Lock()
+	udp, relay := b.udp, b.relay
+	b.mu.Unlock()
+	if udp == nil {
+		return net.ErrClosed
+	}
+
+	dst, err := netip.ParseAddrPort(ep.DstToString())
+	if err != nil {
+		return err
+	}
+	hdr := socksUDPHeader(netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port()))
+	if b.timeout > 0 {
+		udp.SetWriteDeadline(time.Now().Add(b.timeout))
+	}
+	for _, buf := range bufs {
+		if _, err := udp.WriteToUDPAddrPort(append(hdr[:len(hdr):len(hdr)], buf...), relay); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *socksBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	addrPort, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+	return &conn.StdNetEndpoint{AddrPort: addrPort}, nil
+}
+
+func (b *socksBind) BatchSize() int {
+	return 1
+}
@@ -0,0 +1,191 @@
+package app
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/bepass-org/warp-plus/wireguard/conn"
+	qt "github.com/frankban/quicktest"
+)
+
+// socksStub is a SOCKS5 server answering UDP ASSOCIATE with reply, and
+// relaying datagrams to and from their targets when reply is 0.
+func socksStub(t *testing.T, reply byte) string {
+	return socksAuthStub(t, reply, "")
+}
+
+// socksAuthStub is socksStub requiring the user:password credentials when
+// auth is set, and then naming its relay by domain.
+func socksAuthStub(t *testing.T, reply byte, auth string) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	t.Cleanup(func() { ln.Close() })
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	qt.Assert(t, err, qt.IsNil)
+	t.Cleanup(func() { relay.Close() })
+
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		var greeting [2]byte
+		if _, err := io.ReadFull(c, greeting[:]); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(c, make([]byte, greeting[1])); err != nil {
+			return
+		}
+		if auth != "" {
+			c.Write([]byte{5, 2})
+			var hdr [2]byte
+			if _, err := io.ReadFull(c, hdr[:]); err != nil {
+				return
+			}
+			user := make([]byte, hdr[1])
+			io.ReadFull(c, user)
+			var n [1]byte
+			io.ReadFull(c, n[:])
+			pass := make([]byte, n[0])
+			io.ReadFull(c, pass)
+			if string(user)+":"+string(pass) != auth {
+				c.Write([]byte{1, 1})
+				return
+			}
+			c.Write([]byte{1, 0})
+		} else {
+			c.Write([]byte{5, 0})
+		}
+		var req [10]byte
+		if _, err := io.ReadFull(c, req[:]); err != nil || req[1] != 3 {
+			return
+		}
+		if reply != 0 {
+			c.Write([]byte{5, reply, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		// answer with the unspecified address, like many proxies do
+		port := relay.LocalAddr().(*net.UDPAddr).Port
+		if auth != "" {
+			c.Write(append([]byte{5, 0, 0, 3, 9}, "localhost"+string([]byte{byte(port >> 8), byte(port)})...))
+		} else {
+			c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, byte(port >> 8), byte(port)})
+		}
+
+		var client netip.AddrPort
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := relay.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			// the first sender is the client, its datagrams go to the target
+			if !client.IsValid() {
+				client = from
+			}
+			if from == client {
+				r := bytes.NewReader(buf[3:n])
+				dst, err := readSocksAddr(r)
+				if err != nil {
+					return
+				}
+				relay.WriteToUDPAddrPort(buf[n-r.Len():n], dst)
+				continue
+			}
+			// from a target, wrap and return to the client
+			relay.WriteToUDPAddrPort(append(socksUDPHeader(netip.AddrPortFrom(from.Addr().Unmap(), from.Port())), buf[:n]...), client)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestSocksBind(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	qt.Assert(t, err, qt.IsNil)
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := echo.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDPAddrPort(append([]byte("echo "), buf[:n]...), from)
+		}
+	}()
+
+	b := newSocksBind(socksStub(t, 0))
+	fns, _, err := b.Open(0)
+	qt.Assert(t, err, qt.IsNil)
+	defer b.Close()
+
+	ep, err := b.ParseEndpoint(echo.LocalAddr().String())
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, b.Send([][]byte{[]byte("hello")}, ep), qt.IsNil)
+
+	packets := [][]byte{make([]byte, 2048)}
+	sizes := make([]int, 1)
+	eps := make([]conn.Endpoint, 1)
+	n, err := fns[0](packets, sizes, eps)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, n, qt.Equals, 1)
+	qt.Assert(t, string(packets[0][:sizes[0]]), qt.Equals, "echo hello")
+	qt.Assert(t, eps[0].DstToString(), qt.Equals, echo.LocalAddr().String())
+
+	// receive functions fail once the bind is closed
+	qt.Assert(t, b.Close(), qt.IsNil)
+	_, err = fns[0](packets, sizes, eps)
+	qt.Assert(t, err, qt.ErrorIs, net.ErrClosed)
+}
+
+func TestSocksBindNoAssociate(t *testing.T) {
+	b := newSocksBind(socksStub(t, 7))
+	_, _, err := b.Open(0)
+	qt.Assert(t, err, qt.ErrorMatches, `socks5 proxy .*: UDP ASSOCIATE not supported \(reply 7\)`)
+}
+
+func TestSocksBindAuth(t *testing.T) {
+	proxy := socksAuthStub(t, 0, "user:secret")
+	b := newSocksBind("user:secret@" + proxy)
+	_, _, err := b.Open(0)
+	qt.Assert(t, err, qt.IsNil)
+	defer b.Close()
+	qt.Assert(t, b.relay.Addr().IsLoopback(), qt.IsTrue)
+
+	b = newSocksBind(socksAuthStub(t, 0, "user:secret"))
+	_, _, err = b.Open(0)
+	qt.Assert(t, err, qt.ErrorMatches, `socks5 proxy .*: proxy requires authentication, .*`)
+
+	b = newSocksBind("user:wrong@" + socksAuthStub(t, 0, "user:secret"))
+	_, _, err = b.Open(0)
+	qt.Assert(t, err, qt.ErrorMatches, `socks5 proxy .*: proxy rejected the credentials`)
+}
+
+func TestParseSocksProxy(t *testing.T) {
+	addr, user, pass, err := parseSocksProxy("127.0.0.1:1080")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, []string{addr, user, pass}, qt.DeepEquals, []string{"127.0.0.1:1080", "", ""})
+
+	addr, user, pass, err = parseSocksProxy("me:p@ss:word@proxy.example:1080")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, []string{addr, user, pass}, qt.DeepEquals, []string{"proxy.example:1080", "me", "p@ss:word"})
+
+	for _, proxy := range []string{"127.0.0.1", "me@127.0.0.1:1080", ":pass@127.0.0.1:1080"} {
+		_, _, _, err := parseSocksProxy(proxy)
+		qt.Assert(t, err, qt.IsNotNil, qt.Commentf("%s", proxy))
+	}
+}
+
+func TestDeviceOptionsInner(t *testing.T) {
+	devOpts := deviceOptions{socks: "127.0.0.1:1080", fwmark: 7, history: &endpointHistory{}}
+	qt.Assert(t, devOpts.inner().socks, qt.Equals, "")
+	qt.Assert(t, devOpts.inner().history, qt.IsNil)
+	qt.Assert(t, devOpts.inner().fwmark, qt.Equals, uint32(7))
+}
@@ -0,0 +1,143 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// DefaultStatsdInterval is how often metrics are pushed to StatsD.
+const DefaultStatsdInterval = 10 * time.Second
+
+// StatsdOptions configure pushing metrics to a StatsD server.
+type StatsdOptions struct {
+	// Addr is the host:port of the StatsD server, metrics are sent over
+	// UDP.
+	Addr string
+	// Prefix is prepended to every metric name, "warp_plus." when empty.
+	Prefix string
+	// Interval is how often metrics are pushed, DefaultStatsdInterval when
+	// 0.
+	Interval time.Duration
+	// Tags adds DogStatsD tags, e.g. the mode. Plain StatsD servers don't
+	// support them.
+	Tags bool
+}
+
+// statsdPusher sends the tunnel metrics to a StatsD server. Byte, connection
+// and reconnect counts are sent as counters with the change since the last
+// push, the handshake age as a gauge.
+type statsdPusher struct {
+	conn   net.Conn
+	prefix string
+	tags   string
+	t      *Tunnel
+
+	rx, tx, dials, dialErrors, reconnects uint64
+	closes                                map[string]uint64
+}
+
+func newStatsdPusher(opts StatsdOptions, mode string, t *Tunnel) (*statsdPusher, error) {
+	conn, err := net.Dial("udp", opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &statsdPusher{conn: conn, prefix: opts.Prefix, t: t}
+	if p.prefix == "" {
+		p.prefix = "warp_plus."
+	}
+	if opts.Tags {
+		p.tags = "|#mode:" + mode
+	}
+	return p, nil
+}
+
+// counterDelta returns how much a counter grew since last. Device counters
+// restart from zero on a reconnect, in which case all of cur is new.
+func counterDelta(cur, last uint64) uint64 {
+	if cur < last {
+		return cur
+	}
+	return cur - last
+}
+
+// push sends the current metrics in a single datagram.
+func (p *statsdPusher) push() error {
+	stats := p.t.Stats()
+	p.t.mu.Lock()
+	reconnects := p.t.reconnects
+	p.t.mu.Unlock()
+	dials, dialErrors := p.t.dials.Load(), p.t.dialErrors.Load()
+	closes := p.t.CloseReasons()
+
+	// the result or reason becomes a tag with DogStatsD and a name suffix
+	// otherwise
+	var b strings.Builder
+	metric := func(name, tag, value string, n any, typ string) {
+		tags := p.tags
+		if value != "" && tags != "" {
+			tags += "," + tag + ":" + value
+		} else if value != "" {
+			name += "." + value
+		}
+		fmt.Fprintf(&b, "%s%s:%v|%s%s\n", p.prefix, name, n, typ, tags)
+	}
+
+	metric("rx_bytes", "", "", counterDelta(stats.RxBytes, p.rx), "c")
+	metric("tx_bytes", "", "", counterDelta(stats.TxBytes, p.tx), "c")
+	metric("connections", "result", "ok", dials-p.dials, "c")
+	metric("connections", "result", "error", dialErrors-p.dialErrors, "c")
+	for _, reason := range wiresocks.CloseReasons {
+		if n := closes[reason] - p.closes[reason]; n > 0 {
+			metric("connection_closes", "reason", reason, n, "c")
+		}
+	}
+	metric("reconnects", "", "", reconnects-p.reconnects, "c")
+	if !stats.LastHandshake.IsZero() {
+		metric("handshake_age_seconds", "", "", int64(time.Since(stats.LastHandshake).Seconds()), "g")
+	}
+
+	if _, err := p.conn.Write([]byte(strings.TrimSuffix(b.String(), "\n"))); err != nil {
+		return err
+	}
+	p.rx, p.tx = stats.RxBytes, stats.TxBytes
+	p.dials, p.dialErrors, p.reconnects = dials, dialErrors, reconnects
+	p.closes = closes
+	return nil
+}
+
+// runStatsd pushes metrics every interval until ctx is done.
+func runStatsd(ctx context.Context, l *slog.Logger, opts StatsdOptions, mode string, t *Tunnel) error {
+	p, err := newStatsdPusher(opts, mode, t)
+	if err != nil {
+		return err
+	}
+
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = DefaultStatsdInterval
+	}
+	l = l.With("subsystem", "statsd")
+	go func() {
+		defer p.conn.Close()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := p.push(); err != nil {
+					l.Debug("failed to push metrics", "addr", opts.Addr, "error", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,71 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wiresocks"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestStatsdPush(t *testing.T) {
+	ln, err := net.ListenPacket("udp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	defer ln.Close()
+	read := func() []string {
+		buf := make([]byte, 1500)
+		ln.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := ln.ReadFrom(buf)
+		qt.Assert(t, err, qt.IsNil)
+		return strings.Split(string(buf[:n]), "\n")
+	}
+
+	tunnel := &Tunnel{}
+	dev := &countingDevice{}
+	tunnel.connected(context.Background(), "162.159.192.1:2408", dev, nil)
+	dev.transfer(100)
+	tunnel.countDial("tcp", "example.com:443", nil)
+	tunnel.countDial("tcp", "example.com:443", nil)
+	tunnel.countDial("tcp", "example.org:443", errors.New("refused"))
+	tunnel.countClose(wiresocks.CloseRemoteEOF)
+	tunnel.countClose(wiresocks.CloseRemoteEOF)
+	tunnel.countClose(wiresocks.CloseIdleTimeout)
+
+	p, err := newStatsdPusher(StatsdOptions{Addr: ln.LocalAddr().String(), Tags: true}, "warp", tunnel)
+	qt.Assert(t, err, qt.IsNil)
+	defer p.conn.Close()
+
+	qt.Assert(t, p.push(), qt.IsNil)
+	lines := read()
+	qt.Assert(t, lines[:7], qt.DeepEquals, []string{
+		"warp_plus.rx_bytes:200|c|#mode:warp",
+		"warp_plus.tx_bytes:100|c|#mode:warp",
+		"warp_plus.connections:2|c|#mode:warp,result:ok",
+		"warp_plus.connections:1|c|#mode:warp,result:error",
+		"warp_plus.connection_closes:2|c|#mode:warp,reason:remote_eof",
+		"warp_plus.connection_closes:1|c|#mode:warp,reason:idle_timeout",
+		"warp_plus.reconnects:0|c|#mode:warp",
+	})
+	qt.Assert(t, lines[7], qt.Matches, `warp_plus\.handshake_age_seconds:\d+\|g\|#mode:warp`)
+
+	// the counters of a new device start over, they are all new
+	dev = &countingDevice{}
+	tunnel.connected(context.Background(), "162.159.192.1:2408", dev, nil)
+	dev.transfer(10)
+	tunnel.countClose(wiresocks.CloseRemoteEOF)
+	p.tags = ""
+	qt.Assert(t, p.push(), qt.IsNil)
+	lines = read()
+	qt.Assert(t, lines[:6], qt.DeepEquals, []string{
+		"warp_plus.rx_bytes:20|c",
+		"warp_plus.tx_bytes:10|c",
+		"warp_plus.connections.ok:0|c",
+		"warp_plus.connections.error:0|c",
+		"warp_plus.connection_closes.remote_eof:1|c",
+		"warp_plus.reconnects:1|c",
+	})
+}
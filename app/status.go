@@ -0,0 +1,289 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
+)
+
+const statusRefreshInterval = 5 * time.Second
+
+// Status is the connection state written to the status file.
+type Status struct {
+	Mode          string    `json:"mode"`
+	Endpoint      string    `json:"endpoint"`
+	EgressIP      string    `json:"egress_ip,omitempty"`
+	Country       string    `json:"country,omitempty"`
+	RxBytes       uint64    `json:"rx_bytes"`
+	TxBytes       uint64    `json:"tx_bytes"`
+	LastHandshake time.Time `json:"last_handshake,omitzero"`
+	HandshakeAge  float64   `json:"handshake_age_sec"`
+	Reconnects    int       `json:"reconnects"`
+	// Healthy is false once the last handshake is older than the max
+	// handshake age.
+	Healthy bool `json:"healthy"`
+	// Paused is true while the proxy refuses new requests.
+	Paused bool `json:"paused"`
+	// EndpointHistory are the handshake outcomes of the endpoint across runs.
+	EndpointHistory *EndpointRecord `json:"endpoint_history,omitempty"`
+	Updated         time.Time       `json:"updated"`
+}
+
+// ipcGetter is implemented by *device.Device.
+type ipcGetter interface {
+	IpcGet() (string, error)
+}
+
+// deviceStats holds the counters reported by a wireguard device.
+type deviceStats struct {
+	RxBytes       uint64
+	TxBytes       uint64
+	LastHandshake time.Time
+}
+
+// readDeviceStats sums the transfer counters of all peers of dev and returns
+// the most recent handshake time.
+func readDeviceStats(dev ipcGetter) (deviceStats, error) {
+	get, err := dev.IpcGet()
+	if err != nil {
+		return deviceStats{}, err
+	}
+
+	var stats deviceStats
+	var hsSec, hsNsec int64
+	scanner := bufio.NewScanner(strings.NewReader(get))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case "rx_bytes":
+			n, _ := strconv.ParseUint(value, 10, 64)
+			stats.RxBytes += n
+		case "tx_bytes":
+			n, _ := strconv.ParseUint(value, 10, 64)
+			stats.TxBytes += n
+		case "last_handshake_time_sec":
+			hsSec, _ = strconv.ParseInt(value, 10, 64)
+		case "last_handshake_time_nsec":
+			hsNsec, _ = strconv.ParseInt(value, 10, 64)
+			if hs := time.Unix(hsSec, hsNsec); hsSec != 0 && hs.After(stats.LastHandshake) {
+				stats.LastHandshake = hs
+			}
+		}
+	}
+	return stats, scanner.Err()
+}
+
+// statusFile keeps a JSON snapshot of the connection state on disk. The file
+// is atomically replaced on every update so readers never see a partial
+// write. A nil *statusFile ignores all calls.
+type statusFile struct {
+	l    *slog.Logger
+	path string
+	// traceCA verifies the egress IP lookup when set.
+	traceCA *x509.CertPool
+	// traceURL is the trace endpoint of the egress IP lookup.
+	traceURL string
+
+	mu     sync.Mutex
+	health handshakeHealth
+	status Status
+	dev    ipcGetter
+	up     bool
+	closed bool
+	cancel context.CancelFunc
+}
+
+func newStatusFile(l *slog.Logger, path, mode string, health handshakeHealth) *statusFile {
+	if path == "" {
+		return nil
+	}
+	return &statusFile{
+		l:      l.With("subsystem", "status"),
+		path:   path,
+		health: health,
+		status: Status{Mode: mode},
+	}
+}
+
+// connected records a new tunnel, counting it as a reconnect if one was
+// already established, and refreshes the device counters periodically
+// until the next call or ctx is done. The egress IP is looked up through
+// tnet in the background when tnet is not nil.
+func (s *statusFile) connected(ctx context.Context, endpoint string, dev ipcGetter, tnet *netstack.Net) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	if s.cancel != nil {
+		s.cancel()
+	}
+	ctx, s.cancel = context.WithCancel(ctx)
+	if s.up {
+		s.status.Reconnects++
+	}
+	s.up = true
+	s.dev = dev
+	s.status.Endpoint = endpoint
+	s.status.EgressIP = ""
+	s.status.EndpointHistory = nil
+	s.refreshLocked()
+	s.mu.Unlock()
+
+	go func() {
+		if tnet != nil {
+			if trace, err := fetchTrace(ctx, tnet, s.traceURL, s.traceCA); err == nil {
+				s.mu.Lock()
+				// a reconnect may have happened while waiting on the trace
+				if ctx.Err() == nil {
+					s.status.EgressIP = trace["ip"]
+					s.refreshLocked()
+				}
+				s.mu.Unlock()
+			} else {
+				s.l.Debug("failed to detect egress ip", "error", err)
+			}
+		}
+
+		ticker := time.NewTicker(statusRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.mu.Lock()
+				s.refreshLocked()
+				s.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// setCountry records the psiphon egress country.
+func (s *statusFile) setCountry(country string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Country = country
+	s.refreshLocked()
+}
+
+// setMode records the mode the proxy is serving in.
+func (s *statusFile) setMode(mode string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Mode = mode
+	s.refreshLocked()
+}
+
+// setPaused records whether the proxy is paused.
+func (s *statusFile) setPaused(paused bool) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Paused = paused
+	s.refreshLocked()
+}
+
+// setEndpointRecord records the handshake history of the current endpoint.
+func (s *statusFile) setEndpointRecord(r EndpointRecord) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.EndpointHistory = &r
+	s.refreshLocked()
+}
+
+// refreshLocked updates the device counters and rewrites the file.
+func (s *statusFile) refreshLocked() {
+	if s.closed {
+		return
+	}
+
+	if s.dev != nil {
+		if stats, err := readDeviceStats(s.dev); err == nil {
+			s.status.RxBytes, s.status.TxBytes = stats.RxBytes, stats.TxBytes
+			s.status.LastHandshake = stats.LastHandshake
+			s.status.HandshakeAge = 0
+			if !stats.LastHandshake.IsZero() {
+				s.status.HandshakeAge = time.Since(stats.LastHandshake).Seconds()
+			}
+			s.status.Healthy = s.health.check(stats.LastHandshake, stats.TxBytes) == nil
+		}
+	}
+	s.status.Updated = time.Now()
+
+	if err := s.writeLocked(); err != nil {
+		s.l.Warn("failed to write status file", "path", s.path, "error", err)
+	}
+}
+
+func (s *statusFile) writeLocked() error {
+	f, err := os.CreateTemp(filepath.Dir(s.path), "."+filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(s.status); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), s.path)
+}
+
+// close stops updating the status file and removes it.
+func (s *statusFile) close() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.closed = true
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		s.l.Warn("failed to remove status file", "path", s.path, "error", err)
+	}
+}
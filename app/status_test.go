@@ -0,0 +1,65 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+type fakeDevice string
+
+func (f fakeDevice) IpcGet() (string, error) {
+	return string(f), nil
+}
+
+func readStatus(t *testing.T, path string) Status {
+	b, err := os.ReadFile(path)
+	qt.Assert(t, err, qt.IsNil)
+
+	var s Status
+	qt.Assert(t, json.Unmarshal(b, &s), qt.IsNil)
+	return s
+}
+
+func TestStatusFileReconnect(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "status.json")
+	st := newStatusFile(slog.Default(), path, "warp", handshakeHealth{maxAge: DefaultMaxHandshakeAge})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	st.connected(ctx, "162.159.192.1:2408", fakeDevice("public_key=a\nlast_handshake_time_sec=1700000000\nlast_handshake_time_nsec=0\ntx_bytes=10\nrx_bytes=20\n"), nil)
+	s := readStatus(t, path)
+	qt.Assert(t, s.Mode, qt.Equals, "warp")
+	qt.Assert(t, s.Endpoint, qt.Equals, "162.159.192.1:2408")
+	qt.Assert(t, s.Reconnects, qt.Equals, 0)
+	qt.Assert(t, s.TxBytes, qt.Equals, uint64(10))
+	qt.Assert(t, s.RxBytes, qt.Equals, uint64(20))
+	qt.Assert(t, s.LastHandshake.Unix(), qt.Equals, int64(1700000000))
+
+	st.connected(ctx, "162.159.195.7:908", fakeDevice("public_key=a\ntx_bytes=1\nrx_bytes=2\n"), nil)
+	s = readStatus(t, path)
+	qt.Assert(t, s.Endpoint, qt.Equals, "162.159.195.7:908")
+	qt.Assert(t, s.Reconnects, qt.Equals, 1)
+	qt.Assert(t, s.TxBytes, qt.Equals, uint64(1))
+	qt.Assert(t, s.LastHandshake.IsZero(), qt.IsTrue)
+
+	// no temporary files are left behind
+	entries, err := os.ReadDir(filepath.Dir(path))
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, entries, qt.HasLen, 1)
+
+	st.close()
+	_, err = os.Stat(path)
+	qt.Assert(t, os.IsNotExist(err), qt.IsTrue)
+
+	// updates after close don't recreate the file
+	st.connected(ctx, "162.159.192.1:2408", fakeDevice(""), nil)
+	_, err = os.Stat(path)
+	qt.Assert(t, os.IsNotExist(err), qt.IsTrue)
+}
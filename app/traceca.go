@@ -0,0 +1,57 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// LoadTraceCA reads the PEM certificates in path into a pool for
+// WarpOptions.TraceCA. A self-signed server certificate pins that exact
+// certificate, a CA certificate everything it issued.
+func LoadTraceCA(path string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// checkTransport returns the transport of the connectivity checks, which
+// verifies TLS servers against roots instead of the system store when set.
+func checkTransport(dial func(ctx context.Context, network, address string) (net.Conn, error), roots *x509.CertPool) *http.Transport {
+	t := &http.Transport{DialContext: dial}
+	if roots != nil {
+		t.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+	return t
+}
+
+// traceURLFor returns the trace endpoint of the lookups through the tunnel:
+// testURL when it is a trace endpoint itself, so the colo and egress IP are
+// those seen by the connectivity test, otherwise the default one. Other test
+// URLs don't answer in the trace format.
+func traceURLFor(testURL string, roots *x509.CertPool) string {
+	if u, err := url.Parse(testURL); err == nil && u.Host != "" && u.Path == "/cdn-cgi/trace" {
+		return testURL
+	}
+	return traceRequestURL(roots)
+}
+
+// traceRequestURL returns the URL of the trace endpoint, over TLS when it is
+// verified against pinned roots.
+func traceRequestURL(roots *x509.CertPool) string {
+	if roots != nil {
+		return traceTLSURL
+	}
+	return traceURL
+}
@@ -0,0 +1,79 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func selfSignedCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	qt.Assert(t, err, qt.IsNil)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "warp-plus test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	qt.Assert(t, err, qt.IsNil)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTraceCA(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ip=192.0.2.1\ncolo=fra\n"))
+	})
+
+	cert := selfSignedCert(t)
+	pinned := httptest.NewUnstartedServer(handler)
+	pinned.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	pinned.StartTLS()
+	defer pinned.Close()
+
+	// an interceptor with a certificate of its own
+	intercepted := httptest.NewTLSServer(handler)
+	defer intercepted.Close()
+
+	path := filepath.Join(t.TempDir(), "trace-ca.pem")
+	qt.Assert(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600), qt.IsNil)
+	roots, err := LoadTraceCA(path)
+	qt.Assert(t, err, qt.IsNil)
+
+	var d net.Dialer
+	client := http.Client{Transport: checkTransport(d.DialContext, roots)}
+
+	resp, err := client.Get(pinned.URL)
+	qt.Assert(t, err, qt.IsNil)
+	resp.Body.Close()
+	qt.Assert(t, resp.StatusCode, qt.Equals, http.StatusOK)
+
+	_, err = client.Get(intercepted.URL)
+	qt.Assert(t, err, qt.ErrorMatches, ".*certificate signed by unknown authority")
+
+	qt.Assert(t, traceRequestURL(roots), qt.Equals, traceTLSURL)
+	qt.Assert(t, traceRequestURL(nil), qt.Equals, traceURL)
+
+	qt.Assert(t, traceURLFor("https://example.com/cdn-cgi/trace", roots), qt.Equals, "https://example.com/cdn-cgi/trace")
+	qt.Assert(t, traceURLFor("http://example.com/generate_204", nil), qt.Equals, traceURL)
+	qt.Assert(t, traceURLFor("https://example.com/generate_204", roots), qt.Equals, traceTLSURL)
+
+	qt.Assert(t, os.WriteFile(path, []byte("not a certificate"), 0o600), qt.IsNil)
+	_, err = LoadTraceCA(path)
+	qt.Assert(t, err, qt.ErrorMatches, "no certificates found in .*")
+}
@@ -0,0 +1,60 @@
+package app
+
+import (
+	"context"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const tracerName = "github.com/bepass-org/warp-plus/app"
+
+// startRootSpan starts the span covering the whole startup. Without a
+// TracerProvider it is a no-op span, and so are all of its children.
+func startRootSpan(ctx context.Context, opts WarpOptions) (context.Context, trace.Span) {
+	tp := opts.TracerProvider
+	if tp == nil {
+		tp = noop.NewTracerProvider()
+	}
+	return tp.Tracer(tracerName).Start(ctx, "warp.startup", trace.WithAttributes(
+		attribute.String("warp.mode", opts.mode()),
+		attribute.String("warp.endpoint", opts.Endpoint),
+	))
+}
+
+// startSpan starts a child of the span in ctx using that span's provider.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err, if any, and ends span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// firstDialHook returns a dial hook that traces the time from the proxy
+// starting until the first successful dial through it.
+func firstDialHook(ctx context.Context) func(network, address string, err error) {
+	if !trace.SpanFromContext(ctx).SpanContext().IsValid() {
+		return nil
+	}
+
+	_, span := startSpan(ctx, "proxy.first_dial")
+	var once sync.Once
+	return func(network, address string, err error) {
+		if err != nil {
+			return
+		}
+		once.Do(func() {
+			span.SetAttributes(attribute.String("net.destination", address))
+			span.End()
+		})
+	}
+}
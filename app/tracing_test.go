@@ -0,0 +1,46 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestStartupSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	ctx, root := startRootSpan(context.Background(), WarpOptions{TracerProvider: tp, Gool: true})
+	_, child := startSpan(ctx, "account.load")
+	endSpan(child, errors.New("boom"))
+
+	hook := firstDialHook(ctx)
+	hook("tcp", "example.com:443", errors.New("refused"))
+	hook("tcp", "example.com:443", nil)
+	hook("tcp", "example.org:443", nil)
+	endSpan(root, nil)
+
+	spans := recorder.Ended()
+	qt.Assert(t, spans, qt.HasLen, 3)
+
+	qt.Assert(t, spans[0].Name(), qt.Equals, "account.load")
+	qt.Assert(t, spans[0].Status().Code, qt.Equals, codes.Error)
+	qt.Assert(t, spans[0].Parent().SpanID(), qt.Equals, root.SpanContext().SpanID())
+
+	qt.Assert(t, spans[1].Name(), qt.Equals, "proxy.first_dial")
+	qt.Assert(t, spans[1].Attributes()[0].Value.AsString(), qt.Equals, "example.com:443")
+
+	qt.Assert(t, spans[2].Name(), qt.Equals, "warp.startup")
+	qt.Assert(t, spans[2].Attributes()[0].Value.AsString(), qt.Equals, "gool")
+}
+
+func TestNoTracerProvider(t *testing.T) {
+	ctx, root := startRootSpan(context.Background(), WarpOptions{})
+	qt.Assert(t, root.SpanContext().IsValid(), qt.IsFalse)
+	qt.Assert(t, firstDialHook(ctx), qt.IsNil)
+}
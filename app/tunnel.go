@@ -0,0 +1,435 @@
+package app
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// statsRefreshInterval is how stale the counters returned by Tunnel.Stats
+// may be.
+const statsRefreshInterval = time.Second
+
+// errNoTunnel is returned by runtime queries before a tunnel is up, or in
+// modes where the warp tunnel isn't the egress.
+var errNoTunnel = errors.New("no warp tunnel available")
+
+// errStarting is reported instead of a health failure during the startup
+// grace period.
+var errStarting = errors.New("starting")
+
+// TunnelStats holds the cumulative counters of the active tunnel.
+type TunnelStats struct {
+	TxBytes       uint64
+	RxBytes       uint64
+	LastHandshake time.Time
+	// Updated is when the counters were read from the device.
+	Updated time.Time
+}
+
+// DefaultMaxHandshakeAge is how old the last handshake may get before the
+// tunnel is considered unhealthy. Wireguard rekeys every two minutes while
+// keepalives flow and drops keys after three, so an older handshake means
+// the tunnel died silently.
+const DefaultMaxHandshakeAge = 3 * time.Minute
+
+// checkHandshakeAge fails when the last handshake is missing or older than
+// maxAge.
+func checkHandshakeAge(last time.Time, maxAge time.Duration) error {
+	if last.IsZero() {
+		return errors.New("no handshake yet")
+	}
+	if age := time.Since(last); age > maxAge {
+		return fmt.Errorf("last handshake %s ago exceeds %s", age.Round(time.Second), maxAge)
+	}
+	return nil
+}
+
+// handshakeHealth judges a tunnel by the age of its last handshake. Without
+// persistent keepalives an idle tunnel stops handshaking altogether, so with
+// idle set a stale handshake only counts once something was sent since the
+// previous check without getting a new handshake. It is not safe for
+// concurrent use.
+type handshakeHealth struct {
+	maxAge time.Duration
+	idle   bool
+	lastTx uint64
+}
+
+func (h *handshakeHealth) check(last time.Time, txBytes uint64) error {
+	err := checkHandshakeAge(last, h.maxAge)
+	sent := txBytes != h.lastTx
+	h.lastTx = txBytes
+	if err != nil && h.idle && !sent {
+		return nil
+	}
+	return err
+}
+
+// Tunnel lifecycle events passed to WarpOptions.OnEvent.
+const (
+	EventConnected    = "connected"
+	EventReconnected  = "reconnected"
+	EventDisconnected = "disconnected"
+	// EventEndpointSwitched is a running tunnel moved to another endpoint.
+	EventEndpointSwitched = "endpoint-switched"
+	// EventFailed is a failed attempt to bring the tunnel up, only sent by
+	// RunWarp.
+	EventFailed = "failed"
+	// EventPsiphonFallback is psiphon failing to connect and the proxy
+	// serving plain warp instead, see PsiphonOptions.Fallback.
+	EventPsiphonFallback = "psiphon-fallback"
+)
+
+// TunnelEvent is a change in the tunnel state.
+type TunnelEvent struct {
+	Kind     string
+	Endpoint string
+	// Err is set for EventFailed and EventPsiphonFallback.
+	Err error
+}
+
+// Tunnel is a handle to the tunnel started by StartWarp. It follows
+// reconnects, so it always reports on the currently active tunnel. A nil
+// *Tunnel ignores all calls.
+type Tunnel struct {
+	status  *statusFile
+	pcap    *pcapWriter
+	history *endpointHistory
+	// onEvent is called on state changes when set.
+	onEvent func(TunnelEvent)
+
+	// dials and dialErrors count the connections made through the proxy.
+	dials, dialErrors atomic.Uint64
+
+	mu sync.Mutex
+	// closes counts the relayed connections by close reason.
+	closes     map[string]uint64
+	endpoint   string
+	dev        ipcGetter
+	tnet       *netstack.Net
+	stats      TunnelStats
+	reconnects uint64
+	// health is the check used by Health.
+	health handshakeHealth
+	// started and grace are the start of the startup grace period and its
+	// length.
+	started time.Time
+	grace   time.Duration
+	// traceCA verifies the egress IP lookups when set.
+	traceCA *x509.CertPool
+	// traceURL is the trace endpoint of the egress IP and colo lookups.
+	traceURL string
+	// pause is shared by the proxies of the tunnel.
+	pause wiresocks.Pause
+	// egress posts the egress IP changes when set.
+	egress *egressWatcher
+}
+
+// deviceOptions returns the socket options for the wireguard devices of the
+// tunnel.
+func (t *Tunnel) deviceOptions(opts WarpOptions) deviceOptions {
+	devOpts := deviceOptions{fwmark: opts.FwMark, dscp: opts.DSCP, port: opts.SourcePort, randomPort: opts.RandomSourcePort, socks: opts.UDPSocks}
+	devOpts.handshakeTimeout = handshakeTimeout(opts.handshakeRetries())
+	devOpts.socketTimeout = opts.SocketTimeout
+	if t != nil {
+		devOpts.pcap, devOpts.history = t.pcap, t.history
+	}
+	return devOpts
+}
+
+// connected records a newly established tunnel. tnet is nil when the warp
+// tunnel is not the egress, e.g. in psiphon mode.
+func (t *Tunnel) connected(ctx context.Context, endpoint string, dev ipcGetter, tnet *netstack.Net) {
+	t.activate(ctx, endpoint, dev, tnet, EventReconnected)
+}
+
+// activate makes dev the active device, reporting it as kind unless it is
+// the first one.
+func (t *Tunnel) activate(ctx context.Context, endpoint string, dev ipcGetter, tnet *netstack.Net, kind string) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	if t.dev == nil {
+		kind = EventConnected
+		// the tunnel goes down with the context of the first connection
+		context.AfterFunc(ctx, t.disconnected)
+	} else {
+		t.reconnects++
+	}
+	t.endpoint, t.dev, t.tnet = endpoint, dev, tnet
+	t.stats = TunnelStats{}
+	t.mu.Unlock()
+
+	t.emit(TunnelEvent{Kind: kind, Endpoint: endpoint})
+
+	t.status.connected(ctx, endpoint, dev, tnet)
+	if r, ok := t.history.get(endpoint); ok {
+		t.status.setEndpointRecord(r)
+	}
+	if tnet != nil {
+		t.checkEgress(ctx, func(ctx context.Context) (map[string]string, error) {
+			return fetchTrace(ctx, tnet, t.traceURL, t.traceCA)
+		})
+	}
+}
+
+// checkEgress looks up the egress IP with trace in the background and posts
+// it if it changed.
+func (t *Tunnel) checkEgress(ctx context.Context, trace func(ctx context.Context) (map[string]string, error)) {
+	if t == nil {
+		return
+	}
+	t.egress.queue(ctx, trace)
+}
+
+func (t *Tunnel) disconnected() {
+	t.mu.Lock()
+	endpoint := t.endpoint
+	t.mu.Unlock()
+	t.emit(TunnelEvent{Kind: EventDisconnected, Endpoint: endpoint})
+}
+
+// dialRecoveryTimeout bounds how long a failed dial waits for the tunnel to
+// recover, see Tunnel.recovered.
+var dialRecoveryTimeout = 5 * time.Second
+
+// recovered waits up to dialRecoveryTimeout for the tunnel to be
+// re-established after since, by a handshake completed after it or a move
+// to another endpoint. Only then is a dial that failed at since worth
+// retrying.
+func (t *Tunnel) recovered(ctx context.Context, since time.Time) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	reconnects := t.reconnects
+	t.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, dialRecoveryTimeout)
+	defer cancel()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		t.mu.Lock()
+		dev, moved := t.dev, t.reconnects != reconnects
+		t.mu.Unlock()
+		if moved {
+			return true
+		}
+		if dev != nil {
+			if stats, err := readDeviceStats(dev); err == nil && stats.LastHandshake.After(since) {
+				return true
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+// countDial is a dial hook counting the connections made through the
+// proxy.
+func (t *Tunnel) countDial(network, address string, err error) {
+	if t == nil {
+		return
+	}
+	if err != nil {
+		t.dialErrors.Add(1)
+	} else {
+		t.dials.Add(1)
+	}
+}
+
+// countClose is a close hook counting the relayed connections by the
+// reason they ended.
+func (t *Tunnel) countClose(reason string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closes == nil {
+		t.closes = make(map[string]uint64)
+	}
+	t.closes[reason]++
+}
+
+// CloseReasons returns how many proxied connections ended for each of the
+// wiresocks close reasons since startup.
+func (t *Tunnel) CloseReasons() map[string]uint64 {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return maps.Clone(t.closes)
+}
+
+func (t *Tunnel) emit(e TunnelEvent) {
+	if t.onEvent != nil {
+		t.onEvent(e)
+	}
+}
+
+// Stats returns the transfer counters and last handshake of the active
+// tunnel. The counters are read from the device at most once per second and
+// cached in between, so it is cheap to call often. Counters restart from
+// zero after a reconnect. It is safe for concurrent use.
+func (t *Tunnel) Stats() TunnelStats {
+	if t == nil {
+		return TunnelStats{}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.dev == nil || time.Since(t.stats.Updated) < statsRefreshInterval {
+		return t.stats
+	}
+	if stats, err := readDeviceStats(t.dev); err == nil {
+		t.stats = TunnelStats{
+			TxBytes:       stats.TxBytes,
+			RxBytes:       stats.RxBytes,
+			LastHandshake: stats.LastHandshake,
+			Updated:       time.Now(),
+		}
+	}
+	return t.stats
+}
+
+// Health reports whether the active tunnel is healthy, i.e. its last
+// handshake is recent enough. An interface that is up but hasn't
+// handshaked in a while is unhealthy, unless keepalives are disabled and
+// the tunnel is merely idle. During the startup grace period failures are
+// reported as "starting" instead.
+func (t *Tunnel) Health() error {
+	if t == nil {
+		return errNoTunnel
+	}
+
+	t.mu.Lock()
+	up := t.dev != nil
+	t.mu.Unlock()
+	if !up {
+		return t.startingOr(errNoTunnel)
+	}
+
+	stats := t.Stats()
+	t.mu.Lock()
+	err := t.health.check(stats.LastHandshake, stats.TxBytes)
+	t.mu.Unlock()
+	if err != nil {
+		return t.startingOr(err)
+	}
+	return nil
+}
+
+// Ready reports whether the tunnel has come up, reporting "starting" until
+// it does during the startup grace period.
+func (t *Tunnel) Ready() error {
+	if t == nil {
+		return errNoTunnel
+	}
+
+	t.mu.Lock()
+	up := t.dev != nil
+	t.mu.Unlock()
+	if !up {
+		return t.startingOr(errNoTunnel)
+	}
+	return nil
+}
+
+// startingOr returns errStarting during the startup grace period and err
+// after it.
+func (t *Tunnel) startingOr(err error) error {
+	if time.Since(t.started) < t.grace {
+		return errStarting
+	}
+	return err
+}
+
+// trace fetches the cloudflare trace through the active tunnel.
+func (t *Tunnel) trace(ctx context.Context) (map[string]string, error) {
+	if t == nil {
+		return nil, errNoTunnel
+	}
+
+	t.mu.Lock()
+	tnet := t.tnet
+	t.mu.Unlock()
+
+	if tnet == nil {
+		return nil, errNoTunnel
+	}
+	return fetchTrace(ctx, tnet, t.traceURL, t.traceCA)
+}
+
+// Dial connects to address through the active tunnel, counted with the
+// connections of the proxy. It fails before the tunnel first comes up and
+// doesn't wait for reconnects.
+func (t *Tunnel) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if t == nil {
+		return nil, errNoTunnel
+	}
+
+	t.mu.Lock()
+	tnet := t.tnet
+	t.mu.Unlock()
+
+	if tnet == nil {
+		return nil, errNoTunnel
+	}
+	conn, err := tnet.DialContext(ctx, network, address)
+	t.countDial(network, address, err)
+	return conn, err
+}
+
+// Pause makes the proxy refuse new requests while the tunnel stays up, so
+// egress can be stopped without reconnecting afterwards. UDP associations are
+// closed, with closeConns the TCP connections being relayed too. It returns
+// the number of connections closed.
+func (t *Tunnel) Pause(closeConns bool) int {
+	if t == nil {
+		return 0
+	}
+	n := t.pause.Pause(closeConns)
+	t.status.setPaused(true)
+	return n
+}
+
+// Resume makes the proxy serve new requests again after Pause.
+func (t *Tunnel) Resume() {
+	if t == nil {
+		return
+	}
+	t.pause.Resume()
+	t.status.setPaused(false)
+}
+
+// Paused reports whether the proxy refuses new requests.
+func (t *Tunnel) Paused() bool {
+	return t.proxyPause().Paused()
+}
+
+// proxyPause returns the pause for the proxies of the tunnel.
+func (t *Tunnel) proxyPause() *wiresocks.Pause {
+	if t == nil {
+		return nil
+	}
+	return &t.pause
+}
@@ -0,0 +1,200 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// countingDevice reports growing transfer counters.
+type countingDevice struct {
+	mu     sync.Mutex
+	tx, rx int
+	reads  int
+}
+
+func (d *countingDevice) transfer(n int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tx += n
+	d.rx += 2 * n
+}
+
+func (d *countingDevice) IpcGet() (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.reads++
+	return fakeDevice("public_key=a\nlast_handshake_time_sec=1700000000\nlast_handshake_time_nsec=0\n" +
+		fmt.Sprintf("tx_bytes=%d\nrx_bytes=%d\n", d.tx, d.rx)).IpcGet()
+}
+
+func TestTunnelStats(t *testing.T) {
+	var tunnel *Tunnel
+	qt.Assert(t, tunnel.Stats(), qt.Equals, TunnelStats{})
+
+	tunnel = &Tunnel{}
+	qt.Assert(t, tunnel.Stats(), qt.Equals, TunnelStats{})
+
+	dev := &countingDevice{}
+	tunnel.connected(context.Background(), "162.159.192.1:2408", dev, nil)
+	dev.transfer(100)
+
+	s := tunnel.Stats()
+	qt.Assert(t, s.TxBytes, qt.Equals, uint64(100))
+	qt.Assert(t, s.RxBytes, qt.Equals, uint64(200))
+	qt.Assert(t, s.LastHandshake.Unix(), qt.Equals, int64(1700000000))
+
+	// within the refresh interval the cached counters are returned
+	dev.transfer(50)
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			qt.Check(t, tunnel.Stats().TxBytes, qt.Equals, uint64(100))
+		}()
+	}
+	wg.Wait()
+	qt.Assert(t, dev.reads, qt.Equals, 1)
+
+	time.Sleep(statsRefreshInterval)
+	s = tunnel.Stats()
+	qt.Assert(t, s.TxBytes, qt.Equals, uint64(150))
+	qt.Assert(t, s.RxBytes, qt.Equals, uint64(300))
+}
+
+func TestTunnelHealth(t *testing.T) {
+	tunnel := &Tunnel{health: handshakeHealth{maxAge: time.Minute}}
+	qt.Assert(t, tunnel.Health(), qt.ErrorIs, errNoTunnel)
+
+	handshake := func(age time.Duration) ipcGetter {
+		return fakeDevice(fmt.Sprintf("public_key=a\nlast_handshake_time_sec=%d\nlast_handshake_time_nsec=0\n", time.Now().Add(-age).Unix()))
+	}
+
+	// the interface is up either way, only the handshake age decides
+	tunnel.connected(context.Background(), "162.159.192.1:2408", handshake(10*time.Second), nil)
+	qt.Assert(t, tunnel.Health(), qt.IsNil)
+
+	tunnel.connected(context.Background(), "162.159.192.1:2408", handshake(5*time.Minute), nil)
+	qt.Assert(t, tunnel.Health(), qt.ErrorMatches, `last handshake 5m\d+s ago exceeds 1m0s`)
+
+	tunnel.connected(context.Background(), "162.159.192.1:2408", fakeDevice("public_key=a\n"), nil)
+	qt.Assert(t, tunnel.Health(), qt.ErrorMatches, "no handshake yet")
+
+	h := healthHandler(tunnel.Health)
+	_, err := h(context.Background())
+	qt.Assert(t, err, qt.IsNotNil)
+}
+
+func TestTunnelHealthNoKeepAlive(t *testing.T) {
+	tunnel := &Tunnel{health: handshakeHealth{maxAge: time.Minute, idle: true}}
+	handshake := func(tx int, age time.Duration) ipcGetter {
+		return fakeDevice(fmt.Sprintf("public_key=a\ntx_bytes=%d\nlast_handshake_time_sec=%d\nlast_handshake_time_nsec=0\n", tx, time.Now().Add(-age).Unix()))
+	}
+
+	tunnel.connected(context.Background(), "162.159.192.1:2408", handshake(100, 10*time.Second), nil)
+	qt.Assert(t, tunnel.Health(), qt.IsNil)
+
+	// an idle tunnel stops handshaking without keepalives
+	tunnel.connected(context.Background(), "162.159.192.1:2408", handshake(100, 5*time.Minute), nil)
+	qt.Assert(t, tunnel.Health(), qt.IsNil)
+
+	// but sending without getting a handshake means it's broken
+	tunnel.connected(context.Background(), "162.159.192.1:2408", handshake(200, 5*time.Minute), nil)
+	qt.Assert(t, tunnel.Health(), qt.ErrorMatches, `last handshake 5m\d+s ago exceeds 1m0s`)
+}
+
+func TestTunnelStartupGrace(t *testing.T) {
+	tunnel := &Tunnel{health: handshakeHealth{maxAge: time.Minute}, started: time.Now(), grace: time.Hour}
+	ready, health := statusHandler(tunnel.Ready, "ready"), healthHandler(tunnel.Health)
+	check := func(h controlHandler) string {
+		res, err := h(context.Background())
+		if err != nil {
+			return err.Error()
+		}
+		return res.(string)
+	}
+
+	qt.Assert(t, check(ready), qt.Equals, "starting")
+	qt.Assert(t, check(health), qt.Equals, "starting")
+
+	// up, but the handshake hasn't settled yet
+	tunnel.connected(context.Background(), "162.159.192.1:2408", fakeDevice("public_key=a\n"), nil)
+	qt.Assert(t, check(ready), qt.Equals, "ready")
+	qt.Assert(t, check(health), qt.Equals, "starting")
+
+	tunnel.connected(context.Background(), "162.159.192.1:2408", fakeDevice(fmt.Sprintf("public_key=a\nlast_handshake_time_sec=%d\nlast_handshake_time_nsec=0\n", time.Now().Unix())), nil)
+	qt.Assert(t, check(ready), qt.Equals, "ready")
+	qt.Assert(t, check(health), qt.Equals, "healthy")
+
+	// after the grace period failures are reported as they are
+	tunnel.started = time.Now().Add(-2 * time.Hour)
+	tunnel.connected(context.Background(), "162.159.192.1:2408", fakeDevice("public_key=a\n"), nil)
+	qt.Assert(t, check(health), qt.Equals, "no handshake yet")
+	qt.Assert(t, (&Tunnel{started: time.Now().Add(-2 * time.Hour), grace: time.Hour}).Ready(), qt.ErrorIs, errNoTunnel)
+}
+
+func TestTunnelEvents(t *testing.T) {
+	events := make(chan TunnelEvent, 4)
+	tunnel := &Tunnel{onEvent: func(e TunnelEvent) { events <- e }}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tunnel.connected(ctx, "162.159.192.1:2408", fakeDevice(""), nil)
+	tunnel.connected(ctx, "162.159.195.7:908", fakeDevice(""), nil)
+	cancel()
+
+	qt.Assert(t, <-events, qt.Equals, TunnelEvent{Kind: EventConnected, Endpoint: "162.159.192.1:2408"})
+	qt.Assert(t, <-events, qt.Equals, TunnelEvent{Kind: EventReconnected, Endpoint: "162.159.195.7:908"})
+	select {
+	case e := <-events:
+		qt.Assert(t, e, qt.Equals, TunnelEvent{Kind: EventDisconnected, Endpoint: "162.159.195.7:908"})
+	case <-time.After(time.Second):
+		t.Fatal("no disconnected event")
+	}
+	qt.Assert(t, events, qt.HasLen, 0)
+}
+
+func TestTunnelDialNoTunnel(t *testing.T) {
+	var tunnel *Tunnel
+	_, err := tunnel.Dial(context.Background(), "tcp", "example.com:443")
+	qt.Assert(t, err, qt.ErrorIs, errNoTunnel)
+
+	tunnel = &Tunnel{}
+	_, err = tunnel.Dial(context.Background(), "tcp", "example.com:443")
+	qt.Assert(t, err, qt.ErrorIs, errNoTunnel)
+}
+
+func TestTunnelRecovered(t *testing.T) {
+	defer func(timeout time.Duration) { dialRecoveryTimeout = timeout }(dialRecoveryTimeout)
+	dialRecoveryTimeout = 300 * time.Millisecond
+
+	handshake := func(at time.Time) ipcGetter {
+		return fakeDevice(fmt.Sprintf("public_key=a\nlast_handshake_time_sec=%d\nlast_handshake_time_nsec=%d\n", at.Unix(), at.Nanosecond()))
+	}
+	ctx := context.Background()
+	failed := time.Now()
+
+	// the same session as before the failure isn't worth retrying over
+	tunnel := &Tunnel{}
+	tunnel.connected(ctx, "162.159.192.1:2408", handshake(failed.Add(-time.Minute)), nil)
+	qt.Assert(t, tunnel.recovered(ctx, failed), qt.IsFalse)
+
+	// a handshake after the failure is
+	tunnel.connected(ctx, "162.159.192.1:2408", handshake(failed.Add(time.Millisecond)), nil)
+	qt.Assert(t, tunnel.recovered(ctx, failed), qt.IsTrue)
+
+	// so is a move to another endpoint while waiting
+	stale := handshake(failed.Add(-time.Minute))
+	tunnel.connected(ctx, "162.159.192.1:2408", stale, nil)
+	time.AfterFunc(50*time.Millisecond, func() {
+		tunnel.activate(ctx, "162.159.192.2:2408", stale, nil, EventEndpointSwitched)
+	})
+	qt.Assert(t, tunnel.recovered(ctx, failed), qt.IsTrue)
+
+	var none *Tunnel
+	qt.Assert(t, none.recovered(ctx, failed), qt.IsFalse)
+}
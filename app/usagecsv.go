@@ -0,0 +1,115 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+)
+
+// DefaultUsageInterval is how often a row is appended to the usage CSV.
+const DefaultUsageInterval = time.Minute
+
+// DefaultUsageCSVMaxSize is the size at which a usage CSV is rotated.
+const DefaultUsageCSVMaxSize = 10 << 20
+
+// usageHeader is the first row of a usage CSV.
+var usageHeader = []string{"time", "tx_bytes", "rx_bytes", "connections"}
+
+// usageCSV appends the traffic of a tunnel to a file as CSV rows of the
+// totals since startup, which carry on across reconnects. Like the event log
+// the file is opened for every row and moved to path+".1", replacing the
+// previous one, once it would grow past maxSize. Every new file starts with
+// a header.
+type usageCSV struct {
+	path    string
+	maxSize int64
+	t       *Tunnel
+
+	// tx and rx are the totals, lastTx and lastRx the device counters they
+	// were last updated from.
+	tx, rx         uint64
+	lastTx, lastRx uint64
+}
+
+func newUsageCSV(path string, maxSize int64, t *Tunnel) *usageCSV {
+	if maxSize <= 0 {
+		maxSize = DefaultUsageCSVMaxSize
+	}
+	return &usageCSV{path: path, maxSize: maxSize, t: t}
+}
+
+// write appends a row of the totals at now.
+func (u *usageCSV) write(now time.Time) error {
+	stats := u.t.Stats()
+	u.tx += counterDelta(stats.TxBytes, u.lastTx)
+	u.rx += counterDelta(stats.RxBytes, u.lastRx)
+	u.lastTx, u.lastRx = stats.TxBytes, stats.RxBytes
+
+	var row bytes.Buffer
+	w := csv.NewWriter(&row)
+	w.Write([]string{
+		now.UTC().Format(time.RFC3339),
+		strconv.FormatUint(u.tx, 10),
+		strconv.FormatUint(u.rx, 10),
+		strconv.FormatUint(u.t.dials.Load(), 10),
+	})
+	w.Flush()
+
+	size := int64(-1)
+	if fi, err := os.Stat(u.path); err == nil {
+		size = fi.Size()
+	}
+	if size > 0 && size+int64(row.Len()) > u.maxSize {
+		if err := os.Rename(u.path, u.path+".1"); err != nil {
+			return err
+		}
+		size = 0
+	}
+
+	f, err := os.OpenFile(u.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if size <= 0 {
+		w := csv.NewWriter(f)
+		w.Write(usageHeader)
+		w.Flush()
+		if err := w.Error(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if _, err := f.Write(row.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// runUsageCSV appends a row of the traffic of t to path every interval until
+// ctx is done.
+func runUsageCSV(ctx context.Context, l *slog.Logger, path string, interval time.Duration, maxSize int64, t *Tunnel) {
+	if interval <= 0 {
+		interval = DefaultUsageInterval
+	}
+	u := newUsageCSV(path, maxSize, t)
+	l = l.With("subsystem", "usage")
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				if err := u.write(now); err != nil {
+					l.Warn("failed to write usage csv", "path", path, "error", err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,79 @@
+package app
+
+import (
+	"context"
+	"encoding/csv"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func readUsageCSV(t *testing.T, path string) [][]string {
+	f, err := os.Open(path)
+	qt.Assert(t, err, qt.IsNil)
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	qt.Assert(t, err, qt.IsNil)
+	return rows
+}
+
+func TestUsageCSV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.csv")
+	tunnel := &Tunnel{}
+	dev := &countingDevice{}
+	tunnel.connected(context.Background(), "162.159.192.1:2408", dev, nil)
+	dev.transfer(100)
+	tunnel.countDial("tcp", "example.com:443", nil)
+
+	u := newUsageCSV(path, 0, tunnel)
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	qt.Assert(t, u.write(start), qt.IsNil)
+
+	// the counters of a new device start over, the totals carry on
+	dev = &countingDevice{}
+	tunnel.connected(context.Background(), "162.159.192.1:2408", dev, nil)
+	dev.transfer(10)
+	tunnel.countDial("tcp", "example.com:443", nil)
+	qt.Assert(t, u.write(start.Add(time.Minute)), qt.IsNil)
+
+	qt.Assert(t, readUsageCSV(t, path), qt.DeepEquals, [][]string{
+		usageHeader,
+		{"2024-01-02T03:04:05Z", "100", "200", "1"},
+		{"2024-01-02T03:05:05Z", "110", "220", "2"},
+	})
+
+	// a full file is rotated and the new one starts with a header
+	u.maxSize = 1
+	qt.Assert(t, u.write(start.Add(2*time.Minute)), qt.IsNil)
+	qt.Assert(t, readUsageCSV(t, path+".1"), qt.HasLen, 3)
+	qt.Assert(t, readUsageCSV(t, path), qt.DeepEquals, [][]string{
+		usageHeader,
+		{"2024-01-02T03:06:05Z", "110", "220", "2"},
+	})
+}
+
+func TestRunUsageCSV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.csv")
+	tunnel := &Tunnel{}
+	dev := &countingDevice{}
+	tunnel.connected(context.Background(), "162.159.192.1:2408", dev, nil)
+	dev.transfer(100)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	const interval = 20 * time.Millisecond
+	runUsageCSV(ctx, slog.Default(), path, interval, 0, tunnel)
+
+	time.Sleep(5*interval + interval/2)
+	cancel()
+	rows := readUsageCSV(t, path)
+	qt.Assert(t, len(rows) >= 4, qt.IsTrue, qt.Commentf("%d rows", len(rows)))
+	qt.Assert(t, rows[0], qt.DeepEquals, usageHeader)
+	for _, row := range rows[1:] {
+		qt.Assert(t, row[1:], qt.DeepEquals, []string{"100", "200", "0"})
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/x509"
 	"fmt"
 	"log/slog"
+	"math/rand/v2"
 	"net/http"
 	"strings"
 	"time"
@@ -15,23 +17,26 @@ import (
 	wgtun "github.com/bepass-org/warp-plus/wireguard/tun"
 	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
 	"github.com/bepass-org/warp-plus/wiresocks"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func usermodeTunTest(ctx context.Context, l *slog.Logger, tnet *netstack.Net, url string) error {
-	ctx, cancel := context.WithDeadline(ctx, time.Now().Add(5*time.Second))
+func usermodeTunTest(parent context.Context, l *slog.Logger, tnet *netstack.Net, url string, roots *x509.CertPool) error {
+	ctx, cancel := context.WithDeadline(parent, time.Now().Add(5*time.Second))
 	defer cancel()
 
 	for {
 		select {
 		case <-ctx.Done():
+			if parent.Err() == nil {
+				return &ConnectError{Class: ErrClassHealthFailure, Err: ctx.Err()}
+			}
 			return ctx.Err()
 		default:
 		}
 
-		client := http.Client{Transport: &http.Transport{
-			DialContext:           tnet.DialContext,
-			ResponseHeaderTimeout: 5 * time.Second,
-		}}
+		transport := checkTransport(tnet.DialContext, roots)
+		transport.ResponseHeaderTimeout = 5 * time.Second
+		client := http.Client{Transport: transport}
 		resp, err := client.Head(url)
 		if err != nil {
 			l.Error("connection test failed")
@@ -49,6 +54,28 @@ func usermodeTunTest(ctx context.Context, l *slog.Logger, tnet *netstack.Net, ur
 	return nil
 }
 
+// DefaultHandshakeRetries is how often the handshake initiation to an
+// endpoint is retransmitted before the endpoint counts as unreachable.
+const DefaultHandshakeRetries = 1
+
+// MaxHandshakeRetries is the number of retransmissions after which wireguard
+// gives up on its own.
+const MaxHandshakeRetries = device.MaxTimerHandshakes
+
+var (
+	// handshakeRetryInterval is how long wireguard waits for an answer
+	// before retransmitting the handshake initiation.
+	handshakeRetryInterval = device.RekeyTimeout
+	// handshakeReplyWait is how long the last initiation has to be answered.
+	handshakeReplyWait = 5 * time.Second
+)
+
+// handshakeTimeout is how long to wait for a handshake that may be
+// retransmitted retries times.
+func handshakeTimeout(retries int) time.Duration {
+	return time.Duration(retries)*handshakeRetryInterval + handshakeReplyWait
+}
+
 func waitHandshake(ctx context.Context, l *slog.Logger, dev *device.Device) error {
 	lastHandshakeSecs := "0"
 	for {
@@ -85,19 +112,103 @@ func waitHandshake(ctx context.Context, l *slog.Logger, dev *device.Device) erro
 		}
 
 		l.Debug("waiting on handshake")
-		time.Sleep(1 * time.Second)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
 	}
 
 	return nil
 }
 
-func establishWireguard(l *slog.Logger, conf *wiresocks.Configuration, tunDev wgtun.Device, fwmark uint32, t string) error {
+// deviceOptions configure the wireguard devices and the UDP socket they send
+// their packets on.
+type deviceOptions struct {
+	fwmark uint32
+	dscp   int
+	// port pins the UDP source port, 0 lets the system pick one.
+	port uint16
+	// randomPort picks a new random source port for every device.
+	randomPort bool
+	// pcap receives a copy of every packet when set.
+	pcap *pcapWriter
+	// history records whether the handshake succeeded.
+	history *endpointHistory
+	// socks sends the packets through this SOCKS5 proxy when set.
+	socks string
+	// handshakeTimeout is how long to wait for the handshake, 0 allows
+	// DefaultHandshakeRetries retransmissions.
+	handshakeTimeout time.Duration
+	// socketTimeout bounds the writes on the outer socket, 0 means no
+	// bound.
+	socketTimeout time.Duration
+}
+
+// inner returns the options for the inner device of gool mode. Its packets
+// go to the local forwarder of the outer device, so they must not take the
+// way out of the outer packets, and its handshakes say nothing about the
+// forwarder address as an endpoint, which only the outer device records.
+func (o deviceOptions) inner() deviceOptions {
+	o.socks = ""
+	o.history = nil
+	return o
+}
+
+func establishWireguard(ctx context.Context, l *slog.Logger, conf *wiresocks.Configuration, tunDev wgtun.Device, devOpts deviceOptions, t string) (_ *device.Device, err error) {
+	ctx, span := startSpan(ctx, "wireguard.handshake", attribute.String("warp.trick", t))
+	defer func() { endSpan(span, err) }()
+	if len(conf.Peers) > 0 {
+		span.SetAttributes(attribute.String("warp.endpoint", conf.Peers[0].Endpoint))
+	}
+
+	dev, err := newWireguardDevice(l, conf, tunDev, devOpts, t)
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoint string
+	if len(conf.Peers) > 0 {
+		endpoint = conf.Peers[0].Endpoint
+	}
+
+	timeout := devOpts.handshakeTimeout
+	if timeout <= 0 {
+		timeout = handshakeTimeout(DefaultHandshakeRetries)
+	}
+	hsCtx, cancel := context.WithDeadline(ctx, time.Now().Add(timeout))
+	defer cancel()
+	if err := waitHandshake(hsCtx, l, dev); err != nil {
+		dev.BindClose()
+		dev.Close()
+		if ctx.Err() == nil {
+			devOpts.history.record(endpoint, false)
+			return nil, &ConnectError{Class: ErrClassNoHandshake, Err: err}
+		}
+		return nil, err
+	}
+	devOpts.history.record(endpoint, true)
+
+	return dev, nil
+}
+
+// newWireguardDevice configures a wireguard device for conf and brings it
+// up without waiting for the handshake.
+func newWireguardDevice(l *slog.Logger, conf *wiresocks.Configuration, tunDev wgtun.Device, devOpts deviceOptions, t string) (*device.Device, error) {
 	// create the IPC message to establish the wireguard conn
 	var request bytes.Buffer
 
 	request.WriteString(fmt.Sprintf("private_key=%s\n", conf.Interface.PrivateKey))
-	if fwmark != 0 {
-		request.WriteString(fmt.Sprintf("fwmark=%d\n", fwmark))
+	if devOpts.fwmark != 0 {
+		request.WriteString(fmt.Sprintf("fwmark=%d\n", devOpts.fwmark))
+	}
+	port := devOpts.port
+	if devOpts.randomPort {
+		port = randomSourcePort()
+	}
+	if port != 0 {
+		l.Debug("using wireguard source port", "port", port)
+		request.WriteString(fmt.Sprintf("listen_port=%d\n", port))
 	}
 
 	for _, peer := range conf.Peers {
@@ -113,27 +224,64 @@ func establishWireguard(l *slog.Logger, conf *wiresocks.Configuration, tunDev wg
 		}
 	}
 
+	bind := conn.NewDefaultBind()
+	if devOpts.socks != "" {
+		bind = newSocksBind(devOpts.socks)
+	}
+	if devOpts.dscp != 0 {
+		setDSCP(l, bind, devOpts.dscp)
+	}
+	if devOpts.socketTimeout > 0 {
+		setSocketTimeout(l, bind, devOpts.socketTimeout)
+	}
+	if devOpts.pcap != nil {
+		bind = &pcapBind{Bind: bind, w: devOpts.pcap}
+	}
+
 	dev := device.NewDevice(
 		tunDev,
-		conn.NewDefaultBind(),
+		bind,
 		device.NewSLogger(l.With("subsystem", "wireguard-go")),
 	)
 
 	if err := dev.IpcSet(request.String()); err != nil {
-		return err
+		dev.Close()
+		return nil, err
 	}
 
 	if err := dev.Up(); err != nil {
-		return err
+		dev.Close()
+		return nil, err
 	}
 
-	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(15*time.Second))
-	defer cancel()
-	if err := waitHandshake(ctx, l, dev); err != nil {
-		dev.BindClose()
-		dev.Close()
-		return err
+	return dev, nil
+}
+
+// randomSourcePort returns a random port outside the well-known range.
+func randomSourcePort() uint16 {
+	return uint16(1024 + rand.N(65536-1024))
+}
+
+// setSocketTimeout bounds the writes of bind to d. Binds that
+// can't only log a warning.
+func setSocketTimeout(l *slog.Logger, bind conn.Bind, d time.Duration) {
+	ts, ok := bind.(interface{ SetTimeout(d time.Duration) })
+	if !ok {
+		l.Warn("socket timeouts are not supported on this platform")
+		return
 	}
+	ts.SetTimeout(d)
+}
 
-	return nil
+// setDSCP marks the packets sent by bind with dscp. Binds or platforms that
+// can't set the ToS byte only log a warning.
+func setDSCP(l *slog.Logger, bind conn.Bind, dscp int) {
+	ts, ok := bind.(interface{ SetTOS(tos int) error })
+	if !ok {
+		l.Warn("dscp marking is not supported on this platform")
+		return
+	}
+	if err := ts.SetTOS(dscp << 2); err != nil {
+		l.Warn("failed to set dscp", "dscp", dscp, "error", err)
+	}
 }
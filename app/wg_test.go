@@ -0,0 +1,151 @@
+package app
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/warp"
+	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
+	"github.com/bepass-org/warp-plus/wiresocks"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestWireguardSourcePort(t *testing.T) {
+	key, err := warp.GeneratePrivateKey()
+	qt.Assert(t, err, qt.IsNil)
+	priv, err := wiresocks.EncodeBase64ToHex(key.String())
+	qt.Assert(t, err, qt.IsNil)
+	conf := &wiresocks.Configuration{Interface: &wiresocks.InterfaceConfig{
+		PrivateKey: priv,
+		Addresses:  []netip.Addr{netip.MustParseAddr("172.16.0.2")},
+		MTU:        1280,
+	}}
+
+	// find a free port
+	ln, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	qt.Assert(t, err, qt.IsNil)
+	port := uint16(ln.LocalAddr().(*net.UDPAddr).Port)
+	ln.Close()
+
+	tunDev, _, err := netstack.CreateNetTUN(conf.Interface.Addresses, nil, conf.Interface.MTU)
+	qt.Assert(t, err, qt.IsNil)
+	dev, err := newWireguardDevice(slog.Default(), conf, tunDev, deviceOptions{port: port}, "t0")
+	qt.Assert(t, err, qt.IsNil)
+	defer dev.Close()
+
+	get, err := dev.IpcGet()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, strings.Contains(get, "listen_port="+strconv.Itoa(int(port))+"\n"), qt.IsTrue, qt.Commentf("%s", get))
+
+	// the bind socket holds the port
+	_, err = net.ListenUDP("udp4", &net.UDPAddr{Port: int(port)})
+	qt.Assert(t, err, qt.ErrorMatches, ".*address already in use")
+}
+
+func TestWireguardKeepAlive(t *testing.T) {
+	hexKey := func() string {
+		key, err := warp.GeneratePrivateKey()
+		qt.Assert(t, err, qt.IsNil)
+		h, err := wiresocks.EncodeBase64ToHex(key.String())
+		qt.Assert(t, err, qt.IsNil)
+		return h
+	}
+
+	for _, tc := range []struct {
+		keepAlive time.Duration
+		want      string
+	}{
+		{0, "persistent_keepalive_interval=5\n"},
+		{25 * time.Second, "persistent_keepalive_interval=25\n"},
+		{-1, "persistent_keepalive_interval=0\n"},
+	} {
+		opts := WarpOptions{KeepAlive: tc.keepAlive}
+		conf := &wiresocks.Configuration{
+			Interface: &wiresocks.InterfaceConfig{
+				PrivateKey: hexKey(),
+				Addresses:  []netip.Addr{netip.MustParseAddr("172.16.0.2")},
+				MTU:        1280,
+			},
+			Peers: []wiresocks.PeerConfig{{
+				PublicKey:    hexKey(),
+				PreSharedKey: strings.Repeat("0", 64),
+				Endpoint:     "127.0.0.1:2408",
+				KeepAlive:    opts.keepAlive(),
+			}},
+		}
+
+		tunDev, _, err := netstack.CreateNetTUN(conf.Interface.Addresses, nil, conf.Interface.MTU)
+		qt.Assert(t, err, qt.IsNil)
+		dev, err := newWireguardDevice(slog.Default(), conf, tunDev, deviceOptions{}, "t0")
+		qt.Assert(t, err, qt.IsNil)
+
+		get, err := dev.IpcGet()
+		dev.Close()
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, strings.Contains(get, tc.want), qt.IsTrue, qt.Commentf("%s", get))
+	}
+}
+
+func TestHandshakeRetries(t *testing.T) {
+	defer func(interval, wait time.Duration) {
+		handshakeRetryInterval, handshakeReplyWait = interval, wait
+	}(handshakeRetryInterval, handshakeReplyWait)
+	handshakeRetryInterval, handshakeReplyWait = 300*time.Millisecond, 100*time.Millisecond
+
+	hexKey := func() string {
+		key, err := warp.GeneratePrivateKey()
+		qt.Assert(t, err, qt.IsNil)
+		h, err := wiresocks.EncodeBase64ToHex(key.String())
+		qt.Assert(t, err, qt.IsNil)
+		return h
+	}
+
+	// the endpoint swallows the handshake initiations
+	blackHole, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	qt.Assert(t, err, qt.IsNil)
+	defer blackHole.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			if _, _, err := blackHole.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	timeToFailure := func(retries int) time.Duration {
+		conf := &wiresocks.Configuration{
+			Interface: &wiresocks.InterfaceConfig{
+				PrivateKey: hexKey(),
+				Addresses:  []netip.Addr{netip.MustParseAddr("172.16.0.2")},
+				MTU:        1280,
+			},
+			Peers: []wiresocks.PeerConfig{{
+				PublicKey:    hexKey(),
+				PreSharedKey: strings.Repeat("0", 64),
+				Endpoint:     blackHole.LocalAddr().String(),
+			}},
+		}
+		tunDev, _, err := netstack.CreateNetTUN(conf.Interface.Addresses, nil, conf.Interface.MTU)
+		qt.Assert(t, err, qt.IsNil)
+
+		opts := WarpOptions{HandshakeRetries: retries}
+		start := time.Now()
+		_, err = establishWireguard(context.Background(), slog.Default(), conf, tunDev, (*Tunnel)(nil).deviceOptions(opts), "t0")
+		elapsed := time.Since(start)
+		qt.Assert(t, ErrorClass(err), qt.Equals, ErrClassNoHandshake)
+		qt.Assert(t, elapsed >= handshakeTimeout(opts.handshakeRetries()), qt.IsTrue, qt.Commentf("%s", elapsed))
+		return elapsed
+	}
+
+	once, persistent := timeToFailure(-1), timeToFailure(3)
+	qt.Assert(t, once < 300*time.Millisecond, qt.IsTrue, qt.Commentf("%s", once))
+	qt.Assert(t, persistent >= time.Second, qt.IsTrue, qt.Commentf("%s", persistent))
+	qt.Assert(t, timeToFailure(0) > once, qt.IsTrue)
+}
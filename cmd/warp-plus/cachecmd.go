@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+
+	"github.com/bepass-org/warp-plus/app"
+	"github.com/peterbourgon/ff/v4"
+	"github.com/peterbourgon/ff/v4/ffval"
+)
+
+func cacheCmd(rootConfig *rootConfig) {
+	var verify bool
+	infoFlags := ff.NewFlagSet("info").SetParent(rootConfig.flags)
+	infoFlags.AddFlag(ff.FlagConfig{
+		LongName: "verify",
+		Value:    ffval.NewValueDefault(&verify, false),
+		Usage:    "check the cached tokens against the cloudflare API",
+	})
+
+	info := &ff.Command{
+		Name:      "info",
+		Usage:     "cache info [FLAGS]",
+		ShortHelp: "show the cached identities and whether they look valid",
+		LongHelp:  "Prints the device id, account type, addresses and token age of the identities under --cache-dir as JSON. Private keys and tokens are never printed and licenses are truncated.",
+		Flags:     infoFlags,
+		Exec: func(ctx context.Context, args []string) error {
+			l := rootConfig.logger()
+			idents, err := app.InspectCache(ctx, l, rootConfig.warpOptions(l), verify)
+			if err != nil {
+				return err
+			}
+
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(idents)
+		},
+	}
+
+	command := &ff.Command{
+		Name:        "cache",
+		Usage:       "cache SUBCOMMAND",
+		ShortHelp:   "inspect the identity cache",
+		Flags:       ff.NewFlagSet("cache").SetParent(rootConfig.flags),
+		Subcommands: []*ff.Command{info},
+		Exec: func(ctx context.Context, args []string) error {
+			return errors.New("missing subcommand, see cache --help")
+		},
+	}
+	rootConfig.command.Subcommands = append(rootConfig.command.Subcommands, command)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/bepass-org/warp-plus/app"
+	"github.com/carlmjohnson/versioninfo"
+	"github.com/peterbourgon/ff/v4"
+	"github.com/peterbourgon/ff/v4/ffval"
+)
+
+func diagCmd(rootConfig *rootConfig) {
+	var output string
+	flags := ff.NewFlagSet("diag").SetParent(rootConfig.flags)
+	flags.AddFlag(ff.FlagConfig{
+		LongName: "output",
+		Value:    ffval.NewValueDefault(&output, "-"),
+		Usage:    "write the bundle to this file, - for stdout",
+	})
+
+	command := &ff.Command{
+		Name:      "diag",
+		Usage:     "diag [FLAGS]",
+		ShortHelp: "write an anonymized diagnostic bundle for bug reports",
+		LongHelp:  "Collects the platform, version, effective flags, cached identities, endpoint history and, when --status-file or --control-socket point at a running instance, its status, health and last errors into a single JSON file. Private keys, tokens, licenses, proxy credentials and the user info and query values of URLs are never included, device ids are truncated and home directories are replaced with ~. Pass the same flags as to the instance being diagnosed.",
+		Flags:     flags,
+		Exec: func(ctx context.Context, args []string) error {
+			l := rootConfig.logger()
+			d := app.Diagnose(ctx, l, rootConfig.warpOptions(l), rootConfig.effectiveConfig())
+			if version == "" {
+				version = versioninfo.Short()
+			}
+			d.Version = version
+
+			out := os.Stdout
+			if output != "-" {
+				f, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				out = f
+			}
+
+			encoder := json.NewEncoder(out)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(d); err != nil {
+				return err
+			}
+			if output != "-" {
+				fmt.Fprintf(os.Stderr, "wrote diagnostic bundle to %s\n", output)
+			}
+			return nil
+		},
+	}
+	rootConfig.command.Subcommands = append(rootConfig.command.Subcommands, command)
+}
+
+// effectiveConfig returns the value of every root flag by its long name,
+// with secrets redacted as by redactFlag.
+func (c *rootConfig) effectiveConfig() map[string]string {
+	config := make(map[string]string)
+	c.flags.WalkFlags(func(f ff.Flag) error {
+		name, ok := f.GetLongName()
+		if !ok {
+			return nil
+		}
+		config[name] = redactFlag(name, f.GetValue())
+		return nil
+	})
+	return config
+}
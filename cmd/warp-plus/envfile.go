@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/peterbourgon/ff/v4"
+	"github.com/peterbourgon/ff/v4/ffenv"
+)
+
+// envFilePrefix may precede the keys of an env file, so a file shared with
+// other programs can namespace them.
+const envFilePrefix = "WARP_PLUS_"
+
+// secretFlags are never logged with their value. They hold license keys,
+// tokens or, for --udp-socks, the credentials of a proxy.
+var secretFlags = []string{"key", "team-token", "license", "udp-socks"}
+
+// redactFlag returns value of the flag name as it may be logged: the values of
+// secret flags are replaced, and URLs, e.g. of --ip-change-webhook or
+// --otel-endpoint, lose their user info and query values, which often carry
+// tokens.
+func redactFlag(name, value string) string {
+	if value == "" {
+		return ""
+	}
+	if slices.Contains(secretFlags, name) {
+		return "REDACTED"
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return value
+	}
+	if u.User != nil {
+		u.User = url.User("REDACTED")
+	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		for k := range query {
+			query[k] = []string{"REDACTED"}
+		}
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+// envFileKey returns the env file key of a flag, e.g. TEAM_TOKEN for
+// --team-token.
+func envFileKey(name string) string {
+	return strings.ReplaceAll(strings.ToUpper(name), "-", "_")
+}
+
+// loadEnvFile sets the flags of fs that weren't given on the command line or
+// in the config file from the KEY=value lines of the file at path. Keys are
+// long flag names in upper case with dashes replaced by underscores,
+// optionally prefixed with WARP_PLUS_. Repeated keys append to list flags.
+// It returns the applied lines with the values of secret flags redacted.
+func loadEnvFile(fs ff.Flags, path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	flags := make(map[string]ff.Flag)
+	provided := make(map[string]bool)
+	fs.WalkFlags(func(f ff.Flag) error {
+		if name, ok := f.GetLongName(); ok {
+			flags[envFileKey(name)] = f
+			provided[envFileKey(name)] = f.IsSet()
+		}
+		return nil
+	})
+
+	var applied []string
+	err = ffenv.Parse(f, func(key, value string) error {
+		key = strings.TrimPrefix(strings.ToUpper(key), envFilePrefix)
+		flag, ok := flags[key]
+		if !ok {
+			return fmt.Errorf("%s: %w", key, ff.ErrUnknownFlag)
+		}
+		if provided[key] {
+			return nil
+		}
+		if err := flag.SetValue(value); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+
+		name, _ := flag.GetLongName()
+		applied = append(applied, key+"="+redactFlag(name, value))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("parse env file: %w", err)
+	}
+	return applied, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/peterbourgon/ff/v4"
+)
+
+func TestLoadEnvFile(t *testing.T) {
+	c := qt.New(t)
+
+	path := filepath.Join(t.TempDir(), "warp.env")
+	err := os.WriteFile(path, []byte(`# warp-plus settings
+WARP_PLUS_BIND=0.0.0.0:9090
+TEAM_TOKEN="secret-token"
+scan=true
+RTT=2s
+SCAN_CIDR=162.159.192.0/24
+SCAN_CIDR=2606:4700:d0::/48
+DNS=9.9.9.9
+`), 0o600)
+	c.Assert(err, qt.IsNil)
+
+	cfg := newRootCmd()
+	c.Assert(cfg.command.Parse([]string{"--dns", "1.0.0.1", "--env-file", path}), qt.IsNil)
+
+	applied, err := loadEnvFile(cfg.flags, cfg.envFile)
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.bind, qt.Equals, "0.0.0.0:9090")
+	c.Assert(cfg.teamTok, qt.Equals, "secret-token")
+	c.Assert(cfg.scan, qt.IsTrue)
+	c.Assert(cfg.rtt, qt.Equals, 2*time.Second)
+	c.Assert(cfg.scanCidr, qt.DeepEquals, []string{"162.159.192.0/24", "2606:4700:d0::/48"})
+	// the command line wins
+	c.Assert(cfg.dns, qt.Equals, "1.0.0.1")
+
+	c.Assert(applied, qt.Contains, "TEAM_TOKEN=REDACTED")
+	c.Assert(applied, qt.Contains, "BIND=0.0.0.0:9090")
+	for _, line := range applied {
+		c.Assert(line, qt.Not(qt.Contains), "secret-token")
+	}
+}
+
+func TestLoadEnvFileUnknownKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "warp.env")
+	qt.Assert(t, os.WriteFile(path, []byte("NO_SUCH_FLAG=1\n"), 0o600), qt.IsNil)
+
+	cfg := newRootCmd()
+	qt.Assert(t, cfg.command.Parse(nil), qt.IsNil)
+	_, err := loadEnvFile(cfg.flags, path)
+	qt.Assert(t, err, qt.ErrorIs, ff.ErrUnknownFlag)
+}
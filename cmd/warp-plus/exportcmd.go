@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/bepass-org/warp-plus/app"
+	"github.com/peterbourgon/ff/v4"
+	"github.com/peterbourgon/ff/v4/ffval"
+)
+
+func exportConfigCmd(rootConfig *rootConfig) {
+	var format string
+	var redact bool
+	flags := ff.NewFlagSet("export-config").SetParent(rootConfig.flags)
+	flags.AddFlag(ff.FlagConfig{
+		LongName: "format",
+		Value:    ffval.NewEnum(&format, "wg", "json"),
+		Usage:    "output format, wg for a wireguard config file or json",
+	})
+	flags.AddFlag(ff.FlagConfig{
+		LongName: "redact",
+		Value:    ffval.NewValueDefault(&redact, false),
+		Usage:    "leave out the private key",
+	})
+
+	command := &ff.Command{
+		Name:      "export-config",
+		Usage:     "export-config [FLAGS]",
+		ShortHelp: "print the wireguard configuration of the account",
+		LongHelp:  "Prints the wireguard configuration of the account under --cache-dir, registering it first if needed, for use with other wireguard clients and tools. The peer endpoint is --endpoint.",
+		Flags:     flags,
+		Exec: func(ctx context.Context, args []string) error {
+			l := rootConfig.logger()
+			conf, err := app.ExportConfig(ctx, l, rootConfig.warpOptions(l))
+			if err != nil {
+				return err
+			}
+			if redact {
+				conf = conf.Redacted()
+			}
+
+			if format == "json" {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				return encoder.Encode(conf)
+			}
+			b, err := conf.MarshalINI()
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Print(string(b))
+			return err
+		},
+	}
+	rootConfig.command.Subcommands = append(rootConfig.command.Subcommands, command)
+}
+
+func exportEnvCmd(rootConfig *rootConfig) {
+	var format string
+	flags := ff.NewFlagSet("export-env").SetParent(rootConfig.flags)
+	flags.AddFlag(ff.FlagConfig{
+		LongName: "format",
+		Value:    ffval.NewEnum(&format, "sh", "json"),
+		Usage:    "output format, sh for export lines or json",
+	})
+
+	command := &ff.Command{
+		Name:      "export-env",
+		Usage:     "export-env [FLAGS]",
+		ShortHelp: "print the account credentials as environment variables",
+		LongHelp:  "Prints the account under --cache-dir, registering it first if needed, as WARP_* environment variables for other tools and CI steps: export lines for eval in a POSIX shell, or a JSON array of name, value and secret. The private key, token and license are printed in the clear and marked as secret.",
+		Flags:     flags,
+		Exec: func(ctx context.Context, args []string) error {
+			l := rootConfig.logger()
+			vars, err := app.ExportEnv(ctx, l, rootConfig.warpOptions(l))
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(os.Stderr, "warning: printing the account credentials, keep the output secret")
+
+			if format == "json" {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				return encoder.Encode(vars)
+			}
+			return app.WriteEnv(os.Stdout, vars)
+		},
+	}
+	rootConfig.command.Subcommands = append(rootConfig.command.Subcommands, command)
+}
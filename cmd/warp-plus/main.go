@@ -21,6 +21,13 @@ func main() {
 	ctx, _ := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	rootCmd := newRootCmd()
 	versionCmd(rootCmd)
+	pingEndpointsCmd(rootCmd)
+	provisionCmd(rootCmd)
+	exportConfigCmd(rootCmd)
+	exportEnvCmd(rootCmd)
+	cacheCmd(rootCmd)
+	profilesCmd(rootCmd)
+	diagCmd(rootCmd)
 	err := rootCmd.command.Parse(
 		args,
 		ff.WithConfigFileFlag("config"),
@@ -36,6 +43,15 @@ func main() {
 		os.Exit(1)
 	}
 
+	// the env file comes last, so the command line and config file win
+	if rootCmd.envFile != "" {
+		rootCmd.envVals, err = loadEnvFile(rootCmd.flags, rootCmd.envFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	if err := rootCmd.command.Run(ctx); err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log/slog"
+
+	"github.com/bepass-org/warp-plus/app"
+	"github.com/bepass-org/warp-plus/notify"
+)
+
+// desktopNotifier returns a tunnel event handler showing desktop
+// notifications, or nil when they aren't available.
+func desktopNotifier(l *slog.Logger) func(app.TunnelEvent) {
+	n, err := notify.New()
+	if err != nil {
+		l.Warn("not showing notifications", "error", err)
+		return nil
+	}
+
+	return func(e app.TunnelEvent) {
+		var message string
+		switch e.Kind {
+		case app.EventConnected:
+			message = "Connected to " + e.Endpoint
+		case app.EventReconnected:
+			message = "Reconnected to " + e.Endpoint
+		case app.EventDisconnected:
+			message = "Disconnected"
+		default:
+			return
+		}
+		go func() {
+			if err := n.Notify(appName, message); err != nil {
+				l.Debug("failed to show notification", "error", err)
+			}
+		}()
+	}
+}
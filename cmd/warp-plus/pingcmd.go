@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/bepass-org/warp-plus/app"
+	"github.com/bepass-org/warp-plus/wiresocks"
+	"github.com/peterbourgon/ff/v4"
+	"github.com/peterbourgon/ff/v4/ffval"
+)
+
+type pingResult struct {
+	Endpoint  string  `json:"endpoint"`
+	LatencyMs float64 `json:"latency_ms,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+func pingEndpointsCmd(rootConfig *rootConfig) {
+	var asJSON bool
+	flags := ff.NewFlagSet("ping-endpoints").SetParent(rootConfig.flags)
+	flags.AddFlag(ff.FlagConfig{
+		LongName: "json",
+		Value:    ffval.NewValueDefault(&asJSON, false),
+		Usage:    "print the results as JSON",
+	})
+
+	command := &ff.Command{
+		Name:      "ping-endpoints",
+		Usage:     "ping-endpoints [FLAGS] [ENDPOINT...]",
+		ShortHelp: "rank endpoints by wireguard handshake latency",
+		LongHelp:  "Measures the time to the first wireguard handshake with each endpoint. Without arguments the endpoints found by a scan are measured.",
+		Flags:     flags,
+		Exec: func(ctx context.Context, args []string) error {
+			l := rootConfig.logger()
+			opts := rootConfig.warpOptions(l)
+
+			endpoints := args
+			if len(endpoints) == 0 {
+				scan := opts.Scan
+				if scan == nil {
+					scan = &wiresocks.ScanOptions{V4: rootConfig.v4, V6: rootConfig.v6, MaxRTT: rootConfig.rtt, ScanDeadline: rootConfig.scanTmo}
+				}
+				res, err := wiresocks.RunScan(ctx, l, *scan)
+				if err != nil {
+					return err
+				}
+				for _, r := range res {
+					endpoints = append(endpoints, r.AddrPort.String())
+				}
+			}
+
+			pings, err := app.PingEndpoints(ctx, l, opts, endpoints)
+			if err != nil {
+				return err
+			}
+
+			results := make([]pingResult, len(pings))
+			for i, p := range pings {
+				results[i] = pingResult{Endpoint: p.Endpoint}
+				if p.Err != nil {
+					results[i].Error = p.Err.Error()
+				} else {
+					results[i].LatencyMs = float64(p.Latency.Microseconds()) / 1000
+				}
+			}
+
+			if asJSON {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				return encoder.Encode(results)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "RANK\tENDPOINT\tHANDSHAKE")
+			for i, r := range results {
+				handshake := fmt.Sprintf("%.1fms", r.LatencyMs)
+				if r.Error != "" {
+					handshake = "failed: " + r.Error
+				}
+				fmt.Fprintf(w, "%d\t%s\t%s\n", i+1, r.Endpoint, handshake)
+			}
+			return w.Flush()
+		},
+	}
+	rootConfig.command.Subcommands = append(rootConfig.command.Subcommands, command)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/bepass-org/warp-plus/app"
+)
+
+// privileges are the user and group to drop to with --drop-privileges.
+type privileges struct {
+	user     string
+	uid, gid int
+}
+
+// checkDropPrivileges fails if opts need privileges after startup, which
+// are lost once they are dropped. Everything is set up again when the
+// network changes.
+func checkDropPrivileges(opts app.WarpOptions) error {
+	if opts.FwMark != 0 {
+		return errors.New("--fwmark needs CAP_NET_ADMIN for every connection")
+	}
+	if opts.SourcePort > 0 && opts.SourcePort < 1024 {
+		return fmt.Errorf("--wg-port %d is privileged and bound on every connection", opts.SourcePort)
+	}
+	if port := opts.Bind.Port(); opts.ReconnectOnNetworkChange && port < 1024 {
+		return fmt.Errorf("the proxy port %d is privileged and bound again on reconnects", port)
+	}
+	return nil
+}
+
+// stateFiles are the files outside the cache directory that opts keeps
+// writing to after startup, with their rotated copies.
+func stateFiles(opts app.WarpOptions) []string {
+	var files []string
+	for _, f := range []string{opts.StatusFile, opts.EventLog, opts.Pcap, opts.UsageCSV} {
+		if f != "" {
+			files = append(files, f, f+".1")
+		}
+	}
+	return files
+}
+
+// chownState hands the state opts writes to after startup over to p before
+// privileges are dropped: the cache directory with the identities, endpoint
+// history and scan checkpoints in it, and the status file, event log, pcap
+// and usage CSV. Files that don't exist yet are skipped.
+func chownState(opts app.WarpOptions, p privileges) error {
+	if !opts.NoCache && opts.CacheDir != "" {
+		err := filepath.WalkDir(opts.CacheDir, func(path string, _ fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Lchown(path, p.uid, p.gid)
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	for _, f := range stateFiles(opts) {
+		if err := os.Lchown(f, p.uid, p.gid); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkStateWritable fails if a directory opts writes its state to isn't
+// writable, run once privileges are dropped. The status file is replaced and
+// the logs are rotated through their directories, which chownState leaves
+// alone.
+func checkStateWritable(opts app.WarpOptions) error {
+	var dirs []string
+	if !opts.NoCache && opts.CacheDir != "" {
+		dirs = append(dirs, opts.CacheDir)
+	}
+	for _, f := range []string{opts.StatusFile, opts.EventLog, opts.Pcap, opts.UsageCSV} {
+		if f != "" {
+			dirs = append(dirs, filepath.Dir(f))
+		}
+	}
+	for _, dir := range dirs {
+		f, err := os.CreateTemp(dir, ".warp-plus-*")
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s isn't writable: %w", dir, err)
+		}
+		f.Close()
+		os.Remove(f.Name())
+	}
+	return nil
+}
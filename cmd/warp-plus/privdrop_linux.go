@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// lookupPrivileges resolves spec, user or user:group by name or id. The
+// group defaults to the primary group of the user.
+func lookupPrivileges(spec string) (privileges, error) {
+	name, group, hasGroup := strings.Cut(spec, ":")
+	u, err := user.Lookup(name)
+	if err != nil {
+		if u, err = user.LookupId(name); err != nil {
+			return privileges{}, fmt.Errorf("unknown user %q", name)
+		}
+	}
+
+	gid := u.Gid
+	if hasGroup {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			if g, err = user.LookupGroupId(group); err != nil {
+				return privileges{}, fmt.Errorf("unknown group %q", group)
+			}
+		}
+		gid = g.Gid
+	}
+
+	p := privileges{user: u.Username}
+	if p.uid, err = strconv.Atoi(u.Uid); err != nil {
+		return privileges{}, fmt.Errorf("invalid uid %q", u.Uid)
+	}
+	if p.gid, err = strconv.Atoi(gid); err != nil {
+		return privileges{}, fmt.Errorf("invalid gid %q", gid)
+	}
+	return p, nil
+}
+
+// dropPrivileges switches all threads of the process to the user and group
+// of p for good, clearing the supplementary groups.
+func dropPrivileges(p privileges) error {
+	if err := syscall.Setgroups(nil); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(p.gid); err != nil {
+		return fmt.Errorf("setgid: %w", err)
+	}
+	if err := syscall.Setuid(p.uid); err != nil {
+		return fmt.Errorf("setuid: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/bepass-org/warp-plus/app"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestLookupPrivileges(t *testing.T) {
+	for _, spec := range []string{"root", "root:root", "0:0", "root:0"} {
+		p, err := lookupPrivileges(spec)
+		qt.Assert(t, err, qt.IsNil, qt.Commentf("%s", spec))
+		qt.Assert(t, p, qt.Equals, privileges{user: "root", uid: 0, gid: 0}, qt.Commentf("%s", spec))
+	}
+
+	_, err := lookupPrivileges("no-such-user-warp-plus")
+	qt.Assert(t, err, qt.ErrorMatches, `unknown user "no-such-user-warp-plus"`)
+	_, err = lookupPrivileges("root:no-such-group-warp-plus")
+	qt.Assert(t, err, qt.ErrorMatches, `unknown group "no-such-group-warp-plus"`)
+}
+
+func TestCheckDropPrivileges(t *testing.T) {
+	bind := netip.MustParseAddrPort("0.0.0.0:80")
+	qt.Assert(t, checkDropPrivileges(app.WarpOptions{Bind: bind}), qt.IsNil)
+	qt.Assert(t, checkDropPrivileges(app.WarpOptions{Bind: bind, SourcePort: 2408}), qt.IsNil)
+
+	qt.Assert(t, checkDropPrivileges(app.WarpOptions{Bind: bind, FwMark: 0x1375}), qt.ErrorMatches, ".*fwmark.*")
+	qt.Assert(t, checkDropPrivileges(app.WarpOptions{Bind: bind, SourcePort: 500}), qt.ErrorMatches, ".*wg-port 500.*")
+	qt.Assert(t, checkDropPrivileges(app.WarpOptions{Bind: bind, ReconnectOnNetworkChange: true}), qt.ErrorMatches, ".*proxy port 80.*")
+	// rotating psiphon keeps the proxy address bound
+	qt.Assert(t, checkDropPrivileges(app.WarpOptions{Bind: bind, Psiphon: &app.PsiphonOptions{Rotate: 1}}), qt.IsNil)
+	qt.Assert(t, checkDropPrivileges(app.WarpOptions{Bind: netip.MustParseAddrPort("0.0.0.0:8086"), ReconnectOnNetworkChange: true}), qt.IsNil)
+}
+
+func TestDropPrivileges(t *testing.T) {
+	// the switch can't be undone, so it happens in a child process
+	if os.Getenv("WARP_PLUS_TEST_DROP") == "1" {
+		p, err := lookupPrivileges("nobody")
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, dropPrivileges(p), qt.IsNil)
+		qt.Assert(t, os.Getuid(), qt.Equals, p.uid)
+		qt.Assert(t, os.Getgid(), qt.Equals, p.gid)
+		groups, err := os.Getgroups()
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, groups, qt.HasLen, 0)
+		// root can't be regained
+		qt.Assert(t, dropPrivileges(privileges{}), qt.IsNotNil)
+
+		dir := os.Getenv("WARP_PLUS_TEST_DROP_DIR")
+		qt.Assert(t, checkStateWritable(app.WarpOptions{StatusFile: filepath.Join(dir, "mine", "status.json")}), qt.IsNil)
+		qt.Assert(t, checkStateWritable(app.WarpOptions{StatusFile: filepath.Join(dir, "status.json")}), qt.ErrorMatches, ".* isn't writable: .*")
+		return
+	}
+	if os.Getuid() != 0 {
+		t.Skip("needs root")
+	}
+	if _, err := lookupPrivileges("nobody"); err != nil {
+		t.Skip("no nobody user")
+	}
+
+	// a directory of root and one handed over to nobody
+	p, _ := lookupPrivileges("nobody")
+	dir, err := os.MkdirTemp("", "privdrop")
+	qt.Assert(t, err, qt.IsNil)
+	defer os.RemoveAll(dir)
+	qt.Assert(t, os.Chmod(dir, 0o755), qt.IsNil)
+	qt.Assert(t, os.Mkdir(filepath.Join(dir, "mine"), 0o755), qt.IsNil)
+	qt.Assert(t, os.Chown(filepath.Join(dir, "mine"), p.uid, p.gid), qt.IsNil)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDropPrivileges$")
+	cmd.Env = append(os.Environ(), "WARP_PLUS_TEST_DROP=1", "WARP_PLUS_TEST_DROP_DIR="+dir)
+	out, err := cmd.CombinedOutput()
+	qt.Assert(t, err, qt.IsNil, qt.Commentf("%s", out))
+}
+
+func TestChownState(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("needs root")
+	}
+	dir := t.TempDir()
+	cacheDir := filepath.Join(dir, "cache")
+	qt.Assert(t, os.MkdirAll(filepath.Join(cacheDir, "primary"), 0o700), qt.IsNil)
+	qt.Assert(t, os.WriteFile(filepath.Join(cacheDir, "primary", "wgcf-identity.json"), nil, 0o600), qt.IsNil)
+	qt.Assert(t, os.WriteFile(filepath.Join(dir, "events.ndjson"), nil, 0o644), qt.IsNil)
+
+	p := privileges{user: "test", uid: 4242, gid: 4243}
+	opts := app.WarpOptions{CacheDir: cacheDir, EventLog: filepath.Join(dir, "events.ndjson"), StatusFile: filepath.Join(dir, "status.json")}
+	qt.Assert(t, chownState(opts, p), qt.IsNil)
+
+	for _, path := range []string{cacheDir, filepath.Join(cacheDir, "primary"), filepath.Join(cacheDir, "primary", "wgcf-identity.json"), filepath.Join(dir, "events.ndjson")} {
+		fi, err := os.Stat(path)
+		qt.Assert(t, err, qt.IsNil)
+		st := fi.Sys().(*syscall.Stat_t)
+		qt.Assert(t, [2]uint32{st.Uid, st.Gid}, qt.Equals, [2]uint32{4242, 4243}, qt.Commentf("%s", path))
+	}
+	// the directory of the files stays as it is
+	fi, err := os.Stat(dir)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, fi.Sys().(*syscall.Stat_t).Uid, qt.Equals, uint32(0))
+}
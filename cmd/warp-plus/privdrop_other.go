@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func lookupPrivileges(string) (privileges, error) {
+	return privileges{}, errors.ErrUnsupported
+}
+
+func dropPrivileges(privileges) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/bepass-org/warp-plus/app"
+	"github.com/peterbourgon/ff/v4"
+)
+
+func profilesCmd(rootConfig *rootConfig) {
+	command := &ff.Command{
+		Name:      "profiles",
+		Usage:     "profiles",
+		ShortHelp: "list the account profiles",
+		LongHelp:  "Prints the names of the account profiles under --cache-dir/profiles, one per line, to be used with --account-profile.",
+		Flags:     ff.NewFlagSet("profiles").SetParent(rootConfig.flags),
+		Exec: func(ctx context.Context, args []string) error {
+			names, err := app.ListProfiles(rootConfig.baseCacheDir())
+			if err != nil {
+				return err
+			}
+			for _, name := range names {
+				fmt.Fprintln(os.Stdout, name)
+			}
+			return nil
+		},
+	}
+	rootConfig.command.Subcommands = append(rootConfig.command.Subcommands, command)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"github.com/bepass-org/warp-plus/app"
+	"github.com/peterbourgon/ff/v4"
+	"github.com/peterbourgon/ff/v4/ffval"
+)
+
+func provisionCmd(rootConfig *rootConfig) {
+	var count, concurrency int
+	flags := ff.NewFlagSet("provision").SetParent(rootConfig.flags)
+	flags.AddFlag(ff.FlagConfig{
+		LongName: "license",
+		Value:    ffval.NewValue(&rootConfig.key),
+		Usage:    "license to apply, same as --key",
+	})
+	flags.AddFlag(ff.FlagConfig{
+		LongName: "count",
+		Value:    ffval.NewValueDefault(&count, 1),
+		Usage:    "number of accounts to provision, each in a numbered directory under --cache-dir",
+	})
+	flags.AddFlag(ff.FlagConfig{
+		LongName: "concurrency",
+		Value:    ffval.NewValueDefault(&concurrency, app.DefaultProvisionConcurrency),
+		Usage:    "number of accounts to register at once with --count",
+	})
+
+	command := &ff.Command{
+		Name:      "provision",
+		Usage:     "provision [FLAGS]",
+		ShortHelp: "register an account, apply a license and print it as JSON",
+		LongHelp:  "Registers the account under --cache-dir, or loads it when it is already there, applies the license given with --license and prints the account as JSON. With --gool the second identity of the inner tunnel is registered too. With --count N, N accounts are provisioned in --cache-dir/1 to --cache-dir/N and printed as a JSON array. No proxy is started.",
+		Flags:     flags,
+		Exec: func(ctx context.Context, args []string) error {
+			l := rootConfig.logger()
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if count == 1 {
+				info, err := app.Provision(ctx, l, rootConfig.warpOptions(l))
+				if err != nil {
+					return err
+				}
+				return encoder.Encode(info)
+			}
+
+			infos, err := app.ProvisionAccounts(ctx, l, rootConfig.warpOptions(l), count, concurrency)
+			if infos != nil {
+				if err := encoder.Encode(infos); err != nil {
+					return err
+				}
+			}
+			return err
+		},
+	}
+	rootConfig.command.Subcommands = append(rootConfig.command.Subcommands, command)
+}
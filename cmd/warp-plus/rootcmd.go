@@ -2,19 +2,27 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"net/netip"
 	"os"
 	"path"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/adrg/xdg"
 	"github.com/bepass-org/warp-plus/app"
+	"github.com/bepass-org/warp-plus/logutils"
 	p "github.com/bepass-org/warp-plus/psiphon"
 	"github.com/bepass-org/warp-plus/warp"
 	"github.com/bepass-org/warp-plus/wiresocks"
+	"github.com/carlmjohnson/versioninfo"
 	"github.com/peterbourgon/ff/v4"
 	"github.com/peterbourgon/ff/v4/ffval"
 )
@@ -24,23 +32,117 @@ type rootConfig struct {
 	command *ff.Command
 
 	verbose  bool
+	logSmpl  time.Duration
+	logFmt   string
+	color    string
+	otelEp   string
+	statsd   string
+	statsTag bool
+	usageCSV string
+	usageInt time.Duration
+	usageMax int64
 	v4       bool
 	v6       bool
 	bind     string
+	advAddr  string
+	noListen bool
+	socksHs  time.Duration
+	backlog  int
+	relayBuf int
+	bufCap   int
 	endpoint string
+	endpt4   string
+	endpt6   string
+	endptTyp string
 	key      string
+	teamTok  string
+	team     bool
+	userAgnt string
+	regRtry  uint
+	minQuota float64
+	identAge time.Duration
+	rcnOn    string
+	rcnNet   bool
+	rcnCool  time.Duration
 	dns      string
+	dnsConc  int
+	dialConc int
+	brkFail  int
+	brkCool  time.Duration
+	dnsByp   []string
+	bootDNS  string
+	dnsPre   string
 	gool     bool
 	psiphon  bool
 	country  string
+	psiRot   time.Duration
+	psiCtry  []string
+	verCtry  bool
+	psiFall  time.Duration
 	scan     bool
+	scanVal  bool
 	rtt      time.Duration
+	scanCidr []string
+	noDefPfx bool
+	scanRprt string
+	probe    bool
+	scanTmo  time.Duration
+	scanMax  int
+	scanPort []string
+	scanPing int
+	scanStab bool
+	scanBn   bool
+	scanTop  int
 	cacheDir string
+	noCache  bool
+	noAutoRg bool
+	acctProf string
 	fwmark   uint32
+	dscp     int
+	wgPort   int
+	wgPortRn bool
+	udpSocks string
 	reserved string
 	wgConf   string
 	testUrl  string
+	traceCA  string
+	reqColo  string
+	dialRtry bool
+	status   string
+	regURL   string
+	ipHook   string
+	maxHsAge time.Duration
+	grace    time.Duration
+	keepAlv  time.Duration
+	hsRetry  int
+	sockTO   time.Duration
+	notify   bool
+	chkUpd   bool
+	mtuProbe bool
+	delay    time.Duration
+	delayRnd bool
+	waitNet  time.Duration
+	budget   time.Duration
+	ctlSock  string
+	proxyPrt bool
+	tlsCert  string
+	tlsKey   string
+	tlsCA    string
+	dropPriv string
+	noPxLoc  bool
+	noPxCidr []string
+	allowDom []string
+	strict   bool
+	nat64    string
+	prRoutes bool
+	prRtOnly bool
+	pcap     string
+	pcapMax  int64
+	eventLog string
+	evLogMax int64
 	config   string
+	envFile  string
+	envVals  []string
 }
 
 func newRootCmd() *rootConfig {
@@ -53,6 +155,51 @@ func newRootCmd() *rootConfig {
 		Usage:     "enable verbose logging",
 		NoDefault: true,
 	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "log-sampling",
+		Value:    ffval.NewValueDefault(&cfg.logSmpl, 0),
+		Usage:    "collapse identical log lines repeated within this window (0 disables)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "log-format",
+		Value:    ffval.NewEnum(&cfg.logFmt, "text", "json", "logfmt"),
+		Usage:    "log output format",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "color",
+		Value:    ffval.NewEnum(&cfg.color, "auto", "always", "never"),
+		Usage:    "color the levels of text logs, auto only when writing to a terminal and NO_COLOR is unset",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "otel-endpoint",
+		Value:    ffval.NewValueDefault(&cfg.otelEp, ""),
+		Usage:    "export startup traces to this OTLP/HTTP endpoint (host:port or URL), needs a build with -tags otel",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "statsd-addr",
+		Value:    ffval.NewValueDefault(&cfg.statsd, ""),
+		Usage:    "push tunnel metrics to this StatsD server over UDP (host:port)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "statsd-tags",
+		Value:    ffval.NewValueDefault(&cfg.statsTag, false),
+		Usage:    "add DogStatsD tags to the pushed metrics",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "usage-csv",
+		Value:    ffval.NewValueDefault(&cfg.usageCSV, ""),
+		Usage:    "append the bytes sent and received and the connections made to this file as CSV rows",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "usage-interval",
+		Value:    ffval.NewValueDefault(&cfg.usageInt, app.DefaultUsageInterval),
+		Usage:    "how often a row is appended to the usage CSV",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "usage-csv-max-mb",
+		Value:    ffval.NewValueDefault(&cfg.usageMax, app.DefaultUsageCSVMaxSize>>20),
+		Usage:    "rotate the usage CSV after this many MiB, keeping one old file",
+	})
 	cfg.flags.AddFlag(ff.FlagConfig{
 		ShortName: '4',
 		Value:     ffval.NewValueDefault(&cfg.v4, false),
@@ -69,23 +216,148 @@ func newRootCmd() *rootConfig {
 		Value:     ffval.NewValueDefault(&cfg.bind, "127.0.0.1:8086"),
 		Usage:     "socks bind address",
 	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "advertise-addr",
+		Value:    ffval.NewValueDefault(&cfg.advAddr, ""),
+		Usage:    "address (ip or ip:port) reported to socks5 clients for UDP ASSOCIATE instead of the bind address",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "no-listener",
+		Value:    ffval.NewValueDefault(&cfg.noListen, false),
+		Usage:    "keep the tunnel up without serving a proxy on the bind address",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "socks-handshake-timeout",
+		Value:    ffval.NewValueDefault(&cfg.socksHs, wiresocks.DefaultHandshakeTimeout),
+		Usage:    "close proxy clients that don't finish the SOCKS or HTTP proxy negotiation within this time (0 waits forever)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "socks-backlog",
+		Value:    ffval.NewValueDefault(&cfg.backlog, 0),
+		Usage:    "accept backlog of the proxy listener, capped by the kernel (net.core.somaxconn on Linux) (0 uses the system default, which is that cap)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "relay-buffer-size",
+		Value:    ffval.NewValueDefault(&cfg.relayBuf, wiresocks.BuffSize),
+		Usage:    "size in bytes of the two copy buffers of every proxied connection",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "conn-buffer-cap",
+		Value:    ffval.NewValueDefault(&cfg.bufCap, 0),
+		Usage:    "cap in bytes of what the tunnel buffers for every proxied connection in each direction, 0 for no cap",
+	})
 	cfg.flags.AddFlag(ff.FlagConfig{
 		ShortName: 'e',
 		LongName:  "endpoint",
 		Value:     ffval.NewValueDefault(&cfg.endpoint, ""),
 		Usage:     "warp endpoint",
 	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "endpoint-v4",
+		Value:    ffval.NewValueDefault(&cfg.endpt4, ""),
+		Usage:    "warp endpoint to use over IPv4",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "endpoint-v6",
+		Value:    ffval.NewValueDefault(&cfg.endpt6, ""),
+		Usage:    "warp endpoint to use over IPv6",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "endpoint-type",
+		Value:    ffval.NewEnum(&cfg.endptTyp, app.EndpointAuto, app.EndpointV4, app.EndpointV6),
+		Usage:    "which of --endpoint-v4/--endpoint-v6 to use, auto prefers IPv4 and falls back to IPv6",
+	})
 	cfg.flags.AddFlag(ff.FlagConfig{
 		ShortName: 'k',
 		LongName:  "key",
 		Value:     ffval.NewValueDefault(&cfg.key, ""),
 		Usage:     "warp key",
 	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "team-token",
+		Value:    ffval.NewValueDefault(&cfg.teamTok, ""),
+		Usage:    "zero trust team enrollment token (see README for limitations)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "team",
+		Value:    ffval.NewValueDefault(&cfg.team, false),
+		Usage:    "connect with the zero trust team identity cached by an earlier --team-token run",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "user-agent",
+		Value:    ffval.NewValueDefault(&cfg.userAgnt, warp.DefaultUserAgent),
+		Usage:    "user agent for cloudflare API requests",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "register-retries",
+		Value:    ffval.NewValueDefault(&cfg.regRtry, 2),
+		Usage:    "retry a failed account registration this many times",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "min-quota",
+		Value:    ffval.NewValueDefault(&cfg.minQuota, 0),
+		Usage:    "refuse to start when the account has less WARP+ data left, in GB (0 disables)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "identity-max-age",
+		Value:    ffval.NewValueDefault(&cfg.identAge, 0),
+		Usage:    "register new identities at startup once the cached ones are older than this (0 keeps them)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "reconnect-on",
+		Value:    ffval.NewValueDefault(&cfg.rcnOn, strings.Join(app.DefaultReconnectOn, ",")),
+		Usage:    "comma separated error classes to reconnect on, others fail right away (" + strings.Join(app.ErrorClasses, ", ") + ")",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "reconnect-on-network-change",
+		Value:    ffval.NewValueDefault(&cfg.rcnNet, false),
+		Usage:    "reconnect when the default route or the addresses of its interface change, e.g. when switching from WiFi to cellular (Linux only)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "reconnect-cooldown",
+		Value:    ffval.NewValueDefault(&cfg.rcnCool, 0),
+		Usage:    "least time between two connection attempts, however quickly they fail (0 disables)",
+	})
 	cfg.flags.AddFlag(ff.FlagConfig{
 		LongName: "dns",
 		Value:    ffval.NewValueDefault(&cfg.dns, "1.1.1.1"),
 		Usage:    "DNS address",
 	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "bootstrap-dns",
+		Value:    ffval.NewValueDefault(&cfg.bootDNS, ""),
+		Usage:    "DNS server[:port] for the lookups made before the tunnel is up, instead of the system resolver",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "dns-concurrency",
+		Value:    ffval.NewValueDefault(&cfg.dnsConc, 0),
+		Usage:    "resolve at most this many destination hostnames at a time, 0 for no limit",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "dial-concurrency",
+		Value:    ffval.NewValueDefault(&cfg.dialConc, wiresocks.DefaultDialConcurrency),
+		Usage:    "dial at most this many connections through the tunnel at a time, queueing the others, 0 for no limit",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "circuit-breaker-failures",
+		Value:    ffval.NewValueDefault(&cfg.brkFail, 0),
+		Usage:    "refuse a destination for --circuit-breaker-cooldown after this many failed dials to it in a row (0 disables)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "circuit-breaker-cooldown",
+		Value:    ffval.NewValueDefault(&cfg.brkCool, 30*time.Second),
+		Usage:    "how long to refuse a destination once the circuit breaker opened",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "dns-bypass-suffix",
+		Value:    ffval.NewList(&cfg.dnsByp),
+		Usage:    "resolve a domain and its subdomains with a DNS server outside the tunnel, as domain=server[:port] (repeatable)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "dns-preload",
+		Value:    ffval.NewValueDefault(&cfg.dnsPre, ""),
+		Usage:    "file of hostnames, one per line, to resolve at startup and keep cached",
+	})
 	cfg.flags.AddFlag(ff.FlagConfig{
 		LongName: "gool",
 		Value:    ffval.NewValueDefault(&cfg.gool, false),
@@ -98,8 +370,28 @@ func newRootCmd() *rootConfig {
 	})
 	cfg.flags.AddFlag(ff.FlagConfig{
 		LongName: "country",
-		Value:    ffval.NewEnum(&cfg.country, p.Countries...),
-		Usage:    "psiphon country code",
+		Value:    ffval.NewEnum(&cfg.country, append(slices.Clone(p.Countries), app.PsiphonCountryAuto)...),
+		Usage:    "psiphon country code, auto picks one near your location",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "psiphon-rotate",
+		Value:    ffval.NewValueDefault(&cfg.psiRot, 0),
+		Usage:    "reconnect psiphon to another of --psiphon-countries at this interval (0 disables)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "psiphon-countries",
+		Value:    ffval.NewList(&cfg.psiCtry),
+		Usage:    "comma separated psiphon country codes --psiphon-rotate picks from, at least two different (repeatable)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "verify-country",
+		Value:    ffval.NewValueDefault(&cfg.verCtry, false),
+		Usage:    "check the psiphon egress country after connecting and reconnect, then fail, while it isn't the requested one",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "psiphon-fallback",
+		Value:    ffval.NewValueDefault(&cfg.psiFall, 0),
+		Usage:    "serve plain warp when psiphon isn't connected within this time, losing the country selection (0 disables)",
 	})
 	cfg.flags.AddFlag(ff.FlagConfig{
 		LongName: "scan",
@@ -110,14 +402,109 @@ func newRootCmd() *rootConfig {
 		LongName: "rtt",
 		Value:    ffval.NewValueDefault(&cfg.rtt, 1000*time.Millisecond),
 	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "scan-cidr",
+		Value:    ffval.NewList(&cfg.scanCidr),
+		Usage:    "prefix to scan instead of the default warp prefixes (repeatable)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "no-default-prefixes",
+		Value:    ffval.NewValueDefault(&cfg.noDefPfx, false),
+		Usage:    "fail the scan instead of using the default warp prefixes when no --scan-cidr is given",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "scan-report",
+		Value:    ffval.NewValueDefault(&cfg.scanRprt, ""),
+		Usage:    "write the full ranked scan results to this file (.json or .csv), scanning every candidate",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "probe-only",
+		Value:    ffval.NewValueDefault(&cfg.probe, false),
+		Usage:    "only check endpoint reachability while scanning, ignoring RTT",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "scan-timeout",
+		Value:    ffval.NewValueDefault(&cfg.scanTmo, time.Minute),
+		Usage:    "stop scanning after this long and use the best endpoints found so far",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "scan-max-candidates",
+		Value:    ffval.NewValueDefault(&cfg.scanMax, 0),
+		Usage:    "probe at most this many addresses, sampled across the scan prefixes (0 probes without a cap)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "scan-ports",
+		Value:    ffval.NewList(&cfg.scanPort),
+		Usage:    "comma separated UDP ports to probe every scanned address on, ranking each address:port (repeatable)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "scan-ping-count",
+		Value:    ffval.NewValueDefault(&cfg.scanPing, 1),
+		Usage:    "probe every scanned address:port this many times, ranking by the median RTT and measuring loss and jitter",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "scan-rank-stability",
+		Value:    ffval.NewValueDefault(&cfg.scanStab, false),
+		Usage:    "rank scan results by RTT weighted with their jitter and loss (needs --scan-ping-count of at least 2)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "scan-bench",
+		Value:    ffval.NewValueDefault(&cfg.scanBn, false),
+		Usage:    "rank the best scan results by the throughput of a short download through each instead of RTT",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "scan-bench-top",
+		Value:    ffval.NewValueDefault(&cfg.scanTop, app.DefaultScanBenchTop),
+		Usage:    "number of scan results to benchmark with --scan-bench",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "scan-validate",
+		Value:    ffval.NewValueDefault(&cfg.scanVal, false),
+		Usage:    "check the scan prefixes against the enabled address families, report the candidate count and exit",
+	})
 	cfg.flags.AddFlag(ff.FlagConfig{
 		LongName: "cache-dir",
 		Value:    ffval.NewValueDefault(&cfg.cacheDir, ""),
 	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "no-cache",
+		Value:    ffval.NewValueDefault(&cfg.noCache, false),
+		Usage:    "register a fresh throwaway identity every run instead of using the cache (uses up device slots)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "no-auto-register",
+		Value:    ffval.NewValueDefault(&cfg.noAutoRg, false),
+		Usage:    "fail when no identity is cached instead of registering one, leaving registration to the provision command",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "account-profile",
+		Value:    ffval.NewValueDefault(&cfg.acctProf, ""),
+		Usage:    "use the account of the named profile, kept in --cache-dir/profiles/NAME and created if absent",
+	})
 	cfg.flags.AddFlag(ff.FlagConfig{
 		LongName: "fwmark",
 		Value:    ffval.NewValueDefault(&cfg.fwmark, 0x0),
 	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "dscp",
+		Value:    ffval.NewValueDefault(&cfg.dscp, 0),
+		Usage:    "mark the outer wireguard packets with this DSCP value (0-63)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "wg-port",
+		Value:    ffval.NewValueDefault(&cfg.wgPort, 0),
+		Usage:    "UDP source port of the outer wireguard packets (0 lets the system pick)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "wg-port-random",
+		Value:    ffval.NewValueDefault(&cfg.wgPortRn, false),
+		Usage:    "use a new random UDP source port on every connect",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "udp-socks",
+		Value:    ffval.NewValueDefault(&cfg.udpSocks, ""),
+		Usage:    "send the outer wireguard packets through the UDP ASSOCIATE relay of this SOCKS5 proxy ([user:password@]host:port)",
+	})
 	cfg.flags.AddFlag(ff.FlagConfig{
 		LongName: "reserved",
 		Value:    ffval.NewValueDefault(&cfg.reserved, ""),
@@ -130,11 +517,191 @@ func newRootCmd() *rootConfig {
 		LongName: "test-url",
 		Value:    ffval.NewValueDefault(&cfg.testUrl, "http://connectivity.cloudflareclient.com/cdn-cgi/trace"),
 	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "trace-ca",
+		Value:    ffval.NewValueDefault(&cfg.traceCA, ""),
+		Usage:    "verify the connectivity checks against the PEM certificates in this file instead of the system store",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "require-colo",
+		Value:    ffval.NewValueDefault(&cfg.reqColo, ""),
+		Usage:    "keep reconnecting until the tunnel lands in this cloudflare colo (e.g. FRA)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "dial-retry",
+		Value:    ffval.NewValueDefault(&cfg.dialRtry, false),
+		Usage:    "retry a failed connection through the tunnel once it handshakes again or moves endpoints, waiting up to 5s",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "mtu-probe",
+		Value:    ffval.NewValueDefault(&cfg.mtuProbe, false),
+		Usage:    "lower the tunnel mtu, down to 1280, while large transfers stall but small ones go through",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "status-file",
+		Value:    ffval.NewValueDefault(&cfg.status, ""),
+		Usage:    "keep a JSON file with the live connection state at this path",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "register-url",
+		Value:    ffval.NewValueDefault(&cfg.regURL, ""),
+		Usage:    "announce the instance for service discovery by POSTing it to this http(s) URL or writing it into this file:// directory",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "ip-change-webhook",
+		Value:    ffval.NewValueDefault(&cfg.ipHook, ""),
+		Usage:    "POST the old and new egress IP as JSON to this http(s) URL whenever it changes",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "max-handshake-age",
+		Value:    ffval.NewValueDefault(&cfg.maxHsAge, app.DefaultMaxHandshakeAge),
+		Usage:    "consider the tunnel unhealthy once the last handshake is older than this",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "startup-grace",
+		Value:    ffval.NewValueDefault(&cfg.grace, time.Duration(0)),
+		Usage:    "report the tunnel as starting rather than unhealthy for this long after startup",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "keepalive",
+		Value:    ffval.NewValueDefault(&cfg.keepAlv, app.DefaultKeepAlive),
+		Usage:    "persistent keepalive interval of the wireguard peers, 0 disables keepalives",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "handshake-retries",
+		Value:    ffval.NewValueDefault(&cfg.hsRetry, app.DefaultHandshakeRetries),
+		Usage:    "retransmit the handshake to an endpoint this many times before trying the next",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "socket-timeout",
+		Value:    ffval.NewValueDefault(&cfg.sockTO, 0),
+		Usage:    "fail writes on the wireguard socket that take longer than this, 0 for no limit",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "notify",
+		Value:    ffval.NewValueDefault(&cfg.notify, false),
+		Usage:    "show desktop notifications when the tunnel connects, reconnects or goes down",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "check-update",
+		Value:    ffval.NewValueDefault(&cfg.chkUpd, false),
+		Usage:    "log a notice at startup when a newer release is available on GitHub",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "startup-delay",
+		Value:    ffval.NewValueDefault(&cfg.delay, 0),
+		Usage:    "wait this long before registering and connecting",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "startup-delay-random",
+		Value:    ffval.NewValueDefault(&cfg.delayRnd, false),
+		Usage:    "wait a random time up to --startup-delay instead",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "wait-for-network",
+		Value:    ffval.NewValueDefault(&cfg.waitNet, 0),
+		Usage:    "wait up to this long for the network to come up before starting (0 doesn't wait)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "startup-budget",
+		Value:    ffval.NewValueDefault(&cfg.budget, 0),
+		Usage:    "give up when the tunnel isn't up after this long, across all retries (0 disables)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "control-socket",
+		Value:    ffval.NewValueDefault(&cfg.ctlSock, ""),
+		Usage:    "accept runtime commands (egress-ip, health, ready, pause, resume, rescan, errors) on a unix socket at this path",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "proxy-protocol",
+		Value:    ffval.NewValueDefault(&cfg.proxyPrt, false),
+		Usage:    "require a PROXY protocol v1/v2 header on proxy connections (behind a load balancer)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "tls-cert",
+		Value:    ffval.NewValueDefault(&cfg.tlsCert, ""),
+		Usage:    "serve the proxy over TLS with this PEM certificate (requires --tls-key)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "tls-key",
+		Value:    ffval.NewValueDefault(&cfg.tlsKey, ""),
+		Usage:    "PEM private key of --tls-cert",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "tls-client-ca",
+		Value:    ffval.NewValueDefault(&cfg.tlsCA, ""),
+		Usage:    "require proxy clients to present a certificate issued by a CA in this PEM file",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "drop-privileges",
+		Value:    ffval.NewValueDefault(&cfg.dropPriv, ""),
+		Usage:    "switch to this user[:group] once the proxy is up, e.g. nobody:nogroup (linux only)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "no-proxy-local",
+		Value:    ffval.NewValueDefault(&cfg.noPxLoc, false),
+		Usage:    "connect to localhost and private network destinations directly instead of through warp",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "no-proxy-cidr",
+		Value:    ffval.NewList(&cfg.noPxCidr),
+		Usage:    "prefix to connect to directly with --no-proxy-local, replacing the default private ranges (repeatable)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "allow-domain",
+		Value:    ffval.NewList(&cfg.allowDom),
+		Usage:    "domain to serve with --strict-allow, *.example.com for its subdomains (repeatable)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "strict-allow",
+		Value:    ffval.NewValueDefault(&cfg.strict, false),
+		Usage:    "refuse proxy requests to destinations not matching an --allow-domain",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "nat64-prefix",
+		Value:    ffval.NewValueDefault(&cfg.nat64, ""),
+		Usage:    "reach IPv4 destinations through the NAT64 gateway of this prefix, e.g. 64:ff9b::/96",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "print-routes",
+		Value:    ffval.NewValueDefault(&cfg.prRoutes, false),
+		Usage:    "print the effective routing rules at startup",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "print-routes-only",
+		Value:    ffval.NewValueDefault(&cfg.prRtOnly, false),
+		Usage:    "print the effective routing rules and exit",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "pcap",
+		Value:    ffval.NewValueDefault(&cfg.pcap, ""),
+		Usage:    "debug: write the outer tunnel packets to this pcap file (reveals endpoints and traffic patterns)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "pcap-max-mb",
+		Value:    ffval.NewValueDefault(&cfg.pcapMax, app.DefaultPcapMaxSize>>20),
+		Usage:    "rotate the pcap file after this many MiB, keeping one old file",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "event-log",
+		Value:    ffval.NewValueDefault(&cfg.eventLog, ""),
+		Usage:    "append connection events as JSON lines to this file",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "event-log-max-mb",
+		Value:    ffval.NewValueDefault(&cfg.evLogMax, app.DefaultEventLogMaxSize>>20),
+		Usage:    "rotate the event log after this many MiB, keeping one old file",
+	})
 	cfg.flags.AddFlag(ff.FlagConfig{
 		ShortName: 'c',
 		LongName:  "config",
 		Value:     ffval.NewValueDefault(&cfg.config, ""),
 	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "env-file",
+		Value:    ffval.NewValueDefault(&cfg.envFile, ""),
+		Usage:    "read unset flags from KEY=value lines, e.g. TEAM_TOKEN or WARP_PLUS_TEAM_TOKEN for --team-token",
+	})
 	cfg.command = &ff.Command{
 		Name:  appName,
 		Flags: cfg.flags,
@@ -143,17 +710,88 @@ func newRootCmd() *rootConfig {
 	return &cfg
 }
 
-func (c *rootConfig) exec(ctx context.Context, args []string) error {
-	l := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
+// textHandler returns the text log handler writing to f, colored as set by
+// the --color mode.
+func textHandler(f *os.File, hOpts *slog.HandlerOptions, color string) slog.Handler {
+	enabled := color == "always"
+	if color == "auto" {
+		fi, err := f.Stat()
+		enabled = err == nil && fi.Mode()&os.ModeCharDevice != 0 && os.Getenv("NO_COLOR") == ""
+	}
+	if enabled {
+		return logutils.NewColorHandler(f, hOpts)
+	}
+	return slog.NewTextHandler(f, hOpts)
+}
 
+// logger sets up logging as configured by the flags.
+func (c *rootConfig) logger() *slog.Logger {
+	level := slog.LevelInfo
 	if c.verbose {
-		l = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		level = slog.LevelDebug
 	}
 
+	hOpts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch c.logFmt {
+	case "json":
+		h = slog.NewJSONHandler(os.Stdout, hOpts)
+	case "logfmt":
+		h = logutils.NewLogfmtHandler(os.Stdout, hOpts)
+	default:
+		h = textHandler(os.Stdout, hOpts, c.color)
+	}
+	if c.logSmpl > 0 {
+		h = logutils.NewSamplingHandler(h, c.logSmpl)
+	}
+	return slog.New(h)
+}
+
+// baseCacheDir returns the cache directory, before any account profile is
+// applied.
+func (c *rootConfig) baseCacheDir() string {
+	switch {
+	case c.cacheDir != "":
+		return c.cacheDir
+	case xdg.CacheHome != "":
+		return path.Join(xdg.CacheHome, appName)
+	case os.Getenv("HOME") != "":
+		return path.Join(os.Getenv("HOME"), ".cache", appName)
+	default:
+		return "warp_plus_cache"
+	}
+}
+
+// warpOptions validates the flags and turns them into app options. It exits
+// on invalid flags.
+func (c *rootConfig) warpOptions(l *slog.Logger) app.WarpOptions {
 	if c.psiphon && c.gool {
 		fatal(l, errors.New("can't use cfon and gool at the same time"))
 	}
 
+	if c.noListen && c.psiphon {
+		fatal(l, errors.New("can't use no-listener and cfon at the same time"))
+	}
+
+	if (c.teamTok != "" || c.team) && c.key != "" {
+		fatal(l, errors.New("can't use a warp key and a team token at the same time"))
+	}
+
+	if c.team && c.teamTok == "" && c.noCache {
+		fatal(l, errors.New("--team without --team-token needs the cache, enroll with --team-token instead"))
+	}
+
+	if c.dscp < 0 || c.dscp > 63 {
+		fatal(l, errors.New("dscp must be between 0 and 63"))
+	}
+
+	if c.wgPort < 0 || c.wgPort > 65535 {
+		fatal(l, errors.New("wg-port must be between 0 and 65535"))
+	}
+	if c.wgPort != 0 && c.wgPortRn {
+		fatal(l, errors.New("--wg-port and --wg-port-random can't be used together"))
+	}
+
 	if c.v4 && c.v6 {
 		fatal(l, errors.New("can't force v4 and v6 at the same time"))
 	}
@@ -167,42 +805,400 @@ func (c *rootConfig) exec(ctx context.Context, args []string) error {
 		fatal(l, fmt.Errorf("invalid bind address: %w", err))
 	}
 
+	// the port of the advertised address is optional
+	var advAddr netip.AddrPort
+	if c.advAddr != "" {
+		if addr, err := netip.ParseAddr(c.advAddr); err == nil {
+			advAddr = netip.AddrPortFrom(addr, 0)
+		} else if advAddr, err = netip.ParseAddrPort(c.advAddr); err != nil {
+			fatal(l, fmt.Errorf("invalid advertise address: %w", err))
+		}
+		if advAddr.Addr().IsUnspecified() {
+			fatal(l, errors.New("--advertise-addr must be an address clients can reach"))
+		}
+	}
+
 	dnsAddr, err := netip.ParseAddr(c.dns)
 	if err != nil {
 		fatal(l, fmt.Errorf("invalid DNS address: %w", err))
 	}
 
+	var bootDNS netip.AddrPort
+	if c.bootDNS != "" {
+		if bootDNS, err = wiresocks.ParseDNSServer(c.bootDNS); err != nil {
+			fatal(l, fmt.Errorf("invalid bootstrap DNS server: %w", err))
+		}
+	}
+
 	opts := app.WarpOptions{
 		Bind:            bindAddrPort,
+		AdvertiseAddr:   advAddr,
+		NoListener:      c.noListen,
+		ListenBacklog:   c.backlog,
 		Endpoint:        c.endpoint,
 		License:         c.key,
+		TeamToken:       c.teamTok,
+		Team:            c.team,
+		UserAgent:       c.userAgnt,
+		RegisterRetries: c.regRtry,
 		DnsAddr:         dnsAddr,
+		BootstrapDNS:    bootDNS,
 		Gool:            c.gool,
 		FwMark:          c.fwmark,
 		WireguardConfig: c.wgConf,
 		Reserved:        c.reserved,
 		TestURL:         c.testUrl,
+		RequireColo:     strings.ToUpper(c.reqColo),
+		DialRetry:       c.dialRtry,
+		StatusFile:      c.status,
+		IPChangeWebhook: c.ipHook,
+		MaxHandshakeAge: c.maxHsAge,
+		NoCache:         c.noCache,
+		NoAutoRegister:  c.noAutoRg,
+		MTUProbe:        c.mtuProbe,
+		ControlSocket:   c.ctlSock,
+		ProxyProtocol:   c.proxyPrt,
+		DSCP:            c.dscp,
+		Pcap:            c.pcap,
+		PcapMaxSize:     c.pcapMax << 20,
 	}
 
+	opts.StartupDelay, opts.StartupDelayRandom = c.delay, c.delayRnd
+	if c.waitNet < 0 {
+		fatal(l, errors.New("--wait-for-network can't be negative"))
+	}
+	opts.WaitForNetwork = c.waitNet
+	if c.budget > 0 && c.delay >= c.budget {
+		fatal(l, errors.New("--startup-budget must be longer than --startup-delay"))
+	}
+	opts.StartupBudget = c.budget
+	if c.grace < 0 {
+		fatal(l, errors.New("--startup-grace can't be negative"))
+	}
+	opts.StartupGrace = c.grace
+	opts.SourcePort, opts.RandomSourcePort = uint16(c.wgPort), c.wgPortRn
+	opts.UDPSocks = c.udpSocks
+	opts.ReconnectOnNetworkChange = c.rcnNet
+	if c.rcnCool < 0 {
+		fatal(l, errors.New("--reconnect-cooldown can't be negative"))
+	}
+	opts.ReconnectCooldown = c.rcnCool
+	opts.EventLog, opts.EventLogMaxSize = c.eventLog, c.evLogMax<<20
+
+	if c.relayBuf < wiresocks.MinBufferSize || c.relayBuf > wiresocks.MaxBufferSize {
+		fatal(l, fmt.Errorf("--relay-buffer-size must be between %d and %d", wiresocks.MinBufferSize, wiresocks.MaxBufferSize))
+	}
+	opts.RelayBufferSize = c.relayBuf
+	if c.socksHs < 0 {
+		fatal(l, errors.New("--socks-handshake-timeout can't be negative"))
+	}
+	opts.SocksHandshakeTimeout = c.socksHs
+
+	if c.bufCap != 0 && c.bufCap < wiresocks.MinConnBufferCap {
+		fatal(l, fmt.Errorf("--conn-buffer-cap must be 0 or at least %d", wiresocks.MinConnBufferCap))
+	}
+	opts.ConnBufferCap = c.bufCap
+
+	if c.dnsConc < 0 {
+		fatal(l, errors.New("--dns-concurrency can't be negative"))
+	}
+	opts.DNSConcurrency = c.dnsConc
+
+	if c.dialConc < 0 {
+		fatal(l, errors.New("--dial-concurrency can't be negative"))
+	}
+	opts.DialConcurrency = c.dialConc
+
 	switch {
-	case c.cacheDir != "":
-		opts.CacheDir = c.cacheDir
-	case xdg.CacheHome != "":
-		opts.CacheDir = path.Join(xdg.CacheHome, appName)
-	case os.Getenv("HOME") != "":
-		opts.CacheDir = path.Join(os.Getenv("HOME"), ".cache", appName)
+	case c.brkFail < 0:
+		fatal(l, errors.New("--circuit-breaker-failures can't be negative"))
+	case c.brkFail > 0 && c.brkCool <= 0:
+		fatal(l, errors.New("--circuit-breaker-cooldown must be positive"))
+	}
+	opts.CircuitBreakerFailures, opts.CircuitBreakerCooldown = c.brkFail, c.brkCool
+
+	for _, rule := range c.dnsByp {
+		bypass, err := wiresocks.ParseDNSBypass(rule)
+		if err != nil {
+			fatal(l, err)
+		}
+		opts.DNSBypass = append(opts.DNSBypass, bypass)
+	}
+	if c.dnsPre != "" {
+		b, err := os.ReadFile(c.dnsPre)
+		if err != nil {
+			fatal(l, fmt.Errorf("invalid dns preload list: %w", err))
+		}
+		hosts, err := wiresocks.ParseHostList(string(b))
+		if err != nil {
+			fatal(l, fmt.Errorf("invalid dns preload list %s: %w", c.dnsPre, err))
+		}
+		opts.DNSPreload = hosts
+	}
+
+	switch {
+	case c.keepAlv < 0:
+		fatal(l, errors.New("--keepalive can't be negative"))
+	case c.keepAlv == 0:
+		opts.KeepAlive = -1
+	case c.keepAlv < time.Second:
+		fatal(l, errors.New("--keepalive must be at least 1s"))
+	default:
+		opts.KeepAlive = c.keepAlv
+	}
+
+	switch {
+	case c.hsRetry < 0 || c.hsRetry > app.MaxHandshakeRetries:
+		fatal(l, fmt.Errorf("--handshake-retries must be between 0 and %d", app.MaxHandshakeRetries))
+	case c.hsRetry == 0:
+		opts.HandshakeRetries = -1
 	default:
-		opts.CacheDir = "warp_plus_cache"
+		opts.HandshakeRetries = c.hsRetry
+	}
+
+	if c.sockTO != 0 && c.sockTO < time.Second {
+		fatal(l, errors.New("--socket-timeout must be 0 or at least 1s"))
+	}
+	opts.SocketTimeout = c.sockTO
+
+	if c.statsd != "" {
+		opts.Statsd = &app.StatsdOptions{Addr: c.statsd, Tags: c.statsTag}
+	} else if c.statsTag {
+		fatal(l, errors.New("--statsd-tags requires --statsd-addr"))
+	}
+	if c.usageInt <= 0 {
+		fatal(l, errors.New("--usage-interval must be positive"))
+	}
+	opts.UsageCSV, opts.UsageInterval, opts.UsageCSVMaxSize = c.usageCSV, c.usageInt, c.usageMax<<20
+
+	if c.minQuota < 0 {
+		fatal(l, errors.New("min-quota can't be negative"))
+	}
+	opts.MinQuota = int64(c.minQuota * 1e9)
+
+	if c.identAge < 0 {
+		fatal(l, errors.New("identity-max-age can't be negative"))
+	}
+	opts.IdentityMaxAge = c.identAge
+	if c.noAutoRg && c.noCache {
+		fatal(l, errors.New("--no-auto-register can't be used with --no-cache"))
+	}
+	if c.noAutoRg && c.identAge > 0 {
+		fatal(l, errors.New("--no-auto-register can't be used with --identity-max-age"))
+	}
+
+	if c.notify {
+		opts.OnEvent = desktopNotifier(l)
+	}
+
+	if (c.tlsCert == "") != (c.tlsKey == "") {
+		fatal(l, errors.New("--tls-cert and --tls-key must be given together"))
+	}
+	if c.tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.tlsCert, c.tlsKey)
+		if err != nil {
+			fatal(l, fmt.Errorf("invalid tls certificate or key: %w", err))
+		}
+		opts.ProxyTLS = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+	if c.tlsCA != "" {
+		if opts.ProxyTLS == nil {
+			fatal(l, errors.New("--tls-client-ca requires --tls-cert"))
+		}
+		b, err := os.ReadFile(c.tlsCA)
+		if err != nil {
+			fatal(l, fmt.Errorf("invalid tls client ca: %w", err))
+		}
+		opts.ProxyTLS.ClientCAs = x509.NewCertPool()
+		if !opts.ProxyTLS.ClientCAs.AppendCertsFromPEM(b) {
+			fatal(l, fmt.Errorf("no certificates found in %s", c.tlsCA))
+		}
+		opts.ProxyTLS.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	if c.traceCA != "" {
+		roots, err := app.LoadTraceCA(c.traceCA)
+		if err != nil {
+			fatal(l, fmt.Errorf("invalid trace ca: %w", err))
+		}
+		opts.TraceCA = roots
+	}
+
+	for _, class := range strings.Split(c.rcnOn, ",") {
+		class = strings.TrimSpace(class)
+		if class == "" {
+			continue
+		}
+		if !slices.Contains(app.ErrorClasses, class) {
+			fatal(l, fmt.Errorf("invalid reconnect error class: %q", class))
+		}
+		opts.ReconnectOn = append(opts.ReconnectOn, class)
+	}
+
+	opts.CacheDir = c.baseCacheDir()
+	if c.acctProf != "" {
+		if c.noCache {
+			fatal(l, errors.New("--account-profile can't be used with --no-cache"))
+		}
+		dir, err := app.ProfileDir(opts.CacheDir, c.acctProf)
+		if err != nil {
+			fatal(l, err)
+		}
+		opts.CacheDir = dir
 	}
 
 	if c.psiphon {
 		l.Info("psiphon mode enabled", "country", c.country)
-		opts.Psiphon = &app.PsiphonOptions{Country: c.country}
+		if c.psiFall < 0 {
+			fatal(l, errors.New("--psiphon-fallback can't be negative"))
+		}
+		opts.Psiphon = &app.PsiphonOptions{Country: c.country, Rotate: c.psiRot, VerifyCountry: c.verCtry, Fallback: c.psiFall}
+		for _, list := range c.psiCtry {
+			for _, country := range strings.Split(list, ",") {
+				country = strings.ToUpper(strings.TrimSpace(country))
+				if !slices.Contains(p.Countries, country) {
+					fatal(l, fmt.Errorf("invalid psiphon country %q", country))
+				}
+				if !slices.Contains(opts.Psiphon.Countries, country) {
+					opts.Psiphon.Countries = append(opts.Psiphon.Countries, country)
+				}
+			}
+		}
+		if c.psiRot > 0 && len(opts.Psiphon.Countries) < 2 {
+			fatal(l, errors.New("--psiphon-rotate needs at least two different --psiphon-countries"))
+		}
+	} else if c.psiFall > 0 {
+		fatal(l, errors.New("--psiphon-fallback requires --cfon"))
+	} else if c.psiRot > 0 {
+		fatal(l, errors.New("--psiphon-rotate requires --cfon"))
+	} else if len(c.psiCtry) > 0 {
+		fatal(l, errors.New("--psiphon-countries requires --cfon"))
+	} else if c.verCtry {
+		fatal(l, errors.New("--verify-country requires --cfon"))
+	}
+
+	if c.noPxLoc {
+		opts.DirectPrefixes = wiresocks.DefaultLocalPrefixes
+		if len(c.noPxCidr) > 0 {
+			opts.DirectPrefixes = nil
+		}
+		for _, cidr := range c.noPxCidr {
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				fatal(l, fmt.Errorf("invalid no-proxy prefix: %w", err))
+			}
+			opts.DirectPrefixes = append(opts.DirectPrefixes, prefix)
+		}
+	} else if len(c.noPxCidr) > 0 {
+		fatal(l, errors.New("--no-proxy-cidr requires --no-proxy-local"))
+	}
+
+	if c.strict {
+		if len(c.allowDom) == 0 {
+			fatal(l, errors.New("--strict-allow requires at least one --allow-domain"))
+		}
+		for _, pattern := range c.allowDom {
+			if err := wiresocks.ValidateDomainPattern(pattern); err != nil {
+				fatal(l, err)
+			}
+		}
+		opts.AllowDomains = c.allowDom
+	} else if len(c.allowDom) > 0 {
+		fatal(l, errors.New("--allow-domain requires --strict-allow"))
+	}
+
+	if c.nat64 != "" {
+		prefix, err := netip.ParsePrefix(c.nat64)
+		if err != nil {
+			fatal(l, fmt.Errorf("invalid nat64 prefix: %w", err))
+		}
+		if err := wiresocks.ValidateNAT64Prefix(prefix); err != nil {
+			fatal(l, err)
+		}
+		opts.NAT64Prefix = prefix
+	}
+
+	if c.scanBn {
+		if !c.scan {
+			fatal(l, errors.New("--scan-bench requires --scan"))
+		}
+		if c.scanTop < 1 {
+			fatal(l, errors.New("scan-bench-top must be at least 1"))
+		}
+		opts.ScanBench = c.scanTop
+	}
+
+	if c.scan || c.scanVal {
+		opts.Scan = &wiresocks.ScanOptions{V4: c.v4, V6: c.v6, MaxRTT: c.rtt, NoDefaultPrefixes: c.noDefPfx, ReportPath: c.scanRprt, ProbeOnly: c.probe, ScanDeadline: c.scanTmo}
+		if c.scanMax < 0 {
+			fatal(l, errors.New("scan-max-candidates can't be negative"))
+		}
+		opts.Scan.MaxCandidates = c.scanMax
+		if c.scanPing < 1 {
+			fatal(l, errors.New("scan-ping-count must be at least 1"))
+		}
+		if c.scanStab && c.scanPing < 2 {
+			fatal(l, errors.New("--scan-rank-stability needs --scan-ping-count of at least 2"))
+		}
+		opts.Scan.PingCount, opts.Scan.RankStability = c.scanPing, c.scanStab
+		for _, cidr := range c.scanCidr {
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				fatal(l, fmt.Errorf("invalid scan prefix: %w", err))
+			}
+			opts.Scan.Prefixes = append(opts.Scan.Prefixes, prefix)
+		}
+		for _, list := range c.scanPort {
+			for _, p := range strings.Split(list, ",") {
+				port, err := strconv.ParseUint(strings.TrimSpace(p), 10, 16)
+				if err != nil || port == 0 {
+					fatal(l, fmt.Errorf("invalid scan port %q", p))
+				}
+				opts.Scan.Ports = append(opts.Scan.Ports, uint16(port))
+			}
+		}
+	}
+
+	return opts
+}
+
+func (c *rootConfig) exec(ctx context.Context, args []string) error {
+	l := c.logger()
+	if c.envFile != "" {
+		l.Info("loaded flags from env file", "path", c.envFile, "flags", c.envVals)
+	}
+	opts := c.warpOptions(l)
+
+	if c.scanVal {
+		plan, err := wiresocks.ValidateScan(*opts.Scan)
+		if err != nil {
+			fatal(l, fmt.Errorf("invalid scan configuration: %w", err))
+		}
+		for _, prefix := range plan.Skipped {
+			l.Warn("skipping prefix of a disabled address family", "prefix", prefix)
+		}
+		fmt.Printf("scan configuration is valid: %d prefixes, %s candidate addresses, %s probes\n", len(plan.Prefixes), plan.Candidates, plan.Probes)
+		if plan.Collect > 0 {
+			fmt.Printf("the scan stops early once %d endpoints respond, and after %s at the latest\n", plan.Collect, plan.Deadline)
+		} else {
+			fmt.Printf("the scan probes every candidate, stopping after %s at the latest\n", plan.Deadline)
+		}
+		return nil
 	}
 
 	if c.scan {
 		l.Info("scanner mode enabled", "max-rtt", c.rtt)
-		opts.Scan = &wiresocks.ScanOptions{V4: c.v4, V6: c.v6, MaxRTT: c.rtt}
+	}
+
+	if c.endpt4 != "" || c.endpt6 != "" {
+		if c.endpoint != "" {
+			fatal(l, errors.New("can't use --endpoint with --endpoint-v4/--endpoint-v6"))
+		}
+		primary, fallback, err := app.FamilyEndpoints(c.endpt4, c.endpt6, c.endptTyp)
+		if err != nil {
+			fatal(l, err)
+		}
+		opts.Endpoint, opts.FallbackEndpoint = primary, fallback
 	}
 
 	// If the endpoint is not set, choose a random warp endpoint
@@ -214,13 +1210,102 @@ func (c *rootConfig) exec(ctx context.Context, args []string) error {
 		opts.Endpoint = addrPort.String()
 	}
 
+	if c.prRoutes || c.prRtOnly {
+		if err := app.WriteRoutes(os.Stdout, app.EffectiveRoutes(opts)); err != nil {
+			return err
+		}
+		if c.prRtOnly {
+			return nil
+		}
+	}
+
+	if c.otelEp != "" {
+		if version == "" {
+			version = versioninfo.Short()
+		}
+		tp, shutdown, err := newTracerProvider(ctx, c.otelEp)
+		if err != nil {
+			fatal(l, fmt.Errorf("failed to set up tracing: %w", err))
+		}
+		defer func() {
+			// ctx is already done here, give pending spans a moment to flush
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdown(ctx); err != nil {
+				l.Warn("failed to flush traces", "error", err)
+			}
+		}()
+		opts.TracerProvider = tp
+	}
+
+	if c.chkUpd {
+		if version == "" {
+			version = versioninfo.Short()
+		}
+		go checkUpdate(ctx, l, http.DefaultClient, version)
+	}
+
+	var drop *privileges
+	if c.dropPriv != "" {
+		p, err := lookupPrivileges(c.dropPriv)
+		switch {
+		case errors.Is(err, errors.ErrUnsupported):
+			l.Warn("dropping privileges is only supported on linux, keeping the current user")
+		case err != nil:
+			fatal(l, fmt.Errorf("invalid --drop-privileges: %w", err))
+		default:
+			if err := checkDropPrivileges(opts); err != nil {
+				fatal(l, fmt.Errorf("can't drop privileges: %w", err))
+			}
+			drop = &p
+		}
+	}
+
+	var registrar *app.Registrar
+	if c.regURL != "" {
+		r, err := app.NewRegistrar(l, c.regURL, opts)
+		if err != nil {
+			fatal(l, err)
+		}
+		onEvent := opts.OnEvent
+		opts.OnEvent = func(e app.TunnelEvent) {
+			r.OnEvent(e)
+			if onEvent != nil {
+				onEvent(e)
+			}
+		}
+		registrar = r
+	}
+
 	go func() {
 		if err := app.RunWarp(ctx, l, opts); err != nil {
 			fatal(l, err)
 		}
+		if drop != nil {
+			if err := chownState(opts, *drop); err != nil {
+				fatal(l, fmt.Errorf("failed to hand over state files: %w", err))
+			}
+			if err := dropPrivileges(*drop); err != nil {
+				fatal(l, fmt.Errorf("failed to drop privileges: %w", err))
+			}
+			if err := checkStateWritable(opts); err != nil {
+				fatal(l, fmt.Errorf("can't write state after dropping privileges: %w", err))
+			}
+			l.Info("dropped privileges", "user", drop.user, "uid", drop.uid, "gid", drop.gid)
+		}
 	}()
 
 	<-ctx.Done()
 
+	// the app removes it as well, but may not get to run before we exit
+	if c.status != "" {
+		_ = os.Remove(c.status)
+	}
+	if registrar != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		registrar.Deregister(ctx)
+		cancel()
+	}
+
 	return nil
 }
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestTextHandlerColor(t *testing.T) {
+	logged := func(color string) string {
+		f, err := os.Create(filepath.Join(t.TempDir(), "log"))
+		qt.Assert(t, err, qt.IsNil)
+		defer f.Close()
+		l := slog.New(textHandler(f, nil, color))
+		l.Info("serving proxy")
+		l.Error("dial failed")
+		b, err := os.ReadFile(f.Name())
+		qt.Assert(t, err, qt.IsNil)
+		return string(b)
+	}
+
+	qt.Assert(t, logged("never"), qt.Not(qt.Contains), "\x1b")
+	// a file isn't a terminal
+	qt.Assert(t, logged("auto"), qt.Not(qt.Contains), "\x1b")
+	out := logged("always")
+	qt.Assert(t, out, qt.Contains, "level=\x1b[32mINFO\x1b[0m")
+	qt.Assert(t, strings.Count(out, "\x1b[0m"), qt.Equals, 2)
+}
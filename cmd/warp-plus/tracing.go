@@ -0,0 +1,42 @@
+//go:build otel
+
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/bepass-org/warp-plus/app"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newTracerProvider returns a provider exporting spans over OTLP/HTTP to
+// endpoint, given either as host:port or as a full URL, and the function
+// flushing and stopping it.
+func newTracerProvider(ctx context.Context, endpoint string) (trace.TracerProvider, func(context.Context) error, error) {
+	opt := otlptracehttp.WithEndpoint(endpoint)
+	if strings.Contains(endpoint, "://") {
+		opt = otlptracehttp.WithEndpointURL(endpoint)
+	}
+
+	exporter, err := otlptracehttp.New(ctx, opt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res := resource.NewSchemaless(
+		attribute.String("service.name", appName),
+		attribute.String("service.version", version),
+		attribute.String("service.instance.id", app.InstanceID()),
+	)
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	return tp, tp.Shutdown, nil
+}
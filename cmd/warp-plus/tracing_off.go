@@ -0,0 +1,16 @@
+//go:build !otel
+
+package main
+
+import (
+	"context"
+	"errors"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newTracerProvider fails in builds without the otel tag, which leave out
+// the OTLP exporter and its dependencies.
+func newTracerProvider(context.Context, string) (trace.TracerProvider, func(context.Context) error, error) {
+	return nil, nil, errors.New("tracing isn't built in, rebuild with -tags otel")
+}
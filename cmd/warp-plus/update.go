@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"golang.org/x/mod/semver"
+)
+
+// releasesURL is the GitHub API endpoint describing the latest release.
+var releasesURL = "https://api.github.com/repos/bepass-org/warp-plus/releases/latest"
+
+const updateCheckTimeout = 10 * time.Second
+
+// checkUpdate logs a notice when the latest release is newer than current.
+// It never downloads anything, and failures such as a missing network are
+// only logged at debug level. Development builds without a release version
+// are not checked.
+func checkUpdate(ctx context.Context, l *slog.Logger, client *http.Client, current string) {
+	if !semver.IsValid(current) {
+		l.Debug("not checking for updates of a development build", "version", current)
+		return
+	}
+
+	latest, err := latestRelease(ctx, client)
+	if err != nil {
+		l.Debug("update check failed", "error", err)
+		return
+	}
+	if semver.Compare(latest, current) > 0 {
+		l.Info("a newer version is available", "version", latest, "current", current, "url", "https://github.com/bepass-org/warp-plus/releases/latest")
+	}
+}
+
+// latestRelease returns the tag of the latest release.
+func latestRelease(ctx context.Context, client *http.Client) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, updateCheckTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, releasesURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("releases request failed with status: %s", resp.Status)
+	}
+
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return "", err
+	}
+	if !semver.IsValid(release.TagName) {
+		return "", fmt.Errorf("unexpected release tag %q", release.TagName)
+	}
+	return release.TagName, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestCheckUpdate(t *testing.T) {
+	latest := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if latest == "" {
+			http.Error(w, "rate limited", http.StatusForbidden)
+			return
+		}
+		fmt.Fprintf(w, `{"tag_name": %q, "name": "warp-plus %s"}`, latest, latest)
+	}))
+	defer srv.Close()
+	defer func(url string) { releasesURL = url }(releasesURL)
+	releasesURL = srv.URL
+
+	check := func(current string) string {
+		var buf bytes.Buffer
+		l := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+		checkUpdate(context.Background(), l, srv.Client(), current)
+		return buf.String()
+	}
+
+	latest = "v1.3.0"
+	qt.Assert(t, check("v1.2.4"), qt.Contains, `msg="a newer version is available" version=v1.3.0 current=v1.2.4`)
+	qt.Assert(t, check("v1.3.0"), qt.Equals, "")
+	qt.Assert(t, check("v1.4.0-rc.1"), qt.Equals, "")
+	// development builds aren't checked
+	qt.Assert(t, check("devel"), qt.Equals, "")
+
+	// failures stay silent
+	latest = ""
+	qt.Assert(t, check("v1.2.4"), qt.Equals, "")
+}
@@ -4,18 +4,30 @@ import (
 	"context"
 	"errors"
 	"log/slog"
+	"math"
 	"net/netip"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/bepass-org/warp-plus/ipscanner/iterator"
 	"github.com/bepass-org/warp-plus/ipscanner/ping"
 	"github.com/bepass-org/warp-plus/ipscanner/statute"
+	"github.com/bepass-org/warp-plus/warp"
 )
 
 type Engine struct {
 	generator *iterator.IpGenerator
 	ipQueue   *IPQueue
-	ping      func(context.Context, netip.Addr) (statute.IPInfo, error)
+	ping      func(context.Context, netip.AddrPort) (statute.IPInfo, error)
+	ports     []uint16
+	pingCount int
 	log       *slog.Logger
+	probeOnly bool
+	resume    []statute.ProbeResult
+	onProbe   func(statute.ProbeResult)
+	mu        sync.Mutex
+	reachable map[netip.Addr]bool
 }
 
 func NewScannerEngine(opts *statute.ScannerOptions) *Engine {
@@ -27,8 +39,14 @@ func NewScannerEngine(opts *statute.ScannerOptions) *Engine {
 	return &Engine{
 		ipQueue:   queue,
 		ping:      p.DoPing,
+		ports:     opts.Ports,
+		pingCount: opts.PingCount,
 		generator: iterator.NewIterator(opts),
 		log:       opts.Logger,
+		probeOnly: opts.ProbeOnly,
+		resume:    opts.Resume,
+		onProbe:   opts.OnProbe,
+		reachable: make(map[netip.Addr]bool),
 	}
 }
 
@@ -39,17 +57,77 @@ func (e *Engine) GetAvailableIPs(desc bool) []statute.IPInfo {
 	return nil
 }
 
+// Reachability returns whether each probed address responded.
+func (e *Engine) Reachability() map[netip.Addr]bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	reachable := make(map[netip.Addr]bool, len(e.reachable))
+	for addr, ok := range e.reachable {
+		reachable[addr] = ok
+	}
+	return reachable
+}
+
+func (e *Engine) setReachable(addr netip.Addr, ok bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.reachable[addr] = ok
+}
+
+func (e *Engine) probed(addr netip.Addr) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, ok := e.reachable[addr]
+	return ok
+}
+
+func (e *Engine) report(result statute.ProbeResult) {
+	if e.onProbe != nil {
+		e.onProbe(result)
+	}
+}
+
+// restore re-applies the results of an interrupted scan.
+func (e *Engine) restore() {
+	for _, r := range e.resume {
+		e.setReachable(r.Addr, r.Reachable)
+		if !r.Reachable {
+			continue
+		}
+		info := r.Info
+		info.CreatedAt = time.Now()
+		if e.probeOnly {
+			info.RTT = 0
+		}
+		e.ipQueue.Enqueue(info)
+	}
+	if len(e.resume) > 0 {
+		e.log.Info("resumed scan", "probed", len(e.resume))
+	}
+}
+
 func (e *Engine) Run(ctx context.Context) {
 	e.ipQueue.Init()
+	e.restore()
 
 	select {
 	case <-ctx.Done():
 		return
 	case <-e.ipQueue.available:
+	}
+
+	// every batch takes one address of each prefix, until the prefixes or
+	// the candidate cap run out
+	for {
 		e.log.Debug("Started new scanning round")
 		batch, err := e.generator.NextBatch()
+		if errors.Is(err, iterator.ErrNoMoreAddresses) {
+			e.log.Debug("every candidate was probed")
+			return
+		}
 		if err != nil {
-			e.log.Error("Error while generating IP: %v", err)
+			e.log.Error("Error while generating IP", "error", err)
 			return
 		}
 		for _, ip := range batch {
@@ -57,16 +135,112 @@ func (e *Engine) Run(ctx context.Context) {
 			case <-ctx.Done():
 				return
 			default:
-				ipInfo, err := e.ping(ctx, ip)
-				if err != nil {
-					if !errors.Is(err, context.Canceled) {
-						e.log.Error("ping error", "addr", ip, "error", err)
-					}
+				if e.probed(ip) {
+					e.log.Debug("skipping already probed address", "addr", ip)
 					continue
 				}
-				e.log.Debug("ping success", "addr", ipInfo.AddrPort, "rtt", ipInfo.RTT)
-				e.ipQueue.Enqueue(ipInfo)
+				e.probe(ctx, ip)
 			}
 		}
 	}
 }
+
+// probe pings ip on every port and queues the ports that answered. The
+// address counts as unreachable if none did.
+func (e *Engine) probe(ctx context.Context, ip netip.Addr) {
+	ports := e.ports
+	if len(ports) == 0 {
+		// the ping picks a random warp port
+		ports = []uint16{0}
+	}
+
+	reachable := false
+	for _, port := range ports {
+		addr := netip.AddrPortFrom(ip, port)
+		ipInfo, err := e.pingN(ctx, addr)
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				// an address that didn't answer yet is left unprobed
+				if !reachable {
+					return
+				}
+				break
+			}
+			e.log.Error("ping error", "addr", addr, "error", err)
+			continue
+		}
+		reachable = true
+		e.report(statute.ProbeResult{Addr: ip, Reachable: true, Info: ipInfo})
+		e.log.Debug("ping success", "addr", ipInfo.AddrPort, "rtt", ipInfo.RTT, "loss", ipInfo.Loss, "jitter", ipInfo.Jitter)
+		if e.probeOnly {
+			// RTT is meaningless in probe-only mode, treat every
+			// reachable address as equally good.
+			ipInfo.RTT = 0
+		}
+		e.ipQueue.Enqueue(ipInfo)
+	}
+
+	e.setReachable(ip, reachable)
+	if !reachable {
+		e.report(statute.ProbeResult{Addr: ip})
+	}
+}
+
+// pingN pings addr pingCount times and summarizes the answers into the
+// median RTT, the loss and the jitter. It fails with the last error when
+// no probe was answered.
+func (e *Engine) pingN(ctx context.Context, addr netip.AddrPort) (statute.IPInfo, error) {
+	if e.pingCount < 2 {
+		return e.ping(ctx, addr)
+	}
+	if addr.Port() == 0 {
+		// measure a single port instead of a random one per probe
+		addr = netip.AddrPortFrom(addr.Addr(), warp.RandomWarpPort())
+	}
+
+	var (
+		info    statute.IPInfo
+		rtts    []time.Duration
+		lastErr error
+	)
+	for range e.pingCount {
+		res, err := e.ping(ctx, addr)
+		if errors.Is(err, context.Canceled) {
+			return statute.IPInfo{}, err
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		info = res
+		rtts = append(rtts, res.RTT)
+	}
+	if len(rtts) == 0 {
+		return statute.IPInfo{}, lastErr
+	}
+	info.RTT, info.Jitter = rttStats(rtts)
+	info.Loss = 100 * float64(e.pingCount-len(rtts)) / float64(e.pingCount)
+	return info, nil
+}
+
+// rttStats returns the median and the standard deviation of rtts.
+func rttStats(rtts []time.Duration) (median, stddev time.Duration) {
+	sorted := slices.Clone(rtts)
+	slices.Sort(sorted)
+	n := len(sorted)
+	median = sorted[n/2]
+	if n%2 == 0 {
+		median = (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+
+	var mean float64
+	for _, rtt := range sorted {
+		mean += float64(rtt)
+	}
+	mean /= float64(n)
+	var variance float64
+	for _, rtt := range sorted {
+		variance += (float64(rtt) - mean) * (float64(rtt) - mean)
+	}
+	return median, time.Duration(math.Sqrt(variance / float64(n)))
+}
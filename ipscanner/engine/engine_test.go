@@ -0,0 +1,300 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/ipscanner/statute"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestProbeOnlyReachability(t *testing.T) {
+	reachable := netip.MustParseAddr("192.0.2.1")
+	unreachable := netip.MustParseAddr("198.51.100.1")
+
+	opts := &statute.ScannerOptions{
+		UseIPv4: true,
+		CidrList: []netip.Prefix{
+			netip.PrefixFrom(reachable, 32),
+			netip.PrefixFrom(unreachable, 32),
+		},
+		Logger:          slog.Default(),
+		IPQueueSize:     8,
+		IPQueueTTL:      time.Minute,
+		MaxDesirableRTT: time.Millisecond,
+		ProbeOnly:       true,
+	}
+
+	e := NewScannerEngine(opts)
+	e.ping = func(_ context.Context, addr netip.AddrPort) (statute.IPInfo, error) {
+		ip := addr.Addr()
+		if ip != reachable {
+			return statute.IPInfo{}, errors.New("i/o timeout")
+		}
+		// Far above MaxDesirableRTT, which probe-only mode must ignore.
+		return statute.IPInfo{AddrPort: netip.AddrPortFrom(ip, 2408), RTT: 3 * time.Second, CreatedAt: time.Now()}, nil
+	}
+	e.Run(context.Background())
+
+	qt.Assert(t, e.Reachability(), qt.DeepEquals, map[netip.Addr]bool{
+		reachable:   true,
+		unreachable: false,
+	})
+
+	ips := e.GetAvailableIPs(false)
+	qt.Assert(t, ips, qt.HasLen, 1)
+	qt.Assert(t, ips[0].AddrPort.Addr(), qt.Equals, reachable)
+}
+
+func TestResumeSkipsProbed(t *testing.T) {
+	probed := netip.MustParseAddr("192.0.2.1")
+	fresh := netip.MustParseAddr("198.51.100.1")
+
+	opts := &statute.ScannerOptions{
+		UseIPv4: true,
+		CidrList: []netip.Prefix{
+			netip.PrefixFrom(probed, 32),
+			netip.PrefixFrom(fresh, 32),
+		},
+		Logger:          slog.Default(),
+		IPQueueSize:     8,
+		IPQueueTTL:      time.Minute,
+		MaxDesirableRTT: time.Second,
+		Resume: []statute.ProbeResult{{
+			Addr:      probed,
+			Reachable: true,
+			Info:      statute.IPInfo{AddrPort: netip.AddrPortFrom(probed, 2408), RTT: 50 * time.Millisecond},
+		}},
+	}
+
+	var results []statute.ProbeResult
+	opts.OnProbe = func(r statute.ProbeResult) {
+		results = append(results, r)
+	}
+
+	e := NewScannerEngine(opts)
+	var pinged []netip.Addr
+	e.ping = func(_ context.Context, addr netip.AddrPort) (statute.IPInfo, error) {
+		ip := addr.Addr()
+		pinged = append(pinged, ip)
+		return statute.IPInfo{AddrPort: netip.AddrPortFrom(ip, 2408), RTT: 100 * time.Millisecond, CreatedAt: time.Now()}, nil
+	}
+	e.Run(context.Background())
+
+	qt.Assert(t, pinged, qt.HasLen, 1)
+	qt.Assert(t, pinged[0], qt.Equals, fresh)
+	qt.Assert(t, results, qt.HasLen, 1)
+	qt.Assert(t, results[0].Addr, qt.Equals, fresh)
+	qt.Assert(t, results[0].Reachable, qt.IsTrue)
+
+	// the resumed result still takes part in the ranking
+	ips := e.GetAvailableIPs(false)
+	qt.Assert(t, ips, qt.HasLen, 2)
+	qt.Assert(t, ips[0].AddrPort.Addr(), qt.Equals, probed)
+}
+
+func TestPortsRanked(t *testing.T) {
+	ip := netip.MustParseAddr("192.0.2.1")
+	opts := &statute.ScannerOptions{
+		UseIPv4:         true,
+		CidrList:        []netip.Prefix{netip.PrefixFrom(ip, 32)},
+		Logger:          slog.Default(),
+		IPQueueSize:     8,
+		IPQueueTTL:      time.Minute,
+		MaxDesirableRTT: time.Second,
+		Ports:           []uint16{2408, 500, 1701},
+	}
+
+	rtts := map[uint16]time.Duration{2408: 80 * time.Millisecond, 500: 20 * time.Millisecond}
+	e := NewScannerEngine(opts)
+	var pinged []netip.AddrPort
+	e.ping = func(_ context.Context, addr netip.AddrPort) (statute.IPInfo, error) {
+		pinged = append(pinged, addr)
+		rtt, ok := rtts[addr.Port()]
+		if !ok {
+			return statute.IPInfo{}, errors.New("i/o timeout")
+		}
+		return statute.IPInfo{AddrPort: addr, RTT: rtt, CreatedAt: time.Now()}, nil
+	}
+	e.Run(context.Background())
+
+	qt.Assert(t, pinged, qt.HasLen, 3)
+	for i, port := range opts.Ports {
+		qt.Assert(t, pinged[i], qt.Equals, netip.AddrPortFrom(ip, port))
+	}
+	qt.Assert(t, e.Reachability(), qt.DeepEquals, map[netip.Addr]bool{ip: true})
+
+	ips := e.GetAvailableIPs(false)
+	qt.Assert(t, ips, qt.HasLen, 2)
+	qt.Assert(t, ips[0].AddrPort, qt.Equals, netip.AddrPortFrom(ip, 500))
+	qt.Assert(t, ips[1].AddrPort, qt.Equals, netip.AddrPortFrom(ip, 2408))
+}
+
+func TestPingCount(t *testing.T) {
+	ip := netip.MustParseAddr("192.0.2.1")
+	opts := &statute.ScannerOptions{
+		UseIPv4:         true,
+		CidrList:        []netip.Prefix{netip.PrefixFrom(ip, 32)},
+		Logger:          slog.Default(),
+		IPQueueSize:     8,
+		IPQueueTTL:      time.Minute,
+		MaxDesirableRTT: time.Second,
+		PingCount:       5,
+	}
+
+	// one of five probes lost, the others answered in 10, 20, 30 and 60ms
+	replies := []time.Duration{10 * time.Millisecond, 0, 30 * time.Millisecond, 60 * time.Millisecond, 20 * time.Millisecond}
+	var ports []uint16
+	e := NewScannerEngine(opts)
+	e.ping = func(_ context.Context, addr netip.AddrPort) (statute.IPInfo, error) {
+		ports = append(ports, addr.Port())
+		rtt := replies[0]
+		replies = replies[1:]
+		if rtt == 0 {
+			return statute.IPInfo{}, errors.New("i/o timeout")
+		}
+		return statute.IPInfo{AddrPort: addr, RTT: rtt, CreatedAt: time.Now()}, nil
+	}
+	e.Run(context.Background())
+
+	ips := e.GetAvailableIPs(false)
+	qt.Assert(t, ips, qt.HasLen, 1)
+	qt.Assert(t, ips[0].RTT, qt.Equals, 25*time.Millisecond)
+	qt.Assert(t, ips[0].Loss, qt.Equals, 20.0)
+	// the RTTs average 30ms and deviate by 20, 10, 0 and 30ms: sqrt(350)ms
+	qt.Assert(t, ips[0].Jitter, qt.Equals, time.Duration(18708286))
+
+	// all probes go to the same random warp port
+	qt.Assert(t, ports, qt.HasLen, 5)
+	qt.Assert(t, ports[0], qt.Not(qt.Equals), uint16(0))
+	for _, port := range ports {
+		qt.Assert(t, port, qt.Equals, ports[0])
+	}
+}
+
+func TestPingCountAllLost(t *testing.T) {
+	ip := netip.MustParseAddr("192.0.2.1")
+	opts := &statute.ScannerOptions{
+		UseIPv4:         true,
+		CidrList:        []netip.Prefix{netip.PrefixFrom(ip, 32)},
+		Logger:          slog.Default(),
+		IPQueueSize:     8,
+		IPQueueTTL:      time.Minute,
+		MaxDesirableRTT: time.Second,
+		PingCount:       3,
+	}
+
+	pings := 0
+	e := NewScannerEngine(opts)
+	e.ping = func(context.Context, netip.AddrPort) (statute.IPInfo, error) {
+		pings++
+		return statute.IPInfo{}, errors.New("i/o timeout")
+	}
+	e.Run(context.Background())
+
+	qt.Assert(t, pings, qt.Equals, 3)
+	qt.Assert(t, e.Reachability(), qt.DeepEquals, map[netip.Addr]bool{ip: false})
+	qt.Assert(t, e.GetAvailableIPs(false), qt.HasLen, 0)
+}
+
+func TestRunProbesEveryBatch(t *testing.T) {
+	prefixes := []netip.Prefix{
+		netip.MustParsePrefix("192.0.2.0/29"),
+		netip.MustParsePrefix("198.51.100.0/29"),
+	}
+	newEngine := func(maxCandidates int) (*Engine, *[]netip.Addr) {
+		e := NewScannerEngine(&statute.ScannerOptions{
+			UseIPv4:         true,
+			CidrList:        prefixes,
+			Logger:          slog.Default(),
+			IPQueueSize:     8,
+			IPQueueTTL:      time.Minute,
+			MaxDesirableRTT: time.Second,
+			MaxCandidates:   maxCandidates,
+		})
+		var pinged []netip.Addr
+		e.ping = func(_ context.Context, addr netip.AddrPort) (statute.IPInfo, error) {
+			pinged = append(pinged, addr.Addr())
+			return statute.IPInfo{}, errors.New("i/o timeout")
+		}
+		return e, &pinged
+	}
+
+	// without a cap every address of both prefixes is probed once
+	e, pinged := newEngine(0)
+	e.Run(context.Background())
+	qt.Assert(t, *pinged, qt.HasLen, 16)
+	seen := make(map[netip.Addr]bool)
+	for _, addr := range *pinged {
+		qt.Assert(t, seen[addr], qt.IsFalse, qt.Commentf("%s probed twice", addr))
+		seen[addr] = true
+	}
+
+	// a cap above the number of prefixes takes several batches
+	e, pinged = newEngine(11)
+	e.Run(context.Background())
+	qt.Assert(t, *pinged, qt.HasLen, 11)
+
+	// and the scan stops with the context
+	ctx, cancel := context.WithCancel(context.Background())
+	e, pinged = newEngine(0)
+	e.ping = func(_ context.Context, addr netip.AddrPort) (statute.IPInfo, error) {
+		*pinged = append(*pinged, addr.Addr())
+		if len(*pinged) == 5 {
+			cancel()
+		}
+		return statute.IPInfo{}, errors.New("i/o timeout")
+	}
+	e.Run(ctx)
+	qt.Assert(t, *pinged, qt.HasLen, 5)
+}
+
+func TestResumeSkipsProbedInPrefix(t *testing.T) {
+	newEngine := func(resume []statute.ProbeResult) *Engine {
+		return NewScannerEngine(&statute.ScannerOptions{
+			UseIPv4:         true,
+			CidrList:        []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+			Logger:          slog.Default(),
+			IPQueueSize:     8,
+			IPQueueTTL:      time.Minute,
+			MaxDesirableRTT: time.Second,
+			MaxCandidates:   20,
+			Seed:            42,
+			Resume:          resume,
+		})
+	}
+
+	// the first scan is interrupted after 10 addresses
+	ctx, cancel := context.WithCancel(context.Background())
+	e := newEngine(nil)
+	var results []statute.ProbeResult
+	e.onProbe = func(r statute.ProbeResult) {
+		results = append(results, r)
+		if len(results) == 10 {
+			cancel()
+		}
+	}
+	e.ping = func(context.Context, netip.AddrPort) (statute.IPInfo, error) {
+		return statute.IPInfo{}, errors.New("i/o timeout")
+	}
+	e.Run(ctx)
+	qt.Assert(t, results, qt.HasLen, 10)
+
+	// the resumed scan draws the same sample and probes only the rest of it
+	e = newEngine(results)
+	var pinged []netip.Addr
+	e.ping = func(_ context.Context, addr netip.AddrPort) (statute.IPInfo, error) {
+		pinged = append(pinged, addr.Addr())
+		return statute.IPInfo{}, errors.New("i/o timeout")
+	}
+	e.Run(context.Background())
+	qt.Assert(t, pinged, qt.HasLen, 10)
+	for _, r := range results {
+		qt.Assert(t, slices.Contains(pinged, r.Addr), qt.IsFalse, qt.Commentf("%s probed again", r.Addr))
+	}
+}
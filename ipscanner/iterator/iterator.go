@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"errors"
 	"math/big"
+	mrand "math/rand/v2"
 	"net"
 	"net/netip"
 
@@ -18,19 +19,51 @@ type LCG struct {
 	current    *big.Int
 }
 
+// randInt returns a uniform random number in [0, max).
+type randInt func(max *big.Int) (*big.Int, error)
+
+// cryptoInt is a randInt using crypto/rand.
+func cryptoInt(max *big.Int) (*big.Int, error) {
+	return rand.Int(rand.Reader, max)
+}
+
+// seededInt returns a randInt drawing from r, so the numbers repeat for the
+// same seed.
+func seededInt(r *mrand.Rand) randInt {
+	return func(max *big.Int) (*big.Int, error) {
+		bits := max.BitLen()
+		b := make([]byte, (bits+7)/8)
+		n := new(big.Int)
+		for {
+			for i := range b {
+				b[i] = byte(r.Uint32())
+			}
+			// drop the bits above the length of max
+			b[0] &= byte(0xff >> (len(b)*8 - bits))
+			if n.SetBytes(b).Cmp(max) < 0 {
+				return n, nil
+			}
+		}
+	}
+}
+
 // NewLCG creates a new LCG instance with a given size.
 func NewLCG(size *big.Int) *LCG {
+	return newLCG(size, cryptoInt)
+}
+
+func newLCG(size *big.Int, randInt randInt) *LCG {
 	modulus := new(big.Int).Set(size)
 
 	// Generate random multiplier (a) and increment (c) that satisfy Hull-Dobell Theorem
 	var multiplier, increment *big.Int
 	for {
 		var err error
-		multiplier, err = rand.Int(rand.Reader, modulus)
+		multiplier, err = randInt(modulus)
 		if err != nil {
 			continue
 		}
-		increment, err = rand.Int(rand.Reader, modulus)
+		increment, err = randInt(modulus)
 		if err != nil {
 			continue
 		}
@@ -93,7 +126,7 @@ type ipRange struct {
 	index *big.Int
 }
 
-func newIPRange(cidr netip.Prefix) (ipRange, error) {
+func newIPRange(cidr netip.Prefix, randInt randInt) (ipRange, error) {
 	startIP := cidr.Addr()
 	stopIP := lastIP(cidr)
 	size := ipRangeSize(cidr)
@@ -102,7 +135,7 @@ func newIPRange(cidr netip.Prefix) (ipRange, error) {
 		stop:  stopIP,
 		size:  size,
 		index: big.NewInt(0),
-		lcg:   NewLCG(size),
+		lcg:   newLCG(size, randInt),
 	}, nil
 }
 
@@ -165,13 +198,33 @@ func ipRangeSize(prefix netip.Prefix) *big.Int {
 	return size
 }
 
+// ErrNoMoreAddresses is returned by NextBatch once every address was
+// generated or the limit was reached.
+var ErrNoMoreAddresses = errors.New("no more IP addresses")
+
 type IpGenerator struct {
 	ipRanges []ipRange
+	// limit caps the number of addresses generated in total, 0 means no
+	// limit. yielded counts them.
+	limit   int
+	yielded int
 }
 
+// NextBatch returns the next address of every range that has any left, in
+// random order. Once every address was generated it fails with
+// ErrNoMoreAddresses. With a limit, the batch that reaches it is cut short
+// and later calls fail the same way. Since the ranges are shuffled, a cut
+// batch covers a random subset of them.
 func (g *IpGenerator) NextBatch() ([]netip.Addr, error) {
+	if g.limit > 0 && g.yielded >= g.limit {
+		return nil, ErrNoMoreAddresses
+	}
+
 	var results []netip.Addr
 	for i, r := range g.ipRanges {
+		if g.limit > 0 && g.yielded+len(results) >= g.limit {
+			break
+		}
 		if r.index.Cmp(r.size) >= 0 {
 			continue
 		}
@@ -183,30 +236,16 @@ func (g *IpGenerator) NextBatch() ([]netip.Addr, error) {
 		g.ipRanges[i].index.Add(g.ipRanges[i].index, big.NewInt(1))
 	}
 	if len(results) == 0 {
-		okFlag := false
-		for i := range g.ipRanges {
-			if g.ipRanges[i].index.Cmp(big.NewInt(0)) > 0 {
-				okFlag = true
-			}
-			g.ipRanges[i].index.SetInt64(0)
-		}
-		if okFlag {
-			// Reshuffle and start over
-			for i := range g.ipRanges {
-				g.ipRanges[i].lcg = NewLCG(g.ipRanges[i].size)
-			}
-			return g.NextBatch()
-		} else {
-			return nil, errors.New("no more IP addresses")
-		}
+		return nil, ErrNoMoreAddresses
 	}
+	g.yielded += len(results)
 	return results, nil
 }
 
-// shuffleSubnetsIpRange shuffles a slice of ipRange using crypto/rand
-func shuffleSubnetsIpRange(subnets []ipRange) error {
+// shuffleSubnetsIpRange shuffles a slice of ipRange using randInt
+func shuffleSubnetsIpRange(subnets []ipRange, randInt randInt) error {
 	for i := range subnets {
-		jBig, err := rand.Int(rand.Reader, big.NewInt(int64(len(subnets))))
+		jBig, err := randInt(big.NewInt(int64(len(subnets))))
 		if err != nil {
 			return err
 		}
@@ -217,17 +256,38 @@ func shuffleSubnetsIpRange(subnets []ipRange) error {
 	return nil
 }
 
-func NewIterator(opts *statute.ScannerOptions) *IpGenerator {
-	var ranges []ipRange
-	for _, cidr := range opts.CidrList {
-		if !opts.UseIPv6 && cidr.Addr().Is6() {
+// FilterFamilies returns the prefixes belonging to an enabled address family.
+func FilterFamilies(prefixes []netip.Prefix, useIPv4, useIPv6 bool) []netip.Prefix {
+	var filtered []netip.Prefix
+	for _, cidr := range prefixes {
+		if !useIPv6 && cidr.Addr().Is6() {
 			continue
 		}
-		if !opts.UseIPv4 && cidr.Addr().Is4() {
+		if !useIPv4 && cidr.Addr().Is4() {
 			continue
 		}
+		filtered = append(filtered, cidr)
+	}
+	return filtered
+}
+
+// RangeSize returns the number of addresses the iterator generates for prefix.
+func RangeSize(prefix netip.Prefix) *big.Int {
+	return ipRangeSize(prefix)
+}
 
-		ipRange, err := newIPRange(cidr)
+// NewIterator returns a generator of the addresses in the prefixes of opts.
+// With opts.Seed the addresses come in the same order for the same seed,
+// otherwise in a random one.
+func NewIterator(opts *statute.ScannerOptions) *IpGenerator {
+	randInt := cryptoInt
+	if opts.Seed != 0 {
+		randInt = seededInt(mrand.New(mrand.NewPCG(opts.Seed, opts.Seed)))
+	}
+
+	var ranges []ipRange
+	for _, cidr := range FilterFamilies(opts.CidrList, opts.UseIPv4, opts.UseIPv6) {
+		ipRange, err := newIPRange(cidr, randInt)
 		if err != nil {
 			// TODO
 			continue
@@ -238,10 +298,10 @@ func NewIterator(opts *statute.ScannerOptions) *IpGenerator {
 		// TODO
 		return nil
 	}
-	err := shuffleSubnetsIpRange(ranges)
+	err := shuffleSubnetsIpRange(ranges, randInt)
 	if err != nil {
 		// TODO
 		return nil
 	}
-	return &IpGenerator{ipRanges: ranges}
+	return &IpGenerator{ipRanges: ranges, limit: opts.MaxCandidates}
 }
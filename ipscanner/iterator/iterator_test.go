@@ -0,0 +1,60 @@
+package iterator
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/bepass-org/warp-plus/ipscanner/statute"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestMaxCandidates(t *testing.T) {
+	prefixes := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("172.16.0.0/12"),
+		netip.MustParsePrefix("192.168.0.0/16"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}
+	prefixOf := func(addr netip.Addr) netip.Prefix {
+		for _, p := range prefixes {
+			if p.Contains(addr) {
+				return p
+			}
+		}
+		t.Fatalf("%s is outside of the prefixes", addr)
+		return netip.Prefix{}
+	}
+
+	gen := NewIterator(&statute.ScannerOptions{UseIPv4: true, UseIPv6: true, CidrList: prefixes, MaxCandidates: 10})
+	perPrefix := make(map[netip.Prefix]int)
+	total := 0
+	for {
+		batch, err := gen.NextBatch()
+		if err != nil {
+			break
+		}
+		total += len(batch)
+		for _, addr := range batch {
+			perPrefix[prefixOf(addr)]++
+		}
+	}
+	qt.Assert(t, total, qt.Equals, 10)
+	// the sample is spread over all prefixes
+	qt.Assert(t, perPrefix, qt.HasLen, len(prefixes))
+	for _, n := range perPrefix {
+		qt.Assert(t, n >= 2 && n <= 3, qt.IsTrue, qt.Commentf("%v", perPrefix))
+	}
+
+	// a cap below the number of prefixes samples a subset of them
+	gen = NewIterator(&statute.ScannerOptions{UseIPv4: true, UseIPv6: true, CidrList: prefixes, MaxCandidates: 3})
+	batch, err := gen.NextBatch()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, batch, qt.HasLen, 3)
+	seen := make(map[netip.Prefix]bool)
+	for _, addr := range batch {
+		seen[prefixOf(addr)] = true
+	}
+	qt.Assert(t, seen, qt.HasLen, 3)
+	_, err = gen.NextBatch()
+	qt.Assert(t, err, qt.IsNotNil)
+}
@@ -11,9 +11,12 @@ type Ping struct {
 	Options *statute.ScannerOptions
 }
 
-// DoPing performs a ping on the given IP address.
-func (p *Ping) DoPing(ctx context.Context, ip netip.Addr) (statute.IPInfo, error) {
-	res, err := p.calc(ctx, NewWarpPing(ip, p.Options))
+// DoPing performs a ping on the given address, on a random warp port if
+// its port is 0.
+func (p *Ping) DoPing(ctx context.Context, addr netip.AddrPort) (statute.IPInfo, error) {
+	wp := NewWarpPing(addr.Addr(), p.Options)
+	wp.Port = addr.Port()
+	res, err := p.calc(ctx, wp)
 	if err != nil {
 		return statute.IPInfo{}, err
 	}
@@ -47,6 +47,8 @@ type WarpPing struct {
 	PeerPublicKey string
 	PresharedKey  string
 	IP            netip.Addr
+	// Port is the port to ping, a random warp port if 0.
+	Port uint16
 }
 
 func (h *WarpPing) Ping() statute.IPingResult {
@@ -54,7 +56,11 @@ func (h *WarpPing) Ping() statute.IPingResult {
 }
 
 func (h *WarpPing) PingContext(ctx context.Context) statute.IPingResult {
-	addr := netip.AddrPortFrom(h.IP, warp.RandomWarpPort())
+	port := h.Port
+	if port == 0 {
+		port = warp.RandomWarpPort()
+	}
+	addr := netip.AddrPortFrom(h.IP, port)
 	rtt, err := initiateHandshake(
 		ctx,
 		addr,
@@ -14,6 +14,7 @@ type IPScanner struct {
 	options statute.ScannerOptions
 	log     *slog.Logger
 	engine  *engine.Engine
+	done    chan struct{}
 }
 
 func NewScanner(options ...Option) *IPScanner {
@@ -30,7 +31,8 @@ func NewScanner(options ...Option) *IPScanner {
 			MaxDesirableRTT:   400 * time.Millisecond,
 			IPQueueTTL:        30 * time.Second,
 		},
-		log: slog.Default(),
+		log:  slog.Default(),
+		done: make(chan struct{}),
 	}
 
 	for _, option := range options {
@@ -103,16 +105,81 @@ func WithWarpPreSharedKey(presharedKey string) Option {
 	}
 }
 
+func WithProbeOnly(probeOnly bool) Option {
+	return func(i *IPScanner) {
+		i.options.ProbeOnly = probeOnly
+	}
+}
+
+// WithResume seeds the scan with the results of an earlier, interrupted scan.
+// Those addresses are not probed again.
+func WithResume(results []statute.ProbeResult) Option {
+	return func(i *IPScanner) {
+		i.options.Resume = results
+	}
+}
+
+// WithMaxCandidates caps the number of addresses probed, after which the
+// scan is done. The sample is spread over the prefixes, 0 probes without a
+// cap.
+func WithMaxCandidates(n int) Option {
+	return func(i *IPScanner) {
+		i.options.MaxCandidates = n
+	}
+}
+
+// WithSeed generates the candidates in the order given by seed, the same
+// for every scan with the same seed and prefixes, so a resumed scan skips
+// the addresses probed before. 0 picks a random order.
+func WithSeed(seed uint64) Option {
+	return func(i *IPScanner) {
+		i.options.Seed = seed
+	}
+}
+
+// WithPorts probes every address on each of ports, ranking every addr:port
+// on its own. Without ports each address is probed on a random warp port.
+func WithPorts(ports []uint16) Option {
+	return func(i *IPScanner) {
+		i.options.Ports = ports
+	}
+}
+
+// WithPingCount probes every addr:port n times, ranking it by the median
+// RTT and reporting the loss and jitter of the probes. n below 2 probes once.
+func WithPingCount(n int) Option {
+	return func(i *IPScanner) {
+		i.options.PingCount = n
+	}
+}
+
+// WithOnProbe registers a callback run after every probe.
+func WithOnProbe(fn func(statute.ProbeResult)) Option {
+	return func(i *IPScanner) {
+		i.options.OnProbe = fn
+	}
+}
+
 // run engine and in case of new event call onChange callback also if it gets canceled with context
 // cancel all operations
 
 func (i *IPScanner) Run(ctx context.Context) {
 	if !i.options.UseIPv4 && !i.options.UseIPv6 {
 		i.log.Error("Fatal: both IPv4 and IPv6 are disabled, nothing to do")
+		close(i.done)
 		return
 	}
 	i.engine = engine.NewScannerEngine(&i.options)
-	go i.engine.Run(ctx)
+	go func() {
+		defer close(i.done)
+		i.engine.Run(ctx)
+	}()
+}
+
+// Done is closed once the scan stopped, because every candidate was probed
+// or the context of Run is done.
+func (i *IPScanner) Done() <-chan struct{} {
+	return i.done
 }
 
 func (i *IPScanner) GetAvailableIPs() []statute.IPInfo {
@@ -122,4 +189,14 @@ func (i *IPScanner) GetAvailableIPs() []statute.IPInfo {
 	return nil
 }
 
+// GetReachability reports which probed addresses responded at all.
+func (i *IPScanner) GetReachability() map[netip.Addr]bool {
+	if i.engine != nil {
+		return i.engine.Reachability()
+	}
+	return nil
+}
+
 type IPInfo = statute.IPInfo
+
+type ProbeResult = statute.ProbeResult
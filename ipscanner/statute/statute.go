@@ -7,11 +7,24 @@ import (
 )
 
 type IPInfo struct {
-	AddrPort  netip.AddrPort
-	RTT       time.Duration
+	AddrPort netip.AddrPort
+	RTT      time.Duration
+	// Loss is the percentage of unanswered probes and Jitter the standard
+	// deviation of the RTT of the answered ones, both zero unless every
+	// address is probed more than once.
+	Loss      float64
+	Jitter    time.Duration
 	CreatedAt time.Time
 }
 
+// ProbeResult is the outcome of probing a single address. Info is only set
+// when the address was reachable.
+type ProbeResult struct {
+	Addr      netip.Addr `json:"addr"`
+	Reachable bool       `json:"reachable"`
+	Info      IPInfo     `json:"info,omitzero"`
+}
+
 type ScannerOptions struct {
 	UseIPv4           bool
 	UseIPv6           bool
@@ -23,6 +36,13 @@ type ScannerOptions struct {
 	IPQueueSize       int
 	IPQueueTTL        time.Duration
 	MaxDesirableRTT   time.Duration
+	ProbeOnly         bool              // only check reachability, don't rank by RTT
+	Resume            []ProbeResult     // results of an interrupted scan, not probed again
+	OnProbe           func(ProbeResult) // called after every probe, e.g. for checkpointing
+	MaxCandidates     int               // caps the number of addresses probed, 0 means no cap
+	Seed              uint64            // repeats the order of the candidates of an earlier scan, 0 picks a random order
+	Ports             []uint16          // ports to probe every address on, empty probes a random warp port
+	PingCount         int               // probes per addr:port, ranked by their median RTT, 0 probes once
 }
 
 func DefaultCFRanges() []netip.Prefix {
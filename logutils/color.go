@@ -0,0 +1,95 @@
+package logutils
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+)
+
+// ANSI colors of the levels, by the lowest level they apply to.
+const (
+	colorDebug = "\x1b[90m" // gray
+	colorInfo  = "\x1b[32m" // green
+	colorWarn  = "\x1b[33m" // yellow
+	colorError = "\x1b[31m" // red
+	colorReset = "\x1b[0m"
+)
+
+// ColorHandler is slog.TextHandler with the level colored for terminals.
+// Nothing else of the output changes.
+type ColorHandler struct {
+	text  slog.Handler // writes to buf
+	state *colorState
+}
+
+type colorState struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+	w   io.Writer
+}
+
+// NewColorHandler returns a text handler writing to w with colored levels.
+// opts are passed to slog.NewTextHandler and may be nil.
+func NewColorHandler(w io.Writer, opts *slog.HandlerOptions) *ColorHandler {
+	state := &colorState{w: w}
+	return &ColorHandler{text: slog.NewTextHandler(&state.buf, opts), state: state}
+}
+
+func (h *ColorHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.text.Enabled(ctx, level)
+}
+
+func (h *ColorHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.state.mu.Lock()
+	defer h.state.mu.Unlock()
+	h.state.buf.Reset()
+	if err := h.text.Handle(ctx, r); err != nil {
+		return err
+	}
+	_, err := h.state.w.Write(colorLevel(h.state.buf.Bytes(), r.Level))
+	return err
+}
+
+func (h *ColorHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &ColorHandler{text: h.text.WithAttrs(attrs), state: h.state}
+}
+
+func (h *ColorHandler) WithGroup(name string) slog.Handler {
+	return &ColorHandler{text: h.text.WithGroup(name), state: h.state}
+}
+
+// colorLevel colors the value of the first level pair of line.
+func colorLevel(line []byte, level slog.Level) []byte {
+	start := 0
+	if !bytes.HasPrefix(line, []byte("level=")) {
+		i := bytes.Index(line, []byte(" level="))
+		if i < 0 {
+			return line
+		}
+		start = i + 1
+	}
+	start += len("level=")
+	end := bytes.IndexAny(line[start:], " \n")
+	if end < 0 {
+		end = len(line) - start
+	}
+	end += start
+
+	color := colorDebug
+	switch {
+	case level >= slog.LevelError:
+		color = colorError
+	case level >= slog.LevelWarn:
+		color = colorWarn
+	case level >= slog.LevelInfo:
+		color = colorInfo
+	}
+	out := make([]byte, 0, len(line)+len(color)+len(colorReset))
+	out = append(out, line[:start]...)
+	out = append(out, color...)
+	out = append(out, line[start:end]...)
+	out = append(out, colorReset...)
+	return append(out, line[end:]...)
+}
@@ -0,0 +1,45 @@
+package logutils
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestColorHandler(t *testing.T) {
+	var colored, plain bytes.Buffer
+	opts := &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		// drop the time so both outputs match
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}
+	for _, l := range []*slog.Logger{
+		slog.New(NewColorHandler(&colored, opts)).With("subsystem", "vtun"),
+		slog.New(slog.NewTextHandler(&plain, opts)).With("subsystem", "vtun"),
+	} {
+		l.Debug("serving proxy", "level", "not the level")
+		l.WithGroup("scan").Info("found endpoint", "rtt", 42)
+		l.Warn("handshake slow")
+		l.Error("dial failed")
+	}
+
+	lines := strings.Split(strings.TrimSpace(colored.String()), "\n")
+	qt.Assert(t, lines, qt.DeepEquals, []string{
+		"level=\x1b[90mDEBUG\x1b[0m msg=\"serving proxy\" subsystem=vtun level=\"not the level\"",
+		"level=\x1b[32mINFO\x1b[0m msg=\"found endpoint\" subsystem=vtun scan.rtt=42",
+		"level=\x1b[33mWARN\x1b[0m msg=\"handshake slow\" subsystem=vtun",
+		"level=\x1b[31mERROR\x1b[0m msg=\"dial failed\" subsystem=vtun",
+	})
+
+	// apart from the colors the output is that of the text handler
+	stripped := strings.NewReplacer("\x1b[90m", "", "\x1b[32m", "", "\x1b[33m", "", "\x1b[31m", "", "\x1b[0m", "").Replace(colored.String())
+	qt.Assert(t, stripped, qt.Equals, plain.String())
+}
@@ -0,0 +1,118 @@
+package logutils
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// LogfmtHandler writes records as logfmt: a line of space separated
+// key=value pairs starting with ts, level and msg. It is slog.TextHandler
+// with the time key renamed to ts, lowercase levels, RFC 3339 times with
+// nanoseconds and keys that never need quoting: '=', quotes, spaces and
+// control characters in keys and group names are replaced by '_'. Values are
+// quoted as by slog.TextHandler.
+type LogfmtHandler struct {
+	text slog.Handler
+}
+
+// NewLogfmtHandler returns a handler writing logfmt to w. opts may be nil.
+// opts.ReplaceAttr sees the built-in attributes under their slog keys and
+// values, before they are renamed and formatted.
+func NewLogfmtHandler(w io.Writer, opts *slog.HandlerOptions) *LogfmtHandler {
+	var o slog.HandlerOptions
+	if opts != nil {
+		o = *opts
+	}
+	o.ReplaceAttr = logfmtReplaceAttr(o.ReplaceAttr)
+	return &LogfmtHandler{text: slog.NewTextHandler(w, &o)}
+}
+
+func (h *LogfmtHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.text.Enabled(ctx, level)
+}
+
+func (h *LogfmtHandler) Handle(ctx context.Context, r slog.Record) error {
+	// ReplaceAttr isn't called for groups, their keys are fixed here
+	r2 := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		r2.AddAttrs(groupKeys(a))
+		return true
+	})
+	return h.text.Handle(ctx, r2)
+}
+
+func (h *LogfmtHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	fixed := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		fixed[i] = groupKeys(a)
+	}
+	return &LogfmtHandler{text: h.text.WithAttrs(fixed)}
+}
+
+func (h *LogfmtHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &LogfmtHandler{text: h.text.WithGroup(logfmtKey(name))}
+}
+
+// logfmtReplaceAttr returns the slog.HandlerOptions.ReplaceAttr of the
+// logfmt handler, calling replace first if it isn't nil.
+func logfmtReplaceAttr(replace func([]string, slog.Attr) slog.Attr) func([]string, slog.Attr) slog.Attr {
+	return func(groups []string, a slog.Attr) slog.Attr {
+		key := a.Key
+		if replace != nil {
+			a = replace(groups, a)
+			if a.Key == "" {
+				return a
+			}
+		}
+
+		v := a.Value.Resolve()
+		if len(groups) == 0 {
+			switch key {
+			case slog.TimeKey:
+				if a.Key == slog.TimeKey {
+					a.Key = "ts"
+				}
+			case slog.LevelKey:
+				if level, ok := v.Any().(slog.Level); ok {
+					a.Value = slog.StringValue(strings.ToLower(level.String()))
+				}
+			}
+		}
+		if v.Kind() == slog.KindTime {
+			a.Value = slog.StringValue(v.Time().Format(time.RFC3339Nano))
+		}
+		a.Key = logfmtKey(a.Key)
+		return a
+	}
+}
+
+// groupKeys returns a with the keys of the groups in it made logfmt keys.
+func groupKeys(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	if v.Kind() != slog.KindGroup {
+		return a
+	}
+	group := v.Group()
+	attrs := make([]slog.Attr, len(group))
+	for i, ga := range group {
+		attrs[i] = groupKeys(ga)
+	}
+	return slog.Attr{Key: logfmtKey(a.Key), Value: slog.GroupValue(attrs...)}
+}
+
+// logfmtKey replaces the characters of key that would need quoting.
+func logfmtKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '=' || r == '"' || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return '_'
+		}
+		return r
+	}, key)
+}
@@ -0,0 +1,64 @@
+package logutils
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestLogfmtHandler(t *testing.T) {
+	var buf bytes.Buffer
+	h := NewLogfmtHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	})
+	l := slog.New(h).With("mode", "warp", "subsystem", "vtun")
+
+	l.Debug("serving proxy", "address", "127.0.0.1:8086", "reason", "user asked nicely", "empty", "")
+	l.WithGroup("scan").Info(`quoted "msg"`, "rtt", 42, slog.Group("best", "endpoint", "162.159.192.1:2408"))
+	l.Error("dial failed", "error", errors.New("dial tcp: i/o timeout"), "bad key=", "x=y")
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	qt.Assert(t, lines, qt.HasLen, 3)
+
+	// strip the ts pair
+	for i, line := range lines {
+		_, rest, ok := bytes.Cut(line, []byte(" "))
+		qt.Assert(t, ok, qt.IsTrue)
+		qt.Assert(t, string(line), qt.Matches, `ts=\d{4}-\d\d-\d\dT\S+ .*`)
+		lines[i] = rest
+	}
+
+	qt.Assert(t, string(lines[0]), qt.Equals, `level=debug msg="serving proxy" mode=warp subsystem=vtun address=127.0.0.1:8086 reason="user asked nicely" empty=""`)
+	qt.Assert(t, string(lines[1]), qt.Equals, `level=info msg="quoted \"msg\"" mode=warp subsystem=vtun scan.rtt=42 scan.best.endpoint=162.159.192.1:2408`)
+	qt.Assert(t, string(lines[2]), qt.Equals, `level=error msg="dial failed" mode=warp subsystem=vtun error="dial tcp: i/o timeout" bad_key_="x=y"`)
+}
+
+func TestLogfmtHandlerLevel(t *testing.T) {
+	var buf bytes.Buffer
+	l := slog.New(NewLogfmtHandler(&buf, nil))
+	l.Debug("hidden")
+	qt.Assert(t, buf.Len(), qt.Equals, 0)
+}
+
+func TestLogfmtHandlerOptions(t *testing.T) {
+	var buf bytes.Buffer
+	l := slog.New(NewLogfmtHandler(&buf, &slog.HandlerOptions{
+		AddSource: true,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			switch {
+			case len(groups) == 0 && a.Key == slog.TimeKey:
+				return slog.Attr{}
+			case a.Key == "token":
+				return slog.String(a.Key, "REDACTED")
+			}
+			return a
+		},
+	}))
+	l.Info("registered", "token", "secret")
+
+	line := buf.String()
+	qt.Assert(t, line, qt.Matches, `level=info source=\S+/logfmt_test\.go:\d+ msg=registered token=REDACTED\n`)
+}
@@ -0,0 +1,150 @@
+package logutils
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSamples bounds the number of distinct messages tracked before stale
+// entries are pruned.
+const maxSamples = 1024
+
+// SamplingHandler collapses identical log records emitted within a window
+// into the first record plus a single summary line carrying a repeat count.
+// Records are identical when they share level, message, logger attributes and
+// record attributes, so records differing only in, say, an address or an
+// attempt number are all written. Error records are never sampled.
+type SamplingHandler struct {
+	next   slog.Handler
+	window time.Duration
+	prefix string
+	state  *samplingState
+}
+
+type samplingState struct {
+	mu   sync.Mutex
+	seen map[string]*sample
+}
+
+type sample struct {
+	start time.Time
+	count int
+	last  slog.Record
+	next  slog.Handler
+}
+
+// NewSamplingHandler wraps next so that repeated records within window are
+// collapsed.
+func NewSamplingHandler(next slog.Handler, window time.Duration) *SamplingHandler {
+	return &SamplingHandler{
+		next:   next,
+		window: window,
+		state:  &samplingState{seen: make(map[string]*sample)},
+	}
+}
+
+func (h *SamplingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *SamplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelError || h.window <= 0 {
+		return h.next.Handle(ctx, r)
+	}
+
+	var b strings.Builder
+	b.WriteString(h.prefix)
+	b.WriteString(r.Level.String())
+	b.WriteByte(0)
+	b.WriteString(r.Message)
+	r.Attrs(func(a slog.Attr) bool {
+		b.WriteByte(0)
+		b.WriteString(a.String())
+		return true
+	})
+	key := b.String()
+	now := time.Now()
+
+	h.state.mu.Lock()
+	s, ok := h.state.seen[key]
+	if !ok || now.Sub(s.start) >= h.window {
+		if len(h.state.seen) >= maxSamples {
+			h.state.prune(now, h.window)
+		}
+		h.state.seen[key] = &sample{start: now, next: h.next}
+		h.state.mu.Unlock()
+
+		// The flush timer of an expired sample may not have fired yet.
+		if ok {
+			h.state.flush(key, s)
+		}
+		return h.next.Handle(ctx, r)
+	}
+
+	s.count++
+	s.last = r.Clone()
+	if s.count == 1 {
+		time.AfterFunc(h.window-now.Sub(s.start), func() { h.state.flush(key, s) })
+	}
+	h.state.mu.Unlock()
+	return nil
+}
+
+func (h *SamplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var b strings.Builder
+	b.WriteString(h.prefix)
+	for _, a := range attrs {
+		b.WriteString(a.String())
+		b.WriteByte(0)
+	}
+	return &SamplingHandler{
+		next:   h.next.WithAttrs(attrs),
+		window: h.window,
+		prefix: b.String(),
+		state:  h.state,
+	}
+}
+
+func (h *SamplingHandler) WithGroup(name string) slog.Handler {
+	return &SamplingHandler{
+		next:   h.next.WithGroup(name),
+		window: h.window,
+		prefix: h.prefix + name + ".\x00",
+		state:  h.state,
+	}
+}
+
+// flush emits the summary line for smp if any records were suppressed.
+func (s *samplingState) flush(key string, smp *sample) {
+	s.mu.Lock()
+	if s.seen[key] == smp {
+		delete(s.seen, key)
+	}
+	count, last := smp.count, smp.last
+	smp.count = 0
+	s.mu.Unlock()
+
+	if count == 0 {
+		return
+	}
+
+	r := slog.NewRecord(last.Time, last.Level, fmt.Sprintf("%s (repeated %d times)", last.Message, count), 0)
+	last.Attrs(func(a slog.Attr) bool {
+		r.AddAttrs(a)
+		return true
+	})
+	_ = smp.next.Handle(context.Background(), r)
+}
+
+// prune drops expired entries that have nothing left to flush.
+func (s *samplingState) prune(now time.Time, window time.Duration) {
+	for key, smp := range s.seen {
+		if smp.count == 0 && now.Sub(smp.start) >= window {
+			delete(s.seen, key)
+		}
+	}
+}
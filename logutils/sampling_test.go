@@ -0,0 +1,72 @@
+package logutils
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// syncBuffer is a bytes.Buffer safe for use by the flush timer.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.Split(strings.TrimSpace(b.buf.String()), "\n")
+}
+
+func newSampledLogger(window time.Duration) (*slog.Logger, *syncBuffer) {
+	var out syncBuffer
+	h := slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug})
+	return slog.New(NewSamplingHandler(h, window)), &out
+}
+
+func TestSamplingCollapsesRepeats(t *testing.T) {
+	l, out := newSampledLogger(100 * time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		l.Warn("connection test failed", "endpoint", "162.159.192.1:2408")
+	}
+	qt.Assert(t, out.Lines(), qt.HasLen, 1)
+
+	time.Sleep(200 * time.Millisecond)
+	lines := out.Lines()
+	qt.Assert(t, lines, qt.HasLen, 2)
+	qt.Assert(t, lines[1], qt.Contains, "connection test failed (repeated 4 times)")
+	qt.Assert(t, lines[1], qt.Contains, "endpoint=162.159.192.1:2408")
+}
+
+func TestSamplingKeepsDistinctMessages(t *testing.T) {
+	l, out := newSampledLogger(time.Minute)
+
+	l.Info("first")
+	l.Info("second")
+	l.Warn("first")
+	l.With("subsystem", "scanner").Info("first")
+	l.Info("first", "attempt", 1)
+	l.Info("first", "attempt", 2)
+	qt.Assert(t, out.Lines(), qt.HasLen, 6)
+}
+
+func TestSamplingNeverDropsErrors(t *testing.T) {
+	l, out := newSampledLogger(time.Minute)
+
+	for i := 0; i < 3; i++ {
+		l.Error("handshake failed")
+	}
+	qt.Assert(t, out.Lines(), qt.HasLen, 3)
+}
@@ -0,0 +1,32 @@
+// Package notify shows desktop notifications through the tools the platform
+// ships with.
+package notify
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// Notifier shows a desktop notification.
+type Notifier interface {
+	Notify(title, message string) error
+}
+
+// ErrUnsupported is returned by New when notifications aren't available.
+var ErrUnsupported = errors.New("desktop notifications are not available")
+
+// New returns the notifier of the current platform, or ErrUnsupported when
+// the platform has no way to show notifications.
+func New() (Notifier, error) {
+	return newNotifier()
+}
+
+// commandNotifier runs a command to show each notification.
+type commandNotifier struct {
+	args func(title, message string) []string
+}
+
+func (n commandNotifier) Notify(title, message string) error {
+	args := n.args(title, message)
+	return exec.Command(args[0], args[1:]...).Run()
+}
@@ -0,0 +1,12 @@
+//go:build darwin
+
+package notify
+
+import "strconv"
+
+func newNotifier() (Notifier, error) {
+	return commandNotifier{args: func(title, message string) []string {
+		script := "display notification " + strconv.Quote(message) + " with title " + strconv.Quote(title)
+		return []string{"osascript", "-e", script}
+	}}, nil
+}
@@ -0,0 +1,15 @@
+//go:build linux && !android
+
+package notify
+
+import "os/exec"
+
+func newNotifier() (Notifier, error) {
+	path, err := exec.LookPath("notify-send")
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+	return commandNotifier{args: func(title, message string) []string {
+		return []string{path, "--app-name=warp-plus", title, message}
+	}}, nil
+}
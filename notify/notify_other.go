@@ -0,0 +1,7 @@
+//go:build !(linux && !android) && !darwin
+
+package notify
+
+func newNotifier() (Notifier, error) {
+	return nil, ErrUnsupported
+}
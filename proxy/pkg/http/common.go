@@ -62,6 +62,11 @@ type customConn struct {
 	once        sync.Once
 }
 
+// NetConn returns the underlying net.Conn
+func (c *customConn) NetConn() net.Conn {
+	return c.Conn
+}
+
 func (c *customConn) Read(p []byte) (n int, err error) {
 	c.once.Do(func() {
 		buf := &bytes.Buffer{}
@@ -3,11 +3,13 @@ package http
 import (
 	"bufio"
 	"context"
+	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
 )
@@ -23,6 +25,9 @@ type Server struct {
 	ProxyDial statute.ProxyDialFunc
 	// UserConnectHandle gives the user control to handle the TCP CONNECT requests
 	UserConnectHandle statute.UserConnectHandler
+	// DestinationFilter answers requests to the hosts it rejects with 403
+	// Forbidden
+	DestinationFilter statute.DestinationFilter
 	// Logger error log
 	Logger *slog.Logger
 	// Context is default context
@@ -135,11 +140,35 @@ func (s *Server) ServeConn(conn net.Conn) error {
 	if err != nil {
 		return err
 	}
+	// the request is read, lift a handshake timeout set by the caller
+	_ = conn.SetDeadline(time.Time{})
 
 	return s.handleHTTP(conn, req, req.Method == http.MethodConnect)
 }
 
+// requestAddress returns the host:port req is for, with the default port of
+// its scheme when it has none.
+func requestAddress(req *http.Request, isConnectMethod bool) string {
+	port := req.URL.Port()
+	switch {
+	case port != "":
+	case isConnectMethod || req.URL.Scheme == "https":
+		port = "443"
+	default:
+		port = "80"
+	}
+	return net.JoinHostPort(req.URL.Hostname(), port)
+}
+
 func (s *Server) handleHTTP(conn net.Conn, req *http.Request, isConnectMethod bool) error {
+	if s.DestinationFilter != nil && !s.DestinationFilter(requestAddress(req, isConnectMethod)) {
+		_, err := conn.Write([]byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("request to %s not allowed", req.URL.Host)
+	}
+
 	if s.UserConnectHandle == nil {
 		return s.embedHandleHTTP(conn, req, isConnectMethod)
 	}
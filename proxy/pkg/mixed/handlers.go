@@ -4,6 +4,8 @@ import (
 	"context"
 	"log/slog"
 	"net"
+	"net/netip"
+	"time"
 
 	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
 )
@@ -61,6 +63,16 @@ func WithUserUDPHandler(handler userHandler) Option {
 	}
 }
 
+// WithDestinationFilter refuses the requests to the hosts filter rejects,
+// with the refusal of the respective protocol.
+func WithDestinationFilter(filter statute.DestinationFilter) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.DestinationFilter = filter
+		p.socks4Proxy.DestinationFilter = filter
+		p.httpProxy.DestinationFilter = filter
+	}
+}
+
 func WithUserDialFunc(proxyDial statute.ProxyDialFunc) Option {
 	return func(p *Proxy) {
 		p.userDialFunc = proxyDial
@@ -82,6 +94,23 @@ func WithUserForwardAddressFunc(packetForwardAddress statute.PacketForwardAddres
 	}
 }
 
+// WithAdvertiseAddr reports addr in socks5 UDP ASSOCIATE replies instead of
+// the address the relay listens on, see socks5.WithAdvertiseAddr.
+func WithAdvertiseAddr(addr netip.AddrPort) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.AdvertiseAddr = addr
+	}
+}
+
+// WithHandshakeTimeout closes connections that don't finish the negotiation
+// of their protocol, up to the SOCKS request or the HTTP request header,
+// within timeout. Relaying afterwards isn't bound by it. 0 waits forever.
+func WithHandshakeTimeout(timeout time.Duration) Option {
+	return func(p *Proxy) {
+		p.handshakeTimeout = timeout
+	}
+}
+
 func WithContext(ctx context.Context) Option {
 	return func(p *Proxy) {
 		p.ctx = ctx
@@ -3,8 +3,10 @@ package mixed
 import (
 	"bufio"
 	"context"
+	"errors"
 	"log/slog"
 	"net"
+	"time"
 
 	"github.com/bepass-org/warp-plus/proxy/pkg/http"
 	"github.com/bepass-org/warp-plus/proxy/pkg/socks4"
@@ -34,6 +36,9 @@ type Proxy struct {
 	userUDPHandler userHandler
 	// overwrite dial functions of http, socks4, socks5
 	userDialFunc statute.ProxyDialFunc
+	// handshakeTimeout closes connections that don't finish the protocol
+	// negotiation in time, 0 waits forever
+	handshakeTimeout time.Duration
 	// logger error log
 	logger *slog.Logger
 	// ctx is default context
@@ -79,6 +84,20 @@ func (c *SwitchConn) Read(p []byte) (n int, err error) {
 	return c.Reader.Read(p)
 }
 
+// NetConn returns the underlying net.Conn
+func (c *SwitchConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// CloseWrite shuts down the writing side of the underlying net.Conn if it
+// supports half-close
+func (c *SwitchConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
 func (p *Proxy) ListenAndServe() error {
 	// Create a new listener
 	if p.listener == nil {
@@ -101,6 +120,7 @@ func (p *Proxy) ListenAndServe() error {
 	defer cancel() // Ensure resources are cleaned up
 
 	// Start to accept connections and serve them
+	var tempDelay time.Duration
 	for {
 		select {
 		case <-ctx.Done():
@@ -108,9 +128,21 @@ func (p *Proxy) ListenAndServe() error {
 		default:
 			conn, err := p.listener.Accept()
 			if err != nil {
-				p.logger.Error(err.Error())
+				if errors.Is(err, net.ErrClosed) {
+					return err
+				}
+				// Back off on errors like EMFILE instead of spinning, the
+				// same way net/http does
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay = min(2*tempDelay, time.Second)
+				}
+				p.logger.Error(err.Error(), "retry", tempDelay)
+				time.Sleep(tempDelay)
 				continue
 			}
+			tempDelay = 0
 
 			// Start a new goroutine to handle each connection
 			// This way, the server can handle multiple connections concurrently
@@ -126,6 +158,11 @@ func (p *Proxy) ListenAndServe() error {
 }
 
 func (p *Proxy) handleConnection(conn net.Conn) error {
+	if p.handshakeTimeout > 0 {
+		// lifted by the protocol servers once the request is read
+		_ = conn.SetDeadline(time.Now().Add(p.handshakeTimeout))
+	}
+
 	// Create a SwitchConn
 	switchConn := NewSwitchConn(conn)
 
@@ -0,0 +1,174 @@
+package mixed
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+)
+
+// BenchmarkAccept measures how fast the proxy accepts connections and gets
+// them to the protocol handlers.
+func BenchmarkAccept(b *testing.B) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p := NewProxy(
+		WithListener(ln),
+		WithContext(ctx),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		WithUserHandler(func(*statute.ProxyRequest) error { return nil }),
+	)
+	go func() {
+		_ = p.ListenAndServe()
+	}()
+
+	addr := ln.Addr().String()
+	greeting := []byte{5, 1, 0} // socks5, one method, no auth
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		reply := make([]byte, 2)
+		for pb.Next() {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			if _, err := conn.Write(greeting); err != nil {
+				b.Error(err)
+			}
+			if _, err := io.ReadFull(conn, reply); err != nil {
+				b.Error(err)
+			}
+			conn.Close()
+		}
+	})
+	b.StopTimer()
+
+	_ = ln.Close()
+}
+
+func TestAdvertiseAddr(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p := NewProxy(
+		WithListener(ln),
+		WithContext(ctx),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		WithUserHandler(func(*statute.ProxyRequest) error { return nil }),
+		WithAdvertiseAddr(netip.MustParseAddrPort("203.0.113.7:0")),
+	)
+	go func() {
+		_ = p.ListenAndServe()
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// no auth, then UDP ASSOCIATE from 0.0.0.0:0
+	if _, err := conn.Write([]byte{5, 1, 0, 5, 3, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[3] != 0 {
+		t.Fatalf("associate failed with reply %d", reply[3])
+	}
+	if got := netip.AddrFrom4([4]byte(reply[6:10])); got != netip.MustParseAddr("203.0.113.7") {
+		t.Errorf("reply address is %v, want the advertised address", got)
+	}
+	// the relay port is kept
+	if port := binary.BigEndian.Uint16(reply[10:12]); port == 0 {
+		t.Error("reply port is 0, want the port of the relay")
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const timeout = 100 * time.Millisecond
+	p := NewProxy(
+		WithListener(ln),
+		WithContext(ctx),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		WithUserHandler(func(req *statute.ProxyRequest) error {
+			// echo until the client is done
+			_, err := io.Copy(req.Conn, req.Conn)
+			return err
+		}),
+		WithHandshakeTimeout(timeout),
+	)
+	go func() {
+		_ = p.ListenAndServe()
+	}()
+
+	// a client stalling after its greeting is disconnected
+	stalled, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	if _, err := stalled.Write([]byte{5, 1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_ = stalled.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(stalled); err != nil {
+		t.Fatalf("stalled client wasn't disconnected: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < timeout/2 {
+		t.Errorf("stalled client disconnected after %v, before the timeout", elapsed)
+	}
+
+	// a client that finished the handshake may idle past the timeout
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// no auth, then CONNECT to 192.0.2.1:80
+	if _, err := conn.Write([]byte{5, 1, 0, 5, 1, 0, 1, 192, 0, 2, 1, 0, 80}); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * timeout)
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	echo := make([]byte, 4)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, echo); err != nil {
+		t.Fatalf("connection closed after the handshake: %v", err)
+	}
+}
@@ -0,0 +1,304 @@
+// Package proxyproto implements the receiving side of the HAProxy PROXY
+// protocol, versions 1 and 2.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultHeaderTimeout bounds how long a client may take to send the header.
+const DefaultHeaderTimeout = 5 * time.Second
+
+var (
+	// ErrNoHeader is returned when a connection doesn't start with a PROXY
+	// protocol header.
+	ErrNoHeader = errors.New("proxyproto: missing PROXY protocol header")
+	// ErrInvalidHeader is returned for a malformed header.
+	ErrInvalidHeader = errors.New("proxyproto: invalid PROXY protocol header")
+)
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	v1Prefix    = "PROXY "
+	v1MaxLength = 107
+)
+
+// Header holds the addresses conveyed by a PROXY protocol header. Both are
+// nil for LOCAL (v2) and UNKNOWN (v1) headers, in which case the addresses
+// of the connection itself apply.
+type Header struct {
+	Source      net.Addr
+	Destination net.Addr
+}
+
+// ReadHeader reads a v1 or v2 header from r. It never reads past the
+// header, so it doesn't wait for more data than the header takes, such as
+// the 15 bytes of a v1 UNKNOWN header.
+func ReadHeader(r *bufio.Reader) (Header, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return Header{}, ErrNoHeader
+		}
+		return Header{}, err
+	}
+
+	switch first[0] {
+	case v1Prefix[0]:
+		prefix, err := r.Peek(len(v1Prefix))
+		if string(prefix) == v1Prefix {
+			return readV1(r)
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return Header{}, err
+		}
+	case v2Signature[0]:
+		sig, err := r.Peek(len(v2Signature))
+		if bytes.Equal(sig, v2Signature) {
+			return readV2(r)
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return Header{}, err
+		}
+	}
+	return Header{}, ErrNoHeader
+}
+
+func readV1(r *bufio.Reader) (Header, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return Header{}, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= v1MaxLength {
+			return Header{}, ErrInvalidHeader
+		}
+	}
+
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return Header{}, ErrInvalidHeader
+	}
+
+	fields := strings.Split(s, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return Header{}, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return Header{}, ErrInvalidHeader
+	}
+
+	src, err := parseV1Addr(fields[2], fields[4], fields[1] == "TCP4")
+	if err != nil {
+		return Header{}, err
+	}
+	dst, err := parseV1Addr(fields[3], fields[5], fields[1] == "TCP4")
+	if err != nil {
+		return Header{}, err
+	}
+	return Header{Source: src, Destination: dst}, nil
+}
+
+func parseV1Addr(ip, port string, is4 bool) (net.Addr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Is4() != is4 {
+		return nil, ErrInvalidHeader
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, ErrInvalidHeader
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(p))), nil
+}
+
+func readV2(r *bufio.Reader) (Header, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return Header{}, err
+	}
+
+	verCmd, fam := hdr[12], hdr[13]
+	length := int(binary.BigEndian.Uint16(hdr[14:16]))
+	if verCmd>>4 != 2 {
+		return Header{}, ErrInvalidHeader
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return Header{}, err
+	}
+
+	switch verCmd & 0xf {
+	case 0: // LOCAL, e.g. health checks from the balancer itself
+		return Header{}, nil
+	case 1: // PROXY
+	default:
+		return Header{}, ErrInvalidHeader
+	}
+
+	var ipLen int
+	switch fam >> 4 {
+	case 1:
+		ipLen = 4
+	case 2:
+		ipLen = 16
+	default:
+		// AF_UNSPEC and AF_UNIX carry no usable address
+		return Header{}, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return Header{}, ErrInvalidHeader
+	}
+
+	srcIP, _ := netip.AddrFromSlice(payload[:ipLen])
+	dstIP, _ := netip.AddrFromSlice(payload[ipLen : 2*ipLen])
+	srcPort := binary.BigEndian.Uint16(payload[2*ipLen:])
+	dstPort := binary.BigEndian.Uint16(payload[2*ipLen+2:])
+
+	if fam&0xf == 2 {
+		return Header{
+			Source:      net.UDPAddrFromAddrPort(netip.AddrPortFrom(srcIP, srcPort)),
+			Destination: net.UDPAddrFromAddrPort(netip.AddrPortFrom(dstIP, dstPort)),
+		}, nil
+	}
+	return Header{
+		Source:      net.TCPAddrFromAddrPort(netip.AddrPortFrom(srcIP, srcPort)),
+		Destination: net.TCPAddrFromAddrPort(netip.AddrPortFrom(dstIP, dstPort)),
+	}, nil
+}
+
+// Listener wraps a net.Listener and requires every accepted connection to
+// start with a PROXY protocol header. The header is read on first use of the
+// connection so a slow client can't stall Accept; connections without a
+// valid header fail their first Read.
+type Listener struct {
+	net.Listener
+	// HeaderTimeout limits how long reading the header may take.
+	HeaderTimeout time.Duration
+}
+
+// NewListener returns a Listener using DefaultHeaderTimeout.
+func NewListener(ln net.Listener) *Listener {
+	return &Listener{Listener: ln, HeaderTimeout: DefaultHeaderTimeout}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn, r: bufio.NewReader(conn), timeout: l.HeaderTimeout}, nil
+}
+
+// Conn is a connection whose remote address is taken from its PROXY protocol
+// header once it has been read. LocalAddr is left untouched since it's used
+// to bind UDP relays.
+type Conn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	header Header
+	err    error
+	// done is set once header and err are filled in.
+	done atomic.Bool
+
+	mu sync.Mutex
+	// readDeadline is the read deadline set by the user of the connection,
+	// restored once the header is read.
+	readDeadline time.Time
+}
+
+func (c *Conn) readHeader() {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			c.mu.Lock()
+			deadline := time.Now().Add(c.timeout)
+			if !c.readDeadline.IsZero() && c.readDeadline.Before(deadline) {
+				deadline = c.readDeadline
+			}
+			_ = c.Conn.SetReadDeadline(deadline)
+			c.mu.Unlock()
+			defer func() {
+				c.mu.Lock()
+				_ = c.Conn.SetReadDeadline(c.readDeadline)
+				c.mu.Unlock()
+			}()
+		}
+		c.header, c.err = ReadHeader(c.r)
+		if c.err != nil {
+			c.err = fmt.Errorf("rejecting connection from %s: %w", c.Conn.RemoteAddr(), c.err)
+		}
+		c.done.Store(true)
+	})
+}
+
+// Header returns the parsed PROXY protocol header, reading it if needed.
+func (c *Conn) Header() (Header, error) {
+	c.readHeader()
+	return c.header, c.err
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+// SetDeadline sets the read and write deadlines of the connection. The read
+// deadline also bounds reading the header if it is sooner than the header
+// timeout, and stays in place after it.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline like SetDeadline does.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// RemoteAddr returns the client address conveyed by the header. It doesn't
+// wait for the header: until the first Read or Header call has read it, and
+// for headers without addresses, it is the address of the connection itself.
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.done.Load() && c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// CloseWrite shuts down the writing side of the underlying connection if it
+// supports half-close.
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
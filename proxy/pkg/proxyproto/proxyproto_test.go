@@ -0,0 +1,163 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestReadHeaderV1(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 203.0.113.7 192.0.2.1 51234 8086\r\nGET / HTTP/1.1\r\n"))
+	h, err := ReadHeader(r)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, h.Source.String(), qt.Equals, "203.0.113.7:51234")
+	qt.Assert(t, h.Destination.String(), qt.Equals, "192.0.2.1:8086")
+
+	rest, _ := r.ReadString('\n')
+	qt.Assert(t, rest, qt.Equals, "GET / HTTP/1.1\r\n")
+
+	h, err = ReadHeader(bufio.NewReader(strings.NewReader("PROXY TCP6 2001:db8::1 2001:db8::2 1 2\r\n")))
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, h.Source.String(), qt.Equals, "[2001:db8::1]:1")
+
+	h, err = ReadHeader(bufio.NewReader(strings.NewReader("PROXY UNKNOWN\r\n")))
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, h.Source, qt.IsNil)
+
+	for _, in := range []string{
+		"PROXY TCP4 203.0.113.7 192.0.2.1 51234\r\n",
+		"PROXY TCP4 2001:db8::1 192.0.2.1 1 2\r\n",
+		"PROXY TCP4 203.0.113.7 192.0.2.1 70000 2\r\n",
+		"PROXY TCP4 203.0.113.7 192.0.2.1 1 2\n",
+		"PROXY " + strings.Repeat("A", 200) + "\r\n",
+	} {
+		_, err := ReadHeader(bufio.NewReader(strings.NewReader(in)))
+		qt.Assert(t, err, qt.ErrorIs, ErrInvalidHeader, qt.Commentf("%q", in))
+	}
+
+	_, err = ReadHeader(bufio.NewReader(strings.NewReader("\x05\x01\x00")))
+	qt.Assert(t, err, qt.ErrorIs, ErrNoHeader)
+}
+
+func v2Header(cmd, fam byte, addrs []byte) []byte {
+	b := append([]byte{}, v2Signature...)
+	b = append(b, 0x20|cmd, fam, byte(len(addrs)>>8), byte(len(addrs)))
+	return append(b, addrs...)
+}
+
+func TestReadHeaderV2(t *testing.T) {
+	addrs := []byte{203, 0, 113, 7, 192, 0, 2, 1, 0xc8, 0x22, 0x1f, 0x96}
+	in := append(v2Header(1, 0x11, addrs), 5, 1, 0)
+	r := bufio.NewReader(bytes.NewReader(in))
+	h, err := ReadHeader(r)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, h.Source.String(), qt.Equals, "203.0.113.7:51234")
+	qt.Assert(t, h.Destination.String(), qt.Equals, "192.0.2.1:8086")
+
+	b, _ := r.ReadByte()
+	qt.Assert(t, b, qt.Equals, byte(5))
+
+	ip6 := append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...)
+	h, err = ReadHeader(bufio.NewReader(bytes.NewReader(v2Header(1, 0x21, append(ip6, 0, 1, 0, 2)))))
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, h.Source.String(), qt.Equals, "[2001:db8::1]:1")
+
+	// LOCAL commands keep the connection's own addresses, TLVs are skipped
+	h, err = ReadHeader(bufio.NewReader(bytes.NewReader(v2Header(0, 0x00, []byte{1, 0, 0}))))
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, h.Source, qt.IsNil)
+
+	_, err = ReadHeader(bufio.NewReader(bytes.NewReader(v2Header(1, 0x11, addrs[:8]))))
+	qt.Assert(t, err, qt.ErrorIs, ErrInvalidHeader)
+
+	_, err = ReadHeader(bufio.NewReader(bytes.NewReader(v2Header(3, 0x11, addrs))))
+	qt.Assert(t, err, qt.ErrorIs, ErrInvalidHeader)
+}
+
+func TestListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	pln := NewListener(ln)
+	defer pln.Close()
+
+	for _, tc := range []struct {
+		send string
+		err  error
+	}{
+		{"PROXY TCP4 203.0.113.7 192.0.2.1 51234 8086\r\nhello", nil},
+		{"hello", ErrNoHeader},
+	} {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		qt.Assert(t, err, qt.IsNil)
+		_, err = client.Write([]byte(tc.send))
+		qt.Assert(t, err, qt.IsNil)
+		client.Close()
+
+		conn, err := pln.Accept()
+		qt.Assert(t, err, qt.IsNil)
+
+		buf := make([]byte, 5)
+		_, err = conn.Read(buf)
+		if tc.err != nil {
+			qt.Assert(t, errors.Is(err, tc.err), qt.IsTrue)
+			qt.Assert(t, conn.RemoteAddr().String(), qt.Equals, client.LocalAddr().String())
+		} else {
+			qt.Assert(t, err, qt.IsNil)
+			qt.Assert(t, string(buf), qt.Equals, "hello")
+			qt.Assert(t, conn.RemoteAddr().String(), qt.Equals, "203.0.113.7:51234")
+		}
+		conn.Close()
+	}
+}
+
+func TestShortHeader(t *testing.T) {
+	// the client sends a bare UNKNOWN header and waits for the server to
+	// speak first, so nothing beyond its 15 bytes may be waited for
+	server, client := net.Pipe()
+	defer client.Close()
+	go client.Write([]byte("PROXY UNKNOWN\r\n"))
+
+	conn := &Conn{Conn: server, r: bufio.NewReader(server), timeout: time.Second}
+	defer conn.Close()
+	// the address isn't known before the header is read, RemoteAddr
+	// doesn't wait for it
+	qt.Assert(t, conn.RemoteAddr(), qt.Equals, server.RemoteAddr())
+
+	h, err := conn.Header()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, h.Source, qt.IsNil)
+}
+
+func TestListenerKeepsDeadline(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	pln := NewListener(ln)
+	defer pln.Close()
+
+	// the client sends its header, then stalls
+	client, err := net.Dial("tcp", ln.Addr().String())
+	qt.Assert(t, err, qt.IsNil)
+	defer client.Close()
+	_, err = client.Write([]byte("PROXY TCP4 203.0.113.7 192.0.2.1 51234 8086\r\n"))
+	qt.Assert(t, err, qt.IsNil)
+
+	conn, err := pln.Accept()
+	qt.Assert(t, err, qt.IsNil)
+	defer conn.Close()
+
+	// a deadline set before the header is read outlives it
+	const timeout = 100 * time.Millisecond
+	qt.Assert(t, conn.SetDeadline(time.Now().Add(timeout)), qt.IsNil)
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 1))
+	qt.Assert(t, err, qt.ErrorIs, os.ErrDeadlineExceeded)
+	qt.Assert(t, time.Since(start) < DefaultHeaderTimeout, qt.IsTrue)
+	qt.Assert(t, conn.RemoteAddr().String(), qt.Equals, "203.0.113.7:51234")
+}
@@ -6,6 +6,8 @@ import (
 	"io"
 	"log/slog"
 	"net"
+	"strconv"
+	"time"
 
 	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
 )
@@ -22,6 +24,8 @@ type Server struct {
 	ProxyDial statute.ProxyDialFunc
 	// UserConnectHandle gives the user control to handle the TCP CONNECT requests
 	UserConnectHandle statute.UserConnectHandler
+	// DestinationFilter refuses the CONNECT requests to the hosts it rejects
+	DestinationFilter statute.DestinationFilter
 	// Logger error log
 	Logger *slog.Logger
 	// Context is default context
@@ -155,6 +159,8 @@ func (s *Server) ServeConn(conn net.Conn) error {
 	}
 	req.DestinationAddr = &addr.address
 	req.Username = addr.Username
+	// the handshake is done, lift a handshake timeout set by the caller
+	_ = conn.SetDeadline(time.Time{})
 	return s.handle(req)
 }
 
@@ -171,6 +177,13 @@ func (s *Server) handle(req *request) error {
 }
 
 func (s *Server) handleConnect(req *request) error {
+	if !s.allowed(req.DestinationAddr) {
+		if err := sendReply(req.Conn, rejectedReply, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
+		}
+		return fmt.Errorf("connect to %v not allowed", req.DestinationAddr)
+	}
+
 	if s.UserConnectHandle == nil {
 		return s.embedHandleConnect(req)
 	}
@@ -196,6 +209,18 @@ func (s *Server) handleConnect(req *request) error {
 	return s.UserConnectHandle(proxyReq)
 }
 
+// allowed reports whether DestinationFilter lets requests to addr through.
+func (s *Server) allowed(addr *address) bool {
+	if s.DestinationFilter == nil {
+		return true
+	}
+	host := addr.IP.String()
+	if addr.Name != "" {
+		host = addr.Name
+	}
+	return s.DestinationFilter(net.JoinHostPort(host, strconv.Itoa(addr.Port)))
+}
+
 func (s *Server) embedHandleConnect(req *request) error {
 	defer func() {
 		_ = req.Conn.Close()
@@ -7,6 +7,9 @@ import (
 	"io"
 	"log/slog"
 	"net"
+	"net/netip"
+	"strconv"
+	"time"
 
 	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
 )
@@ -28,8 +31,12 @@ type Server struct {
 	PacketForwardAddress statute.PacketForwardAddress
 	// UserConnectHandle gives the user control to handle the TCP CONNECT requests
 	UserConnectHandle statute.UserConnectHandler
+	// DestinationFilter refuses the CONNECT requests to the hosts it rejects
+	DestinationFilter statute.DestinationFilter
 	// UserAssociateHandle gives the user control to handle the UDP ASSOCIATE requests
 	UserAssociateHandle statute.UserAssociateHandler
+	// AdvertiseAddr overrides the relay address in UDP ASSOCIATE replies
+	AdvertiseAddr netip.AddrPort
 	// Logger error log
 	Logger *slog.Logger
 	// Context is default context
@@ -114,6 +121,15 @@ func WithBind(bindAddress string) ServerOption {
 	}
 }
 
+// WithAdvertiseAddr reports addr in UDP ASSOCIATE replies instead of the
+// address the relay listens on, for clients reaching the server through NAT.
+// A zero port keeps the port of the relay.
+func WithAdvertiseAddr(addr netip.AddrPort) ServerOption {
+	return func(s *Server) {
+		s.AdvertiseAddr = addr
+	}
+}
+
 func WithConnectHandle(handler statute.UserConnectHandler) ServerOption {
 	return func(s *Server) {
 		s.UserConnectHandle = handler
@@ -211,6 +227,8 @@ func (s *Server) ServeConn(conn net.Conn) error {
 		return err
 	}
 	req.DestinationAddr = dest
+	// the handshake is done, lift a handshake timeout set by the caller
+	_ = conn.SetDeadline(time.Time{})
 	err = s.handle(req)
 	if err != nil {
 		return err
@@ -234,6 +252,13 @@ func (s *Server) handle(req *request) error {
 }
 
 func (s *Server) handleConnect(req *request) error {
+	if !s.allowed(req.DestinationAddr) {
+		if err := sendReply(req.Conn, ruleFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
+		}
+		return fmt.Errorf("connect to %v not allowed", req.DestinationAddr)
+	}
+
 	if s.UserConnectHandle == nil {
 		return s.embedHandleConnect(req)
 	}
@@ -259,6 +284,18 @@ func (s *Server) handleConnect(req *request) error {
 	return s.UserConnectHandle(proxyReq)
 }
 
+// allowed reports whether DestinationFilter lets requests to addr through.
+func (s *Server) allowed(addr *address) bool {
+	if s.DestinationFilter == nil {
+		return true
+	}
+	host := addr.IP.String()
+	if addr.Name != "" {
+		host = addr.Name
+	}
+	return s.DestinationFilter(net.JoinHostPort(host, strconv.Itoa(addr.Port)))
+}
+
 func (s *Server) embedHandleConnect(req *request) error {
 	defer func() {
 		_ = req.Conn.Close()
@@ -314,6 +351,12 @@ func (s *Server) handleAssociate(req *request) error {
 	if err != nil {
 		return err
 	}
+	if s.AdvertiseAddr.IsValid() {
+		ip = s.AdvertiseAddr.Addr().Unmap().AsSlice()
+		if p := s.AdvertiseAddr.Port(); p != 0 {
+			port = int(p)
+		}
+	}
 	bind := address{IP: ip, Port: port}
 	if err := sendReply(req.Conn, successReply, &bind); err != nil {
 		return fmt.Errorf("failed to send reply: %v", err)
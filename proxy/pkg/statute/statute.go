@@ -35,6 +35,11 @@ type ProxyRequest struct {
 // UserConnectHandler is used for socks5, socks4 and http
 type UserConnectHandler func(request *ProxyRequest) error
 
+// DestinationFilter reports whether a request to address may be served.
+// address is host:port, the host being the hostname or IP address as sent
+// by the client.
+type DestinationFilter func(address string) bool
+
 // UserAssociateHandler is used for socks5
 type UserAssociateHandler func(request *ProxyRequest) error
 
@@ -56,12 +56,25 @@ type NoticeEvent struct {
 	Timestamp string                 `json:"timestamp"`
 }
 
-func StartTunnel(ctx context.Context, l *slog.Logger, config *psiphon.Config) error {
-	controllerCtx, cancel := context.WithCancel(ctx)
+// Tunnel is a running psiphon controller.
+type Tunnel struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Close stops the controller and waits for it to release the local proxy
+// port.
+func (t *Tunnel) Close() {
+	t.cancel()
+	<-t.done
+	psiphon.CloseDataStore()
+}
+
+func StartTunnel(ctx context.Context, l *slog.Logger, config *psiphon.Config) (*Tunnel, error) {
 	// config.Commit must be called before calling config.SetParameters
 	// or attempting to connect.
 	if err := config.Commit(true); err != nil {
-		return errors.New("config.Commit failed")
+		return nil, errors.New("config.Commit failed")
 	}
 
 	// Will receive a value when the tunnel has successfully connected.
@@ -97,21 +110,27 @@ func StartTunnel(ctx context.Context, l *slog.Logger, config *psiphon.Config) er
 		}))
 
 	if err := psiphon.OpenDataStore(config); err != nil {
-		return errors.New("failed to open data store")
+		return nil, errors.New("failed to open data store")
 	}
 
-	if err := psiphon.ImportEmbeddedServerEntries(controllerCtx, config, "", ""); err != nil {
-		return err
+	if err := psiphon.ImportEmbeddedServerEntries(ctx, config, "", ""); err != nil {
+		psiphon.CloseDataStore()
+		return nil, err
 	}
 
 	// Create the Psiphon controller
 	controller, err := psiphon.NewController(config)
 	if err != nil {
-		return errors.New("psiphon.NewController failed")
+		psiphon.CloseDataStore()
+		return nil, errors.New("psiphon.NewController failed")
 	}
 
+	controllerCtx, cancel := context.WithCancel(ctx)
+	t := &Tunnel{cancel: cancel, done: make(chan struct{})}
+
 	// Begin tunnel connection
 	go func() {
+		defer close(t.done)
 		// Start the tunnel. Only returns on error (or internal timeout).
 		controller.Run(controllerCtx)
 
@@ -124,16 +143,15 @@ func StartTunnel(ctx context.Context, l *slog.Logger, config *psiphon.Config) er
 	// Wait for an active tunnel or error
 	select {
 	case <-connected:
-		return nil
+		return t, nil
 	case err := <-errored:
-		cancel()
-		psiphon.CloseDataStore()
+		t.Close()
 		psiphon.SetNoticeWriter(io.Discard)
-		return err
+		return nil, err
 	}
 }
 
-func RunPsiphon(ctx context.Context, l *slog.Logger, wgBind netip.AddrPort, dir string, localSocksAddr netip.AddrPort, country string) error {
+func RunPsiphon(ctx context.Context, l *slog.Logger, wgBind netip.AddrPort, dir string, localSocksAddr netip.AddrPort, country string) (*Tunnel, error) {
 	host := ""
 	if !netip.MustParsePrefix("127.0.0.0/8").Contains(localSocksAddr.Addr()) {
 		host = "any"
@@ -162,9 +180,10 @@ func RunPsiphon(ctx context.Context, l *slog.Logger, wgBind netip.AddrPort, dir
 	}
 
 	l.Info("starting handshake")
-	if err := StartTunnel(ctx, l, &config); err != nil {
-		return fmt.Errorf("Unable to start psiphon: %w", err)
+	t, err := StartTunnel(ctx, l, &config)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to start psiphon: %w", err)
 	}
-	l.Info("psiphon started successfully")
-	return nil
+	l.Info("psiphon started successfully", "country", country)
+	return t, nil
 }
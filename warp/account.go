@@ -3,13 +3,23 @@ package warp
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 var identityFile = "wgcf-identity.json"
 
+// stampCreated records the registration time in i if the API didn't, so
+// the age of cached identities is known.
+func stampCreated(i *Identity) {
+	if i.Created == "" {
+		i.Created = time.Now().UTC().Format(time.RFC3339)
+	}
+}
+
 func saveIdentity(a Identity, path string) error {
 	file, err := os.Create(filepath.Join(path, identityFile))
 	if err != nil {
@@ -26,10 +36,32 @@ func saveIdentity(a Identity, path string) error {
 	return file.Close()
 }
 
-func LoadOrCreateIdentity(l *slog.Logger, path, license string) (*Identity, error) {
+// devicePrivateKey returns the private key to register a new device with,
+// the one given with WithPrivateKey or a freshly generated one.
+func (w *WarpAPI) devicePrivateKey() (Key, error) {
+	if w.privateKey == "" {
+		return GeneratePrivateKey()
+	}
+	key, err := ParseKey(w.privateKey)
+	if err != nil {
+		return Key{}, fmt.Errorf("invalid private key: %w", err)
+	}
+	return key, nil
+}
+
+// saveIdentity writes i to the cache under path, without the private key
+// when it was given with WithPrivateKey.
+func (w *WarpAPI) saveIdentity(i Identity, path string) error {
+	if w.privateKey != "" {
+		i.PrivateKey = ""
+	}
+	return saveIdentity(i, path)
+}
+
+func LoadOrCreateIdentity(l *slog.Logger, path, license string, options ...APIOption) (*Identity, error) {
 	l = l.With("subsystem", "warp/account")
 
-	warpAPI := NewWarpAPI(l)
+	warpAPI := NewWarpAPI(l, options...)
 
 	i, err := LoadIdentity(path)
 	if err != nil {
@@ -47,7 +79,7 @@ func LoadOrCreateIdentity(l *slog.Logger, path, license string) (*Identity, erro
 			return nil, err
 		}
 
-		if err = saveIdentity(i, path); err != nil {
+		if err = warpAPI.saveIdentity(i, path); err != nil {
 			return nil, err
 		}
 	}
@@ -71,7 +103,7 @@ func LoadOrCreateIdentity(l *slog.Logger, path, license string) (*Identity, erro
 		}
 		i.Account = iAcc
 
-		if err = saveIdentity(i, path); err != nil {
+		if err = warpAPI.saveIdentity(i, path); err != nil {
 			return nil, err
 		}
 	}
@@ -106,7 +138,7 @@ func LoadIdentity(path string) (Identity, error) {
 }
 
 func CreateIdentity(l *slog.Logger, warpAPI *WarpAPI, license string) (Identity, error) {
-	priv, err := GeneratePrivateKey()
+	priv, err := warpAPI.devicePrivateKey()
 	if err != nil {
 		return Identity{}, err
 	}
@@ -140,6 +172,68 @@ func CreateIdentity(l *slog.Logger, warpAPI *WarpAPI, license string) (Identity,
 	i.Account = ac
 
 	i.PrivateKey = privateKey
+	stampCreated(&i)
+
+	return i, nil
+}
+
+// LoadOrCreateTeamIdentity is the Zero Trust counterpart of
+// LoadOrCreateIdentity. The enrollment token is only used when no identity
+// is cached under path, since it is short-lived and single use.
+func LoadOrCreateTeamIdentity(l *slog.Logger, path, teamToken string, options ...APIOption) (*Identity, error) {
+	l = l.With("subsystem", "warp/account")
+
+	i, err := LoadIdentity(path)
+	if err != nil {
+		l.Info("failed to load team identity", "path", path, "error", err)
+		if teamToken == "" {
+			return nil, errors.New("no cached team identity and no team token provided")
+		}
+
+		if err := os.RemoveAll(path); err != nil {
+			return nil, err
+		}
+
+		if err := os.MkdirAll(path, os.ModePerm); err != nil {
+			return nil, err
+		}
+
+		warpAPI := NewWarpAPI(l, options...)
+		i, err = CreateTeamIdentity(l, warpAPI, teamToken)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = warpAPI.saveIdentity(i, path); err != nil {
+			return nil, err
+		}
+	}
+
+	l.Info("successfully loaded warp team identity")
+	return &i, nil
+}
+
+// CreateTeamIdentity enrolls a new device in a Zero Trust team. Unlike
+// CreateIdentity it doesn't touch the device name or license, both of which
+// are managed by the team.
+func CreateTeamIdentity(l *slog.Logger, warpAPI *WarpAPI, teamToken string) (Identity, error) {
+	priv, err := warpAPI.devicePrivateKey()
+	if err != nil {
+		return Identity{}, err
+	}
+
+	l.Info("enrolling new team identity")
+	i, err := warpAPI.RegisterTeam(priv.PublicKey().String(), teamToken)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	if len(i.Config.Peers) < 1 {
+		return Identity{}, errors.New("team registration returned 0 peers")
+	}
+
+	i.PrivateKey = priv.String()
+	stampCreated(&i)
 
 	return i, nil
 }
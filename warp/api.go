@@ -4,12 +4,15 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"net/http"
 	"time"
+
+	"github.com/avast/retry-go"
 )
 
 const (
@@ -19,7 +22,7 @@ const (
 func defaultHeaders() map[string]string {
 	return map[string]string{
 		"Content-Type":      "application/json; charset=UTF-8",
-		"User-Agent":        "okhttp/3.12.1",
+		"User-Agent":        DefaultUserAgent,
 		"CF-Client-Version": "a-6.30-3596",
 	}
 }
@@ -108,12 +111,82 @@ type License struct {
 	License string `json:"license"`
 }
 
+// DefaultUserAgent mimics the official Android client.
+const DefaultUserAgent = "okhttp/3.12.1"
+
+// ErrAccountRejected is returned when cloudflare keeps refusing to register a
+// device.
+var ErrAccountRejected = errors.New("account registration rejected")
+
+// defaultRegisterRetryDelay is the initial backoff between registration
+// attempts.
+const defaultRegisterRetryDelay = time.Second
+
 type WarpAPI struct {
-	l      *slog.Logger
-	client *http.Client
+	l         *slog.Logger
+	ctx       context.Context
+	client    *http.Client
+	userAgent string
+
+	registerRetries    uint
+	registerRetryDelay time.Duration
+
+	privateKey string
+}
+
+// APIOption configures a WarpAPI.
+type APIOption func(*WarpAPI)
+
+// WithHTTPClient makes the API use client for all requests instead of the
+// default client, which dials cloudflare with a custom TLS fingerprint.
+// Useful for custom timeouts, proxies, instrumentation and tests.
+func WithHTTPClient(client *http.Client) APIOption {
+	return func(w *WarpAPI) {
+		if client != nil {
+			w.client = client
+		}
+	}
+}
+
+// WithUserAgent overrides the User-Agent sent with every request. An empty
+// value keeps DefaultUserAgent.
+func WithUserAgent(userAgent string) APIOption {
+	return func(w *WarpAPI) {
+		if userAgent != "" {
+			w.userAgent = userAgent
+		}
+	}
+}
+
+// WithRegisterRetries retries a failed registration up to retries times
+// with exponential backoff. Only server errors, rate limiting and network
+// timeouts are retried, a rate limited attempt waits as long as its
+// Retry-After header asks.
+func WithRegisterRetries(retries uint) APIOption {
+	return func(w *WarpAPI) {
+		w.registerRetries = retries
+	}
 }
 
-func NewWarpAPI(l *slog.Logger) *WarpAPI {
+// WithPrivateKey registers new devices with key instead of a freshly
+// generated one. The key is kept out of the identities written to the
+// cache, it is expected to be supplied again on every run.
+func WithPrivateKey(key string) APIOption {
+	return func(w *WarpAPI) {
+		w.privateKey = key
+	}
+}
+
+// WithContext bounds all requests and registration retries by ctx.
+func WithContext(ctx context.Context) APIOption {
+	return func(w *WarpAPI) {
+		if ctx != nil {
+			w.ctx = ctx
+		}
+	}
+}
+
+func NewWarpAPI(l *slog.Logger, options ...APIOption) *WarpAPI {
 	tlsDialer := Dialer{l: l}
 	// Create a custom HTTP transport
 	transport := &http.Transport{
@@ -122,25 +195,40 @@ func NewWarpAPI(l *slog.Logger) *WarpAPI {
 		},
 	}
 
-	return &WarpAPI{
-		l:      l,
-		client: &http.Client{Transport: transport},
+	w := &WarpAPI{
+		l:         l,
+		ctx:       context.Background(),
+		client:    &http.Client{Transport: transport},
+		userAgent: DefaultUserAgent,
+
+		registerRetryDelay: defaultRegisterRetryDelay,
+	}
+
+	for _, option := range options {
+		option(w)
+	}
+
+	return w
+}
+
+func (w *WarpAPI) setHeaders(req *http.Request) {
+	for k, v := range defaultHeaders() {
+		req.Header.Set(k, v)
 	}
+	req.Header.Set("User-Agent", w.userAgent)
 }
 
 func (w *WarpAPI) GetAccount(authToken, deviceID string) (IdentityAccount, error) {
 	reqUrl := fmt.Sprintf("%s/reg/%s/account", apiBase, deviceID)
 	method := "GET"
 
-	req, err := http.NewRequest(method, reqUrl, nil)
+	req, err := http.NewRequestWithContext(w.ctx, method, reqUrl, nil)
 	if err != nil {
 		return IdentityAccount{}, err
 	}
 
 	// Set headers
-	for k, v := range defaultHeaders() {
-		req.Header.Set(k, v)
-	}
+	w.setHeaders(req)
 	req.Header.Set("Authorization", "Bearer "+authToken)
 
 	// Create HTTP client and execute request
@@ -151,7 +239,7 @@ func (w *WarpAPI) GetAccount(authToken, deviceID string) (IdentityAccount, error
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return IdentityAccount{}, fmt.Errorf("API request failed with status: %s", resp.Status)
+		return IdentityAccount{}, responseError(resp)
 	}
 
 	// convert response to byte array
@@ -172,15 +260,13 @@ func (w *WarpAPI) GetBoundDevices(authToken, deviceID string) ([]IdentityDevice,
 	reqUrl := fmt.Sprintf("%s/reg/%s/account/devices", apiBase, deviceID)
 	method := "GET"
 
-	req, err := http.NewRequest(method, reqUrl, nil)
+	req, err := http.NewRequestWithContext(w.ctx, method, reqUrl, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	// Set headers
-	for k, v := range defaultHeaders() {
-		req.Header.Set(k, v)
-	}
+	w.setHeaders(req)
 	req.Header.Set("Authorization", "Bearer "+authToken)
 
 	// Create HTTP client and execute request
@@ -191,7 +277,7 @@ func (w *WarpAPI) GetBoundDevices(authToken, deviceID string) ([]IdentityDevice,
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return nil, fmt.Errorf("API request failed with status: %s", resp.Status)
+		return nil, responseError(resp)
 	}
 
 	// convert response to byte array
@@ -212,15 +298,13 @@ func (w *WarpAPI) GetSourceDevice(authToken, deviceID string) (Identity, error)
 	reqUrl := fmt.Sprintf("%s/reg/%s", apiBase, deviceID)
 	method := "GET"
 
-	req, err := http.NewRequest(method, reqUrl, nil)
+	req, err := http.NewRequestWithContext(w.ctx, method, reqUrl, nil)
 	if err != nil {
 		return Identity{}, err
 	}
 
 	// Set headers
-	for k, v := range defaultHeaders() {
-		req.Header.Set(k, v)
-	}
+	w.setHeaders(req)
 	req.Header.Set("Authorization", "Bearer "+authToken)
 
 	// Create HTTP client and execute request
@@ -231,7 +315,7 @@ func (w *WarpAPI) GetSourceDevice(authToken, deviceID string) (Identity, error)
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return Identity{}, fmt.Errorf("API request failed with status: %s", resp.Status)
+		return Identity{}, responseError(resp)
 	}
 
 	// convert response to byte array
@@ -249,6 +333,51 @@ func (w *WarpAPI) GetSourceDevice(authToken, deviceID string) (Identity, error)
 }
 
 func (w *WarpAPI) Register(publicKey string) (Identity, error) {
+	return w.register(publicKey, nil)
+}
+
+// RegisterTeam registers a new device against a Cloudflare Zero Trust team
+// using the enrollment token obtained from the team's /warp login page.
+// The resulting device is managed by the team: it has no license and is
+// subject to the organization's device and gateway policies.
+func (w *WarpAPI) RegisterTeam(publicKey, teamToken string) (Identity, error) {
+	return w.register(publicKey, map[string]string{"CF-Access-Jwt-Assertion": teamToken})
+}
+
+// register posts a new device, retrying transient failures as configured
+// by WithRegisterRetries. Once cloudflare has answered with an error status
+// for the last time the error wraps ErrAccountRejected.
+func (w *WarpAPI) register(publicKey string, headers map[string]string) (Identity, error) {
+	var i Identity
+	err := retry.Do(
+		func() error {
+			var err error
+			i, err = w.registerOnce(publicKey, headers)
+			return err
+		},
+		retry.Context(w.ctx),
+		retry.Attempts(w.registerRetries+1),
+		retry.Delay(w.registerRetryDelay),
+		retry.DelayType(retryDelay),
+		retry.LastErrorOnly(true),
+		retry.RetryIf(isTransientError),
+		retry.OnRetry(func(n uint, err error) {
+			var re *rateLimitError
+			if errors.As(err, &re) {
+				w.l.Warn("rate limited by cloudflare, retrying registration", "attempt", n+1, "retry_after", re.retryAfter)
+				return
+			}
+			w.l.Info("retrying registration", "attempt", n+1, "error", err)
+		}),
+	)
+	var se statusError
+	if errors.As(err, &se) || IsRateLimited(err) {
+		return Identity{}, fmt.Errorf("%w: %w", ErrAccountRejected, err)
+	}
+	return i, err
+}
+
+func (w *WarpAPI) registerOnce(publicKey string, headers map[string]string) (Identity, error) {
 	reqUrl := fmt.Sprintf("%s/reg", apiBase)
 	method := "POST"
 
@@ -268,13 +397,14 @@ func (w *WarpAPI) Register(publicKey string) (Identity, error) {
 		return Identity{}, err
 	}
 
-	req, err := http.NewRequest(method, reqUrl, bytes.NewBuffer(jsonBody))
+	req, err := http.NewRequestWithContext(w.ctx, method, reqUrl, bytes.NewBuffer(jsonBody))
 	if err != nil {
 		return Identity{}, err
 	}
 
 	// Set headers
-	for k, v := range defaultHeaders() {
+	w.setHeaders(req)
+	for k, v := range headers {
 		req.Header.Set(k, v)
 	}
 
@@ -286,7 +416,7 @@ func (w *WarpAPI) Register(publicKey string) (Identity, error) {
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return Identity{}, fmt.Errorf("API request failed with status: %s", resp.Status)
+		return Identity{}, responseError(resp)
 	}
 
 	// convert response to byte array
@@ -307,15 +437,13 @@ func (w *WarpAPI) ResetAccountLicense(authToken, deviceID string) (License, erro
 	reqUrl := fmt.Sprintf("%s/reg/%s/account/license", apiBase, deviceID)
 	method := "POST"
 
-	req, err := http.NewRequest(method, reqUrl, nil)
+	req, err := http.NewRequestWithContext(w.ctx, method, reqUrl, nil)
 	if err != nil {
 		return License{}, err
 	}
 
 	// Set headers
-	for k, v := range defaultHeaders() {
-		req.Header.Set(k, v)
-	}
+	w.setHeaders(req)
 	req.Header.Set("Authorization", "Bearer "+authToken)
 
 	// Create HTTP client and execute request
@@ -352,15 +480,13 @@ func (w *WarpAPI) UpdateAccount(authToken, deviceID, license string) (IdentityAc
 		return IdentityAccount{}, err
 	}
 
-	req, err := http.NewRequest(method, reqUrl, bytes.NewBuffer(jsonBody))
+	req, err := http.NewRequestWithContext(w.ctx, method, reqUrl, bytes.NewBuffer(jsonBody))
 	if err != nil {
 		return IdentityAccount{}, err
 	}
 
 	// Set headers
-	for k, v := range defaultHeaders() {
-		req.Header.Set(k, v)
-	}
+	w.setHeaders(req)
 	req.Header.Set("Authorization", "Bearer "+authToken)
 
 	// Create HTTP client and execute request
@@ -371,7 +497,7 @@ func (w *WarpAPI) UpdateAccount(authToken, deviceID, license string) (IdentityAc
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return IdentityAccount{}, fmt.Errorf("API request failed with status: %s", resp.Status)
+		return IdentityAccount{}, responseError(resp)
 	}
 
 	// convert response to byte array
@@ -402,15 +528,13 @@ func (w *WarpAPI) UpdateBoundDevice(authToken, deviceID, otherDeviceID, name str
 		return IdentityDevice{}, err
 	}
 
-	req, err := http.NewRequest(method, reqUrl, bytes.NewBuffer(jsonBody))
+	req, err := http.NewRequestWithContext(w.ctx, method, reqUrl, bytes.NewBuffer(jsonBody))
 	if err != nil {
 		return IdentityDevice{}, err
 	}
 
 	// Set headers
-	for k, v := range defaultHeaders() {
-		req.Header.Set(k, v)
-	}
+	w.setHeaders(req)
 	req.Header.Set("Authorization", "Bearer "+authToken)
 
 	// Create HTTP client and execute request
@@ -421,7 +545,7 @@ func (w *WarpAPI) UpdateBoundDevice(authToken, deviceID, otherDeviceID, name str
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return IdentityDevice{}, fmt.Errorf("API request failed with status: %s", resp.Status)
+		return IdentityDevice{}, responseError(resp)
 	}
 
 	// convert response to byte array
@@ -447,15 +571,13 @@ func (w *WarpAPI) UpdateSourceDevice(authToken, deviceID, publicKey string) (Ide
 		return Identity{}, err
 	}
 
-	req, err := http.NewRequest(method, reqUrl, bytes.NewBuffer(jsonBody))
+	req, err := http.NewRequestWithContext(w.ctx, method, reqUrl, bytes.NewBuffer(jsonBody))
 	if err != nil {
 		return Identity{}, err
 	}
 
 	// Set headers
-	for k, v := range defaultHeaders() {
-		req.Header.Set(k, v)
-	}
+	w.setHeaders(req)
 	req.Header.Set("Authorization", "Bearer "+authToken)
 
 	// Create HTTP client and execute request
@@ -466,7 +588,7 @@ func (w *WarpAPI) UpdateSourceDevice(authToken, deviceID, publicKey string) (Ide
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return Identity{}, fmt.Errorf("API request failed with status: %s", resp.Status)
+		return Identity{}, responseError(resp)
 	}
 
 	// convert response to byte array
@@ -487,15 +609,13 @@ func (w *WarpAPI) DeleteDevice(authToken, deviceID string) error {
 	reqUrl := fmt.Sprintf("%s/reg/%s", apiBase, deviceID)
 	method := "DELETE"
 
-	req, err := http.NewRequest(method, reqUrl, nil)
+	req, err := http.NewRequestWithContext(w.ctx, method, reqUrl, nil)
 	if err != nil {
 		return err
 	}
 
 	// Set headers
-	for k, v := range defaultHeaders() {
-		req.Header.Set(k, v)
-	}
+	w.setHeaders(req)
 	req.Header.Set("Authorization", "Bearer "+authToken)
 
 	// Create HTTP client and execute request
@@ -506,7 +626,7 @@ func (w *WarpAPI) DeleteDevice(authToken, deviceID string) error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("API request failed with status: %s", resp.Status)
+		return responseError(resp)
 	}
 
 	return nil
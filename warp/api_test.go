@@ -0,0 +1,195 @@
+package warp
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestWithHTTPClient(t *testing.T) {
+	var requests []*http.Request
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		requests = append(requests, req)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{"id":"device","token":"token","config":{"peers":[{"public_key":"peer"}]}}`)),
+			Header:     make(http.Header),
+			Request:    req,
+		}, nil
+	})}
+
+	api := NewWarpAPI(slog.Default(), WithHTTPClient(client))
+
+	i, err := api.RegisterTeam("pubkey", "team-token")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, i.ID, qt.Equals, "device")
+	qt.Assert(t, i.Config.Peers, qt.HasLen, 1)
+
+	qt.Assert(t, requests, qt.HasLen, 1)
+	qt.Assert(t, requests[0].Method, qt.Equals, http.MethodPost)
+	qt.Assert(t, requests[0].URL.String(), qt.Equals, apiBase+"/reg")
+	qt.Assert(t, requests[0].Header.Get("CF-Access-Jwt-Assertion"), qt.Equals, "team-token")
+
+	qt.Assert(t, requests[0].Header.Get("User-Agent"), qt.Equals, DefaultUserAgent)
+
+	// a nil client keeps the default
+	qt.Assert(t, NewWarpAPI(slog.Default(), WithHTTPClient(nil)).client, qt.Not(qt.IsNil))
+}
+
+func TestWithUserAgent(t *testing.T) {
+	var userAgents []string
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		userAgents = append(userAgents, req.Header.Get("User-Agent"))
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{}`)),
+			Header:     make(http.Header),
+			Request:    req,
+		}, nil
+	})}
+
+	api := NewWarpAPI(slog.Default(), WithHTTPClient(client), WithUserAgent("custom/1.0"))
+	_, err := api.GetAccount("token", "device")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, api.DeleteDevice("token", "device"), qt.IsNil)
+
+	qt.Assert(t, userAgents, qt.DeepEquals, []string{"custom/1.0", "custom/1.0"})
+}
+
+func TestRegisterRetries(t *testing.T) {
+	var statuses []int
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		status := statuses[0]
+		statuses = statuses[1:]
+		return &http.Response{
+			StatusCode: status,
+			Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+			Body:       io.NopCloser(strings.NewReader(`{"id":"device"}`)),
+			Header:     make(http.Header),
+			Request:    req,
+		}, nil
+	})}
+
+	api := NewWarpAPI(slog.Default(), WithHTTPClient(client), WithRegisterRetries(2))
+	api.registerRetryDelay = time.Millisecond
+
+	// two server errors, then success
+	statuses = []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK}
+	i, err := api.Register("pubkey")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, i.ID, qt.Equals, "device")
+	qt.Assert(t, statuses, qt.HasLen, 0)
+
+	// retries exhausted
+	statuses = []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusOK}
+	_, err = api.Register("pubkey")
+	qt.Assert(t, err, qt.ErrorIs, ErrAccountRejected)
+	qt.Assert(t, statuses, qt.HasLen, 1)
+
+	// client errors aren't retried
+	statuses = []int{http.StatusForbidden, http.StatusOK}
+	_, err = api.Register("pubkey")
+	qt.Assert(t, err, qt.ErrorIs, ErrAccountRejected)
+	qt.Assert(t, statuses, qt.HasLen, 1)
+}
+
+func TestRegisterRateLimited(t *testing.T) {
+	var attempts []time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts = append(attempts, time.Now())
+		if len(attempts) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"id":"device"}`))
+	}))
+	defer srv.Close()
+
+	// send the requests for the API to the test server
+	target, err := url.Parse(srv.URL)
+	qt.Assert(t, err, qt.IsNil)
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		req.URL.Scheme, req.URL.Host = target.Scheme, target.Host
+		return http.DefaultTransport.RoundTrip(req)
+	})}
+
+	api := NewWarpAPI(slog.Default(), WithHTTPClient(client), WithRegisterRetries(1))
+	api.registerRetryDelay = time.Millisecond
+
+	i, err := api.Register("pubkey")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, i.ID, qt.Equals, "device")
+	qt.Assert(t, attempts, qt.HasLen, 2)
+	qt.Assert(t, attempts[1].Sub(attempts[0]) >= time.Second, qt.IsTrue)
+
+	// rate limited until the retries run out
+	attempts = nil
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts = append(attempts, time.Now())
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	_, err = api.Register("pubkey")
+	qt.Assert(t, IsRateLimited(err), qt.IsTrue)
+	qt.Assert(t, err, qt.ErrorIs, ErrAccountRejected)
+	qt.Assert(t, attempts, qt.HasLen, 2)
+
+	qt.Assert(t, IsRateLimited(statusError("403 Forbidden")), qt.IsFalse)
+	qt.Assert(t, IsRateLimited(nil), qt.IsFalse)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	qt.Assert(t, parseRetryAfter("30", now), qt.Equals, 30*time.Second)
+	qt.Assert(t, parseRetryAfter(now.Add(time.Minute).Format(http.TimeFormat), now), qt.Equals, time.Minute)
+	qt.Assert(t, parseRetryAfter(now.Add(-time.Minute).Format(http.TimeFormat), now), qt.Equals, time.Duration(0))
+	qt.Assert(t, parseRetryAfter("86400", now), qt.Equals, maxRetryAfter)
+	qt.Assert(t, parseRetryAfter("", now), qt.Equals, time.Duration(0))
+	qt.Assert(t, parseRetryAfter("soon", now), qt.Equals, time.Duration(0))
+}
+
+func TestWithPrivateKey(t *testing.T) {
+	key, err := GeneratePrivateKey()
+	qt.Assert(t, err, qt.IsNil)
+
+	var registered string
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		body, _ := io.ReadAll(req.Body)
+		registered = string(body)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{"id":"device","config":{"peers":[{"public_key":"peer"}]}}`)),
+			Header:     make(http.Header),
+			Request:    req,
+		}, nil
+	})}
+
+	// the device is registered with the given key, which isn't cached
+	dir := t.TempDir()
+	i, err := LoadOrCreateTeamIdentity(slog.Default(), dir, "team-token", WithHTTPClient(client), WithPrivateKey(key.String()))
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, i.PrivateKey, qt.Equals, key.String())
+	qt.Assert(t, registered, qt.Contains, key.PublicKey().String())
+
+	cached, err := LoadIdentity(dir)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, cached.ID, qt.Equals, "device")
+	qt.Assert(t, cached.PrivateKey, qt.Equals, "")
+
+	_, err = CreateTeamIdentity(slog.Default(), NewWarpAPI(slog.Default(), WithHTTPClient(client), WithPrivateKey("bogus")), "team-token")
+	qt.Assert(t, err, qt.ErrorMatches, "invalid private key: .*")
+}
@@ -1,6 +1,19 @@
 package warp
 
-import "strings"
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/avast/retry-go"
+)
+
+// maxRetryAfter caps the wait asked for by a Retry-After header, so a
+// bogus value can't stall registration.
+const maxRetryAfter = 5 * time.Minute
 
 func IsHTTPClientError(err error) bool {
 	if err == nil {
@@ -8,3 +21,65 @@ func IsHTTPClientError(err error) bool {
 	}
 	return strings.Contains(err.Error(), "API request failed with status: 5")
 }
+
+// IsRateLimited reports whether err is cloudflare answering 429 Too Many
+// Requests, as happens when the API is called too often.
+func IsRateLimited(err error) bool {
+	var re *rateLimitError
+	return errors.As(err, &re)
+}
+
+// statusError is returned when the API answers with a non-2xx status.
+type statusError string
+
+func (e statusError) Error() string {
+	return "API request failed with status: " + string(e)
+}
+
+// rateLimitError is returned when the API answers 429. retryAfter is the
+// wait asked for by the Retry-After header, zero without one.
+type rateLimitError struct {
+	status     string
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return "API request failed with status: " + e.status
+}
+
+// responseError returns the error for a non-2xx response.
+func responseError(resp *http.Response) error {
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return &rateLimitError{status: resp.Status, retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+	}
+	return statusError(resp.Status)
+}
+
+// parseRetryAfter parses a Retry-After value, in seconds or an HTTP date,
+// into the wait from now. It returns zero for missing or invalid values.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	var d time.Duration
+	if secs, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		d = t.Sub(now)
+	}
+	return min(max(d, 0), maxRetryAfter)
+}
+
+// isTransientError reports whether a failed request is worth retrying:
+// server errors, rate limiting and network timeouts.
+func isTransientError(err error) bool {
+	var ne net.Error
+	return IsHTTPClientError(err) || IsRateLimited(err) || (errors.As(err, &ne) && ne.Timeout())
+}
+
+// retryDelay waits as long as a rate limited answer asked for, backing off
+// exponentially otherwise.
+func retryDelay(n uint, err error, config *retry.Config) time.Duration {
+	var re *rateLimitError
+	if errors.As(err, &re) && re.retryAfter > 0 {
+		return re.retryAfter
+	}
+	return retry.BackOffDelay(n, err, config)
+}
@@ -14,7 +14,9 @@ import (
 	"runtime"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
@@ -46,6 +48,10 @@ type StdNetBind struct {
 
 	blackhole4 bool
 	blackhole6 bool
+
+	tos int // ToS/traffic class of outgoing packets (0 = unset)
+
+	timeout atomic.Int64 // write deadline of the sockets (0 = none), not guarded by mu
 }
 
 func NewStdNetBind() Bind {
@@ -73,6 +79,22 @@ func NewStdNetBind() Bind {
 	}
 }
 
+// SetTimeout bounds every write on the sockets to d, so a wedged socket
+// fails with os.ErrDeadlineExceeded instead of blocking. Reads are never
+// bounded: a quiet socket is normal and the device gives up on a receive
+// loop that keeps failing. It is meant to be set before Open, 0 means no
+// bound.
+func (s *StdNetBind) SetTimeout(d time.Duration) {
+	s.timeout.Store(int64(d))
+}
+
+// deadline returns the deadline of a socket call starting now, if a timeout
+// is set.
+func (s *StdNetBind) deadline() (time.Time, bool) {
+	d := s.timeout.Load()
+	return time.Now().Add(time.Duration(d)), d > 0
+}
+
 type StdNetEndpoint struct {
 	// AddrPort is the endpoint destination.
 	netip.AddrPort
@@ -194,6 +216,10 @@ again:
 	if len(fns) == 0 {
 		return nil, 0, syscall.EAFNOSUPPORT
 	}
+	if s.tos != 0 {
+		// best effort, SetTOS already reported whether it's supported
+		_ = s.applyTOSLocked()
+	}
 
 	return fns, uint16(port), nil
 }
@@ -375,6 +401,11 @@ func (s *StdNetBind) Send(bufs [][]byte, endpoint Endpoint) error {
 		ua.IP = ua.IP[:4]
 	}
 	ua.Port = int(endpoint.(*StdNetEndpoint).Port())
+	if deadline, ok := s.deadline(); ok {
+		if err := conn.SetWriteDeadline(deadline); err != nil {
+			return err
+		}
+	}
 	var (
 		retried bool
 		err     error
@@ -2,8 +2,10 @@ package conn
 
 import (
 	"encoding/binary"
+	"errors"
 	"net"
 	"testing"
+	"time"
 
 	"golang.org/x/net/ipv6"
 )
@@ -27,6 +29,35 @@ func TestStdNetBindReceiveFuncAfterClose(t *testing.T) {
 	}
 }
 
+func TestStdNetBindTimeout(t *testing.T) {
+	bind := NewStdNetBind().(*StdNetBind)
+	const timeout = 50 * time.Millisecond
+	bind.SetTimeout(timeout)
+	fns, _, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is ever sent to the socket, like an idle tunnel, which must
+	// not fail the receive loop of the device
+	done := make(chan error, 1)
+	go func() {
+		bufs := [][]byte{make([]byte, 1500)}
+		_, err := fns[0](bufs, make([]int, 1), make([]Endpoint, 1))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("idle receive returned %v, want it to block", err)
+	case <-time.After(4 * timeout):
+	}
+
+	bind.Close()
+	if err := <-done; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("receive error after close = %v, want %v", err, net.ErrClosed)
+	}
+}
+
 func mockSetGSOSize(control *[]byte, gsoSize uint16) {
 	*control = (*control)[:cap(*control)]
 	binary.LittleEndian.PutUint16(*control, gsoSize)
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package conn
+
+import "errors"
+
+// SetTOS is not supported on this platform.
+func (s *StdNetBind) SetTOS(tos int) error {
+	return errors.ErrUnsupported
+}
+
+func (s *StdNetBind) applyTOSLocked() error {
+	return nil
+}
@@ -0,0 +1,51 @@
+//go:build unix
+
+package conn
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// SetTOS sets the IPv4 ToS and IPv6 traffic class byte of outgoing packets.
+// The value is kept and reapplied whenever the bind is reopened.
+func (s *StdNetBind) SetTOS(tos int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tos = tos
+	return s.applyTOSLocked()
+}
+
+func (s *StdNetBind) applyTOSLocked() error {
+	if s.ipv4 != nil {
+		fd, err := s.ipv4.SyscallConn()
+		if err != nil {
+			return err
+		}
+		var operr error
+		if err := fd.Control(func(fd uintptr) {
+			operr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, s.tos)
+		}); err != nil {
+			return err
+		}
+		if operr != nil {
+			return operr
+		}
+	}
+	if s.ipv6 != nil {
+		fd, err := s.ipv6.SyscallConn()
+		if err != nil {
+			return err
+		}
+		var operr error
+		if err := fd.Control(func(fd uintptr) {
+			operr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, s.tos)
+		}); err != nil {
+			return err
+		}
+		if operr != nil {
+			return operr
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+//go:build unix
+
+package conn
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func getsockoptInt(t *testing.T, conn *net.UDPConn, level, opt int) int {
+	t.Helper()
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	var operr error
+	if err := rc.Control(func(fd uintptr) {
+		v, operr = unix.GetsockoptInt(int(fd), level, opt)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if operr != nil {
+		t.Fatal(operr)
+	}
+	return v
+}
+
+func TestStdNetBindSetTOS(t *testing.T) {
+	bind := NewStdNetBind().(*StdNetBind)
+
+	// set before Open, the way the device configures it
+	const tos = 46 << 2 // DSCP EF
+	if err := bind.SetTOS(tos); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := bind.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+
+	if bind.ipv4 != nil {
+		if got := getsockoptInt(t, bind.ipv4, unix.IPPROTO_IP, unix.IP_TOS); got != tos {
+			t.Errorf("IP_TOS = %d, want %d", got, tos)
+		}
+	}
+	if bind.ipv6 != nil {
+		if got := getsockoptInt(t, bind.ipv6, unix.IPPROTO_IPV6, unix.IPV6_TCLASS); got != tos {
+			t.Errorf("IPV6_TCLASS = %d, want %d", got, tos)
+		}
+	}
+}
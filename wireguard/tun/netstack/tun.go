@@ -203,6 +203,25 @@ func convertToFullAddr(endpoint netip.AddrPort) (tcpip.FullAddress, tcpip.Networ
 	}, protoNumber
 }
 
+// SetTCPBufferCap caps the send and receive buffers of the TCP connections
+// created afterwards at size bytes each, instead of letting them grow up to
+// tcp.MaxBufferSize. Writers to a connection whose peer drains slowly then
+// block instead of buffering more.
+func (net *Net) SetTCPBufferCap(size int) error {
+	if size < tcp.MinBufferSize {
+		return fmt.Errorf("tcp buffer cap must be at least %d bytes", tcp.MinBufferSize)
+	}
+	send := tcpip.TCPSendBufferSizeRangeOption{Min: tcp.MinBufferSize, Default: min(size, tcp.DefaultSendBufferSize), Max: size}
+	if err := net.stack.SetTransportProtocolOption(tcp.ProtocolNumber, &send); err != nil {
+		return fmt.Errorf("could not set the TCP send buffer size: %v", err)
+	}
+	recv := tcpip.TCPReceiveBufferSizeRangeOption{Min: tcp.MinBufferSize, Default: min(size, tcp.DefaultReceiveBufferSize), Max: size}
+	if err := net.stack.SetTransportProtocolOption(tcp.ProtocolNumber, &recv); err != nil {
+		return fmt.Errorf("could not set the TCP receive buffer size: %v", err)
+	}
+	return nil
+}
+
 func (net *Net) DialContextTCPAddrPort(ctx context.Context, addr netip.AddrPort) (*gonet.TCPConn, error) {
 	fa, pn := convertToFullAddr(addr)
 	return gonet.DialContextTCP(ctx, net.stack, fa, pn)
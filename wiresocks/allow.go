@@ -0,0 +1,65 @@
+package wiresocks
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ValidateDomainPattern checks a pattern for WithAllowedDomains.
+func ValidateDomainPattern(pattern string) error {
+	name := strings.TrimPrefix(pattern, "*.")
+	if name == "" || strings.Contains(name, "*") {
+		return fmt.Errorf("invalid domain pattern %q, use example.com or *.example.com", pattern)
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			return fmt.Errorf("invalid domain pattern %q, it has an empty label", pattern)
+		}
+	}
+	return nil
+}
+
+// domainAllowlist matches hosts against patterns accepted by
+// ValidateDomainPattern.
+type domainAllowlist []string
+
+func newDomainAllowlist(patterns []string) (domainAllowlist, error) {
+	list := make(domainAllowlist, 0, len(patterns))
+	for _, pattern := range patterns {
+		if err := ValidateDomainPattern(pattern); err != nil {
+			return nil, err
+		}
+		list = append(list, normalizeHost(pattern))
+	}
+	return list, nil
+}
+
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// allows reports whether host matches one of the patterns. A pattern
+// matches the name itself, *.name matches its subdomains but not name.
+func (a domainAllowlist) allows(host string) bool {
+	host = normalizeHost(host)
+	for _, pattern := range a {
+		if parent, ok := strings.CutPrefix(pattern, "*."); ok {
+			if strings.HasSuffix(host, "."+parent) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsAddress is allows for a host:port address.
+func (a domainAllowlist) allowsAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	return a.allows(host)
+}
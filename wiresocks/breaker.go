@@ -0,0 +1,130 @@
+package wiresocks
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxBreakerEntries bounds the destinations tracked by a circuitBreaker,
+// past it the least recently failed destination is forgotten.
+const maxBreakerEntries = 4096
+
+type breakerEntry struct {
+	failures  int
+	openUntil time.Time
+	// failed is the time of the last failure.
+	failed time.Time
+}
+
+// circuitBreaker refuses a destination for cooldown once threshold dials
+// to it failed in a row. The first dial after the cooldown is let through
+// and a failure refuses the destination again right away. Failures more
+// than a cooldown apart don't count as in a row, so destinations that
+// haven't failed for a while are forgotten. It is safe for concurrent use.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*breakerEntry
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+		entries:   make(map[string]*breakerEntry),
+	}
+}
+
+// allows reports whether address may be dialed.
+func (b *circuitBreaker) allows(address string) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.entries[address]
+	return !ok || !b.now().Before(e.openUntil)
+}
+
+// record counts the outcome of a dial to address.
+func (b *circuitBreaker) record(address string, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		delete(b.entries, address)
+		return
+	}
+
+	now := b.now()
+	e, ok := b.entries[address]
+	if ok && b.expired(e, now) {
+		e.failures = 0
+	}
+	if !ok {
+		if len(b.entries) >= maxBreakerEntries {
+			b.pruneLocked(now)
+		}
+		e = &breakerEntry{}
+		b.entries[address] = e
+	}
+	e.failures++
+	e.failed = now
+	if e.failures >= b.threshold {
+		// let one dial through after the cooldown, which reopens on failure
+		e.failures = b.threshold - 1
+		e.openUntil = now.Add(b.cooldown)
+	}
+}
+
+// expired reports whether e neither failed nor stopped refusing its
+// destination within the last cooldown. A destination that was refused keeps
+// reopening on the first failure for a cooldown past the refusal.
+func (b *circuitBreaker) expired(e *breakerEntry, now time.Time) bool {
+	return now.Sub(e.failed) >= b.cooldown && now.Sub(e.openUntil) >= b.cooldown
+}
+
+// pruneLocked forgets the expired destinations, or the least recently
+// failed one if none expired.
+func (b *circuitBreaker) pruneLocked(now time.Time) {
+	var oldest string
+	for address, e := range b.entries {
+		if b.expired(e, now) {
+			delete(b.entries, address)
+		} else if oldest == "" || e.failed.Before(b.entries[oldest].failed) {
+			oldest = address
+		}
+	}
+	if len(b.entries) >= maxBreakerEntries {
+		delete(b.entries, oldest)
+	}
+}
+
+// destinationError is a failed dial of the destination through the tunnel,
+// as opposed to a failure before getting there such as a full dial queue,
+// a failed lookup or a cancelled request. Only these count for the circuit
+// breaker.
+type destinationError struct{ err error }
+
+func (e *destinationError) Error() string { return e.err.Error() }
+func (e *destinationError) Unwrap() error { return e.err }
+
+// markDestinationErrors marks the failures of dial, which dials the
+// destination itself, as destinationErrors.
+func markDestinationErrors(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil && ctx.Err() == nil {
+			err = &destinationError{err}
+		}
+		return conn, err
+	}
+}
@@ -0,0 +1,115 @@
+package wiresocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	b := newCircuitBreaker(3, time.Minute)
+	b.now = func() time.Time { return now }
+	dead, other := "192.0.2.1:443", "192.0.2.2:443"
+	errTimeout := errors.New("connect: connection timed out")
+
+	// opens after 3 failures in a row
+	b.record(dead, errTimeout)
+	b.record(dead, errTimeout)
+	qt.Assert(t, b.allows(dead), qt.IsTrue)
+	b.record(dead, errTimeout)
+	qt.Assert(t, b.allows(dead), qt.IsFalse)
+	qt.Assert(t, b.allows(other), qt.IsTrue)
+
+	// closes after the cooldown, a single failure reopens it
+	now = now.Add(time.Minute)
+	qt.Assert(t, b.allows(dead), qt.IsTrue)
+	b.record(dead, errTimeout)
+	qt.Assert(t, b.allows(dead), qt.IsFalse)
+
+	// a success resets it
+	now = now.Add(time.Minute)
+	b.record(dead, nil)
+	b.record(dead, errTimeout)
+	qt.Assert(t, b.allows(dead), qt.IsTrue)
+
+	// failures must be consecutive
+	b.record(other, errTimeout)
+	b.record(other, errTimeout)
+	b.record(other, nil)
+	b.record(other, errTimeout)
+	qt.Assert(t, b.allows(other), qt.IsTrue)
+
+	// a nil breaker allows everything
+	var none *circuitBreaker
+	none.record(dead, errTimeout)
+	qt.Assert(t, none.allows(dead), qt.IsTrue)
+}
+
+func TestCircuitBreakerEviction(t *testing.T) {
+	now := time.Now()
+	b := newCircuitBreaker(3, time.Minute)
+	b.now = func() time.Time { return now }
+	errTimeout := errors.New("connect: connection timed out")
+
+	// failures more than a cooldown apart aren't in a row
+	b.record("192.0.2.1:443", errTimeout)
+	b.record("192.0.2.1:443", errTimeout)
+	now = now.Add(time.Minute)
+	b.record("192.0.2.1:443", errTimeout)
+	qt.Assert(t, b.allows("192.0.2.1:443"), qt.IsTrue)
+
+	// a full breaker forgets the least recently failed destination
+	for i := range maxBreakerEntries - 1 {
+		now = now.Add(time.Millisecond)
+		b.record(fmt.Sprintf("198.51.100.1:%d", i), errTimeout)
+	}
+	qt.Assert(t, b.entries, qt.HasLen, maxBreakerEntries)
+	b.record("203.0.113.1:443", errTimeout)
+	qt.Assert(t, b.entries, qt.HasLen, maxBreakerEntries)
+	qt.Assert(t, b.entries["192.0.2.1:443"], qt.IsNil)
+
+	// expired destinations go first
+	now = now.Add(2 * time.Minute)
+	b.record("203.0.113.2:443", errTimeout)
+	qt.Assert(t, b.entries, qt.HasLen, 1)
+}
+
+func TestCircuitBreakerCountsDestinationErrors(t *testing.T) {
+	errTimeout := errors.New("connect: connection timed out")
+	var dialErr error
+	var healthErr error
+	vt := VirtualTun{
+		Logger:  slog.Default(),
+		Ctx:     context.Background(),
+		breaker: newCircuitBreaker(1, time.Minute),
+		health:  func() error { return healthErr },
+	}
+
+	// a failed lookup, a full dial queue or a cancelled request isn't the
+	// fault of the destination
+	for _, err := range []error{errDialQueueFull, context.Canceled, errors.New("lookup example.com: no such host")} {
+		vt.dialFunc = func(context.Context, string, string) (net.Conn, error) { return nil, err }
+		_, got := vt.dial("tcp", "192.0.2.1:443")
+		qt.Assert(t, got, qt.Equals, err)
+		qt.Assert(t, vt.breaker.allows("192.0.2.1:443"), qt.IsTrue)
+	}
+
+	// nor is a failure while the tunnel is down
+	vt.dialFunc = markDestinationErrors(func(context.Context, string, string) (net.Conn, error) { return nil, dialErr })
+	dialErr, healthErr = errTimeout, errors.New("last handshake 5m ago")
+	_, err := vt.dial("tcp", "192.0.2.1:443")
+	qt.Assert(t, err, qt.ErrorMatches, "connect: connection timed out")
+	qt.Assert(t, vt.breaker.allows("192.0.2.1:443"), qt.IsTrue)
+
+	healthErr = nil
+	_, err = vt.dial("tcp", "192.0.2.1:443")
+	qt.Assert(t, errors.Is(err, errTimeout), qt.IsTrue)
+	qt.Assert(t, vt.breaker.allows("192.0.2.1:443"), qt.IsFalse)
+}
@@ -0,0 +1,166 @@
+package wiresocks
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/bepass-org/warp-plus/ipscanner"
+)
+
+// scanCheckpoint is the progress of a scan saved to disk so an interrupted
+// scan can be resumed.
+type scanCheckpoint struct {
+	// Params identifies the scan parameters, a checkpoint written for other
+	// parameters is ignored.
+	Params string `json:"params"`
+	// Seed is the order the candidates are generated in, so the resumed
+	// scan generates the same addresses and skips those in Results.
+	Seed    uint64                  `json:"seed,omitempty"`
+	Results []ipscanner.ProbeResult `json:"results"`
+}
+
+// checkpointParams hashes the options that affect which candidates are
+// probed and how they're ranked.
+func checkpointParams(opts ScanOptions, prefixes []netip.Prefix) string {
+	h := sha256.New()
+	fmt.Fprintln(h, opts.V4, opts.V6, opts.MaxRTT, opts.ProbeOnly, opts.PublicKey, opts.Ports, opts.PingCount)
+	for _, p := range prefixes {
+		fmt.Fprintln(h, p)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// loadCheckpoint returns the checkpoint saved at path if it was written for
+// the same parameters, a zero one otherwise.
+func loadCheckpoint(path, params string) (scanCheckpoint, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return scanCheckpoint{}, err
+	}
+
+	var cp scanCheckpoint
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return scanCheckpoint{}, err
+	}
+	if cp.Params != params {
+		return scanCheckpoint{}, nil
+	}
+	return cp, nil
+}
+
+// saveCheckpoint atomically replaces the checkpoint at path.
+func saveCheckpoint(path string, cp scanCheckpoint) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := json.NewEncoder(f).Encode(cp); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// checkpointer collects probe results and periodically saves them. A nil
+// *checkpointer ignores all calls.
+type checkpointer struct {
+	path   string
+	params string
+	order  uint64
+
+	mu      sync.Mutex
+	results []ipscanner.ProbeResult
+	dirty   bool
+}
+
+func newCheckpointer(l *slog.Logger, path, params string) *checkpointer {
+	if path == "" {
+		return nil
+	}
+
+	cp, err := loadCheckpoint(path, params)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		l.Warn("ignoring unreadable scan checkpoint", "path", path, "error", err)
+	}
+	// a fresh scan, or one saved without a seed, starts a new order
+	for cp.Seed == 0 {
+		cp.Seed = rand.Uint64()
+	}
+	return &checkpointer{path: path, params: params, order: cp.Seed, results: cp.Results}
+}
+
+// seed returns the order of the candidates for ipscanner.WithSeed, 0 without
+// a checkpoint.
+func (c *checkpointer) seed() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.order
+}
+
+// resumed returns the results loaded from an earlier scan.
+func (c *checkpointer) resumed() []ipscanner.ProbeResult {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.results)
+}
+
+func (c *checkpointer) add(r ipscanner.ProbeResult) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.results = append(c.results, r)
+	c.dirty = true
+}
+
+// save writes the results if anything changed since the last save.
+func (c *checkpointer) save() error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return nil
+	}
+	if err := saveCheckpoint(c.path, scanCheckpoint{Params: c.params, Seed: c.order, Results: c.results}); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// remove deletes the checkpoint once the scan is complete.
+func (c *checkpointer) remove() error {
+	if c == nil {
+		return nil
+	}
+
+	if err := os.Remove(c.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package wiresocks
+
+import (
+	"log/slog"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/ipscanner"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scan-checkpoint.json")
+	prefixes := []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+	opts := ScanOptions{V4: true, MaxRTT: time.Second}
+	params := checkpointParams(opts, prefixes)
+
+	cp := newCheckpointer(slog.Default(), path, params)
+	qt.Assert(t, cp.resumed(), qt.HasLen, 0)
+
+	addr := netip.MustParseAddr("192.0.2.7")
+	cp.add(ipscanner.ProbeResult{
+		Addr:      addr,
+		Reachable: true,
+		Info:      ipscanner.IPInfo{AddrPort: netip.AddrPortFrom(addr, 2408), RTT: 80 * time.Millisecond},
+	})
+	cp.add(ipscanner.ProbeResult{Addr: netip.MustParseAddr("192.0.2.8")})
+	qt.Assert(t, cp.save(), qt.IsNil)
+
+	// same parameters resume, in the same order
+	again := newCheckpointer(slog.Default(), path, params)
+	qt.Assert(t, again.seed(), qt.Not(qt.Equals), uint64(0))
+	qt.Assert(t, again.seed(), qt.Equals, cp.seed())
+	resumed := again.resumed()
+	qt.Assert(t, resumed, qt.HasLen, 2)
+	qt.Assert(t, resumed[0].Addr, qt.Equals, addr)
+	qt.Assert(t, resumed[0].Info.RTT, qt.Equals, 80*time.Millisecond)
+	qt.Assert(t, resumed[1].Reachable, qt.IsFalse)
+
+	// changed parameters invalidate the checkpoint
+	opts.MaxRTT = 2 * time.Second
+	qt.Assert(t, newCheckpointer(slog.Default(), path, checkpointParams(opts, prefixes)).resumed(), qt.HasLen, 0)
+
+	qt.Assert(t, cp.remove(), qt.IsNil)
+	qt.Assert(t, newCheckpointer(slog.Default(), path, params).resumed(), qt.HasLen, 0)
+}
@@ -0,0 +1,70 @@
+package wiresocks
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Reasons a relayed connection ended, passed to the hook of WithCloseHook.
+// The reason is taken from whichever direction of the relay finished first.
+const (
+	// CloseClientEOF is the client closing its side.
+	CloseClientEOF = "client_eof"
+	// CloseRemoteEOF is the destination closing its side.
+	CloseRemoteEOF = "remote_eof"
+	// CloseIdleTimeout is a connection idle for longer than its timeout.
+	CloseIdleTimeout = "idle_timeout"
+	// CloseTunnelError is a failure reading from or writing to the
+	// destination through the tunnel.
+	CloseTunnelError = "tunnel_error"
+	// CloseClientError is a failure reading from or writing to the client.
+	CloseClientError = "client_error"
+	// CloseShutdown is the proxy shutting down.
+	CloseShutdown = "shutdown"
+)
+
+// CloseReasons lists all close reasons.
+var CloseReasons = []string{CloseClientEOF, CloseRemoteEOF, CloseIdleTimeout, CloseTunnelError, CloseClientError, CloseShutdown}
+
+// connEnd holds the close reasons attributed to one end of a relay.
+type connEnd struct {
+	eof, err string
+}
+
+var (
+	clientEnd = connEnd{eof: CloseClientEOF, err: CloseClientError}
+	remoteEnd = connEnd{eof: CloseRemoteEOF, err: CloseTunnelError}
+)
+
+// closeReason attributes the outcome err of copying from src to dst. A
+// reset counts as the end closing, like an EOF.
+func closeReason(err error, readErr bool, src, dst connEnd) string {
+	switch {
+	case err == nil:
+		return src.eof
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		// only reads have deadlines
+		return CloseIdleTimeout
+	case readErr && errors.Is(err, syscall.ECONNRESET):
+		return src.eof
+	case readErr:
+		return src.err
+	case errors.Is(err, syscall.ECONNRESET):
+		return dst.eof
+	}
+	return dst.err
+}
+
+// readErrConn records the error of the last read.
+type readErrConn struct {
+	net.Conn
+	err error
+}
+
+func (c *readErrConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.err = err
+	return n, err
+}
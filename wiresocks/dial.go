@@ -0,0 +1,46 @@
+package wiresocks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+)
+
+// DefaultDialConcurrency is a dial concurrency for WithDialConcurrency that
+// absorbs the bursts of browsers without flooding the userspace device.
+const DefaultDialConcurrency = 64
+
+// dialQueuePerSlot bounds how many dials may wait for each slot of the dial
+// concurrency.
+const dialQueuePerSlot = 8
+
+// errDialQueueFull is returned by dials finding the dial queue full.
+var errDialQueueFull = errors.New("too many dials waiting for the tunnel")
+
+// limitDials returns dial limited to n concurrent calls. Calls over the
+// limit wait for a slot or until their context is done, at most queue of
+// them, further calls fail right away.
+func limitDials(n, queue int, dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	slots := make(chan struct{}, n)
+	var waiting atomic.Int32
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		select {
+		case slots <- struct{}{}:
+		default:
+			if waiting.Add(1) > int32(queue) {
+				waiting.Add(-1)
+				return nil, errDialQueueFull
+			}
+			select {
+			case slots <- struct{}{}:
+				waiting.Add(-1)
+			case <-ctx.Done():
+				waiting.Add(-1)
+				return nil, ctx.Err()
+			}
+		}
+		defer func() { <-slots }()
+		return dial(ctx, network, address)
+	}
+}
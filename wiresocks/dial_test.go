@@ -0,0 +1,122 @@
+package wiresocks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// congestedDevice dials like a userspace device that slows down with every
+// dial in flight, timing out dials that take longer than timeout.
+type congestedDevice struct {
+	perDial      time.Duration
+	timeout      time.Duration
+	active, peak atomic.Int32
+	timeouts     atomic.Int32
+}
+
+func (d *congestedDevice) dial(ctx context.Context, _, _ string) (net.Conn, error) {
+	n := d.active.Add(1)
+	defer d.active.Add(-1)
+	for {
+		peak := d.peak.Load()
+		if n <= peak || d.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	latency := time.Duration(n) * d.perDial
+	if latency > d.timeout {
+		time.Sleep(d.timeout)
+		d.timeouts.Add(1)
+		return nil, context.DeadlineExceeded
+	}
+	time.Sleep(latency)
+	c, _ := net.Pipe()
+	return c, nil
+}
+
+func dialConcurrently(dial func(ctx context.Context, network, address string) (net.Conn, error), n int) (failed int) {
+	var wg sync.WaitGroup
+	var fails atomic.Int32
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := dial(context.Background(), "tcp", "192.0.2.1:443")
+			if err != nil {
+				fails.Add(1)
+				return
+			}
+			conn.Close()
+		}()
+	}
+	wg.Wait()
+	return int(fails.Load())
+}
+
+func TestLimitDials(t *testing.T) {
+	// a herd of 64 dials times out on the device unless limited
+	d := &congestedDevice{perDial: time.Millisecond, timeout: 20 * time.Millisecond}
+	qt.Assert(t, dialConcurrently(d.dial, 64), qt.Not(qt.Equals), 0)
+
+	d = &congestedDevice{perDial: time.Millisecond, timeout: 20 * time.Millisecond}
+	qt.Assert(t, dialConcurrently(limitDials(4, 64, d.dial), 64), qt.Equals, 0)
+	qt.Assert(t, d.peak.Load(), qt.Equals, int32(4))
+	qt.Assert(t, d.timeouts.Load(), qt.Equals, int32(0))
+
+	// dials past the queue fail right away
+	block := make(chan struct{})
+	dial := limitDials(1, 1, func(ctx context.Context, _, _ string) (net.Conn, error) {
+		<-block
+		return nil, context.Canceled
+	})
+	go dial(context.Background(), "tcp", "192.0.2.1:443")
+	time.Sleep(10 * time.Millisecond)
+	go dial(context.Background(), "tcp", "192.0.2.1:443")
+	time.Sleep(10 * time.Millisecond)
+	_, err := dial(context.Background(), "tcp", "192.0.2.1:443")
+	qt.Assert(t, err, qt.Equals, errDialQueueFull)
+
+	// a waiting dial gives up with its context
+	close(block)
+	dial = limitDials(1, 1, func(ctx context.Context, _, _ string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go dial(ctx, "tcp", "192.0.2.1:443")
+	time.Sleep(10 * time.Millisecond)
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer waitCancel()
+	_, err = dial(waitCtx, "tcp", "192.0.2.1:443")
+	qt.Assert(t, err, qt.ErrorIs, context.DeadlineExceeded)
+}
+
+// BenchmarkDialConcurrency dials bursts of 128 connections on a device
+// getting 100µs slower with every dial in flight and timing out dials after
+// 10ms.
+func BenchmarkDialConcurrency(b *testing.B) {
+	for _, limit := range []int{8, 32, DefaultDialConcurrency, 0} {
+		b.Run(fmt.Sprintf("limit=%d", limit), func(b *testing.B) {
+			d := &congestedDevice{perDial: 100 * time.Microsecond, timeout: 10 * time.Millisecond}
+			dial := d.dial
+			if limit > 0 {
+				dial = limitDials(limit, dialQueuePerSlot*limit, dial)
+			}
+			var failed int
+			start := time.Now()
+			for range b.N {
+				failed += dialConcurrently(dial, 128)
+			}
+			b.ReportMetric(float64(128*b.N-failed)/time.Since(start).Seconds(), "dials/s")
+			b.ReportMetric(float64(failed)/float64(b.N), "failed/op")
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package wiresocks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+)
+
+// Resolver resolves destination hostnames for the proxy, e.g. to apply
+// hosts file overrides or split-horizon DNS.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]netip.Addr, error)
+}
+
+// resolverLookup adapts r to the lookup functions used by the dialers.
+func resolverLookup(r Resolver) func(ctx context.Context, host string) ([]string, error) {
+	return func(ctx context.Context, host string) ([]string, error) {
+		addrs, err := r.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		hosts := make([]string, len(addrs))
+		for i, addr := range addrs {
+			hosts[i] = addr.Unmap().String()
+		}
+		return hosts, nil
+	}
+}
+
+// limitLookups returns lookup limited to n concurrent calls. Calls over the
+// limit wait for a slot or until their context is done.
+func limitLookups(n int, lookup func(ctx context.Context, host string) ([]string, error)) func(ctx context.Context, host string) ([]string, error) {
+	slots := make(chan struct{}, n)
+	return func(ctx context.Context, host string) ([]string, error) {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		defer func() { <-slots }()
+		return lookup(ctx, host)
+	}
+}
+
+// dialResolved wraps dial so hostnames are resolved with lookup first and
+// their addresses dialed in order until one connects. IP addresses are
+// dialed as they are.
+func dialResolved(lookup func(ctx context.Context, host string) ([]string, error), dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) != nil {
+			return dial(ctx, network, address)
+		}
+
+		addrs, err := lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var errs []error
+		for _, addr := range addrs {
+			conn, err := dial(ctx, network, net.JoinHostPort(addr, port))
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		if len(errs) == 0 {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return nil, errors.Join(errs...)
+	}
+}
@@ -0,0 +1,335 @@
+package wiresocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// slowLookup answers every lookup after latency, tracking the peak number
+// of concurrent lookups.
+type slowLookup struct {
+	latency      time.Duration
+	active, peak atomic.Int32
+}
+
+func (s *slowLookup) lookup(ctx context.Context, host string) ([]string, error) {
+	n := s.active.Add(1)
+	defer s.active.Add(-1)
+	for {
+		peak := s.peak.Load()
+		if n <= peak || s.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	select {
+	case <-time.After(s.latency):
+		return []string{"192.0.2.1"}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func resolveConcurrently(lookup func(ctx context.Context, host string) ([]string, error), n int) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := lookup(context.Background(), "host"+strconv.Itoa(i)+".example.com")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestLimitLookups(t *testing.T) {
+	s := &slowLookup{latency: 10 * time.Millisecond}
+	qt.Assert(t, resolveConcurrently(limitLookups(4, s.lookup), 32), qt.IsNil)
+	qt.Assert(t, s.peak.Load(), qt.Equals, int32(4))
+
+	// a waiting lookup gives up with its context
+	block := limitLookups(1, func(ctx context.Context, host string) ([]string, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	go block(ctx, "a.example.com")
+	time.Sleep(10 * time.Millisecond)
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer waitCancel()
+	_, err := block(waitCtx, "b.example.com")
+	qt.Assert(t, err, qt.ErrorIs, context.DeadlineExceeded)
+	cancel()
+}
+
+func TestDialResolved(t *testing.T) {
+	var dialed []string
+	dial := dialResolved(
+		func(ctx context.Context, host string) ([]string, error) {
+			return []string{"2001:db8::1", "192.0.2.1"}, nil
+		},
+		func(_ context.Context, _, address string) (net.Conn, error) {
+			dialed = append(dialed, address)
+			if address == "[2001:db8::1]:443" {
+				return nil, errors.New("unreachable")
+			}
+			c, _ := net.Pipe()
+			return c, nil
+		},
+	)
+
+	conn, err := dial(context.Background(), "tcp", "example.com:443")
+	qt.Assert(t, err, qt.IsNil)
+	conn.Close()
+	qt.Assert(t, dialed, qt.DeepEquals, []string{"[2001:db8::1]:443", "192.0.2.1:443"})
+
+	dialed = nil
+	conn, err = dial(context.Background(), "tcp", "198.51.100.1:80")
+	qt.Assert(t, err, qt.IsNil)
+	conn.Close()
+	qt.Assert(t, dialed, qt.DeepEquals, []string{"198.51.100.1:80"})
+}
+
+// BenchmarkDNSConcurrency resolves bursts of 64 hostnames, like a browser
+// opening a page, against a resolver with 2ms latency.
+func BenchmarkDNSConcurrency(b *testing.B) {
+	for _, limit := range []int{1, 8, 32, 0} {
+		b.Run(fmt.Sprintf("limit=%d", limit), func(b *testing.B) {
+			s := &slowLookup{latency: 2 * time.Millisecond}
+			lookup := s.lookup
+			if limit > 0 {
+				lookup = limitLookups(limit, lookup)
+			}
+			start := time.Now()
+			for range b.N {
+				if err := resolveConcurrently(lookup, 64); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(64*b.N)/time.Since(start).Seconds(), "lookups/s")
+		})
+	}
+}
+
+// staticResolver answers lookups from a fixed table.
+type staticResolver map[string][]netip.Addr
+
+func (r staticResolver) LookupHost(_ context.Context, host string) ([]netip.Addr, error) {
+	if addrs, ok := r[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestResolver(t *testing.T) {
+	// echo server, reached directly once resolved to its loopback address
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resolver := staticResolver{"echo.internal": {netip.MustParseAddr("127.0.0.1")}}
+	addr, err := StartProxy(ctx, slog.Default(), nil, netip.MustParseAddrPort("127.0.0.1:0"),
+		WithResolver(resolver),
+		WithDirectPrefixes(DefaultLocalPrefixes),
+	)
+	qt.Assert(t, err, qt.IsNil)
+
+	// socks5 connect, returning the reply code
+	socksConnect := func(host string) (net.Conn, byte) {
+		conn, err := net.Dial("tcp", addr.String())
+		qt.Assert(t, err, qt.IsNil)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		req := []byte{5, 1, 0, 5, 1, 0, 3, byte(len(host))}
+		req = append(req, host...)
+		req = append(req, byte(port>>8), byte(port))
+		_, err = conn.Write(req)
+		qt.Assert(t, err, qt.IsNil)
+		reply := make([]byte, 2+10)
+		_, err = io.ReadFull(conn, reply)
+		qt.Assert(t, err, qt.IsNil)
+		return conn, reply[3]
+	}
+
+	conn, code := socksConnect("echo.internal")
+	defer conn.Close()
+	qt.Assert(t, code, qt.Equals, byte(0))
+	_, err = conn.Write([]byte("ping"))
+	qt.Assert(t, err, qt.IsNil)
+	b := make([]byte, 4)
+	_, err = io.ReadFull(conn, b)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, string(b), qt.Equals, "ping")
+
+	// names the resolver doesn't know fail, the connection is dropped
+	// after the reply
+	conn, _ = socksConnect("unknown.internal")
+	defer conn.Close()
+	_, err = conn.Read(b)
+	qt.Assert(t, err, qt.IsNotNil)
+}
+
+// serveDNS answers A queries on a local UDP socket with addr, other
+// queries with no records, returning the server address.
+func serveDNS(t *testing.T, addr netip.Addr) netip.AddrPort {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			header, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+			b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true, Authoritative: true})
+			b.EnableCompression()
+			_ = b.StartQuestions()
+			_ = b.Question(q)
+			_ = b.StartAnswers()
+			if q.Type == dnsmessage.TypeA {
+				_ = b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.AResource{A: addr.As4()})
+			}
+			msg, err := b.Finish()
+			if err != nil {
+				continue
+			}
+			_, _ = conn.WriteTo(msg, from)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+func TestDNSBypass(t *testing.T) {
+	server := serveDNS(t, netip.MustParseAddr("10.1.2.3"))
+	rule, err := ParseDNSBypass("Corp.Internal=" + server.String())
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, rule, qt.Equals, DNSBypass{Suffix: "corp.internal", Server: server})
+
+	var tunneled []string
+	lookup := bypassLookup([]DNSBypass{rule}, directLookup, func(_ context.Context, host string) ([]string, error) {
+		tunneled = append(tunneled, host)
+		return []string{"192.0.2.1"}, nil
+	})
+
+	// a bypassed suffix is answered by its server, not the tunnel
+	addrs, err := lookup(context.Background(), "git.corp.internal")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, addrs, qt.DeepEquals, []string{"10.1.2.3"})
+	qt.Assert(t, tunneled, qt.HasLen, 0)
+
+	// everything else stays in the tunnel
+	addrs, err = lookup(context.Background(), "example.com")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, addrs, qt.DeepEquals, []string{"192.0.2.1"})
+	_, err = lookup(context.Background(), "notcorp.internal")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, tunneled, qt.DeepEquals, []string{"example.com", "notcorp.internal"})
+}
+
+func TestParseDNSBypass(t *testing.T) {
+	rule, err := ParseDNSBypass("corp.internal=10.0.0.53")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, rule.Server, qt.Equals, netip.MustParseAddrPort("10.0.0.53:53"))
+	rule, err = ParseDNSBypass("lan=[fd00::53]:5353")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, rule.Server, qt.Equals, netip.MustParseAddrPort("[fd00::53]:5353"))
+
+	for _, bad := range []string{"corp.internal", "=10.0.0.53", "*.corp.internal=10.0.0.53", "corp..internal=10.0.0.53", "corp.internal=dns.example", "corp.internal=10.0.0.53:0"} {
+		_, err := ParseDNSBypass(bad)
+		qt.Check(t, err, qt.IsNotNil, qt.Commentf("%s", bad))
+	}
+}
+
+func TestDNSPreload(t *testing.T) {
+	hosts, err := ParseHostList("# appliance destinations\napi.example.com\n\nCDN.example.net.\nmissing.example.org\n")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, hosts, qt.DeepEquals, []string{"api.example.com", "cdn.example.net", "missing.example.org"})
+	_, err = ParseHostList("api.example.com\n*.example.net\n")
+	qt.Assert(t, err, qt.ErrorMatches, `line 2: .*`)
+
+	var mu sync.Mutex
+	lookups := map[string]int{}
+	cache := newDNSCache(hosts, time.Hour, func(_ context.Context, host string) ([]string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		lookups[host]++
+		if host == "missing.example.org" {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return []string{"192.0.2.1"}, nil
+	})
+	var logs lockedBuffer
+	cache.preload(context.Background(), slog.New(slog.NewTextHandler(&logs, nil)))
+
+	// resolved entries are cached, failures are only logged
+	for _, host := range []string{"api.example.com", "cdn.example.net"} {
+		addrs, ok := cache.cached(host)
+		qt.Assert(t, ok, qt.IsTrue, qt.Commentf("%s", host))
+		qt.Assert(t, addrs, qt.DeepEquals, []string{"192.0.2.1"})
+	}
+	_, ok := cache.cached("missing.example.org")
+	qt.Assert(t, ok, qt.IsFalse)
+	qt.Assert(t, logs.String(), qt.Contains, "failed to preload hostname")
+
+	// cached entries are served without a lookup, others are looked up
+	_, err = cache.lookupHost(context.Background(), "API.example.com")
+	qt.Assert(t, err, qt.IsNil)
+	_, err = cache.lookupHost(context.Background(), "other.example.com")
+	qt.Assert(t, err, qt.IsNil)
+	_, err = cache.lookupHost(context.Background(), "other.example.com")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, lookups, qt.DeepEquals, map[string]int{"api.example.com": 1, "cdn.example.net": 1, "missing.example.org": 1, "other.example.com": 2})
+
+	// expired entries are resolved again
+	cache.entries["cdn.example.net"].expires = time.Now().Add(-time.Second)
+	_, err = cache.lookupHost(context.Background(), "cdn.example.net")
+	qt.Assert(t, err, qt.IsNil)
+	_, err = cache.lookupHost(context.Background(), "cdn.example.net")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, lookups["cdn.example.net"], qt.Equals, 2)
+}
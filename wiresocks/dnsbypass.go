@@ -0,0 +1,94 @@
+package wiresocks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// DNSBypass sends the lookups of a domain and its subdomains to Server
+// over the local network instead of the DNS servers of the tunnel.
+type DNSBypass struct {
+	Suffix string
+	Server netip.AddrPort
+}
+
+// ParseDNSBypass parses a domain=server rule. The server is an IP address
+// with an optional port, 53 by default.
+func ParseDNSBypass(rule string) (DNSBypass, error) {
+	suffix, server, ok := strings.Cut(rule, "=")
+	if !ok || suffix == "" || server == "" {
+		return DNSBypass{}, fmt.Errorf("invalid dns bypass rule %q, use domain=server", rule)
+	}
+	if strings.Contains(suffix, "*") {
+		return DNSBypass{}, fmt.Errorf("invalid dns bypass rule %q, the domain covers its subdomains without a wildcard", rule)
+	}
+	if err := ValidateDomainPattern(suffix); err != nil {
+		return DNSBypass{}, err
+	}
+
+	addrPort, err := ParseDNSServer(server)
+	if err != nil {
+		return DNSBypass{}, fmt.Errorf("invalid dns server %q in rule %q", server, rule)
+	}
+	return DNSBypass{Suffix: normalizeHost(suffix), Server: addrPort}, nil
+}
+
+// ParseDNSServer parses a DNS server given as an address with an optional
+// port, which defaults to 53.
+func ParseDNSServer(server string) (netip.AddrPort, error) {
+	addrPort, err := netip.ParseAddrPort(server)
+	if err != nil {
+		addr, err := netip.ParseAddr(server)
+		if err != nil {
+			return netip.AddrPort{}, fmt.Errorf("invalid dns server %q", server)
+		}
+		addrPort = netip.AddrPortFrom(addr, 53)
+	}
+	if addrPort.Port() == 0 {
+		return netip.AddrPort{}, fmt.Errorf("invalid dns server %q", server)
+	}
+	return addrPort, nil
+}
+
+// matches reports whether host is the suffix or one of its subdomains.
+func (b DNSBypass) matches(host string) bool {
+	return host == b.Suffix || strings.HasSuffix(host, "."+b.Suffix)
+}
+
+// bypassLookup wraps lookup so hosts matching a rule are resolved by its
+// server with direct instead, the longest matching suffix winning.
+func bypassLookup(rules []DNSBypass, direct func(server netip.AddrPort) func(ctx context.Context, host string) ([]string, error), lookup func(ctx context.Context, host string) ([]string, error)) func(ctx context.Context, host string) ([]string, error) {
+	lookups := make([]func(ctx context.Context, host string) ([]string, error), len(rules))
+	for i, rule := range rules {
+		lookups[i] = direct(rule.Server)
+	}
+	return func(ctx context.Context, host string) ([]string, error) {
+		name := normalizeHost(host)
+		best := -1
+		for i, rule := range rules {
+			if rule.matches(name) && (best < 0 || len(rule.Suffix) > len(rules[best].Suffix)) {
+				best = i
+			}
+		}
+		if best < 0 {
+			return lookup(ctx, host)
+		}
+		return lookups[best](ctx, host)
+	}
+}
+
+// directLookup resolves hostnames with the DNS server at server, queried
+// from the local network.
+func directLookup(server netip.AddrPort) func(ctx context.Context, host string) ([]string, error) {
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server.String())
+		},
+	}
+	return r.LookupHost
+}
@@ -0,0 +1,117 @@
+package wiresocks
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNSPreloadTTL is how long the addresses of a preloaded hostname are
+// used before it is resolved again. The tunnel resolver doesn't report
+// record TTLs.
+const DNSPreloadTTL = 5 * time.Minute
+
+// ParseHostList parses a list of hostnames, one per line. Blank lines and
+// lines starting with # are skipped.
+func ParseHostList(list string) ([]string, error) {
+	var hosts []string
+	for i, line := range strings.Split(list, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.Contains(line, "*") {
+			return nil, fmt.Errorf("line %d: %q is not a hostname", i+1, line)
+		}
+		if err := ValidateDomainPattern(line); err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		hosts = append(hosts, normalizeHost(line))
+	}
+	return hosts, nil
+}
+
+type dnsCacheEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// dnsCache keeps the addresses of a fixed set of hostnames, resolving them
+// again with lookup once they are older than ttl. Other hostnames are
+// passed to lookup as they are.
+type dnsCache struct {
+	hosts  []string
+	ttl    time.Duration
+	lookup func(ctx context.Context, host string) ([]string, error)
+
+	mu      sync.Mutex
+	entries map[string]*dnsCacheEntry
+}
+
+func newDNSCache(hosts []string, ttl time.Duration, lookup func(ctx context.Context, host string) ([]string, error)) *dnsCache {
+	c := &dnsCache{ttl: ttl, lookup: lookup, entries: make(map[string]*dnsCacheEntry, len(hosts))}
+	for _, host := range hosts {
+		host = normalizeHost(host)
+		if _, ok := c.entries[host]; !ok {
+			c.hosts = append(c.hosts, host)
+			c.entries[host] = &dnsCacheEntry{}
+		}
+	}
+	return c
+}
+
+// preload resolves every hostname, logging the ones that fail.
+func (c *dnsCache) preload(ctx context.Context, l *slog.Logger) {
+	var resolved int
+	for _, host := range c.hosts {
+		if _, err := c.resolve(ctx, host); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			l.Warn("failed to preload hostname", "host", host, "error", err)
+			continue
+		}
+		resolved++
+	}
+	l.Debug("preloaded hostnames", "resolved", resolved, "total", len(c.hosts))
+}
+
+// cached returns the fresh addresses of host.
+func (c *dnsCache) cached(host string) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[host]
+	if !ok || entry.addrs == nil || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.addrs, true
+}
+
+func (c *dnsCache) resolve(ctx context.Context, host string) ([]string, error) {
+	addrs, err := c.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.entries[host] = &dnsCacheEntry{addrs: addrs, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+	return addrs, nil
+}
+
+// lookupHost resolves host from the cache if it is one of its hostnames.
+func (c *dnsCache) lookupHost(ctx context.Context, host string) ([]string, error) {
+	name := normalizeHost(host)
+	if addrs, ok := c.cached(name); ok {
+		return addrs, nil
+	}
+	c.mu.Lock()
+	_, ok := c.entries[name]
+	c.mu.Unlock()
+	if !ok {
+		return c.lookup(ctx, host)
+	}
+	return c.resolve(ctx, name)
+}
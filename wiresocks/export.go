@@ -0,0 +1,198 @@
+package wiresocks
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// zeroKey is the hex preshared key of peers without one.
+var zeroKey = strings.Repeat("0", 64)
+
+// jsonConfig is the JSON form of a Configuration. Keys are base64 encoded
+// and addresses carry their prefix length, like in wireguard config files.
+type jsonConfig struct {
+	Interface jsonInterface `json:"interface"`
+	Peers     []jsonPeer    `json:"peers"`
+}
+
+type jsonInterface struct {
+	PrivateKey string         `json:"private_key,omitempty"`
+	Addresses  []netip.Prefix `json:"addresses"`
+	DNS        []netip.Addr   `json:"dns,omitempty"`
+	MTU        int            `json:"mtu,omitempty"`
+}
+
+type jsonPeer struct {
+	PublicKey    string         `json:"public_key"`
+	PreSharedKey string         `json:"preshared_key,omitempty"`
+	Endpoint     string         `json:"endpoint"`
+	AllowedIPs   []netip.Prefix `json:"allowed_ips"`
+	KeepAlive    int            `json:"persistent_keepalive,omitempty"`
+	Reserved     [3]byte        `json:"reserved"`
+}
+
+func encodeHexToBase64(key string) (string, error) {
+	decoded, err := hex.DecodeString(key)
+	if err != nil || len(decoded) != 32 {
+		return "", errors.New("key should be 32 hex encoded bytes")
+	}
+	return base64.StdEncoding.EncodeToString(decoded), nil
+}
+
+// Redacted returns a copy of c without the private and preshared keys.
+func (c Configuration) Redacted() Configuration {
+	if c.Interface != nil {
+		iface := *c.Interface
+		iface.PrivateKey = ""
+		c.Interface = &iface
+	}
+	peers := make([]PeerConfig, len(c.Peers))
+	for i, peer := range c.Peers {
+		peer.PreSharedKey = ""
+		peers[i] = peer
+	}
+	c.Peers = peers
+	return c
+}
+
+// MarshalJSON encodes the configuration for other tools. Empty keys, as
+// left by Redacted, are omitted.
+func (c Configuration) MarshalJSON() ([]byte, error) {
+	var out jsonConfig
+	if c.Interface != nil {
+		if c.Interface.PrivateKey != "" {
+			key, err := encodeHexToBase64(c.Interface.PrivateKey)
+			if err != nil {
+				return nil, fmt.Errorf("invalid private key: %w", err)
+			}
+			out.Interface.PrivateKey = key
+		}
+		for _, addr := range c.Interface.Addresses {
+			out.Interface.Addresses = append(out.Interface.Addresses, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+		out.Interface.DNS = c.Interface.DNS
+		out.Interface.MTU = c.Interface.MTU
+	}
+
+	for _, peer := range c.Peers {
+		p := jsonPeer{
+			Endpoint:   peer.Endpoint,
+			AllowedIPs: peer.AllowedIPs,
+			KeepAlive:  peer.KeepAlive,
+			Reserved:   peer.Reserved,
+		}
+		key, err := encodeHexToBase64(peer.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key: %w", err)
+		}
+		p.PublicKey = key
+		if peer.PreSharedKey != "" && peer.PreSharedKey != zeroKey {
+			if p.PreSharedKey, err = encodeHexToBase64(peer.PreSharedKey); err != nil {
+				return nil, fmt.Errorf("invalid preshared key: %w", err)
+			}
+		}
+		out.Peers = append(out.Peers, p)
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON decodes a configuration written by MarshalJSON. Like a
+// wireguard config file it must have a private key and at least one peer.
+func (c *Configuration) UnmarshalJSON(b []byte) error {
+	var in jsonConfig
+	if err := json.Unmarshal(b, &in); err != nil {
+		return err
+	}
+	if in.Interface.PrivateKey == "" {
+		return errors.New("private key should not be empty")
+	}
+	if len(in.Peers) == 0 {
+		return errors.New("at least one peer is expected")
+	}
+
+	iface := InterfaceConfig{DNS: in.Interface.DNS, MTU: in.Interface.MTU}
+	var err error
+	if iface.PrivateKey, err = EncodeBase64ToHex(in.Interface.PrivateKey); err != nil {
+		return err
+	}
+	for _, prefix := range in.Interface.Addresses {
+		iface.Addresses = append(iface.Addresses, prefix.Addr())
+	}
+
+	peers := make([]PeerConfig, len(in.Peers))
+	for i, p := range in.Peers {
+		peer := PeerConfig{
+			PreSharedKey: zeroKey,
+			Endpoint:     p.Endpoint,
+			AllowedIPs:   p.AllowedIPs,
+			KeepAlive:    p.KeepAlive,
+			Reserved:     p.Reserved,
+		}
+		if peer.PublicKey, err = EncodeBase64ToHex(p.PublicKey); err != nil {
+			return err
+		}
+		if p.PreSharedKey != "" {
+			if peer.PreSharedKey, err = EncodeBase64ToHex(p.PreSharedKey); err != nil {
+				return err
+			}
+		}
+		peers[i] = peer
+	}
+
+	*c = Configuration{Interface: &iface, Peers: peers}
+	return nil
+}
+
+// MarshalINI encodes the configuration as a wireguard config file, as read
+// by ParseConfig and wg-quick. Empty keys, as left by Redacted, are omitted.
+func (c Configuration) MarshalINI() ([]byte, error) {
+	var b strings.Builder
+	b.WriteString("[Interface]\n")
+	if c.Interface != nil {
+		if c.Interface.PrivateKey != "" {
+			key, err := encodeHexToBase64(c.Interface.PrivateKey)
+			if err != nil {
+				return nil, fmt.Errorf("invalid private key: %w", err)
+			}
+			fmt.Fprintf(&b, "PrivateKey = %s\n", key)
+		}
+		for _, addr := range c.Interface.Addresses {
+			fmt.Fprintf(&b, "Address = %s\n", netip.PrefixFrom(addr, addr.BitLen()))
+		}
+		for _, addr := range c.Interface.DNS {
+			fmt.Fprintf(&b, "DNS = %s\n", addr)
+		}
+		if c.Interface.MTU != 0 {
+			fmt.Fprintf(&b, "MTU = %d\n", c.Interface.MTU)
+		}
+	}
+
+	for _, peer := range c.Peers {
+		key, err := encodeHexToBase64(peer.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key: %w", err)
+		}
+		fmt.Fprintf(&b, "\n[Peer]\nPublicKey = %s\n", key)
+		if peer.PreSharedKey != "" && peer.PreSharedKey != zeroKey {
+			key, err := encodeHexToBase64(peer.PreSharedKey)
+			if err != nil {
+				return nil, fmt.Errorf("invalid preshared key: %w", err)
+			}
+			fmt.Fprintf(&b, "PreSharedKey = %s\n", key)
+		}
+		for _, prefix := range peer.AllowedIPs {
+			fmt.Fprintf(&b, "AllowedIPs = %s\n", prefix)
+		}
+		fmt.Fprintf(&b, "Endpoint = %s\n", peer.Endpoint)
+		if peer.KeepAlive != 0 {
+			fmt.Fprintf(&b, "PersistentKeepalive = %d\n", peer.KeepAlive)
+		}
+		fmt.Fprintf(&b, "Reserved = %d,%d,%d\n", peer.Reserved[0], peer.Reserved[1], peer.Reserved[2])
+	}
+	return []byte(b.String()), nil
+}
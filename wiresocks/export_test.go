@@ -0,0 +1,61 @@
+package wiresocks
+
+import (
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func parseTestConfig(t *testing.T, config string) *Configuration {
+	path := filepath.Join(t.TempDir(), "wg.conf")
+	qt.Assert(t, os.WriteFile(path, []byte(config), 0o600), qt.IsNil)
+	conf, err := ParseConfig(path)
+	qt.Assert(t, err, qt.IsNil)
+	return conf
+}
+
+func TestConfigJSON(t *testing.T) {
+	conf := parseTestConfig(t, testConfig)
+	// tricks are specific to warp-plus and not exported
+	conf.Peers[0].Trick = false
+
+	b, err := json.Marshal(conf)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, string(b), qt.Equals, `{"interface":{`+
+		`"private_key":"aK8FWhiV1CtKFbKUPssL13P+Tv+c5owmYcU5PCP6yFw=",`+
+		`"addresses":["172.16.0.2/32","2606:4700:110:8cc0:1ad3:9155:6742:ea8d/128"],`+
+		`"dns":["8.8.8.8"],"mtu":1500},"peers":[{`+
+		`"public_key":"bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=",`+
+		`"endpoint":"engage.cloudflareclient.com:2408","allowed_ips":["0.0.0.0/0","::/0"],`+
+		`"persistent_keepalive":3,"reserved":[1,2,3]}]}`)
+
+	var decoded Configuration
+	qt.Assert(t, json.Unmarshal(b, &decoded), qt.IsNil)
+	qt.Assert(t, decoded, qt.CmpEquals(cmpopts.EquateComparable(netip.Addr{}, netip.Prefix{})), *conf)
+
+	// the wireguard config file parses into the same configuration
+	ini, err := decoded.MarshalINI()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, parseTestConfig(t, string(ini)), qt.CmpEquals(cmpopts.EquateComparable(netip.Addr{}, netip.Prefix{})), conf)
+}
+
+func TestConfigRedacted(t *testing.T) {
+	conf := parseTestConfig(t, testConfig)
+	redacted := conf.Redacted()
+	qt.Assert(t, conf.Interface.PrivateKey, qt.Equals, privateKeyBase64)
+
+	b, err := json.Marshal(redacted)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, strings.Contains(string(b), "private_key"), qt.IsFalse)
+	qt.Assert(t, json.Unmarshal(b, new(Configuration)), qt.ErrorMatches, "private key should not be empty")
+
+	ini, err := redacted.MarshalINI()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, strings.Contains(string(ini), "PrivateKey"), qt.IsFalse)
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package wiresocks
+
+import (
+	"net"
+	"net/netip"
+)
+
+// listenTCP listens on addr. Setting the accept backlog is not supported on
+// this platform, so the system default is always used.
+func listenTCP(addr netip.AddrPort, _ int) (net.Listener, error) {
+	return net.Listen("tcp", addr.String())
+}
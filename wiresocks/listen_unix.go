@@ -0,0 +1,81 @@
+//go:build unix
+
+package wiresocks
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// listenTCP listens on addr with the given accept backlog. The kernel caps
+// the backlog (net.core.somaxconn on Linux), and the system default Go uses
+// is that cap already, so a backlog can only lower it unless the cap is
+// raised. A backlog <= 0 uses the system default. The zone of an IPv6 addr
+// selects the interface of a link-local address.
+func listenTCP(addr netip.AddrPort, backlog int) (net.Listener, error) {
+	if backlog <= 0 {
+		return net.Listen("tcp", addr.String())
+	}
+
+	var family int
+	var sa syscall.Sockaddr
+	if addr.Addr().Unmap().Is4() {
+		family = syscall.AF_INET
+		sa = &syscall.SockaddrInet4{Port: int(addr.Port()), Addr: addr.Addr().Unmap().As4()}
+	} else {
+		family = syscall.AF_INET6
+		sa6 := &syscall.SockaddrInet6{Port: int(addr.Port()), Addr: addr.Addr().As16()}
+		if zone := addr.Addr().Zone(); zone != "" {
+			id, err := zoneIndex(zone)
+			if err != nil {
+				return nil, err
+			}
+			sa6.ZoneId = id
+		}
+		sa = sa6
+	}
+
+	syscall.ForkLock.RLock()
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM, syscall.IPPROTO_TCP)
+	if err == nil {
+		syscall.CloseOnExec(fd)
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err := syscall.Listen(fd, backlog); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("listen", err)
+	}
+
+	// FileListener dups the descriptor, so the file can be closed right away
+	f := os.NewFile(uintptr(fd), "tcp:"+addr.String())
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// zoneIndex returns the index of the interface an IPv6 zone names, given
+// either by name or by index.
+func zoneIndex(zone string) (uint32, error) {
+	if id, err := strconv.ParseUint(zone, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	ifi, err := net.InterfaceByName(zone)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(ifi.Index), nil
+}
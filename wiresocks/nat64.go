@@ -0,0 +1,88 @@
+package wiresocks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+)
+
+// WellKnownNAT64Prefix is the well-known prefix of RFC 6052.
+var WellKnownNAT64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// nat64PrefixLengths are the prefix lengths defined by RFC 6052.
+var nat64PrefixLengths = []int{32, 40, 48, 56, 64, 96}
+
+// ValidateNAT64Prefix checks that prefix can embed IPv4 addresses as
+// described in RFC 6052.
+func ValidateNAT64Prefix(prefix netip.Prefix) error {
+	if !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+		return fmt.Errorf("nat64 prefix %s is not an IPv6 prefix", prefix)
+	}
+	if !slices.Contains(nat64PrefixLengths, prefix.Bits()) {
+		return fmt.Errorf("nat64 prefix %s must be a /32, /40, /48, /56, /64 or /96", prefix)
+	}
+	if prefix.Masked() != prefix {
+		return fmt.Errorf("nat64 prefix %s has bits set past its length", prefix)
+	}
+	// bits 64 to 71 are reserved, only a /96 covers them
+	if prefix.Bits() == 96 && prefix.Addr().As16()[8] != 0 {
+		return fmt.Errorf("nat64 prefix %s sets bits 64 to 71, which must be zero", prefix)
+	}
+	return nil
+}
+
+// synthesizeNAT64 embeds v4 into prefix as described in RFC 6052 section
+// 2.2, skipping the u octet (bits 64 to 71).
+func synthesizeNAT64(prefix netip.Prefix, v4 netip.Addr) netip.Addr {
+	b := prefix.Addr().As16()
+	ip := v4.As4()
+	i := prefix.Bits() / 8
+	for _, octet := range ip {
+		if i == 8 {
+			i++
+		}
+		b[i] = octet
+		i++
+	}
+	return netip.AddrFrom16(b)
+}
+
+// dialNAT64 wraps dial so IPv4 destinations are reached through the NAT64
+// gateway of prefix. IPv4 literals are translated, hostnames are resolved
+// with lookup and dialed on an IPv6 address if they have one, otherwise on
+// an address synthesized from their first IPv4 address.
+func dialNAT64(prefix netip.Prefix, lookup func(ctx context.Context, host string) ([]string, error), dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+
+		var addrs []netip.Addr
+		if addr, err := netip.ParseAddr(host); err == nil {
+			addrs = []netip.Addr{addr}
+		} else {
+			hosts, err := lookup(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			for _, h := range hosts {
+				if addr, err := netip.ParseAddr(h); err == nil {
+					addrs = append(addrs, addr)
+				}
+			}
+		}
+
+		v6 := slices.IndexFunc(addrs, func(a netip.Addr) bool { return a.Is6() && !a.Is4In6() })
+		switch {
+		case v6 >= 0:
+			return dial(ctx, network, net.JoinHostPort(addrs[v6].String(), port))
+		case len(addrs) > 0:
+			addr := synthesizeNAT64(prefix, addrs[0].Unmap())
+			return dial(ctx, network, net.JoinHostPort(addr.String(), port))
+		}
+		return nil, fmt.Errorf("no addresses for %s", host)
+	}
+}
@@ -0,0 +1,78 @@
+package wiresocks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestSynthesizeNAT64(t *testing.T) {
+	// the examples of RFC 6052 section 2.4
+	v4 := netip.MustParseAddr("192.0.2.33")
+	for prefix, want := range map[string]string{
+		"2001:db8::/32":               "2001:db8:c000:221::",
+		"2001:db8:100::/40":           "2001:db8:1c0:2:21::",
+		"2001:db8:122::/48":           "2001:db8:122:c000:2:2100::",
+		"2001:db8:122:300::/56":       "2001:db8:122:3c0:0:221::",
+		"2001:db8:122:344::/64":       "2001:db8:122:344:c0:2:2100:0",
+		"2001:db8:122:344::/96":       "2001:db8:122:344::c000:221",
+		WellKnownNAT64Prefix.String(): "64:ff9b::c000:221",
+	} {
+		p := netip.MustParsePrefix(prefix)
+		qt.Assert(t, ValidateNAT64Prefix(p), qt.IsNil)
+		qt.Assert(t, synthesizeNAT64(p, v4), qt.Equals, netip.MustParseAddr(want), qt.Commentf("%s", prefix))
+	}
+}
+
+func TestValidateNAT64Prefix(t *testing.T) {
+	for prefix, want := range map[string]string{
+		"10.0.0.0/8":           "nat64 prefix 10.0.0.0/8 is not an IPv6 prefix",
+		"::ffff:0:0/96":        "nat64 prefix ::ffff:0.0.0.0/96 is not an IPv6 prefix",
+		"64:ff9b::/64":         "",
+		"64:ff9b::/80":         "nat64 prefix 64:ff9b::/80 must be a /32, /40, /48, /56, /64 or /96",
+		"64:ff9b::1/96":        "nat64 prefix 64:ff9b::1/96 has bits set past its length",
+		"64:ff9b:0:0:100::/96": "nat64 prefix 64:ff9b:0:0:100::/96 sets bits 64 to 71, which must be zero",
+	} {
+		err := ValidateNAT64Prefix(netip.MustParsePrefix(prefix))
+		if want == "" {
+			qt.Assert(t, err, qt.IsNil)
+		} else {
+			qt.Assert(t, err, qt.ErrorMatches, want)
+		}
+	}
+}
+
+func TestDialNAT64(t *testing.T) {
+	lookup := func(_ context.Context, host string) ([]string, error) {
+		switch host {
+		case "v4only.example":
+			return []string{"192.0.2.33"}, nil
+		case "dual.example":
+			return []string{"192.0.2.33", "2001:db8::1"}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	var dialed []string
+	dial := dialNAT64(WellKnownNAT64Prefix, lookup, func(_ context.Context, network, address string) (net.Conn, error) {
+		dialed = append(dialed, address)
+		return nil, nil
+	})
+
+	for _, address := range []string{"192.0.2.33:443", "v4only.example:80", "dual.example:80", "[2001:db8::2]:443"} {
+		_, err := dial(context.Background(), "tcp", address)
+		qt.Assert(t, err, qt.IsNil)
+	}
+	qt.Assert(t, dialed, qt.DeepEquals, []string{
+		"[64:ff9b::c000:221]:443",
+		"[64:ff9b::c000:221]:80",
+		"[2001:db8::1]:80",
+		"[2001:db8::2]:443",
+	})
+
+	_, err := dial(context.Background(), "tcp", "missing.example:80")
+	qt.Assert(t, err, qt.ErrorMatches, "no such host")
+}
@@ -0,0 +1,81 @@
+package wiresocks
+
+import (
+	"net"
+	"sync"
+)
+
+// Pause stops proxies from serving new requests while the tunnel behind
+// them keeps running, so egress can be suspended without reconnecting. A
+// zero Pause is resumed and a nil *Pause never pauses. It is safe for
+// concurrent use and may be shared by several proxies.
+type Pause struct {
+	mu     sync.Mutex
+	paused bool
+	// conns are the relayed connections, true for UDP associations.
+	conns map[net.Conn]bool
+}
+
+// Pause refuses new requests from now on. UDP associations are closed, as
+// they would keep sending datagrams to their destination for as long as the
+// client likes. With closeConns the TCP connections already being relayed
+// are closed too, otherwise they carry on. It returns the number of
+// connections closed.
+func (p *Pause) Pause(closeConns bool) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused = true
+	n := 0
+	for conn, udp := range p.conns {
+		if udp || closeConns {
+			_ = conn.Close()
+			delete(p.conns, conn)
+			n++
+		}
+	}
+	return n
+}
+
+// Resume serves new requests again.
+func (p *Pause) Resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused = false
+}
+
+// Paused reports whether new requests are refused.
+func (p *Pause) Paused() bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
+
+// track registers conn, a UDP association with udp, to be closed by Pause,
+// failing while paused.
+func (p *Pause) track(conn net.Conn, udp bool) bool {
+	if p == nil {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paused {
+		return false
+	}
+	if p.conns == nil {
+		p.conns = make(map[net.Conn]bool)
+	}
+	p.conns[conn] = udp
+	return true
+}
+
+func (p *Pause) untrack(conn net.Conn) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.conns, conn)
+}
@@ -2,19 +2,23 @@ package wiresocks
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
-	"github.com/sagernet/sing/common/buf"
+	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"net/netip"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/bepass-org/warp-plus/proxy/pkg/mixed"
+	"github.com/bepass-org/warp-plus/proxy/pkg/proxyproto"
 	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
 	"github.com/bepass-org/warp-plus/wireguard/device"
 	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
+	"github.com/sagernet/sing/common/buf"
 )
 
 // VirtualTun stores a reference to netstack network and DNS configuration
@@ -25,95 +29,580 @@ type VirtualTun struct {
 	Ctx    context.Context
 	pool   buf.Allocator
 	//pool bufferpool.BufPool
+
+	dialFunc  func(ctx context.Context, network, address string) (net.Conn, error)
+	dialRetry func(ctx context.Context, since time.Time) bool
+	backlog   int
+	dialHook  func(network, address string, err error)
+	proxyProt bool
+	direct    []netip.Prefix
+	advertise netip.AddrPort
+	hsTimeout time.Duration
+	tlsConfig *tls.Config
+	bufSize   int
+	bufCap    int
+	nat64     netip.Prefix
+	allowed   []string
+	allowlist domainAllowlist
+	dnsLimit  int
+	dialLimit int
+	breakN    int
+	breakFor  time.Duration
+	breaker   *circuitBreaker
+	health    func() error
+	pause     *Pause
+	closeHook func(reason string)
+	resolver  Resolver
+	dnsBypass []DNSBypass
+	preload   []string
+	// lookup resolves hostnames before they are dialed when a resolver,
+	// DNS bypass rules or preloaded hostnames are set.
+	lookup func(ctx context.Context, host string) ([]string, error)
 }
 
 var BuffSize = 65536
 
+// The range of relay buffer sizes accepted by WithBufferSize.
+const (
+	MinBufferSize = 4 << 10
+	MaxBufferSize = 4 << 20
+)
+
+// errPaused is returned for requests made while the proxy is paused.
+var errPaused = errors.New("proxy is paused")
+
+type ProxyOption func(*VirtualTun)
+
+// WithDialRetry retries a failed through-tunnel dial once, but only when
+// recovered reports that the tunnel was re-established since the dial
+// started, e.g. it handshaked again or moved to another endpoint. A retry
+// over the unchanged tunnel would fail the same way. recovered may wait a
+// while for that and the dial fails as is when it returns false. nil
+// disables the retry.
+func WithDialRetry(recovered func(ctx context.Context, since time.Time) bool) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.dialRetry = recovered
+	}
+}
+
+// WithListenBacklog sets the accept backlog of the proxy listener. Values
+// <= 0 keep the system default, which is already the kernel maximum
+// (net.core.somaxconn on Linux), so larger values only take effect once
+// that is raised. Ignored on platforms other than unix.
+func WithListenBacklog(backlog int) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.backlog = backlog
+	}
+}
+
+// WithDialHook registers fn to be called with the outcome of every dial
+// through the tunnel.
+func WithDialHook(fn func(network, address string, err error)) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.dialHook = fn
+	}
+}
+
+// WithCloseHook registers fn to be called with the reason every relayed
+// connection ended for, one of the Close constants.
+func WithCloseHook(fn func(reason string)) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.closeHook = fn
+	}
+}
+
+// WithProxyProtocol requires a PROXY protocol v1 or v2 header on every
+// accepted connection and uses the client address it conveys. Connections
+// without a valid header are rejected.
+func WithProxyProtocol(enabled bool) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.proxyProt = enabled
+	}
+}
+
+// WithTLSConfig serves the proxy over TLS with config, plaintext clients
+// fail the handshake. With config.ClientAuth set to require client
+// certificates, the subject of the client certificate is logged with every
+// request. A nil config serves plaintext.
+func WithTLSConfig(config *tls.Config) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.tlsConfig = config
+	}
+}
+
+// WithBufferSize sets the size of the two copy buffers of every relayed
+// connection. Smaller buffers save memory with many connections, larger ones
+// help throughput of large transfers. 0 keeps BuffSize.
+func WithBufferSize(size int) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.bufSize = size
+	}
+}
+
+// MinConnBufferCap is the smallest cap accepted by WithConnBufferCap.
+const MinConnBufferCap = 16 << 10
+
+// WithConnBufferCap caps the bytes the tunnel stack buffers for every
+// relayed connection at size in each direction, on top of the two copy
+// buffers. A side that drains slowly then blocks the relay instead of
+// letting the buffers grow to megabytes per connection, bounding memory on
+// small devices at the cost of throughput on fast, high latency paths. 0
+// keeps the growing buffers.
+func WithConnBufferCap(size int) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.bufCap = size
+	}
+}
+
+// WithNAT64Prefix reaches IPv4 destinations through the NAT64 gateway of
+// prefix, which must be reachable through the tunnel. IPv4 addresses are
+// translated and hostnames without an IPv6 address get one synthesized, like
+// DNS64. The zero prefix disables it.
+func WithNAT64Prefix(prefix netip.Prefix) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.nat64 = prefix
+	}
+}
+
+// WithAllowedDomains only serves destinations matching one of patterns and
+// refuses all others before connecting, with a SOCKS "not allowed" reply or
+// an HTTP 403. A pattern is a domain name, matching only itself, or
+// *.domain, matching its subdomains. Destinations given as IP addresses
+// match only when listed literally. A nil slice allows everything.
+func WithAllowedDomains(patterns []string) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.allowed = patterns
+	}
+}
+
+// WithDNSConcurrency resolves at most n destination hostnames at a time,
+// further requests wait for a lookup to finish. The lookups of a burst of
+// browser connections otherwise all hit the DNS servers at once. 0 doesn't
+// limit them.
+func WithDNSConcurrency(n int) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.dnsLimit = n
+	}
+}
+
+// WithDialConcurrency lets at most n dials through the tunnel run at once,
+// further dials wait for one to finish, so a burst of connections doesn't
+// overwhelm the userspace device and time out. Up to 8 dials per slot wait,
+// more fail right away. Direct dials aren't limited. 0 doesn't limit them.
+func WithDialConcurrency(n int) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.dialLimit = n
+	}
+}
+
+// WithCircuitBreaker refuses requests to a host:port for cooldown once
+// threshold TCP dials to it through the tunnel failed in a row, with a
+// SOCKS "not allowed" reply or an HTTP 403, so clients retrying a dead
+// destination don't keep the tunnel busy. After the cooldown one dial is
+// let through again, a failure refuses the destination for another
+// cooldown. Only failures of the dial to the destination itself count, not
+// full dial queues, failed lookups or cancelled requests. A threshold of 0
+// disables it.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.breakN, vt.breakFor = threshold, cooldown
+	}
+}
+
+// WithTunnelHealth skips counting dial failures for WithCircuitBreaker
+// while check fails, since destinations can't be reached while the tunnel
+// is down. A nil check counts all of them.
+func WithTunnelHealth(check func() error) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.health = check
+	}
+}
+
+// WithResolver resolves destination hostnames with r instead of the DNS
+// servers of the tunnel. The addresses it returns are dialed like addresses
+// requested by the client, so they go direct when they match
+// WithDirectPrefixes and through the NAT64 gateway with WithNAT64Prefix.
+// The allowlist of WithAllowedDomains is still matched against the
+// hostname. A nil r keeps the built-in resolver.
+func WithResolver(r Resolver) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.resolver = r
+	}
+}
+
+// WithDNSBypass resolves destination hostnames matching one of rules with
+// the DNS server of the rule, queried over the local network instead of the
+// tunnel. Other hostnames keep the resolver of WithResolver or the DNS
+// servers of the tunnel. Only the lookups bypass the tunnel, the addresses
+// are dialed like any other, see WithResolver. A nil slice disables it.
+func WithDNSBypass(rules []DNSBypass) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.dnsBypass = rules
+	}
+}
+
+// WithDNSPreload resolves hosts in the background once the proxy is up and
+// serves their addresses from a cache for DNSPreloadTTL, resolving them
+// again on the first request past it, so the first connections to them
+// don't wait for a lookup through the tunnel. Hostnames failing to resolve
+// are logged and looked up on request like any other. A nil slice disables
+// it.
+func WithDNSPreload(hosts []string) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.preload = hosts
+	}
+}
+
+// WithPause refuses new requests while p is paused, like disallowed
+// destinations, and lets p close the relayed connections and UDP
+// associations. A nil p never pauses.
+func WithPause(p *Pause) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.pause = p
+	}
+}
+
+// DefaultLocalPrefixes are the loopback, private and link-local ranges used
+// by WithDirectPrefixes when no prefixes are given.
+var DefaultLocalPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+}
+
+// WithDirectPrefixes dials localhost and destinations within prefixes
+// directly instead of through the tunnel, like NO_PROXY. Hostnames other
+// than localhost are never resolved to be matched. A nil slice disables it.
+func WithDirectPrefixes(prefixes []netip.Prefix) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.direct = prefixes
+	}
+}
+
+// DefaultHandshakeTimeout is a handshake timeout for WithHandshakeTimeout
+// that slow clients on mobile networks still make.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// WithHandshakeTimeout closes client connections that don't finish the
+// SOCKS or HTTP proxy negotiation within timeout, so stalled clients can't
+// tie up connections. 0 waits forever.
+func WithHandshakeTimeout(timeout time.Duration) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.hsTimeout = timeout
+	}
+}
+
+// WithAdvertiseAddr reports addr to socks5 clients as the address of the UDP
+// relay instead of the address it listens on, for clients reaching the proxy
+// through NAT or a container network. A zero port keeps the port of the
+// relay, an invalid addr disables it.
+func WithAdvertiseAddr(addr netip.AddrPort) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.advertise = addr
+	}
+}
+
 // StartProxy spawns a socks5 server.
-func StartProxy(ctx context.Context, l *slog.Logger, tnet *netstack.Net, bindAddress netip.AddrPort) (netip.AddrPort, error) {
-	ln, err := net.Listen("tcp", bindAddress.String())
+func StartProxy(ctx context.Context, l *slog.Logger, tnet *netstack.Net, bindAddress netip.AddrPort, options ...ProxyOption) (netip.AddrPort, error) {
+	vt := VirtualTun{
+		Tnet:     tnet,
+		Logger:   l.With("subsystem", "vtun"),
+		Dev:      nil,
+		Ctx:      ctx,
+		pool:     buf.DefaultAllocator,
+		dialFunc: tnet.DialContext,
+	}
+
+	for _, option := range options {
+		option(&vt)
+	}
+	if vt.bufSize == 0 {
+		vt.bufSize = BuffSize
+	}
+	if vt.bufSize < MinBufferSize || vt.bufSize > MaxBufferSize {
+		return netip.AddrPort{}, fmt.Errorf("relay buffer size must be between %d and %d bytes", MinBufferSize, MaxBufferSize)
+	}
+	if vt.bufCap != 0 {
+		if vt.bufCap < MinConnBufferCap {
+			return netip.AddrPort{}, fmt.Errorf("connection buffer cap must be 0 or at least %d bytes", MinConnBufferCap)
+		}
+		if err := tnet.SetTCPBufferCap(vt.bufCap); err != nil {
+			return netip.AddrPort{}, err
+		}
+	}
+	if vt.allowed != nil {
+		list, err := newDomainAllowlist(vt.allowed)
+		if err != nil {
+			return netip.AddrPort{}, err
+		}
+		vt.allowlist = list
+	}
+	if vt.dnsLimit < 0 {
+		return netip.AddrPort{}, errors.New("dns concurrency can't be negative")
+	}
+	if vt.hsTimeout < 0 {
+		return netip.AddrPort{}, errors.New("handshake timeout can't be negative")
+	}
+	switch {
+	case vt.breakN < 0:
+		return netip.AddrPort{}, errors.New("circuit breaker threshold can't be negative")
+	case vt.breakN > 0 && vt.breakFor <= 0:
+		return netip.AddrPort{}, errors.New("circuit breaker cooldown must be positive")
+	case vt.breakN > 0:
+		vt.breaker = newCircuitBreaker(vt.breakN, vt.breakFor)
+		vt.dialFunc = markDestinationErrors(vt.dialFunc)
+	}
+	if vt.dialLimit < 0 {
+		return netip.AddrPort{}, errors.New("dial concurrency can't be negative")
+	}
+	if vt.dialLimit > 0 {
+		vt.dialFunc = limitDials(vt.dialLimit, dialQueuePerSlot*vt.dialLimit, vt.dialFunc)
+	}
+	lookup := tnet.LookupContextHost
+	if vt.resolver != nil {
+		lookup = resolverLookup(vt.resolver)
+	}
+	if len(vt.dnsBypass) > 0 {
+		lookup = bypassLookup(vt.dnsBypass, directLookup, lookup)
+	}
+	if vt.dnsLimit > 0 {
+		lookup = limitLookups(vt.dnsLimit, lookup)
+	}
+	var cache *dnsCache
+	if len(vt.preload) > 0 {
+		cache = newDNSCache(vt.preload, DNSPreloadTTL, lookup)
+		lookup = cache.lookupHost
+	}
+	switch {
+	case vt.resolver != nil, len(vt.dnsBypass) > 0, cache != nil:
+		vt.lookup = lookup
+	case vt.dnsLimit > 0:
+		vt.dialFunc = dialResolved(lookup, vt.dialFunc)
+	}
+	if vt.nat64.IsValid() {
+		if err := ValidateNAT64Prefix(vt.nat64); err != nil {
+			return netip.AddrPort{}, err
+		}
+		vt.dialFunc = dialNAT64(vt.nat64, lookup, vt.dialFunc)
+	}
+
+	ln, err := listenTCP(bindAddress, vt.backlog)
 	if err != nil {
 		return netip.AddrPort{}, err // Return error if binding was unsuccessful
 	}
-
-	vt := VirtualTun{
-		Tnet:   tnet,
-		Logger: l.With("subsystem", "vtun"),
-		Dev:    nil,
-		Ctx:    ctx,
-		pool:   buf.DefaultAllocator,
+	addr := ln.Addr().(*net.TCPAddr).AddrPort()
+	if vt.proxyProt {
+		ln = proxyproto.NewListener(ln)
+	}
+	// the PROXY header comes in the clear ahead of the TLS handshake
+	if vt.tlsConfig != nil {
+		ln = tls.NewListener(ln, vt.tlsConfig)
 	}
 
-	proxy := mixed.NewProxy(
+	proxyOptions := []mixed.Option{
 		mixed.WithListener(ln),
 		mixed.WithLogger(l),
 		mixed.WithContext(ctx),
 		mixed.WithUserHandler(func(request *statute.ProxyRequest) error {
 			return vt.generalHandler(request)
 		}),
-	)
+	}
+	if vt.advertise.IsValid() {
+		proxyOptions = append(proxyOptions, mixed.WithAdvertiseAddr(vt.advertise))
+	}
+	if vt.hsTimeout > 0 {
+		proxyOptions = append(proxyOptions, mixed.WithHandshakeTimeout(vt.hsTimeout))
+	}
+	if vt.allowlist != nil || vt.pause != nil || vt.breaker != nil {
+		proxyOptions = append(proxyOptions, mixed.WithDestinationFilter(vt.allows))
+	}
+	proxy := mixed.NewProxy(proxyOptions...)
 	go func() {
 		_ = proxy.ListenAndServe()
 	}()
+	if cache != nil {
+		go cache.preload(ctx, vt.Logger)
+	}
 	go func() {
 		<-vt.Ctx.Done()
 		vt.Stop()
 	}()
 
-	return ln.Addr().(*net.TCPAddr).AddrPort(), nil
+	return addr, nil
 }
 
 func (vt *VirtualTun) generalHandler(req *statute.ProxyRequest) error {
-	vt.Logger.Debug("handling connection", "protocol", req.Network, "destination", req.Destination)
-	conn, err := vt.Tnet.Dial(req.Network, req.Destination)
+	attrs := []any{"client", req.Conn.RemoteAddr(), "protocol", req.Network, "destination", req.Destination}
+	if subject := clientCertSubject(req.Conn); subject != "" {
+		attrs = append(attrs, "client_cert", subject)
+	}
+	vt.Logger.Debug("handling connection", attrs...)
+	conn, err := vt.dial(req.Network, req.Destination)
 	if err != nil {
 		return err
 	}
-
 	timeout := 0 * time.Second
+	udp := false
 	switch req.Network {
 	case "udp", "udp4", "udp6":
 		timeout = 15 * time.Second
+		udp = true
 	}
 
-	// Close the connections when this function exits
-	defer conn.Close()
-	defer req.Conn.Close()
-	// Channel to notify when copy operation is done
-	done := make(chan error, 1)
-	// Copy data from req.Conn to conn
-	go func() {
-		buf1 := vt.pool.Get(BuffSize)
-		defer func(pool buf.Allocator, buf []byte) {
-			_ = pool.Put(buf)
-		}(vt.pool, buf1)
-		_, err := copyConnTimeout(conn, req.Conn, buf1, timeout)
-		if errors.Is(err, syscall.ECONNRESET) {
-			done <- nil
-			return
-		}
-		done <- err
-	}()
-	// Copy data from conn to req.Conn
-	go func() {
-		buf2 := vt.pool.Get(BuffSize)
-		defer func(pool buf.Allocator, buf []byte) {
-			_ = pool.Put(buf)
-		}(vt.pool, buf2)
-		_, err := copyConnTimeout(req.Conn, conn, buf2, timeout)
-		done <- err
+	if !vt.pause.track(req.Conn, udp) {
+		conn.Close()
+		return errPaused
+	}
+	defer vt.pause.untrack(req.Conn)
+
+	buf1, buf2 := vt.getBuffer(), vt.getBuffer()
+	defer func() {
+		_ = vt.pool.Put(buf1)
+		_ = vt.pool.Put(buf2)
 	}()
-	// Wait for one of the copy operations to finish
-	err = <-done
+
+	reason, err := relay(req.Conn, conn, buf1, buf2, timeout)
+	if vt.Ctx.Err() != nil {
+		reason = CloseShutdown
+	}
+	vt.Logger.Debug("connection closed", "client", req.Conn.RemoteAddr(), "destination", req.Destination, "reason", reason)
+	if vt.closeHook != nil {
+		vt.closeHook(reason)
+	}
 	if err != nil {
 		vt.Logger.Warn(err.Error())
 	}
-
-	// Close connections and wait for the other copy operation to finish
-	<-done
 	return nil
 }
 
+// allows reports whether requests to address are served.
+func (vt *VirtualTun) allows(address string) bool {
+	if vt.pause.Paused() {
+		return false
+	}
+	if vt.allowlist != nil && !vt.allowlist.allowsAddress(address) {
+		return false
+	}
+	if !vt.breaker.allows(address) {
+		vt.Logger.Debug("refusing destination after repeated dial failures", "destination", address)
+		return false
+	}
+	return true
+}
+
+// clientCertSubject returns the subject of the certificate the client
+// authenticated with, empty when it didn't connect over TLS or sent none.
+func clientCertSubject(conn net.Conn) string {
+	for {
+		switch c := conn.(type) {
+		case *tls.Conn:
+			if certs := c.ConnectionState().PeerCertificates; len(certs) > 0 {
+				return certs[0].Subject.String()
+			}
+			return ""
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return ""
+		}
+	}
+}
+
+// getBuffer returns a relay buffer, from the pool unless it's too large for
+// it. Putting back a buffer that didn't come from the pool is a no-op.
+func (vt *VirtualTun) getBuffer() []byte {
+	if b := vt.pool.Get(vt.bufSize); b != nil {
+		return b
+	}
+	return make([]byte, vt.bufSize)
+}
+
+// isDirect reports whether address should bypass the tunnel.
+func (vt *VirtualTun) isDirect(address string) bool {
+	if len(vt.direct) == 0 {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(strings.TrimSuffix(host, "."), "localhost") {
+		return true
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range vt.direct {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (vt *VirtualTun) dial(network, address string) (conn net.Conn, err error) {
+	if vt.pause.Paused() {
+		return nil, errPaused
+	}
+	// UDP destinations aren't known when the association is set up
+	if vt.allowlist != nil && !vt.allowlist.allowsAddress(address) {
+		return nil, fmt.Errorf("destination %s not allowed", address)
+	}
+
+	if network == "tcp" && vt.breaker != nil && !vt.isDirect(address) {
+		defer func() {
+			var dest *destinationError
+			if vt.Ctx.Err() != nil || (err != nil && !errors.As(err, &dest)) {
+				return
+			}
+			if vt.health != nil && vt.health() != nil {
+				return
+			}
+			vt.breaker.record(address, err)
+		}()
+	}
+
+	// localhost is never looked up, isDirect matches it by name
+	if vt.lookup != nil && !vt.isDirect(address) {
+		return dialResolved(vt.lookup, vt.dialAddress)(vt.Ctx, network, address)
+	}
+	return vt.dialAddress(vt.Ctx, network, address)
+}
+
+// dialAddress dials address directly or through the tunnel.
+func (vt *VirtualTun) dialAddress(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	if vt.isDirect(address) {
+		vt.Logger.Debug("dialing local destination directly", "destination", address)
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	}
+
+	if vt.dialHook != nil {
+		defer func() { vt.dialHook(network, address, err) }()
+	}
+
+	start := time.Now()
+	conn, err = vt.dialFunc(ctx, network, address)
+	if err == nil || vt.dialRetry == nil || ctx.Err() != nil {
+		return conn, err
+	}
+	if !vt.dialRetry(ctx, start) {
+		return nil, err
+	}
+
+	vt.Logger.Debug("dial failed, retrying once over the recovered tunnel", "destination", address, "error", err)
+	return vt.dialFunc(ctx, network, address)
+}
+
 func (vt *VirtualTun) Stop() {
 	if vt.Dev != nil {
 		if err := vt.Dev.Down(); err != nil {
@@ -122,47 +611,81 @@ func (vt *VirtualTun) Stop() {
 	}
 }
 
-var errInvalidWrite = errors.New("invalid write result")
+// relay copies data between client and remote in both directions until both
+// directions are done. A clean EOF on one side is propagated to the other as a
+// half-close, any other error tears down both connections so the opposite
+// direction can't hang. It returns why the connection ended, one of the
+// Close constants, and the first error encountered.
+func relay(client, remote net.Conn, buf1, buf2 []byte, timeout time.Duration) (string, error) {
+	defer remote.Close()
+	defer client.Close()
+
+	type result struct {
+		reason string
+		err    error
+	}
+	done := make(chan result, 2)
+	pipe := func(dst, src net.Conn, buf []byte, dstEnd, srcEnd connEnd) {
+		rec := &readErrConn{Conn: src}
+		_, err := copyConnTimeout(dst, rec, buf, timeout)
+		reason := closeReason(err, err != nil && err == rec.err, srcEnd, dstEnd)
+		if errors.Is(err, syscall.ECONNRESET) {
+			err = nil
+		}
+		failed := err != nil || closeWrite(dst) != nil
+		// reported before closing, which fails the other direction
+		done <- result{reason, err}
+		if failed {
+			// Without a half-close the peer would never see the EOF, so
+			// close both sides to unblock the other direction.
+			_ = client.Close()
+			_ = remote.Close()
+		}
+	}
+	go pipe(remote, client, buf1, remoteEnd, clientEnd)
+	go pipe(client, remote, buf2, clientEnd, remoteEnd)
+
+	first := <-done
+	err := first.err
+	if second := <-done; err == nil && !errors.Is(second.err, net.ErrClosed) {
+		err = second.err
+	}
+	return first.reason, err
+}
+
+// closeWrite shuts down the writing side of conn if it supports half-close.
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// deadlineReader refreshes the read deadline of the underlying connection
+// before every read so that idle connections time out.
+type deadlineReader struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (r deadlineReader) Read(p []byte) (int, error) {
+	if err := r.Conn.SetReadDeadline(time.Now().Add(r.timeout)); err != nil {
+		return 0, err
+	}
+	return r.Conn.Read(p)
+}
 
 func copyConnTimeout(dst net.Conn, src net.Conn, buf []byte, timeout time.Duration) (written int64, err error) {
 	if buf != nil && len(buf) == 0 {
 		panic("empty buffer in CopyBuffer")
 	}
 
-	for {
-		deadline := time.Time{}
-		if timeout != 0 {
-			deadline = time.Now().Add(timeout)
-		}
-		if err := src.SetReadDeadline(deadline); err != nil {
-			return 0, err
-		}
-
-		nr, er := src.Read(buf)
-		if nr > 0 {
-			nw, ew := dst.Write(buf[0:nr])
-			if nw < 0 || nr < nw {
-				nw = 0
-				if ew == nil {
-					ew = errInvalidWrite
-				}
-			}
-			written += int64(nw)
-			if ew != nil {
-				err = ew
-				break
-			}
-			if nr != nw {
-				err = io.ErrShortWrite
-				break
-			}
-		}
-		if er != nil {
-			if er != io.EOF {
-				err = er
-			}
-			break
-		}
+	var r io.Reader = src
+	if timeout != 0 {
+		r = deadlineReader{Conn: src, timeout: timeout}
 	}
-	return written, err
+
+	// Hide any ReaderFrom/WriterTo implementations so the reusable buffer is
+	// always used; io.CopyBuffer takes care of short reads and writes.
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{r}, buf)
 }
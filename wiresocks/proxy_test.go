@@ -0,0 +1,805 @@
+package wiresocks
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/tun"
+	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
+	qt "github.com/frankban/quicktest"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t testing.TB) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+
+	c1, err := net.Dial("tcp", ln.Addr().String())
+	qt.Assert(t, err, qt.IsNil)
+	c2 := <-accepted
+	qt.Assert(t, c2, qt.IsNotNil)
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+	return c1, c2
+}
+
+// relayResult is what relay returned.
+type relayResult struct {
+	reason string
+	err    error
+}
+
+func startRelay(t testing.TB, bufSize int, timeout time.Duration) (client, server net.Conn, result chan relayResult) {
+	client, proxyClient := tcpPair(t)
+	proxyRemote, server := tcpPair(t)
+
+	result = make(chan relayResult, 1)
+	go func() {
+		reason, err := relay(proxyClient, proxyRemote, make([]byte, bufSize), make([]byte, bufSize), timeout)
+		result <- relayResult{reason, err}
+	}()
+	return client, server, result
+}
+
+func TestRelayIntegrity(t *testing.T) {
+	client, server, result := startRelay(t, 1024, 0)
+
+	up := make([]byte, 8<<20)
+	down := make([]byte, 8<<20)
+	_, _ = rand.Read(up)
+	_, _ = rand.Read(down)
+
+	// Each side writes its payload and then half-closes while reading the
+	// other side's payload concurrently.
+	exchange := func(c net.Conn, payload []byte) chan []byte {
+		got := make(chan []byte, 1)
+		go func() {
+			_, _ = c.Write(payload)
+			_ = c.(*net.TCPConn).CloseWrite()
+		}()
+		go func() {
+			b, _ := io.ReadAll(c)
+			got <- b
+		}()
+		return got
+	}
+	gotDown := exchange(client, up)
+	gotUp := exchange(server, down)
+
+	qt.Assert(t, bytes.Equal(<-gotUp, up), qt.IsTrue)
+	qt.Assert(t, bytes.Equal(<-gotDown, down), qt.IsTrue)
+
+	select {
+	case res := <-result:
+		qt.Assert(t, res.err, qt.IsNil)
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay did not return after both sides finished")
+	}
+}
+
+// BenchmarkRelay shows the throughput of the relay for different buffer
+// sizes, see WithBufferSize.
+func BenchmarkRelay(b *testing.B) {
+	chunk := make([]byte, 1<<20)
+	for _, size := range []int{MinBufferSize, BuffSize, MaxBufferSize} {
+		b.Run(fmt.Sprintf("%dKiB", size>>10), func(b *testing.B) {
+			client, server, _ := startRelay(b, size, 0)
+			b.SetBytes(int64(len(chunk)))
+			b.ResetTimer()
+
+			go func() {
+				for range b.N {
+					if _, err := client.Write(chunk); err != nil {
+						return
+					}
+				}
+			}()
+			if _, err := io.CopyN(io.Discard, server, int64(b.N*len(chunk))); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestBufferSizeRange(t *testing.T) {
+	for _, size := range []int{1024, MaxBufferSize + 1} {
+		_, err := StartProxy(context.Background(), slog.Default(), nil, netip.MustParseAddrPort("127.0.0.1:0"), WithBufferSize(size))
+		qt.Assert(t, err, qt.ErrorMatches, "relay buffer size must be between .*")
+	}
+}
+
+// netstackPair returns two userspace stacks at 10.0.0.1 and 10.0.0.2 wired
+// to each other.
+func netstackPair(t *testing.T) (*netstack.Net, *netstack.Net) {
+	devA, a, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.0.0.1")}, nil, 1280)
+	qt.Assert(t, err, qt.IsNil)
+	devB, b, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.0.0.2")}, nil, 1280)
+	qt.Assert(t, err, qt.IsNil)
+	forward := func(from, to tun.Device) {
+		bufs, sizes := [][]byte{make([]byte, 1500)}, make([]int, 1)
+		for {
+			if _, err := from.Read(bufs, sizes, 0); err != nil {
+				return
+			}
+			if _, err := to.Write([][]byte{bufs[0][:sizes[0]]}, 0); err != nil {
+				return
+			}
+		}
+	}
+	go forward(devA, devB)
+	go forward(devB, devA)
+	t.Cleanup(func() {
+		devA.Close()
+		devB.Close()
+	})
+	return a, b
+}
+
+// bufferedBytes returns how much a writer from a to a peer on b that never
+// reads gets to write before blocking.
+func bufferedBytes(t *testing.T, a, b *netstack.Net, port uint16) int {
+	ln, err := b.ListenTCPAddrPort(netip.AddrPortFrom(netip.MustParseAddr("10.0.0.2"), port))
+	qt.Assert(t, err, qt.IsNil)
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		// the slow reader, never draining
+		t.Cleanup(func() { c.Close() })
+	}()
+
+	c, err := a.DialContextTCPAddrPort(context.Background(), netip.AddrPortFrom(netip.MustParseAddr("10.0.0.2"), port))
+	qt.Assert(t, err, qt.IsNil)
+	defer c.Close()
+
+	chunk := make([]byte, 32<<10)
+	written := 0
+	for {
+		qt.Assert(t, c.SetWriteDeadline(time.Now().Add(200*time.Millisecond)), qt.IsNil)
+		n, err := c.Write(chunk)
+		written += n
+		if err != nil {
+			return written
+		}
+	}
+}
+
+func TestConnBufferCap(t *testing.T) {
+	const bufCap = 64 << 10
+
+	a, b := netstackPair(t)
+	uncapped := bufferedBytes(t, a, b, 80)
+
+	a, b = netstackPair(t)
+	_, err := StartProxy(context.Background(), slog.Default(), a, netip.MustParseAddrPort("127.0.0.1:0"), WithConnBufferCap(bufCap))
+	qt.Assert(t, err, qt.IsNil)
+	// the remote end buffers too, keep it small so the writer side shows
+	qt.Assert(t, b.SetTCPBufferCap(bufCap), qt.IsNil)
+	capped := bufferedBytes(t, a, b, 80)
+
+	qt.Assert(t, capped <= 4*bufCap, qt.IsTrue, qt.Commentf("buffered %d bytes with a cap of %d", capped, bufCap))
+	qt.Assert(t, uncapped > 8*bufCap, qt.IsTrue, qt.Commentf("buffered %d bytes without a cap", uncapped))
+
+	_, err = StartProxy(context.Background(), slog.Default(), a, netip.MustParseAddrPort("127.0.0.1:0"), WithConnBufferCap(1024))
+	qt.Assert(t, err, qt.ErrorMatches, "connection buffer cap must be 0 or at least .*")
+}
+
+func TestRelayRemoteEOF(t *testing.T) {
+	client, server, result := startRelay(t, 1024, 0)
+
+	_, err := server.Write([]byte("bye"))
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, server.Close(), qt.IsNil)
+
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b, err := io.ReadAll(client)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, string(b), qt.Equals, "bye")
+
+	qt.Assert(t, client.Close(), qt.IsNil)
+	select {
+	case res := <-result:
+		qt.Assert(t, res.reason, qt.Equals, CloseRemoteEOF)
+	case <-time.After(2 * time.Second):
+		t.Fatal("relay did not return after remote EOF")
+	}
+}
+
+func TestRelayIdleTimeout(t *testing.T) {
+	client, server, result := startRelay(t, 1024, 100*time.Millisecond)
+	_, err := client.Write([]byte("hello"))
+	qt.Assert(t, err, qt.IsNil)
+	b := make([]byte, 5)
+	_, err = io.ReadFull(server, b)
+	qt.Assert(t, err, qt.IsNil)
+
+	// neither side sends anything more
+	select {
+	case res := <-result:
+		qt.Assert(t, res.reason, qt.Equals, CloseIdleTimeout)
+		qt.Assert(t, res.err, qt.ErrorIs, os.ErrDeadlineExceeded)
+	case <-time.After(2 * time.Second):
+		t.Fatal("relay did not time out")
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	reset := &net.OpError{Op: "read", Err: syscall.ECONNRESET}
+	for _, tc := range []struct {
+		err     error
+		readErr bool
+		src     connEnd
+		want    string
+	}{
+		{nil, false, clientEnd, CloseClientEOF},
+		{nil, false, remoteEnd, CloseRemoteEOF},
+		{os.ErrDeadlineExceeded, true, remoteEnd, CloseIdleTimeout},
+		{reset, true, clientEnd, CloseClientEOF},
+		{reset, false, clientEnd, CloseRemoteEOF},
+		{errors.New("connection timed out"), true, remoteEnd, CloseTunnelError},
+		{errors.New("broken pipe"), false, remoteEnd, CloseClientError},
+		{errors.New("broken pipe"), false, clientEnd, CloseTunnelError},
+	} {
+		dst := remoteEnd
+		if tc.src == remoteEnd {
+			dst = clientEnd
+		}
+		qt.Check(t, closeReason(tc.err, tc.readErr, tc.src, dst), qt.Equals, tc.want, qt.Commentf("%v read=%v src=%v", tc.err, tc.readErr, tc.src))
+	}
+}
+
+func TestDialRetry(t *testing.T) {
+	target, _ := tcpPair(t)
+
+	for _, tc := range []struct {
+		name      string
+		recovered func(context.Context, time.Time) bool
+		attempts  int
+	}{
+		{name: "disabled", attempts: 1},
+		{name: "unchanged tunnel", recovered: func(context.Context, time.Time) bool { return false }, attempts: 1},
+		{name: "recovered tunnel", recovered: func(context.Context, time.Time) bool { return true }, attempts: 2},
+	} {
+		attempts := 0
+		vt := VirtualTun{
+			Logger: slog.Default(),
+			Ctx:    context.Background(),
+			dialFunc: func(context.Context, string, string) (net.Conn, error) {
+				attempts++
+				if attempts == 1 {
+					return nil, errors.New("transient failure")
+				}
+				return target, nil
+			},
+			dialRetry: tc.recovered,
+		}
+
+		conn, err := vt.dial("tcp", "example.com:443")
+		qt.Assert(t, attempts, qt.Equals, tc.attempts, qt.Commentf(tc.name))
+		if tc.attempts == 1 {
+			qt.Assert(t, err, qt.ErrorMatches, "transient failure")
+			continue
+		}
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, conn, qt.Equals, target)
+	}
+}
+
+func TestDirectPrefixes(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	tunnelTarget, _ := tcpPair(t)
+	var tunneled []string
+	vt := VirtualTun{
+		Logger: slog.Default(),
+		Ctx:    context.Background(),
+		dialFunc: func(_ context.Context, _, address string) (net.Conn, error) {
+			tunneled = append(tunneled, address)
+			return tunnelTarget, nil
+		},
+		direct: DefaultLocalPrefixes,
+	}
+
+	// private destination, dialed directly
+	conn, err := vt.dial("tcp", ln.Addr().String())
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, conn.RemoteAddr().String(), qt.Equals, ln.Addr().String())
+	conn.Close()
+	qt.Assert(t, tunneled, qt.HasLen, 0)
+
+	// public destination, through the tunnel
+	conn, err = vt.dial("tcp", "1.1.1.1:443")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, conn, qt.Equals, tunnelTarget)
+	qt.Assert(t, tunneled, qt.DeepEquals, []string{"1.1.1.1:443"})
+
+	for addr, direct := range map[string]bool{
+		"localhost:80":          true,
+		"192.168.1.10:22":       true,
+		"[fd00::1]:80":          true,
+		"[::ffff:10.1.2.3]:80":  true,
+		"example.com:443":       false,
+		"[2606:4700::1111]:443": false,
+		"172.32.0.1:80":         false,
+	} {
+		qt.Assert(t, vt.isDirect(addr), qt.Equals, direct, qt.Commentf(addr))
+	}
+
+	vt.direct = nil
+	qt.Assert(t, vt.isDirect("127.0.0.1:80"), qt.IsFalse)
+}
+
+func TestListenBacklog(t *testing.T) {
+	for _, bind := range []string{"127.0.0.1:0", "[::1]:0"} {
+		ln, err := listenTCP(netip.MustParseAddrPort(bind), 4096)
+		if err != nil && bind == "[::1]:0" {
+			t.Skip("ipv6 loopback not available:", err)
+		}
+		qt.Assert(t, err, qt.IsNil)
+
+		done := make(chan error, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err == nil {
+				conn.Close()
+			}
+			done <- err
+		}()
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		qt.Assert(t, err, qt.IsNil)
+		conn.Close()
+		qt.Assert(t, <-done, qt.IsNil)
+		qt.Assert(t, ln.Close(), qt.IsNil)
+	}
+}
+
+func TestListenBacklogZone(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	qt.Assert(t, err, qt.IsNil)
+	i := slices.IndexFunc(ifaces, func(ifi net.Interface) bool { return ifi.Flags&net.FlagLoopback != 0 })
+	if i < 0 {
+		t.Skip("no loopback interface")
+	}
+
+	// the zone is kept, an unknown one fails instead of being dropped
+	_, err = listenTCP(netip.MustParseAddrPort("[::1%nonexistent0]:0"), 16)
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+
+	ln, err := listenTCP(netip.MustParseAddrPort("[::1%"+ifaces[i].Name+"]:0"), 16)
+	if err != nil {
+		t.Skip("ipv6 loopback not available:", err)
+	}
+	qt.Assert(t, ln.Close(), qt.IsNil)
+}
+
+func selfSignedCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	qt.Assert(t, err, qt.IsNil)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "warp-plus test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	qt.Assert(t, err, qt.IsNil)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTLSProxy(t *testing.T) {
+	// echo server, reached directly
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cert := selfSignedCert(t)
+	addr, err := StartProxy(ctx, slog.Default(), nil, netip.MustParseAddrPort("127.0.0.1:0"),
+		WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+		WithDirectPrefixes(DefaultLocalPrefixes),
+	)
+	qt.Assert(t, err, qt.IsNil)
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	qt.Assert(t, err, qt.IsNil)
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	conn, err := tls.Dial("tcp", addr.String(), &tls.Config{RootCAs: roots})
+	qt.Assert(t, err, qt.IsNil)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", ln.Addr())
+	qt.Assert(t, err, qt.IsNil)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, resp.StatusCode, qt.Equals, http.StatusOK)
+
+	_, err = conn.Write([]byte("ping"))
+	qt.Assert(t, err, qt.IsNil)
+	echo := make([]byte, 4)
+	_, err = io.ReadFull(conn, echo)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, string(echo), qt.Equals, "ping")
+
+	// a plaintext client is rejected
+	plain, err := net.Dial("tcp", addr.String())
+	qt.Assert(t, err, qt.IsNil)
+	defer plain.Close()
+	plain.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = fmt.Fprintf(plain, "CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", ln.Addr())
+	qt.Assert(t, err, qt.IsNil)
+	reply, _ := io.ReadAll(plain)
+	qt.Assert(t, bytes.HasPrefix(reply, []byte("HTTP/1.1 200")), qt.IsFalse)
+}
+
+func TestAllowedDomains(t *testing.T) {
+	list, err := newDomainAllowlist([]string{"example.com", "*.example.org", "192.0.2.1"})
+	qt.Assert(t, err, qt.IsNil)
+	for host, want := range map[string]bool{
+		"example.com":      true,
+		"EXAMPLE.com.":     true,
+		"www.example.com":  false,
+		"example.org":      false,
+		"www.example.org":  true,
+		"a.b.example.org":  true,
+		"badexample.org":   false,
+		"192.0.2.1":        true,
+		"192.0.2.2":        false,
+		"example.com.evil": false,
+	} {
+		qt.Check(t, list.allows(host), qt.Equals, want, qt.Commentf("%s", host))
+	}
+
+	for _, pattern := range []string{"", "*", "*.", "www.*.com", "example..com"} {
+		qt.Check(t, ValidateDomainPattern(pattern), qt.IsNotNil, qt.Commentf("%q", pattern))
+	}
+	_, err = StartProxy(context.Background(), slog.Default(), nil, netip.MustParseAddrPort("127.0.0.1:0"), WithAllowedDomains([]string{"*"}))
+	qt.Assert(t, err, qt.ErrorMatches, `invalid domain pattern "\*".*`)
+
+	// echo server, reached directly as localhost
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr, err := StartProxy(ctx, slog.Default(), nil, netip.MustParseAddrPort("127.0.0.1:0"),
+		WithAllowedDomains([]string{"localhost"}),
+		WithDirectPrefixes(DefaultLocalPrefixes),
+	)
+	qt.Assert(t, err, qt.IsNil)
+
+	// socks5 connect, returning the reply code
+	socksConnect := func(host string) (net.Conn, byte) {
+		conn, err := net.Dial("tcp", addr.String())
+		qt.Assert(t, err, qt.IsNil)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		req := []byte{5, 1, 0, 5, 1, 0, 3, byte(len(host))}
+		req = append(req, host...)
+		req = append(req, byte(port>>8), byte(port))
+		_, err = conn.Write(req)
+		qt.Assert(t, err, qt.IsNil)
+		reply := make([]byte, 6)
+		_, err = io.ReadFull(conn, reply)
+		qt.Assert(t, err, qt.IsNil)
+		return conn, reply[3]
+	}
+
+	conn, code := socksConnect("localhost")
+	defer conn.Close()
+	qt.Assert(t, code, qt.Equals, byte(0))
+
+	conn, code = socksConnect("example.com")
+	defer conn.Close()
+	qt.Assert(t, code, qt.Equals, byte(2), qt.Commentf("connection not allowed by ruleset"))
+
+	for host, want := range map[string]int{
+		net.JoinHostPort("localhost", strconv.Itoa(int(port))):   http.StatusOK,
+		net.JoinHostPort("example.com", strconv.Itoa(int(port))): http.StatusForbidden,
+	} {
+		conn, err := net.Dial("tcp", addr.String())
+		qt.Assert(t, err, qt.IsNil)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", host)
+		qt.Assert(t, err, qt.IsNil)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		qt.Assert(t, err, qt.IsNil)
+		qt.Check(t, resp.StatusCode, qt.Equals, want, qt.Commentf("%s", host))
+		conn.Close()
+	}
+}
+
+func TestTLSProxyClientAuth(t *testing.T) {
+	// echo server, reached directly
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serverCert, clientCert, untrusted := selfSignedCert(t), selfSignedCert(t), selfSignedCert(t)
+	parse := func(cert tls.Certificate) *x509.Certificate {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		qt.Assert(t, err, qt.IsNil)
+		return leaf
+	}
+	serverRoots, clientCAs := x509.NewCertPool(), x509.NewCertPool()
+	serverRoots.AddCert(parse(serverCert))
+	clientCAs.AddCert(parse(clientCert))
+
+	var logs lockedBuffer
+	l := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	addr, err := StartProxy(ctx, l, nil, netip.MustParseAddrPort("127.0.0.1:0"),
+		WithTLSConfig(&tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientCAs:    clientCAs,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		}),
+		WithDirectPrefixes(DefaultLocalPrefixes),
+	)
+	qt.Assert(t, err, qt.IsNil)
+
+	connect := func(certs []tls.Certificate) error {
+		conn, err := tls.Dial("tcp", addr.String(), &tls.Config{RootCAs: serverRoots, Certificates: certs})
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", ln.Addr()); err != nil {
+			return err
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return errors.New(resp.Status)
+		}
+		return nil
+	}
+
+	qt.Assert(t, connect([]tls.Certificate{clientCert}), qt.IsNil)
+	qt.Assert(t, logs.String(), qt.Contains, `client_cert="CN=warp-plus test"`)
+
+	// with TLS 1.3 the client learns about the rejection on its first read
+	qt.Assert(t, connect([]tls.Certificate{untrusted}), qt.ErrorMatches, ".*(unknown certificate authority|bad certificate).*")
+	qt.Assert(t, connect(nil), qt.ErrorMatches, ".*certificate required.*")
+}
+
+// lockedBuffer is a bytes.Buffer written by the proxy and read by the test.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestPause(t *testing.T) {
+	// echo server, reached directly
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var pause Pause
+	addr, err := StartProxy(ctx, slog.Default(), nil, netip.MustParseAddrPort("127.0.0.1:0"),
+		WithPause(&pause),
+		WithDirectPrefixes(DefaultLocalPrefixes),
+	)
+	qt.Assert(t, err, qt.IsNil)
+
+	// socks5 connect, returning the reply code
+	socksConnect := func() (net.Conn, byte) {
+		conn, err := net.Dial("tcp", addr.String())
+		qt.Assert(t, err, qt.IsNil)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		req := []byte{5, 1, 0, 5, 1, 0, 1, 127, 0, 0, 1, byte(port >> 8), byte(port)}
+		_, err = conn.Write(req)
+		qt.Assert(t, err, qt.IsNil)
+		reply := make([]byte, 12)
+		_, err = io.ReadFull(conn, reply)
+		qt.Assert(t, err, qt.IsNil)
+		return conn, reply[3]
+	}
+	echo := func(conn net.Conn) error {
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			return err
+		}
+		b := make([]byte, 4)
+		_, err := io.ReadFull(conn, b)
+		return err
+	}
+
+	open, code := socksConnect()
+	defer open.Close()
+	qt.Assert(t, code, qt.Equals, byte(0))
+	qt.Assert(t, echo(open), qt.IsNil)
+
+	qt.Assert(t, pause.Pause(false), qt.Equals, 0)
+	qt.Assert(t, pause.Paused(), qt.IsTrue)
+	conn, code := socksConnect()
+	conn.Close()
+	qt.Assert(t, code, qt.Equals, byte(2))
+	// connections opened before the pause keep working
+	qt.Assert(t, echo(open), qt.IsNil)
+
+	qt.Assert(t, pause.Pause(true), qt.Equals, 1)
+	qt.Assert(t, echo(open), qt.IsNotNil)
+
+	pause.Resume()
+	conn, code = socksConnect()
+	defer conn.Close()
+	qt.Assert(t, code, qt.Equals, byte(0))
+	qt.Assert(t, echo(conn), qt.IsNil)
+}
+
+func TestPauseUDP(t *testing.T) {
+	// udp echo server, reached directly
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	defer pc.Close()
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(b[:n], addr)
+		}
+	}()
+	port := uint16(pc.LocalAddr().(*net.UDPAddr).Port)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var pause Pause
+	addr, err := StartProxy(ctx, slog.Default(), nil, netip.MustParseAddrPort("127.0.0.1:0"),
+		WithPause(&pause),
+		WithDirectPrefixes(DefaultLocalPrefixes),
+	)
+	qt.Assert(t, err, qt.IsNil)
+
+	// socks5 udp associate
+	ctrl, err := net.Dial("tcp", addr.String())
+	qt.Assert(t, err, qt.IsNil)
+	defer ctrl.Close()
+	ctrl.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = ctrl.Write([]byte{5, 1, 0, 5, 3, 0, 1, 0, 0, 0, 0, 0, 0})
+	qt.Assert(t, err, qt.IsNil)
+	reply := make([]byte, 12)
+	_, err = io.ReadFull(ctrl, reply)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, reply[3], qt.Equals, byte(0))
+	relay := netip.AddrPortFrom(netip.AddrFrom4([4]byte(reply[6:10])), uint16(reply[10])<<8|uint16(reply[11]))
+
+	udp, err := net.Dial("udp", relay.String())
+	qt.Assert(t, err, qt.IsNil)
+	defer udp.Close()
+	datagram := append([]byte{0, 0, 0, 1, 127, 0, 0, 1, byte(port >> 8), byte(port)}, "ping"...)
+	_, err = udp.Write(datagram)
+	qt.Assert(t, err, qt.IsNil)
+	udp.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 1500)
+	n, err := udp.Read(b)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, string(b[n-4:n]), qt.Equals, "ping")
+
+	// the association is closed even without closing the connections
+	qt.Assert(t, pause.Pause(false), qt.Equals, 1)
+	_, err = io.ReadFull(ctrl, make([]byte, 1))
+	qt.Assert(t, err, qt.Equals, io.EOF)
+}
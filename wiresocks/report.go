@@ -0,0 +1,101 @@
+package wiresocks
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bepass-org/warp-plus/ipscanner"
+)
+
+// ScanReportEntry is a single ranked row of a scan report.
+type ScanReportEntry struct {
+	Rank      int       `json:"rank"`
+	Endpoint  string    `json:"endpoint"`
+	RTT       float64   `json:"rtt_ms"`
+	Loss      float64   `json:"loss_pct"`
+	Jitter    float64   `json:"jitter_ms"`
+	Method    string    `json:"method"`
+	Timestamp time.Time `json:"timestamp"`
+	Prefix    string    `json:"prefix"`
+}
+
+var scanReportHeader = []string{"rank", "endpoint", "rtt_ms", "loss_pct", "jitter_ms", "method", "timestamp", "prefix"}
+
+// NewScanReport ranks results by RTT order as returned by the scanner and
+// attributes each one to the prefix it was generated from.
+func NewScanReport(results []ipscanner.IPInfo, prefixes []netip.Prefix, method string) []ScanReportEntry {
+	report := make([]ScanReportEntry, len(results))
+	for i, res := range results {
+		entry := ScanReportEntry{
+			Rank:      i + 1,
+			Endpoint:  res.AddrPort.String(),
+			RTT:       float64(res.RTT) / float64(time.Millisecond),
+			Loss:      res.Loss,
+			Jitter:    float64(res.Jitter) / float64(time.Millisecond),
+			Method:    method,
+			Timestamp: res.CreatedAt,
+		}
+		for _, prefix := range prefixes {
+			if prefix.Contains(res.AddrPort.Addr()) {
+				entry.Prefix = prefix.String()
+				break
+			}
+		}
+		report[i] = entry
+	}
+	return report
+}
+
+// WriteScanReport writes the report to path, as CSV if the file extension is
+// .csv and as JSON otherwise.
+func WriteScanReport(path string, report []ScanReportEntry) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		err = writeScanReportCSV(f, report)
+	} else {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	}
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func writeScanReportCSV(w io.Writer, report []ScanReportEntry) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(scanReportHeader); err != nil {
+		return err
+	}
+	for _, entry := range report {
+		err := cw.Write([]string{
+			strconv.Itoa(entry.Rank),
+			entry.Endpoint,
+			strconv.FormatFloat(entry.RTT, 'f', 3, 64),
+			strconv.FormatFloat(entry.Loss, 'f', 1, 64),
+			strconv.FormatFloat(entry.Jitter, 'f', 3, 64),
+			entry.Method,
+			entry.Timestamp.Format(time.RFC3339Nano),
+			entry.Prefix,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
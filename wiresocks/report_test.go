@@ -0,0 +1,59 @@
+package wiresocks
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/ipscanner"
+	qt "github.com/frankban/quicktest"
+)
+
+func testScanReport() []ScanReportEntry {
+	now := time.Now().UTC().Truncate(time.Second)
+	results := []ipscanner.IPInfo{
+		{AddrPort: netip.MustParseAddrPort("162.159.192.10:2408"), RTT: 42 * time.Millisecond, Loss: 20, Jitter: 1500 * time.Microsecond, CreatedAt: now},
+		{AddrPort: netip.MustParseAddrPort("[2606:4700:d0::1]:500"), RTT: 87 * time.Millisecond, CreatedAt: now},
+	}
+	prefixes := []netip.Prefix{
+		netip.MustParsePrefix("162.159.192.0/24"),
+		netip.MustParsePrefix("2606:4700:d0::/64"),
+	}
+	return NewScanReport(results, prefixes, "warp")
+}
+
+func TestWriteScanReportJSON(t *testing.T) {
+	want := testScanReport()
+	path := filepath.Join(t.TempDir(), "report.json")
+	qt.Assert(t, WriteScanReport(path, want), qt.IsNil)
+
+	b, err := os.ReadFile(path)
+	qt.Assert(t, err, qt.IsNil)
+
+	var got []ScanReportEntry
+	qt.Assert(t, json.Unmarshal(b, &got), qt.IsNil)
+	qt.Assert(t, got, qt.DeepEquals, want)
+	qt.Assert(t, got[1].Prefix, qt.Equals, "2606:4700:d0::/64")
+}
+
+func TestWriteScanReportCSV(t *testing.T) {
+	want := testScanReport()
+	path := filepath.Join(t.TempDir(), "report.csv")
+	qt.Assert(t, WriteScanReport(path, want), qt.IsNil)
+
+	f, err := os.Open(path)
+	qt.Assert(t, err, qt.IsNil)
+	defer f.Close()
+
+	records, err := csv.NewReader(f).ReadAll()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, records, qt.HasLen, len(want)+1)
+	qt.Assert(t, records[0], qt.DeepEquals, scanReportHeader)
+	qt.Assert(t, records[1], qt.DeepEquals, []string{
+		"1", "162.159.192.10:2408", "42.000", "20.0", "1.500", "warp", want[0].Timestamp.Format(time.RFC3339Nano), "162.159.192.0/24",
+	})
+}
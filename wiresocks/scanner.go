@@ -1,27 +1,230 @@
 package wiresocks
 
 import (
+	"cmp"
 	"context"
 	"errors"
+	"fmt"
 	"log/slog"
+	"math/big"
+	"net/netip"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/bepass-org/warp-plus/ipscanner"
+	"github.com/bepass-org/warp-plus/ipscanner/iterator"
 	"github.com/bepass-org/warp-plus/warp"
 )
 
+// ErrNoScanResults is returned when no candidate responded before the scan
+// deadline or the end of the scan.
+var ErrNoScanResults = errors.New("scan found no endpoints")
+
+// defaultScanDeadline bounds a scan when ScanDeadline is not set.
+const defaultScanDeadline = 1 * time.Minute
+
+// DefaultScanCollect is how many endpoints a scan gathers when
+// ScanOptions.Collect is 0, the best one and a fallback.
+const DefaultScanCollect = 2
+
+// RankedScanCollect is how many endpoints a scan ranked by more than the
+// RTT gathers when ScanOptions.Collect is 0, so the ranking has more than
+// the fastest two to choose from.
+const RankedScanCollect = 8
+
 type ScanOptions struct {
 	V4         bool
 	V6         bool
 	MaxRTT     time.Duration
 	PrivateKey string
 	PublicKey  string
+	// Prefixes overrides the built-in warp prefixes when non-empty.
+	Prefixes []netip.Prefix
+	// NoDefaultPrefixes makes the scan fail instead of falling back to the
+	// built-in warp prefixes when Prefixes is empty.
+	NoDefaultPrefixes bool
+	// ReportPath, when set, receives the full ranked scan results as JSON, or
+	// CSV if it has a .csv extension.
+	ReportPath string
+	// ProbeOnly only checks which candidates respond and picks among them
+	// without ranking by RTT.
+	ProbeOnly bool
+	// ScanDeadline bounds the scan. When it passes, the best endpoints found
+	// so far are returned even if not every candidate was probed. Defaults
+	// to one minute.
+	ScanDeadline time.Duration
+	// CheckpointPath, when set, receives the scan progress periodically so
+	// an interrupted scan with the same parameters can resume from it. The
+	// file is removed once a scan completes.
+	CheckpointPath string
+	// MaxCandidates caps how many addresses are probed, sampled at random
+	// and spread over the prefixes, so a scan of large ranges ends once the
+	// sample was probed rather than at the deadline. 0 means no cap.
+	MaxCandidates int
+	// Ports are probed on every candidate address and each addr:port is
+	// ranked on its own, so a network blocking some of the warp ports still
+	// finds endpoints on the others. Empty probes every address on a random
+	// warp port.
+	Ports []uint16
+	// PingCount probes every addr:port this many times, ranking it by the
+	// median RTT and measuring the loss and jitter of the probes. Below 2
+	// every addr:port is probed once.
+	PingCount int
+	// RankStability ranks the results by their RTT plus twice their jitter,
+	// stretched by their loss, instead of by RTT alone. Needs a PingCount of
+	// at least 2.
+	RankStability bool
+	// Collect is how many responding endpoints the scan gathers before it
+	// stops and ranks them, and the most RunScan returns. 0 gathers
+	// DefaultScanCollect, or RankedScanCollect with RankStability. With
+	// ReportPath the scan doesn't stop early, so the report covers every
+	// candidate. A ProbeOnly scan stops like any other, at the first
+	// endpoints that respond.
+	Collect int
+}
+
+// ScanPlan describes what a scan would probe.
+type ScanPlan struct {
+	// Prefixes are the prefixes that will be scanned.
+	Prefixes []netip.Prefix
+	// Skipped are the prefixes of a disabled address family.
+	Skipped []netip.Prefix
+	// Candidates is the number of addresses the scan probes when it runs to
+	// the end, every address in Prefixes capped by MaxCandidates.
+	Candidates *big.Int
+	// Probes is the number of probes sent for them, Candidates times the
+	// number of Ports times PingCount.
+	Probes *big.Int
+	// Collect is the number of responding endpoints after which the scan
+	// stops early, 0 when it probes every candidate for the report.
+	Collect int
+	// Deadline is when the scan stops at the latest, with the candidates
+	// probed so far.
+	Deadline time.Duration
+}
+
+// ValidateScan resolves the scan prefixes and checks them against the enabled
+// address families without probing anything. RunScan performs the same
+// checks before scanning.
+func ValidateScan(opts ScanOptions) (ScanPlan, error) {
+	if !opts.V4 && !opts.V6 {
+		return ScanPlan{}, errors.New("both IPv4 and IPv6 are disabled")
+	}
+
+	for i, port := range opts.Ports {
+		if port == 0 {
+			return ScanPlan{}, errors.New("scan port 0 is invalid")
+		}
+		if slices.Contains(opts.Ports[:i], port) {
+			return ScanPlan{}, fmt.Errorf("scan port %d is listed twice", port)
+		}
+	}
+
+	if opts.PingCount < 0 {
+		return ScanPlan{}, errors.New("scan ping count can't be negative")
+	}
+	if opts.RankStability && opts.PingCount < 2 {
+		return ScanPlan{}, errors.New("ranking by stability needs a scan ping count of at least 2")
+	}
+	if opts.Collect < 0 {
+		return ScanPlan{}, errors.New("scan collect count can't be negative")
+	}
+
+	prefixes := opts.Prefixes
+	if len(prefixes) == 0 {
+		if opts.NoDefaultPrefixes {
+			return ScanPlan{}, errors.New("no scan prefixes provided and default prefixes are disabled")
+		}
+		prefixes = warp.WarpPrefixes()
+	}
+
+	plan := ScanPlan{
+		Prefixes:   iterator.FilterFamilies(prefixes, opts.V4, opts.V6),
+		Candidates: new(big.Int),
+	}
+	for _, prefix := range prefixes {
+		if !slices.Contains(plan.Prefixes, prefix) {
+			plan.Skipped = append(plan.Skipped, prefix)
+		}
+	}
+	if len(plan.Prefixes) == 0 {
+		return plan, errors.New("none of the scan prefixes match the enabled address families")
+	}
+
+	for _, prefix := range plan.Prefixes {
+		plan.Candidates.Add(plan.Candidates, iterator.RangeSize(prefix))
+	}
+	if limit := big.NewInt(int64(opts.MaxCandidates)); opts.MaxCandidates > 0 && plan.Candidates.Cmp(limit) > 0 {
+		plan.Candidates = limit
+	}
+	plan.Probes = new(big.Int).Mul(plan.Candidates, big.NewInt(int64(max(len(opts.Ports), 1)*max(opts.PingCount, 1))))
+
+	plan.Deadline = opts.ScanDeadline
+	if plan.Deadline <= 0 {
+		plan.Deadline = defaultScanDeadline
+	}
+	if !opts.fullScan() {
+		plan.Collect = opts.collect()
+	}
+	return plan, nil
+}
+
+// collect returns how many endpoints the scan gathers at most.
+func (opts ScanOptions) collect() int {
+	switch {
+	case opts.Collect > 0:
+		return opts.Collect
+	case opts.RankStability:
+		return RankedScanCollect
+	}
+	return DefaultScanCollect
+}
+
+// fullScan reports whether the scan probes every candidate for the report
+// instead of stopping once it gathered its endpoints.
+func (opts ScanOptions) fullScan() bool {
+	return opts.ReportPath != ""
 }
 
-func RunScan(ctx context.Context, l *slog.Logger, opts ScanOptions) (result []ipscanner.IPInfo, err error) {
-	ctx, cancel := context.WithTimeout(ctx, 1*time.Minute)
+// RunScan probes the candidates of opts and returns the best endpoints that
+// responded, at most opts.Collect of them, ranked by RTT or by stability.
+func RunScan(ctx context.Context, l *slog.Logger, opts ScanOptions) ([]ipscanner.IPInfo, error) {
+	plan, err := ValidateScan(opts)
+	if err != nil {
+		return nil, err
+	}
+	prefixes := plan.Prefixes
+	collect := opts.collect()
+
+	scanCtx, cancel := context.WithTimeout(ctx, plan.Deadline)
 	defer cancel()
 
+	cp := newCheckpointer(l, opts.CheckpointPath, checkpointParams(opts, prefixes))
+	saveProgress := func() {
+		if err := cp.save(); err != nil {
+			l.Warn("failed to save scan checkpoint", "path", opts.CheckpointPath, "error", err)
+		}
+	}
+
+	// every endpoint that responded, for the report, beyond the best ones
+	// the scanner keeps
+	var mu sync.Mutex
+	var responded []ipscanner.IPInfo
+	onProbe := func(r ipscanner.ProbeResult) {
+		cp.add(r)
+		if r.Reachable {
+			mu.Lock()
+			responded = append(responded, r.Info)
+			mu.Unlock()
+		}
+	}
+	for _, r := range cp.resumed() {
+		if r.Reachable {
+			responded = append(responded, r.Info)
+		}
+	}
+
 	scanner := ipscanner.NewScanner(
 		ipscanner.WithLogger(l.With(slog.String("subsystem", "scanner"))),
 		ipscanner.WithWarpPrivateKey(opts.PrivateKey),
@@ -29,30 +232,132 @@ func RunScan(ctx context.Context, l *slog.Logger, opts ScanOptions) (result []ip
 		ipscanner.WithUseIPv4(opts.V4),
 		ipscanner.WithUseIPv6(opts.V6),
 		ipscanner.WithMaxDesirableRTT(opts.MaxRTT),
-		ipscanner.WithCidrList(warp.WarpPrefixes()),
+		ipscanner.WithCidrList(prefixes),
+		ipscanner.WithProbeOnly(opts.ProbeOnly),
+		ipscanner.WithResume(cp.resumed()),
+		ipscanner.WithSeed(cp.seed()),
+		ipscanner.WithOnProbe(onProbe),
+		ipscanner.WithMaxCandidates(opts.MaxCandidates),
+		ipscanner.WithPorts(opts.Ports),
+		ipscanner.WithPingCount(opts.PingCount),
+		ipscanner.WithIPQueueSize(max(RankedScanCollect, collect)),
 	)
 
-	scanner.Run(ctx)
+	scanner.Run(scanCtx)
+
+	ipList, err := waitScan(ctx, scanCtx, scanner, collect, opts.fullScan(), saveProgress)
+	if err != nil {
+		return nil, err
+	}
+	if scanCtx.Err() != nil {
+		l.Info("scan deadline reached, using best endpoints found so far", "found", len(ipList))
+	}
+
+	if err := cp.remove(); err != nil {
+		l.Warn("failed to remove scan checkpoint", "path", opts.CheckpointPath, "error", err)
+	}
+	if opts.ProbeOnly {
+		l.Info("probe-only scan finished", "reachable", reachableCount(scanner.GetReachability()))
+	}
+	if opts.RankStability {
+		rankStability(ipList)
+	}
+	if opts.ReportPath != "" {
+		mu.Lock()
+		all := slices.Clone(responded)
+		mu.Unlock()
+		method := "warp"
+		if opts.ProbeOnly {
+			method = "probe"
+			for i := range all {
+				all[i].RTT = 0
+			}
+		}
+		slices.SortStableFunc(all, func(a, b ipscanner.IPInfo) int { return cmp.Compare(a.RTT, b.RTT) })
+		if opts.RankStability {
+			rankStability(all)
+		}
+		if err := WriteScanReport(opts.ReportPath, NewScanReport(all, prefixes, method)); err != nil {
+			l.Warn("failed to write scan report", "path", opts.ReportPath, "error", err)
+		}
+	}
+	return ipList[:min(len(ipList), collect)], nil
+}
+
+// scanProgress is what waitScan watches of a running scan.
+type scanProgress interface {
+	GetAvailableIPs() []ipscanner.IPInfo
+	Done() <-chan struct{}
+}
+
+// waitScan waits until s gathered collect endpoints, or with full until
+// every candidate was probed, and returns the endpoints found. Once scanCtx
+// is done it settles for whatever was found so far. It fails with
+// ErrNoScanResults if nothing responded, and if ctx is done. save is called
+// every second and when the scan is left unfinished.
+func waitScan(ctx, scanCtx context.Context, s scanProgress, collect int, full bool, save func()) ([]ipscanner.IPInfo, error) {
+	// settle handles a scan stopped by scanCtx
+	settle := func() ([]ipscanner.IPInfo, error) {
+		if ctx.Err() != nil {
+			// Context is done - canceled externally
+			save()
+			return nil, errors.New("user canceled the operation")
+		}
+		// Deadline hit - settle for whatever was found so far
+		if ipList := s.GetAvailableIPs(); len(ipList) > 0 {
+			return ipList, nil
+		}
+		save()
+		return nil, ErrNoScanResults
+	}
 
 	t := time.NewTicker(1 * time.Second)
 	defer t.Stop()
 
 	for {
-		ipList := scanner.GetAvailableIPs()
-		if len(ipList) > 1 {
-			for i := 0; i < 2; i++ {
-				result = append(result, ipList[i])
-			}
-			return result, nil
+		ipList := s.GetAvailableIPs()
+		if !full && len(ipList) >= collect {
+			return ipList, nil
 		}
 
 		select {
-		case <-ctx.Done():
-			// Context is done - canceled externally
-			return nil, errors.New("user canceled the operation")
+		case <-s.Done():
+			if scanCtx.Err() != nil {
+				return settle()
+			}
+			// every candidate was probed
+			if ipList := s.GetAvailableIPs(); len(ipList) > 0 {
+				return ipList, nil
+			}
+			return nil, ErrNoScanResults
+		case <-scanCtx.Done():
+			return settle()
 		case <-t.C:
 			// Prevent the loop from spinning too fast
-			continue
+			save()
+		}
+	}
+}
+
+func reachableCount(reachability map[netip.Addr]bool) int {
+	n := 0
+	for _, ok := range reachability {
+		if ok {
+			n++
 		}
 	}
+	return n
+}
+
+// stabilityScore is what RankStability ranks by: the RTT plus twice the
+// jitter, divided by the share of probes answered.
+func stabilityScore(info ipscanner.IPInfo) float64 {
+	return float64(info.RTT+2*info.Jitter) / (1 - info.Loss/100)
+}
+
+// rankStability sorts results by stabilityScore.
+func rankStability(results []ipscanner.IPInfo) {
+	slices.SortStableFunc(results, func(a, b ipscanner.IPInfo) int {
+		return cmp.Compare(stabilityScore(a), stabilityScore(b))
+	})
 }
@@ -0,0 +1,173 @@
+package wiresocks
+
+import (
+	"context"
+	"log/slog"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/ipscanner"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestRunScanNoDefaultPrefixes(t *testing.T) {
+	opts := ScanOptions{
+		V4:                true,
+		V6:                true,
+		NoDefaultPrefixes: true,
+	}
+
+	res, err := RunScan(context.Background(), slog.Default(), opts)
+	qt.Assert(t, err, qt.ErrorMatches, "no scan prefixes provided.*")
+	qt.Assert(t, res, qt.IsNil)
+}
+
+func TestRunScanDeadline(t *testing.T) {
+	opts := ScanOptions{
+		V4: true,
+		// TEST-NET-1, nothing will ever answer
+		Prefixes:     []netip.Prefix{netip.MustParsePrefix("192.0.2.0/30")},
+		MaxRTT:       time.Second,
+		ScanDeadline: 200 * time.Millisecond,
+	}
+
+	start := time.Now()
+	res, err := RunScan(context.Background(), slog.Default(), opts)
+	qt.Assert(t, err, qt.ErrorIs, ErrNoScanResults)
+	qt.Assert(t, res, qt.IsNil)
+	qt.Assert(t, time.Since(start) < 5*time.Second, qt.IsTrue)
+}
+
+func TestValidateScan(t *testing.T) {
+	plan, err := ValidateScan(ScanOptions{
+		V4: true,
+		Prefixes: []netip.Prefix{
+			netip.MustParsePrefix("192.0.2.0/24"),
+			netip.MustParsePrefix("198.51.100.0/30"),
+			netip.MustParsePrefix("2001:db8::/64"),
+		},
+	})
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, plan.Prefixes, qt.HasLen, 2)
+	qt.Assert(t, plan.Skipped, qt.HasLen, 1)
+	qt.Assert(t, plan.Skipped[0], qt.Equals, netip.MustParsePrefix("2001:db8::/64"))
+	qt.Assert(t, plan.Candidates.Int64(), qt.Equals, int64(260))
+	qt.Assert(t, plan.Collect, qt.Equals, DefaultScanCollect)
+	qt.Assert(t, plan.Deadline, qt.Equals, defaultScanDeadline)
+
+	// a scan for the report probes every candidate
+	plan, err = ValidateScan(ScanOptions{V4: true, ReportPath: "scan.json", ScanDeadline: time.Hour})
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, plan.Collect, qt.Equals, 0)
+	qt.Assert(t, plan.Deadline, qt.Equals, time.Hour)
+
+	// a probe-only scan stops at the first endpoints that respond
+	plan, err = ValidateScan(ScanOptions{V4: true, ProbeOnly: true})
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, plan.Collect, qt.Equals, DefaultScanCollect)
+
+	// the default prefixes are used when none are given
+	plan, err = ValidateScan(ScanOptions{V4: true, V6: true})
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, plan.Skipped, qt.HasLen, 0)
+	qt.Assert(t, plan.Candidates.Sign(), qt.Equals, 1)
+
+	// the candidates are capped
+	plan, err = ValidateScan(ScanOptions{V4: true, V6: true, MaxCandidates: 1000})
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, plan.Candidates.Int64(), qt.Equals, int64(1000))
+	qt.Assert(t, plan.Probes.Int64(), qt.Equals, int64(1000))
+
+	// every candidate is probed on each port
+	plan, err = ValidateScan(ScanOptions{V4: true, V6: true, MaxCandidates: 1000, Ports: []uint16{2408, 500, 1701}})
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, plan.Probes.Int64(), qt.Equals, int64(3000))
+
+	// and pinged PingCount times
+	plan, err = ValidateScan(ScanOptions{V4: true, V6: true, MaxCandidates: 1000, Ports: []uint16{2408, 500, 1701}, PingCount: 5})
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, plan.Probes.Int64(), qt.Equals, int64(15000))
+	_, err = ValidateScan(ScanOptions{V4: true, RankStability: true, PingCount: 1})
+	qt.Assert(t, err, qt.ErrorMatches, "ranking by stability needs a scan ping count of at least 2")
+
+	_, err = ValidateScan(ScanOptions{V4: true, Ports: []uint16{2408, 0}})
+	qt.Assert(t, err, qt.ErrorMatches, "scan port 0 is invalid")
+	_, err = ValidateScan(ScanOptions{V4: true, Ports: []uint16{2408, 500, 2408}})
+	qt.Assert(t, err, qt.ErrorMatches, "scan port 2408 is listed twice")
+
+	_, err = ValidateScan(ScanOptions{
+		V6:       true,
+		Prefixes: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+	})
+	qt.Assert(t, err, qt.ErrorMatches, "none of the scan prefixes match the enabled address families")
+
+	_, err = ValidateScan(ScanOptions{Prefixes: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}})
+	qt.Assert(t, err, qt.ErrorMatches, "both IPv4 and IPv6 are disabled")
+}
+
+func TestRankStability(t *testing.T) {
+	fast := ipscanner.IPInfo{AddrPort: netip.MustParseAddrPort("192.0.2.1:2408"), RTT: 40 * time.Millisecond, Loss: 50}
+	jittery := ipscanner.IPInfo{AddrPort: netip.MustParseAddrPort("192.0.2.2:2408"), RTT: 50 * time.Millisecond, Jitter: 30 * time.Millisecond}
+	stable := ipscanner.IPInfo{AddrPort: netip.MustParseAddrPort("192.0.2.3:2408"), RTT: 60 * time.Millisecond, Jitter: 5 * time.Millisecond}
+
+	// scored 80, 110 and 70ms
+	results := []ipscanner.IPInfo{fast, jittery, stable}
+	rankStability(results)
+	qt.Assert(t, results[0].AddrPort, qt.Equals, stable.AddrPort)
+	qt.Assert(t, results[1].AddrPort, qt.Equals, fast.AddrPort)
+	qt.Assert(t, results[2].AddrPort, qt.Equals, jittery.AddrPort)
+}
+
+// fakeScan is a scan that found results and is done once done is closed.
+type fakeScan struct {
+	results []ipscanner.IPInfo
+	done    chan struct{}
+}
+
+func (f *fakeScan) GetAvailableIPs() []ipscanner.IPInfo { return f.results }
+func (f *fakeScan) Done() <-chan struct{}               { return f.done }
+
+func TestWaitScan(t *testing.T) {
+	results := make([]ipscanner.IPInfo, 5)
+	for i := range results {
+		results[i] = ipscanner.IPInfo{AddrPort: netip.AddrPortFrom(netip.AddrFrom4([4]byte{192, 0, 2, byte(i)}), 2408), RTT: time.Duration(i+1) * time.Millisecond}
+	}
+	ctx := context.Background()
+	save := func() {}
+
+	// enough results stop the scan early
+	s := &fakeScan{results: results[:3], done: make(chan struct{})}
+	res, err := waitScan(ctx, ctx, s, 3, false, save)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, res, qt.HasLen, 3)
+
+	// a full scan waits for every candidate
+	s = &fakeScan{results: results, done: make(chan struct{})}
+	time.AfterFunc(50*time.Millisecond, func() { close(s.done) })
+	start := time.Now()
+	res, err = waitScan(ctx, ctx, s, 3, true, save)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, res, qt.HasLen, 5)
+	qt.Assert(t, time.Since(start) >= 50*time.Millisecond, qt.IsTrue)
+
+	// a finished scan returns what it found, even if fewer
+	s = &fakeScan{results: results[:1], done: make(chan struct{})}
+	close(s.done)
+	res, err = waitScan(ctx, ctx, s, 3, false, save)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, res, qt.HasLen, 1)
+
+	s = &fakeScan{done: make(chan struct{})}
+	close(s.done)
+	_, err = waitScan(ctx, ctx, s, 3, false, save)
+	qt.Assert(t, err, qt.ErrorIs, ErrNoScanResults)
+
+	// the deadline settles for what was found
+	scanCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	s = &fakeScan{results: results[:1], done: make(chan struct{})}
+	res, err = waitScan(ctx, scanCtx, s, 3, true, save)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, res, qt.HasLen, 1)
+}